@@ -6,6 +6,7 @@ import (
 	"log"
 	"math/rand"
 	"net"
+	"sx-chat/proto"
 	"time"
 )
 
@@ -62,24 +63,24 @@ func sendGroup(sender, groupId int64) {
 
 	seq := 1
 
-	auth := &AuthenticationToken{token: token, platformId: 1, deviceId: "0000000"}
-	SendMessage(conn, &Message{cmd: MSG_AUTH_TOKEN, seq: seq, version: DEFAULT_VERSION, body: auth})
-	m := ReceiveMessage(conn)
+	auth := &proto.AuthenticationToken{Token: token, PlatformId: 1, DeviceId: "0000000"}
+	proto.SendMessage(conn, &proto.Message{Cmd: proto.MSG_AUTH_TOKEN, Seq: seq, Version: proto.DEFAULT_VERSION, Body: auth})
+	m := proto.ReceiveMessage(conn)
 	fmt.Println(m)
-	fmt.Println(m.body)
+	fmt.Println(m.Body)
 
 	ticker := time.NewTicker(10 * time.Second)
 
 	for t := range ticker.C {
 		content := fmt.Sprintf("test....%d", t.Unix())
 		seq++
-		msg := &Message{cmd: MSG_GROUP_IM, seq: seq, version: DEFAULT_VERSION, flag: 0, body: &IMMessage{sender, groupId, 0, 0, content}}
-		SendMessage(conn, msg)
+		msg := &proto.Message{Cmd: proto.MSG_GROUP_IM, Seq: seq, Version: proto.DEFAULT_VERSION, Flag: 0, Body: &proto.IMMessage{Sender: sender, Receiver: groupId, Content: content}}
+		proto.SendMessage(conn, msg)
 		for {
-			ack := ReceiveMessage(conn)
+			ack := proto.ReceiveMessage(conn)
 			fmt.Println(ack)
-			fmt.Println(ack.body)
-			if ack.cmd == MSG_ACK {
+			fmt.Println(ack.Body)
+			if ack.Cmd == proto.MSG_ACK {
 				break
 			}
 		}
@@ -106,24 +107,24 @@ func send(sender, receiver int64) {
 
 	seq := 1
 
-	auth := &AuthenticationToken{token: token, platformId: 1, deviceId: "0000000"}
-	SendMessage(conn, &Message{cmd: MSG_AUTH_TOKEN, seq: seq, version: DEFAULT_VERSION, body: auth})
-	m := ReceiveMessage(conn)
+	auth := &proto.AuthenticationToken{Token: token, PlatformId: 1, DeviceId: "0000000"}
+	proto.SendMessage(conn, &proto.Message{Cmd: proto.MSG_AUTH_TOKEN, Seq: seq, Version: proto.DEFAULT_VERSION, Body: auth})
+	m := proto.ReceiveMessage(conn)
 	fmt.Println(m)
-	fmt.Println(m.body)
+	fmt.Println(m.Body)
 
 	ticker := time.NewTicker(1 * time.Second)
 
 	for t := range ticker.C {
 		content := fmt.Sprintf("test....%d", t.Unix())
 		seq++
-		msg := &Message{cmd: MSG_IM, seq: seq, version: DEFAULT_VERSION, flag: 0, body: &IMMessage{sender, receiver, 0, 0, content}}
-		SendMessage(conn, msg)
+		msg := &proto.Message{Cmd: proto.MSG_IM, Seq: seq, Version: proto.DEFAULT_VERSION, Flag: 0, Body: &proto.IMMessage{Sender: sender, Receiver: receiver, Content: content}}
+		proto.SendMessage(conn, msg)
 		for {
-			ack := ReceiveMessage(conn)
+			ack := proto.ReceiveMessage(conn)
 			fmt.Println(ack)
-			fmt.Println(ack.body)
-			if ack.cmd == MSG_ACK {
+			fmt.Println(ack.Body)
+			if ack.Cmd == proto.MSG_ACK {
 				break
 			}
 		}
@@ -146,39 +147,39 @@ func sync(uid int64) {
 	}
 
 	seq := 1
-	auth := &AuthenticationToken{token: token, platformId: 1, deviceId: "00000000"}
-	SendMessage(conn, &Message{cmd: MSG_AUTH_TOKEN, seq: seq, version: DEFAULT_VERSION, flag: 0, body: auth})
-	ReceiveMessage(conn)
+	auth := &proto.AuthenticationToken{Token: token, PlatformId: 1, DeviceId: "00000000"}
+	proto.SendMessage(conn, &proto.Message{Cmd: proto.MSG_AUTH_TOKEN, Seq: seq, Version: proto.DEFAULT_VERSION, Flag: 0, Body: auth})
+	proto.ReceiveMessage(conn)
 
 	seq++
-	ss := &Message{cmd: MSG_SYNC, seq: seq, version: DEFAULT_VERSION, flag: 0, body: &SyncKey{syncKey: syncKey}}
-	SendMessage(conn, ss)
+	ss := &proto.Message{Cmd: proto.MSG_SYNC, Seq: seq, Version: proto.DEFAULT_VERSION, Flag: 0, Body: &proto.SyncKey{SyncKey: syncKey}}
+	proto.SendMessage(conn, ss)
 
 	for {
-		msg := ReceiveMessage(conn)
+		msg := proto.ReceiveMessage(conn)
 		if msg == nil {
 			log.Println("sync nil message")
 			break
 		}
-		if msg.cmd == MSG_SYNC_BEGIN {
-			m := msg.body.(*SyncKey)
-			log.Printf("syncKey:%d", m.syncKey)
+		if msg.Cmd == proto.MSG_SYNC_BEGIN {
+			m := msg.Body.(*proto.SyncKey)
+			log.Printf("syncKey:%d", m.SyncKey)
 		}
 
-		if msg.cmd == MSG_SYNC_END {
-			m := msg.body.(*SyncKey)
-			log.Printf("syncKey:%d", m.syncKey)
+		if msg.Cmd == proto.MSG_SYNC_END {
+			m := msg.Body.(*proto.SyncKey)
+			log.Printf("syncKey:%d", m.SyncKey)
 
-			if m.syncKey > syncKey {
-				syncKey = m.syncKey
+			if m.SyncKey > syncKey {
+				syncKey = m.SyncKey
 				seq++
-				//sk := &Message{cmd:MSG_SYNC_KEY, seq:seq, version:DEFAULT_VERSION, flag:0, body:&SyncKey{syncKey}}
+				//sk := &Message{Cmd:MSG_SYNC_KEY, seq:seq, version:DEFAULT_VERSION, flag:0, body:&SyncKey{syncKey}}
 				//SendMessage(conn, sk)
 			}
 		}
-		if msg.cmd == MSG_IM {
-			m := msg.body.(*IMMessage)
-			log.Printf("sender:%d receiver:%d content:%s", m.sender, m.receiver, m.content)
+		if msg.Cmd == proto.MSG_IM {
+			m := msg.Body.(*proto.IMMessage)
+			log.Printf("sender:%d receiver:%d content:%s", m.Sender, m.Receiver, m.Content)
 		}
 	}
 	conn.Close()
@@ -197,32 +198,32 @@ func receive(receiver int64) {
 	}
 
 	seq := 1
-	auth := &AuthenticationToken{token: token, platformId: 1, deviceId: "00000000"}
-	SendMessage(conn, &Message{cmd: MSG_AUTH_TOKEN, seq: seq, version: DEFAULT_VERSION, flag: 0, body: auth})
+	auth := &proto.AuthenticationToken{Token: token, PlatformId: 1, DeviceId: "00000000"}
+	proto.SendMessage(conn, &proto.Message{Cmd: proto.MSG_AUTH_TOKEN, Seq: seq, Version: proto.DEFAULT_VERSION, Flag: 0, Body: auth})
 
 	for {
-		msg := ReceiveMessage(conn)
+		msg := proto.ReceiveMessage(conn)
 		if msg == nil {
 			log.Println("receiver nil message")
 			break
 		}
-		if msg.cmd == MSG_SYNC_BEGIN {
-			m := msg.body.(*SyncKey)
-			log.Printf("syncKey:%d", m.syncKey)
+		if msg.Cmd == proto.MSG_SYNC_BEGIN {
+			m := msg.Body.(*proto.SyncKey)
+			log.Printf("syncKey:%d", m.SyncKey)
 		}
 
-		if msg.cmd == MSG_SYNC_END {
-			m := msg.body.(*SyncKey)
-			log.Printf("syncKey:%d", m.syncKey)
+		if msg.Cmd == proto.MSG_SYNC_END {
+			m := msg.Body.(*proto.SyncKey)
+			log.Printf("syncKey:%d", m.SyncKey)
 
-			if m.syncKey > syncKey {
-				syncKey = m.syncKey
+			if m.SyncKey > syncKey {
+				syncKey = m.SyncKey
 				seq++
 			}
 		}
-		if msg.cmd == MSG_IM || msg.cmd == MSG_GROUP_IM {
-			m := msg.body.(*IMMessage)
-			log.Printf("sender:%d receiver:%d content:%s", m.sender, m.receiver, m.content)
+		if msg.Cmd == proto.MSG_IM || msg.Cmd == proto.MSG_GROUP_IM {
+			m := msg.Body.(*proto.IMMessage)
+			log.Printf("sender:%d receiver:%d content:%s", m.Sender, m.Receiver, m.Content)
 		}
 	}
 	conn.Close()
@@ -1,6 +1,6 @@
 module sx-chat
 
-go 1.14
+go 1.18
 
 require (
 	github.com/BurntSushi/toml v0.3.1 // indirect
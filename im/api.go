@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+	"sx-chat/proto"
+)
+
+//管理接口的鉴权header
+const ADMIN_SECRET_HEADER = "X-Admin-Secret"
+
+func StartHttpServer(addr string, secret string) {
+	http.HandleFunc("/devices", RequireAdmin(secret, LoadDevices))
+	http.HandleFunc("/devices/kick", RequireAdmin(secret, KickDevice))
+
+	http.HandleFunc("/stats/rate_limit", RequireAdmin(secret, LoadRateLimitStats))
+
+	http.HandleFunc("/groups/create", RequireAdmin(secret, GroupCommandHandler(proto.GROUP_OP_CREATE)))
+	http.HandleFunc("/groups/members/add", RequireAdmin(secret, GroupCommandHandler(proto.GROUP_OP_ADD_MEMBER)))
+	http.HandleFunc("/groups/members/remove", RequireAdmin(secret, GroupCommandHandler(proto.GROUP_OP_REMOVE_MEMBER)))
+	http.HandleFunc("/groups/transfer", RequireAdmin(secret, GroupCommandHandler(proto.GROUP_OP_TRANSFER)))
+	http.HandleFunc("/groups/mute", RequireAdmin(secret, GroupCommandHandler(proto.GROUP_OP_MUTE)))
+	http.HandleFunc("/groups/unmute", RequireAdmin(secret, GroupCommandHandler(proto.GROUP_OP_UNMUTE)))
+	http.HandleFunc("/groups/dissolve", RequireAdmin(secret, GroupCommandHandler(proto.GROUP_OP_DISSOLVE)))
+	http.HandleFunc("/groups/admin/set", RequireAdmin(secret, GroupCommandHandler(proto.GROUP_OP_SET_ADMIN)))
+	http.HandleFunc("/groups/admin/unset", RequireAdmin(secret, GroupCommandHandler(proto.GROUP_OP_UNSET_ADMIN)))
+	http.HandleFunc("/groups/settings", RequireAdmin(secret, GroupCommandHandler(proto.GROUP_OP_SETTINGS)))
+
+	log.WithField("addr", addr).Info("http server listen")
+	err := http.ListenAndServe(addr, nil)
+	if err != nil {
+		log.WithField("err", err).Error("http server listen失败")
+	}
+}
+
+// 管理接口可以查看和踢掉任意用户的登录设备, 只接受带有密钥的请求
+func RequireAdmin(secret string, f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		s := req.Header.Get(ADMIN_SECRET_HEADER)
+		if secret == "" || subtle.ConstantTimeCompare([]byte(s), []byte(secret)) != 1 {
+			log.WithFields(log.Fields{"path": req.URL.Path, "remote": req.RemoteAddr}).Warning("管理接口鉴权失败")
+			WriteHttpError(http.StatusUnauthorized, "unauthorized", w)
+			return
+		}
+		f(w, req)
+	}
+}
+
+func WriteHttpError(status int, err string, w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	obj := map[string]interface{}{"error": err}
+	b, _ := json.Marshal(obj)
+	w.Write(b)
+}
+
+func WriteHttpObj(data interface{}, w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	obj := map[string]interface{}{"data": data}
+	b, _ := json.Marshal(obj)
+	w.Write(b)
+}
+
+// GET /devices?uid=
+func LoadDevices(w http.ResponseWriter, req *http.Request) {
+	uid, err := strconv.ParseInt(req.URL.Query().Get("uid"), 10, 64)
+	if err != nil || uid == 0 {
+		WriteHttpError(http.StatusBadRequest, "invalid uid", w)
+		return
+	}
+
+	sessions, err := LoadDeviceSessions(uid)
+	if err != nil {
+		WriteHttpError(http.StatusInternalServerError, "server internal error", w)
+		return
+	}
+
+	devices := make([]map[string]interface{}, 0, len(sessions))
+	for _, s := range sessions {
+		d := map[string]interface{}{
+			"session_id":  s.SessionId,
+			"device_id":   s.DeviceId,
+			"platform_id": s.PlatformId,
+			"login_time":  s.LoginTime,
+		}
+		devices = append(devices, d)
+	}
+	WriteHttpObj(devices, w)
+}
+
+// GET /stats/rate_limit
+func LoadRateLimitStats(w http.ResponseWriter, req *http.Request) {
+	WriteHttpObj(GetRateLimitStats(), w)
+}
+
+// POST /devices/kick?uid=&session_id=
+func KickDevice(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		WriteHttpError(http.StatusMethodNotAllowed, "method not allowed", w)
+		return
+	}
+	uid, err := strconv.ParseInt(req.FormValue("uid"), 10, 64)
+	if err != nil || uid == 0 {
+		WriteHttpError(http.StatusBadRequest, "invalid uid", w)
+		return
+	}
+	sessionId, err := strconv.ParseInt(req.FormValue("session_id"), 10, 64)
+	if err != nil || sessionId == 0 {
+		WriteHttpError(http.StatusBadRequest, "invalid session id", w)
+		return
+	}
+
+	sessions, err := LoadDeviceSessions(uid)
+	if err != nil {
+		WriteHttpError(http.StatusInternalServerError, "server internal error", w)
+		return
+	}
+	for _, s := range sessions {
+		if s.SessionId == sessionId {
+			log.WithFields(log.Fields{"uid": uid, "sessionId": sessionId}).Info("管理后台踢掉登录设备")
+			KickUserSession(uid, sessionId, proto.KICK_REASON_ADMIN)
+			WriteHttpObj(map[string]interface{}{"success": true}, w)
+			return
+		}
+	}
+	WriteHttpError(http.StatusNotFound, "device not found", w)
+}
+
+// POST /groups/...?operator=&gid=&uid=&members=1,2,3&name=&super=&mute_all=&invite_only=&max_members=
+// 管理后台代替operator执行群组管理命令, 权限和operator在客户端执行时相同
+// 只能通过RequireAdmin调用, 每次调用记录管理操作的日志
+func GroupCommandHandler(op int8) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			WriteHttpError(http.StatusMethodNotAllowed, "method not allowed", w)
+			return
+		}
+		operator, err := strconv.ParseInt(req.FormValue("operator"), 10, 64)
+		if err != nil || operator == 0 {
+			WriteHttpError(http.StatusBadRequest, "invalid operator", w)
+			return
+		}
+
+		cmd := &proto.GroupCommand{Op: op, Name: req.FormValue("name"), Super: req.FormValue("super") == "1"}
+		if op != proto.GROUP_OP_CREATE {
+			cmd.GroupId, err = strconv.ParseInt(req.FormValue("gid"), 10, 64)
+			if err != nil || cmd.GroupId == 0 {
+				WriteHttpError(http.StatusBadRequest, "invalid gid", w)
+				return
+			}
+		}
+		if v := req.FormValue("uid"); v != "" {
+			cmd.Uid, err = strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				WriteHttpError(http.StatusBadRequest, "invalid uid", w)
+				return
+			}
+		}
+		cmd.MuteAll = req.FormValue("mute_all") == "1"
+		cmd.InviteOnly = req.FormValue("invite_only") == "1"
+		if v := req.FormValue("max_members"); v != "" {
+			maxMembers, err := strconv.ParseInt(v, 10, 32)
+			if err != nil {
+				WriteHttpError(http.StatusBadRequest, "invalid max members", w)
+				return
+			}
+			cmd.MaxMembers = int32(maxMembers)
+		}
+		if v := req.FormValue("members"); v != "" {
+			for _, s := range strings.Split(v, ",") {
+				member, err := strconv.ParseInt(s, 10, 64)
+				if err != nil {
+					WriteHttpError(http.StatusBadRequest, "invalid members", w)
+					return
+				}
+				cmd.Members = append(cmd.Members, member)
+			}
+		}
+
+		gid, status := ExecGroupCommand(operator, cmd)
+		log.WithFields(log.Fields{"op": cmd.Op, "operator": operator, "gid": gid, "status": status,
+			"remote": req.RemoteAddr}).Info("管理后台代替用户执行群组命令")
+		switch status {
+		case proto.GROUP_STATUS_OK:
+			WriteHttpObj(map[string]interface{}{"gid": gid}, w)
+		case proto.GROUP_STATUS_INVALID:
+			WriteHttpError(http.StatusBadRequest, "invalid param", w)
+		case proto.GROUP_STATUS_NOT_FOUND:
+			WriteHttpError(http.StatusNotFound, "group not found", w)
+		case proto.GROUP_STATUS_PERMISSION:
+			WriteHttpError(http.StatusForbidden, "permission denied", w)
+		case proto.GROUP_STATUS_FULL:
+			WriteHttpError(http.StatusConflict, "group is full", w)
+		default:
+			WriteHttpError(http.StatusInternalServerError, "server internal error", w)
+		}
+	}
+}
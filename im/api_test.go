@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sx-chat/proto"
+	"testing"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	ok := func(w http.ResponseWriter, req *http.Request) { WriteHttpObj("ok", w) }
+	cases := []struct {
+		secret string
+		header string
+		status int
+	}{
+		{"s3cret", "s3cret", http.StatusOK},
+		{"s3cret", "", http.StatusUnauthorized},
+		{"s3cret", "wrong", http.StatusUnauthorized},
+		{"", "", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/devices?uid=1", nil)
+		if c.header != "" {
+			req.Header.Set(ADMIN_SECRET_HEADER, c.header)
+		}
+		w := httptest.NewRecorder()
+		RequireAdmin(c.secret, ok)(w, req)
+		if w.Code != c.status {
+			t.Errorf("secret:%q header:%q status:%d expect:%d", c.secret, c.header, w.Code, c.status)
+		}
+	}
+}
+
+// 群组管理接口以operator的身份执行, 没有密钥时不能冒充群主
+func TestGroupCommandRequiresAdmin(t *testing.T) {
+	req := httptest.NewRequest("POST", "/groups/dissolve?operator=1&gid=2", nil)
+	w := httptest.NewRecorder()
+	RequireAdmin("s3cret", GroupCommandHandler(proto.GROUP_OP_DISSOLVE))(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status:%d", w.Code)
+	}
+}
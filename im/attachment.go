@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sx-chat/proto"
+	"sync"
+	"time"
+)
+
+//检查过期上传的间隔
+const UPLOAD_RECYCLE_INTERVAL = 10 * time.Minute
+
+var errUploadOffset = errors.New("upload offset mismatch")
+var errUploadIncomplete = errors.New("upload incomplete")
+var errUploadHash = errors.New("upload hash mismatch")
+
+// 上传完成的附件, 消息中通过id引用
+type Attachment struct {
+	Id          string `json:"id"`
+	Hash        string `json:"sha256"`
+	Size        int64  `json:"size"`
+	Name        string `json:"name,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Uploader    int64  `json:"uploader"`
+	Created     int64  `json:"created"`
+}
+
+// 分块上传的状态, 文件内容追加到uploads/{upload_id}, 已经上传的大小就是文件的大小
+// 上传中的文件只保存在当前im实例的本地磁盘, 断点续传时需要访问同一个实例
+type uploadSession struct {
+	Uid         int64  `json:"uid"`
+	Name        string `json:"name,omitempty"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type,omitempty"`
+	Created     int64  `json:"created"`
+}
+
+type AttachmentService struct {
+	store     AttachmentStore
+	uploadDir string
+	secret    []byte
+
+	maxSize   int64
+	chunkSize int64
+	urlTTL    time.Duration
+	uploadTTL time.Duration
+	urlPrefix string
+
+	mutex sync.Mutex
+	locks map[string]*sync.Mutex //同一个上传不能并发写
+}
+
+func NewAttachmentService(config *Config, store AttachmentStore) *AttachmentService {
+	secret := []byte(config.attachmentSecret)
+	if len(secret) == 0 {
+		//每次启动生成新的密钥, 重启之后之前的下载地址失效, 多个im实例之间不能互相验证
+		log.Warning("没有配置附件下载地址的签名密钥, 使用随机密钥")
+		secret = make([]byte, 32)
+		rand.Read(secret)
+	}
+	return &AttachmentService{
+		store:     store,
+		uploadDir: filepath.Join(config.attachmentRoot, "uploads"),
+		secret:    secret,
+		maxSize:   config.attachmentMaxSize,
+		chunkSize: config.attachmentChunkSize,
+		urlTTL:    time.Duration(config.attachmentUrlTTL) * time.Second,
+		uploadTTL: time.Duration(config.attachmentUploadTTL) * time.Second,
+		urlPrefix: strings.TrimRight(config.attachmentURLPrefix, "/"),
+		locks:     make(map[string]*sync.Mutex),
+	}
+}
+
+// 附件和上传的id都是32位的十六进制字符串, 同时用作文件名
+func newAttachmentId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func IsAttachmentId(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func (s *AttachmentService) lock(uploadId string) *sync.Mutex {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	l, ok := s.locks[uploadId]
+	if !ok {
+		l = new(sync.Mutex)
+		s.locks[uploadId] = l
+	}
+	return l
+}
+
+// 上传完成或者不存在时删除锁, 客户端随意发送的上传id不会一直占用内存
+func (s *AttachmentService) unlock(uploadId string, l *sync.Mutex, remove bool) {
+	if !remove {
+		_, err := os.Stat(s.metaPath(uploadId))
+		remove = os.IsNotExist(err)
+	}
+	if remove {
+		s.mutex.Lock()
+		delete(s.locks, uploadId)
+		s.mutex.Unlock()
+	}
+	l.Unlock()
+}
+
+func (s *AttachmentService) dataPath(uploadId string) string {
+	return filepath.Join(s.uploadDir, uploadId)
+}
+
+func (s *AttachmentService) metaPath(uploadId string) string {
+	return filepath.Join(s.uploadDir, uploadId+".json")
+}
+
+func (s *AttachmentService) CreateUpload(uid int64, name string, size int64, contentType string) (string, error) {
+	if size <= 0 || size > s.maxSize {
+		return "", errors.New("invalid size")
+	}
+	if err := os.MkdirAll(s.uploadDir, 0755); err != nil {
+		return "", err
+	}
+
+	uploadId := newAttachmentId()
+	session := &uploadSession{Uid: uid, Name: name, Size: size, ContentType: contentType, Created: time.Now().Unix()}
+	b, _ := json.Marshal(session)
+	if err := ioutil.WriteFile(s.dataPath(uploadId), nil, 0644); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(s.metaPath(uploadId), b, 0644); err != nil {
+		os.Remove(s.dataPath(uploadId))
+		return "", err
+	}
+	return uploadId, nil
+}
+
+// 读取上传的状态和已经上传的大小, 不属于uid的上传和不存在一样处理
+func (s *AttachmentService) loadUpload(uid int64, uploadId string) (*uploadSession, int64, error) {
+	if !IsAttachmentId(uploadId) {
+		return nil, 0, errAttachmentNotFound
+	}
+	b, err := ioutil.ReadFile(s.metaPath(uploadId))
+	if os.IsNotExist(err) {
+		return nil, 0, errAttachmentNotFound
+	} else if err != nil {
+		return nil, 0, err
+	}
+	session := &uploadSession{}
+	if err := json.Unmarshal(b, session); err != nil {
+		return nil, 0, err
+	}
+	if session.Uid != uid {
+		return nil, 0, errAttachmentNotFound
+	}
+	info, err := os.Stat(s.dataPath(uploadId))
+	if err != nil {
+		return nil, 0, err
+	}
+	return session, info.Size(), nil
+}
+
+func (s *AttachmentService) UploadOffset(uid int64, uploadId string) (*uploadSession, int64, error) {
+	if !IsAttachmentId(uploadId) {
+		return nil, 0, errAttachmentNotFound
+	}
+	l := s.lock(uploadId)
+	l.Lock()
+	defer s.unlock(uploadId, l, false)
+	return s.loadUpload(uid, uploadId)
+}
+
+// 从offset开始追加一块数据, offset必须等于已经上传的大小
+// 写入中断时已经写入的部分仍然保留, 客户端查询offset之后继续上传
+func (s *AttachmentService) WriteChunk(uid int64, uploadId string, offset int64, r io.Reader) (int64, error) {
+	if !IsAttachmentId(uploadId) {
+		return 0, errAttachmentNotFound
+	}
+	l := s.lock(uploadId)
+	l.Lock()
+	defer s.unlock(uploadId, l, false)
+
+	session, current, err := s.loadUpload(uid, uploadId)
+	if err != nil {
+		return 0, err
+	}
+	if offset != current {
+		return current, errUploadOffset
+	}
+
+	f, err := os.OpenFile(s.dataPath(uploadId), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return current, err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, session.Size-current))
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return current + n, err
+}
+
+// 上传完成之后计算sha256, 相同内容的文件只保存一份
+func (s *AttachmentService) CompleteUpload(uid int64, uploadId string, hash string) (*Attachment, error) {
+	if !IsAttachmentId(uploadId) {
+		return nil, errAttachmentNotFound
+	}
+	l := s.lock(uploadId)
+	l.Lock()
+	removed := false
+	defer func() {
+		s.unlock(uploadId, l, removed)
+	}()
+
+	session, current, err := s.loadUpload(uid, uploadId)
+	if err != nil {
+		return nil, err
+	}
+	if current != session.Size {
+		return nil, errUploadIncomplete
+	}
+
+	f, err := os.Open(s.dataPath(uploadId))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if hash != "" && !strings.EqualFold(hash, sum) {
+		s.removeUpload(uploadId)
+		removed = true
+		return nil, errUploadHash
+	}
+
+	blob := "blobs/" + sum
+	exists, err := s.store.Exists(blob)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if err := s.store.Put(blob, f, session.Size); err != nil {
+			return nil, err
+		}
+	}
+
+	a := &Attachment{
+		Id:          newAttachmentId(),
+		Hash:        sum,
+		Size:        session.Size,
+		Name:        session.Name,
+		ContentType: session.ContentType,
+		Uploader:    uid,
+		Created:     time.Now().Unix(),
+	}
+	b, _ := json.Marshal(a)
+	if err := s.store.Put("attachments/"+a.Id, bytes.NewReader(b), int64(len(b))); err != nil {
+		return nil, err
+	}
+	s.removeUpload(uploadId)
+	removed = true
+	log.WithFields(log.Fields{"uid": uid, "id": a.Id, "size": a.Size, "dedup": exists}).Info("附件上传完成")
+	return a, nil
+}
+
+func (s *AttachmentService) removeUpload(uploadId string) {
+	os.Remove(s.metaPath(uploadId))
+	os.Remove(s.dataPath(uploadId))
+}
+
+func (s *AttachmentService) LoadAttachment(id string) (*Attachment, error) {
+	if !IsAttachmentId(id) {
+		return nil, errAttachmentNotFound
+	}
+	r, _, err := s.store.Get("attachments/" + id)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	a := &Attachment{}
+	if err := json.NewDecoder(r).Decode(a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (s *AttachmentService) Exists(id string) (bool, error) {
+	if !IsAttachmentId(id) {
+		return false, nil
+	}
+	return s.store.Exists("attachments/" + id)
+}
+
+// 消息引用的附件必须已经上传完成, 没有启动附件服务时不检查
+func checkAttachment(c proto.Content) error {
+	ac, ok := c.(proto.AttachmentContent)
+	if !ok || ac.AttachmentId() == "" || attachmentService == nil {
+		return nil
+	}
+	exists, err := attachmentService.Exists(ac.AttachmentId())
+	if err != nil {
+		log.WithField("err", err).Warning("查询附件失败")
+		return nil
+	}
+	if !exists {
+		return errAttachmentNotFound
+	}
+	return nil
+}
+
+func (s *AttachmentService) signature(id string, expires int64) string {
+	return hex.EncodeToString(hmacSHA256(s.secret, id+"."+strconv.FormatInt(expires, 10)))
+}
+
+// 下载地址不需要token, 在有效期内可以直接给浏览器或者cdn使用
+func (s *AttachmentService) SignURL(id string, now time.Time) (string, int64) {
+	expires := now.Add(s.urlTTL).Unix()
+	v := url.Values{}
+	v.Set("id", id)
+	v.Set("expires", strconv.FormatInt(expires, 10))
+	v.Set("sig", s.signature(id, expires))
+	return s.urlPrefix + "/attachments/download?" + v.Encode(), expires
+}
+
+func (s *AttachmentService) VerifyURL(id string, expires int64, sig string, now time.Time) bool {
+	if expires < now.Unix() {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(s.signature(id, expires)))
+}
+
+// 删除超过uploadTTL没有写入的上传
+func (s *AttachmentService) RecycleLoop() {
+	ticker := time.NewTicker(UPLOAD_RECYCLE_INTERVAL)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.recycleUploads(time.Now())
+	}
+}
+
+func (s *AttachmentService) recycleUploads(now time.Time) {
+	files, err := ioutil.ReadDir(s.uploadDir)
+	if err != nil {
+		return
+	}
+	for _, info := range files {
+		name := info.Name()
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		uploadId := strings.TrimSuffix(name, ".json")
+		l := s.lock(uploadId)
+		l.Lock()
+		//最后一次写入的时间, 正在上传的文件不删除
+		data, err := os.Stat(s.dataPath(uploadId))
+		expired := err != nil || now.Sub(data.ModTime()) >= s.uploadTTL
+		if expired {
+			s.removeUpload(uploadId)
+			log.WithField("uploadId", uploadId).Info("删除过期的上传")
+		}
+		s.unlock(uploadId, l, expired)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 附件服务直接给客户端使用, 和管理接口监听不同的地址
+// 除了下载之外的请求都需要在Authorization中带上登录的token: Bearer {token}
+func StartAttachmentServer(addr string, s *AttachmentService) {
+	log.WithField("addr", addr).Info("attachment server listen")
+	err := http.ListenAndServe(addr, s.Handler())
+	if err != nil {
+		log.WithField("err", err).Error("attachment server listen失败")
+	}
+}
+
+func (s *AttachmentService) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/attachments/upload/init", s.authHandler(s.HandleCreateUpload))
+	mux.HandleFunc("/attachments/upload", s.authHandler(s.HandleUpload))
+	mux.HandleFunc("/attachments/upload/complete", s.authHandler(s.HandleCompleteUpload))
+	mux.HandleFunc("/attachments/url", s.authHandler(s.HandleSignURL))
+	mux.HandleFunc("/attachments/download", s.HandleDownload)
+	return mux
+}
+
+func (s *AttachmentService) authHandler(h func(uid int64, w http.ResponseWriter, req *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			WriteHttpError(http.StatusUnauthorized, "unauthorized", w)
+			return
+		}
+		uid, err := tokenValidator.Validate(strings.TrimPrefix(auth, "Bearer "))
+		if err != nil {
+			WriteHttpError(http.StatusUnauthorized, "unauthorized", w)
+			return
+		}
+		h(uid, w, req)
+	}
+}
+
+func writeAttachmentError(err error, w http.ResponseWriter) {
+	switch err {
+	case errAttachmentNotFound:
+		WriteHttpError(http.StatusNotFound, "not found", w)
+	case errUploadOffset:
+		WriteHttpError(http.StatusConflict, "offset mismatch", w)
+	case errUploadIncomplete:
+		WriteHttpError(http.StatusBadRequest, "upload incomplete", w)
+	case errUploadHash:
+		WriteHttpError(http.StatusBadRequest, "sha256 mismatch", w)
+	default:
+		log.WithField("err", err).Warning("附件请求失败")
+		WriteHttpError(http.StatusInternalServerError, "server internal error", w)
+	}
+}
+
+// POST /attachments/upload/init?name=&size=&content_type=
+func (s *AttachmentService) HandleCreateUpload(uid int64, w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		WriteHttpError(http.StatusMethodNotAllowed, "method not allowed", w)
+		return
+	}
+	size, err := strconv.ParseInt(req.FormValue("size"), 10, 64)
+	if err != nil || size <= 0 || size > s.maxSize {
+		WriteHttpError(http.StatusBadRequest, "invalid size", w)
+		return
+	}
+
+	uploadId, err := s.CreateUpload(uid, req.FormValue("name"), size, req.FormValue("content_type"))
+	if err != nil {
+		writeAttachmentError(err, w)
+		return
+	}
+	WriteHttpObj(map[string]interface{}{"upload_id": uploadId, "chunk_size": s.chunkSize}, w)
+}
+
+// GET /attachments/upload?upload_id= 查询已经上传的大小
+// PUT /attachments/upload?upload_id=&offset= 上传一块数据, offset必须等于已经上传的大小
+func (s *AttachmentService) HandleUpload(uid int64, w http.ResponseWriter, req *http.Request) {
+	uploadId := req.URL.Query().Get("upload_id")
+	switch req.Method {
+	case http.MethodGet:
+		session, offset, err := s.UploadOffset(uid, uploadId)
+		if err != nil {
+			writeAttachmentError(err, w)
+			return
+		}
+		WriteHttpObj(map[string]interface{}{"offset": offset, "size": session.Size}, w)
+	case http.MethodPut:
+		offset, err := strconv.ParseInt(req.URL.Query().Get("offset"), 10, 64)
+		if err != nil || offset < 0 {
+			WriteHttpError(http.StatusBadRequest, "invalid offset", w)
+			return
+		}
+		if req.ContentLength > s.chunkSize {
+			WriteHttpError(http.StatusRequestEntityTooLarge, "chunk too large", w)
+			return
+		}
+		body := http.MaxBytesReader(w, req.Body, s.chunkSize)
+		offset, err = s.WriteChunk(uid, uploadId, offset, body)
+		if err != nil {
+			writeAttachmentError(err, w)
+			return
+		}
+		WriteHttpObj(map[string]interface{}{"offset": offset}, w)
+	default:
+		WriteHttpError(http.StatusMethodNotAllowed, "method not allowed", w)
+	}
+}
+
+// POST /attachments/upload/complete?upload_id=&sha256=
+// sha256可选, 客户端提供时检查上传的内容是否完整
+func (s *AttachmentService) HandleCompleteUpload(uid int64, w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		WriteHttpError(http.StatusMethodNotAllowed, "method not allowed", w)
+		return
+	}
+	a, err := s.CompleteUpload(uid, req.FormValue("upload_id"), req.FormValue("sha256"))
+	if err != nil {
+		writeAttachmentError(err, w)
+		return
+	}
+	WriteHttpObj(a, w)
+}
+
+// GET /attachments/url?id=
+// 附件id是随机生成的, 知道id的用户(比如收到了引用附件的消息)都可以获取下载地址
+func (s *AttachmentService) HandleSignURL(uid int64, w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get("id")
+	exists, err := s.Exists(id)
+	if err != nil {
+		writeAttachmentError(err, w)
+		return
+	}
+	if !exists {
+		writeAttachmentError(errAttachmentNotFound, w)
+		return
+	}
+	u, expires := s.SignURL(id, time.Now())
+	WriteHttpObj(map[string]interface{}{"url": u, "expires": expires}, w)
+}
+
+// GET /attachments/download?id=&expires=&sig=
+func (s *AttachmentService) HandleDownload(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	id := q.Get("id")
+	expires, _ := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if !s.VerifyURL(id, expires, q.Get("sig"), time.Now()) {
+		WriteHttpError(http.StatusForbidden, "invalid signature", w)
+		return
+	}
+
+	a, err := s.LoadAttachment(id)
+	if err != nil {
+		writeAttachmentError(err, w)
+		return
+	}
+	r, size, err := s.store.Get("blobs/" + a.Hash)
+	if err != nil {
+		writeAttachmentError(err, w)
+		return
+	}
+	defer r.Close()
+
+	if a.ContentType != "" {
+		w.Header().Set("Content-Type", a.ContentType)
+	}
+	if a.Name != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": a.Name}))
+	}
+	w.Header().Set("ETag", `"`+a.Hash+`"`)
+
+	//本地文件支持Range请求
+	if rs, ok := r.(io.ReadSeeker); ok {
+		http.ServeContent(w, req, a.Name, time.Unix(a.Created, 0), rs)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	io.Copy(w, r)
+}
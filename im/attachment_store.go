@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var errAttachmentNotFound = errors.New("attachment not found")
+
+// 附件的存储后端, key是以/分隔的相对路径
+// 文件内容保存在blobs/{sha256}, 附件的元数据保存在attachments/{id}
+type AttachmentStore interface {
+	Put(key string, r io.Reader, size int64) error
+	//不存在时返回errAttachmentNotFound, 调用者负责关闭
+	Get(key string) (io.ReadCloser, int64, error)
+	Exists(key string) (bool, error)
+}
+
+func NewAttachmentStore(config *Config) (AttachmentStore, error) {
+	switch config.attachmentStore {
+	case "", "local":
+		return NewLocalAttachmentStore(filepath.Join(config.attachmentRoot, "store")), nil
+	case "s3":
+		if config.s3Endpoint == "" || config.s3Bucket == "" {
+			return nil, errors.New("s3 endpoint or bucket is empty")
+		}
+		return NewS3AttachmentStore(config.s3Endpoint, config.s3Bucket, config.s3Region, config.s3AccessKey, config.s3SecretKey), nil
+	}
+	return nil, fmt.Errorf("unknown attachment store:%s", config.attachmentStore)
+}
+
+// 保存在本地磁盘, 只适合单个im实例或者root是共享的文件系统
+type LocalAttachmentStore struct {
+	root string
+}
+
+func NewLocalAttachmentStore(root string) *LocalAttachmentStore {
+	return &LocalAttachmentStore{root: root}
+}
+
+func (s *LocalAttachmentStore) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+// 先写到临时文件再rename, 读取的时候不会看到写了一半的文件
+func (s *LocalAttachmentStore) Put(key string, r io.Reader, size int64) error {
+	p := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), ".tmp")
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if err == nil && n != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (s *LocalAttachmentStore) Get(key string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, 0, errAttachmentNotFound
+	} else if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+func (s *LocalAttachmentStore) Exists(key string) (bool, error) {
+	_, err := os.Stat(s.path(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// 兼容S3协议的对象存储, 使用path-style的地址 {endpoint}/{bucket}/{key}
+// 请求使用AWS Signature Version 4签名, 不校验上传内容的hash
+type S3AttachmentStore struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func NewS3AttachmentStore(endpoint, bucket, region, accessKey, secretKey string) *S3AttachmentStore {
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3AttachmentStore{
+		endpoint:  strings.TrimRight(endpoint, "/"),
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 10 * time.Minute},
+	}
+}
+
+func (s *S3AttachmentStore) newRequest(method, key string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, s.endpoint+"/"+s.bucket+"/"+key, body)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, time.Now().UTC())
+	return req, nil
+}
+
+func (s *S3AttachmentStore) Put(key string, r io.Reader, size int64) error {
+	req, err := s.newRequest(http.MethodPut, key, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3 put status:%d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *S3AttachmentStore) Get(key string) (io.ReadCloser, int64, error) {
+	req, err := s.newRequest(http.MethodGet, key, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, 0, errAttachmentNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("s3 get status:%d", resp.StatusCode)
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+func (s *S3AttachmentStore) Exists(key string) (bool, error) {
+	req, err := s.newRequest(http.MethodHead, key, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("s3 head status:%d", resp.StatusCode)
+	}
+	return true, nil
+}
+
+// 签名host, x-amz-content-sha256和x-amz-date三个header
+func (s *S3AttachmentStore) sign(req *http.Request, now time.Time) {
+	const payload = "UNSIGNED-PAYLOAD"
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("x-amz-content-sha256", payload)
+	req.Header.Set("x-amz-date", amzDate)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payload + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payload,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	h := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(h[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
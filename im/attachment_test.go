@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type staticTokenValidator map[string]int64
+
+func (v staticTokenValidator) Validate(token string) (int64, error) {
+	if uid, ok := v[token]; ok {
+		return uid, nil
+	}
+	return 0, errInvalidToken
+}
+
+func newTestAttachmentService(t *testing.T, store AttachmentStore) (*AttachmentService, string) {
+	root, err := ioutil.TempDir("", "attachment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store == nil {
+		store = NewLocalAttachmentStore(filepath.Join(root, "store"))
+	}
+	c := &Config{attachmentRoot: root, attachmentSecret: "secret", attachmentMaxSize: 1024,
+		attachmentChunkSize: 8, attachmentUrlTTL: 60, attachmentUploadTTL: 60}
+	return NewAttachmentService(c, store), root
+}
+
+func doAttachmentRequest(t *testing.T, method, u, token string, body []byte) (int, map[string]interface{}) {
+	req, _ := http.NewRequest(method, u, bytes.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var obj struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	json.NewDecoder(resp.Body).Decode(&obj)
+	return resp.StatusCode, obj.Data
+}
+
+func uploadAttachment(t *testing.T, base string, content []byte) map[string]interface{} {
+	status, data := doAttachmentRequest(t, "POST", base+"/attachments/upload/init?name=a.txt&size="+
+		strconv.Itoa(len(content)), "token", nil)
+	if status != http.StatusOK {
+		t.Fatalf("init status:%d", status)
+	}
+	uploadId := data["upload_id"].(string)
+	for off := 0; off < len(content); off += 8 {
+		end := off + 8
+		if end > len(content) {
+			end = len(content)
+		}
+		status, _ = doAttachmentRequest(t, "PUT", base+"/attachments/upload?upload_id="+uploadId+
+			"&offset="+strconv.Itoa(off), "token", content[off:end])
+		if status != http.StatusOK {
+			t.Fatalf("upload status:%d", status)
+		}
+	}
+	h := sha256.Sum256(content)
+	status, data = doAttachmentRequest(t, "POST", base+"/attachments/upload/complete?upload_id="+uploadId+
+		"&sha256="+hex.EncodeToString(h[:]), "token", nil)
+	if status != http.StatusOK {
+		t.Fatalf("complete status:%d", status)
+	}
+	return data
+}
+
+func TestAttachmentUpload(t *testing.T) {
+	saved := tokenValidator
+	tokenValidator = staticTokenValidator{"token": 1, "other": 2}
+	defer func() { tokenValidator = saved }()
+
+	s, root := newTestAttachmentService(t, nil)
+	defer os.RemoveAll(root)
+	server := httptest.NewServer(s.Handler())
+	defer server.Close()
+	base := server.URL
+
+	if status, _ := doAttachmentRequest(t, "POST", base+"/attachments/upload/init?size=1", "", nil); status != http.StatusUnauthorized {
+		t.Errorf("unauthorized status:%d", status)
+	}
+
+	//断点续传, offset不一致时返回409, 查询之后继续上传
+	status, data := doAttachmentRequest(t, "POST", base+"/attachments/upload/init?size=12", "token", nil)
+	if status != http.StatusOK {
+		t.Fatalf("init status:%d", status)
+	}
+	uploadId := data["upload_id"].(string)
+	doAttachmentRequest(t, "PUT", base+"/attachments/upload?upload_id="+uploadId+"&offset=0", "token", []byte("hello "))
+	if status, _ := doAttachmentRequest(t, "PUT", base+"/attachments/upload?upload_id="+uploadId+"&offset=0", "token", []byte("hello ")); status != http.StatusConflict {
+		t.Errorf("conflict status:%d", status)
+	}
+	if status, _ := doAttachmentRequest(t, "GET", base+"/attachments/upload?upload_id="+uploadId, "other", nil); status != http.StatusNotFound {
+		t.Errorf("other user status:%d", status)
+	}
+	_, data = doAttachmentRequest(t, "GET", base+"/attachments/upload?upload_id="+uploadId, "token", nil)
+	if data["offset"].(float64) != 6 {
+		t.Fatalf("offset:%v", data["offset"])
+	}
+	if status, _ := doAttachmentRequest(t, "POST", base+"/attachments/upload/complete?upload_id="+uploadId, "token", nil); status != http.StatusBadRequest {
+		t.Errorf("incomplete status:%d", status)
+	}
+	doAttachmentRequest(t, "PUT", base+"/attachments/upload?upload_id="+uploadId+"&offset=6", "token", []byte("world!"))
+	status, data = doAttachmentRequest(t, "POST", base+"/attachments/upload/complete?upload_id="+uploadId, "token", nil)
+	if status != http.StatusOK {
+		t.Fatalf("complete status:%d", status)
+	}
+	id := data["id"].(string)
+
+	//相同的内容只保存一份
+	content := []byte("hello world!")
+	a2 := uploadAttachment(t, base, content)
+	if a2["sha256"] != data["sha256"] || a2["id"] == id {
+		t.Errorf("dedup:%v %v", a2, data)
+	}
+	blobs, _ := ioutil.ReadDir(filepath.Join(root, "store", "blobs"))
+	if len(blobs) != 1 {
+		t.Errorf("blobs:%d", len(blobs))
+	}
+
+	_, data = doAttachmentRequest(t, "GET", base+"/attachments/url?id="+id, "other", nil)
+	resp, err := http.Get(base + data["url"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(b, content) {
+		t.Errorf("download:%d %q", resp.StatusCode, b)
+	}
+
+	//不存在的上传不保留锁
+	for _, bogus := range []string{"x", strings.Repeat("0", 32)} {
+		if status, _ := doAttachmentRequest(t, "GET", base+"/attachments/upload?upload_id="+bogus, "token", nil); status != http.StatusNotFound {
+			t.Errorf("bogus upload status:%d", status)
+		}
+	}
+	if len(s.locks) != 0 {
+		t.Errorf("locks:%d", len(s.locks))
+	}
+
+	u, expires := s.SignURL(id, time.Now().Add(-2*time.Minute))
+	if s.VerifyURL(id, expires, s.signature(id, expires), time.Now()) {
+		t.Error("expired url is valid")
+	}
+	resp, _ = http.Get(base + strings.Replace(u, "sig=", "sig=0", 1))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("forged url status:%d", resp.StatusCode)
+	}
+}
+
+// 兼容S3协议的本地替代, 只检查请求是否带有签名
+type fakeS3 struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=ak/") ||
+		req.Header.Get("x-amz-date") == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	switch req.Method {
+	case http.MethodPut:
+		b, _ := ioutil.ReadAll(req.Body)
+		f.objects[req.URL.Path] = b
+	case http.MethodGet, http.MethodHead:
+		b, ok := f.objects[req.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(b)
+	}
+}
+
+func TestS3AttachmentStore(t *testing.T) {
+	server := httptest.NewServer(&fakeS3{objects: make(map[string][]byte)})
+	defer server.Close()
+
+	store := NewS3AttachmentStore(server.URL, "bucket", "", "ak", "sk")
+	if exists, err := store.Exists("blobs/a"); err != nil || exists {
+		t.Fatalf("exists:%v %v", exists, err)
+	}
+	if err := store.Put("blobs/a", bytes.NewReader([]byte("abc")), 3); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := store.Exists("blobs/a"); err != nil || !exists {
+		t.Fatalf("exists:%v %v", exists, err)
+	}
+	r, size, err := store.Get("blobs/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(r)
+	r.Close()
+	if size != 3 || string(b) != "abc" {
+		t.Errorf("get:%d %q", size, b)
+	}
+	if _, _, err := store.Get("blobs/b"); !errors.Is(err, errAttachmentNotFound) {
+		t.Errorf("get missing:%v", err)
+	}
+
+	//使用S3存储时上传的流程和本地存储相同
+	saved := tokenValidator
+	tokenValidator = staticTokenValidator{"token": 1}
+	defer func() { tokenValidator = saved }()
+	s, root := newTestAttachmentService(t, store)
+	defer os.RemoveAll(root)
+	api := httptest.NewServer(s.Handler())
+	defer api.Close()
+	a := uploadAttachment(t, api.URL, []byte("s3 content"))
+	if exists, _ := s.Exists(a["id"].(string)); !exists {
+		t.Error("attachment not saved")
+	}
+}
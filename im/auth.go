@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errInvalidToken = errors.New("invalid token")
+
+// 验证客户端登录的token, 返回token对应的用户id
+type TokenValidator interface {
+	Validate(token string) (int64, error)
+}
+
+func NewTokenValidator(config *Config) (TokenValidator, error) {
+	switch config.authValidator {
+	case "", "redis":
+		return &RedisTokenValidator{}, nil
+	case "jwt":
+		return NewJWTValidator(config.jwtAlgorithm, config.jwtKey, config.jwtIssuer)
+	case "http":
+		if config.introspectionURL == "" {
+			return nil, errors.New("introspection url is empty")
+		}
+		return NewHTTPTokenValidator(config.introspectionURL), nil
+	}
+	return nil, fmt.Errorf("unknown token validator:%s", config.authValidator)
+}
+
+// 从redis的access_token_{token}中读取用户id
+type RedisTokenValidator struct{}
+
+func (v *RedisTokenValidator) Validate(token string) (int64, error) {
+	uid, err := LoadUserAccessToken(token)
+	if err != nil {
+		return 0, err
+	}
+	if uid == 0 {
+		return 0, errInvalidToken
+	}
+	return uid, nil
+}
+
+// 本地验证JWT的签名, 不需要访问redis
+// 用户id在sub或者uid中, 有exp和nbf时检查有效期, 配置了issuer时检查iss
+type JWTValidator struct {
+	alg       string
+	secret    []byte         //HS256
+	publicKey *rsa.PublicKey //RS256
+	issuer    string
+}
+
+// HS256时key是密钥, RS256时key是PEM格式的公钥文件
+func NewJWTValidator(alg string, key string, issuer string) (*JWTValidator, error) {
+	v := &JWTValidator{alg: alg, issuer: issuer}
+	switch alg {
+	case "HS256":
+		if key == "" {
+			return nil, errors.New("jwt secret is empty")
+		}
+		v.secret = []byte(key)
+	case "RS256":
+		data, err := ioutil.ReadFile(key)
+		if err != nil {
+			return nil, err
+		}
+		v.publicKey, err = parseRSAPublicKey(data)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported jwt algorithm:%s", alg)
+	}
+	return v, nil
+}
+
+func parseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid pem")
+	}
+	if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		if rsaKey, ok := key.(*rsa.PublicKey); ok {
+			return rsaKey, nil
+		}
+		return nil, errors.New("not rsa public key")
+	}
+	return x509.ParsePKCS1PublicKey(block.Bytes)
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+}
+
+type jwtClaims struct {
+	Sub string      `json:"sub"`
+	Uid json.Number `json:"uid"`
+	Iss string      `json:"iss"`
+	Exp int64       `json:"exp"`
+	Nbf int64       `json:"nbf"`
+}
+
+func (v *JWTValidator) Validate(token string) (int64, error) {
+	return v.validate(token, time.Now())
+}
+
+func (v *JWTValidator) validate(token string, now time.Time) (int64, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, errInvalidToken
+	}
+
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return 0, errInvalidToken
+	}
+	//只接受配置的算法, 避免用公钥作为HMAC密钥伪造签名
+	if header.Alg != v.alg {
+		return 0, errInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return 0, errInvalidToken
+	}
+	if !v.verify(parts[0]+"."+parts[1], signature) {
+		return 0, errInvalidToken
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return 0, errInvalidToken
+	}
+	if claims.Exp > 0 && now.Unix() >= claims.Exp {
+		return 0, errors.New("token expired")
+	}
+	if claims.Nbf > 0 && now.Unix() < claims.Nbf {
+		return 0, errInvalidToken
+	}
+	if v.issuer != "" && claims.Iss != v.issuer {
+		return 0, errInvalidToken
+	}
+
+	uid := claims.Sub
+	if claims.Uid != "" {
+		uid = string(claims.Uid)
+	}
+	id, err := strconv.ParseInt(uid, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, errInvalidToken
+	}
+	return id, nil
+}
+
+func (v *JWTValidator) verify(signingInput string, signature []byte) bool {
+	switch v.alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write([]byte(signingInput))
+		return hmac.Equal(signature, mac.Sum(nil))
+	case "RS256":
+		h := sha256.Sum256([]byte(signingInput))
+		return rsa.VerifyPKCS1v15(v.publicKey, crypto.SHA256, h[:], signature) == nil
+	}
+	return false
+}
+
+func decodeJWTPart(s string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// 通过认证服务的http接口验证token, 格式参考RFC 7662
+// POST token=xxx, 返回{"active":true, "uid":1}或者{"active":true, "sub":"1"}
+type HTTPTokenValidator struct {
+	url    string
+	client *http.Client
+}
+
+func NewHTTPTokenValidator(url string) *HTTPTokenValidator {
+	return &HTTPTokenValidator{url: url, client: &http.Client{Timeout: 3 * time.Second}}
+}
+
+type introspectionResponse struct {
+	Active bool        `json:"active"`
+	Uid    json.Number `json:"uid"`
+	Sub    string      `json:"sub"`
+}
+
+func (v *HTTPTokenValidator) Validate(token string) (int64, error) {
+	resp, err := v.client.PostForm(v.url, url.Values{"token": {token}})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("introspection status:%d", resp.StatusCode)
+	}
+
+	var r introspectionResponse
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		return 0, err
+	}
+	if !r.Active {
+		return 0, errInvalidToken
+	}
+
+	uid := r.Sub
+	if r.Uid != "" {
+		uid = string(r.Uid)
+	}
+	id, err := strconv.ParseInt(uid, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, errInvalidToken
+	}
+	return id, nil
+}
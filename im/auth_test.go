@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func signJWT(header, claims string, sign func([]byte) []byte) string {
+	input := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString([]byte(claims))
+	return input + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(input)))
+}
+
+func TestJWTValidatorHS256(t *testing.T) {
+	secret := []byte("secret")
+	hs256 := func(input []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(input)
+		return mac.Sum(nil)
+	}
+	v, err := NewJWTValidator("HS256", string(secret), "sx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000, 0)
+
+	cases := []struct {
+		token string
+		uid   int64
+	}{
+		{signJWT(`{"alg":"HS256"}`, `{"sub":"7","iss":"sx","exp":2000}`, hs256), 7},
+		{signJWT(`{"alg":"HS256"}`, `{"uid":8,"iss":"sx"}`, hs256), 8},
+		{signJWT(`{"alg":"HS256"}`, `{"sub":"7","iss":"sx","exp":1000}`, hs256), 0}, //过期
+		{signJWT(`{"alg":"HS256"}`, `{"sub":"7","iss":"other"}`, hs256), 0},          //iss不匹配
+		{signJWT(`{"alg":"none"}`, `{"sub":"7","iss":"sx"}`, hs256), 0},              //算法不匹配
+		{signJWT(`{"alg":"HS256"}`, `{"sub":"7","iss":"sx"}`, func(b []byte) []byte { return []byte("x") }), 0},
+		{"a.b", 0},
+	}
+	for i, c := range cases {
+		uid, err := v.validate(c.token, now)
+		if uid != c.uid || (c.uid == 0) != (err != nil) {
+			t.Errorf("case %d: uid:%d err:%v expect:%d", i, uid, err, c.uid)
+		}
+	}
+}
+
+func TestJWTValidatorRS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	f.Close()
+
+	v, err := NewJWTValidator("RS256", f.Name(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs256 := func(input []byte) []byte {
+		h := sha256.Sum256(input)
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+		return sig
+	}
+
+	uid, err := v.Validate(signJWT(`{"alg":"RS256"}`, `{"sub":"9"}`, rs256))
+	if err != nil || uid != 9 {
+		t.Fatalf("uid:%d err:%v", uid, err)
+	}
+
+	//用公钥作为HMAC密钥伪造的签名
+	forged := signJWT(`{"alg":"HS256"}`, `{"sub":"9"}`, func(input []byte) []byte {
+		mac := hmac.New(sha256.New, der)
+		mac.Write(input)
+		return mac.Sum(nil)
+	})
+	if _, err := v.Validate(forged); err == nil {
+		t.Fatal("accepted forged token")
+	}
+}
+
+func TestHTTPTokenValidator(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.FormValue("token") {
+		case "uid":
+			w.Write([]byte(`{"active":true,"uid":3}`))
+		case "sub":
+			w.Write([]byte(`{"active":true,"sub":"4"}`))
+		case "inactive":
+			w.Write([]byte(`{"active":false}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	v := NewHTTPTokenValidator(server.URL)
+	cases := map[string]int64{"uid": 3, "sub": 4, "inactive": 0, "error": 0}
+	for token, expect := range cases {
+		uid, err := v.Validate(token)
+		if uid != expect || (expect == 0) != (err != nil) {
+			t.Errorf("token:%s uid:%d err:%v expect:%d", token, uid, err, expect)
+		}
+	}
+}
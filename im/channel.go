@@ -3,6 +3,7 @@ package main
 import (
 	log "github.com/sirupsen/logrus"
 	"net"
+	"sx-chat/proto"
 	"sync"
 	"time"
 )
@@ -19,23 +20,26 @@ func NewSubscriber() *Subscriber {
 
 type Channel struct {
 	addr string
-	wt   chan *Message
+	wt   chan *proto.Message
 
 	mutex      sync.Mutex
 	subscriber *Subscriber
 
-	dispatch      func(*AppMessage)
-	dispatchGroup func(*AppMessage)
+	dispatch      func(*proto.AppMessage)
+	dispatchGroup func(*proto.AppMessage)
+
+	done chan struct{} //wt中的消息都已经发送, 连接已经关闭
 }
 
-func NewChannel(addr string, f func(*AppMessage), f2 func(*AppMessage)) *Channel {
+func NewChannel(addr string, f func(*proto.AppMessage), f2 func(*proto.AppMessage)) *Channel {
 	channel := new(Channel)
 	channel.addr = addr
 	channel.subscriber = NewSubscriber()
 	channel.dispatch = f
 	channel.dispatchGroup = f2
 
-	channel.wt = make(chan *Message, 10)
+	channel.wt = make(chan *proto.Message, 10)
+	channel.done = make(chan struct{})
 	return channel
 }
 
@@ -48,35 +52,41 @@ func (channel *Channel) Run() {
 		conn, err := net.Dial("tcp", channel.addr)
 		if err != nil {
 			log.Info("connect route server error:", err)
+			time.Sleep(time.Second)
+			continue
 		}
 		tconn := conn.(*net.TCPConn)
 		tconn.SetKeepAlive(true)
 		tconn.SetKeepAlivePeriod(10 * time.Minute)
 		log.Info("channel connected")
-		channel.RunOnce(tconn)
+		if channel.RunOnce(tconn) {
+			close(channel.done)
+			return
+		}
 	}
 }
 
-func (channel *Channel) RunOnce(conn *net.TCPConn) {
+// 返回channel是否已经关闭
+func (channel *Channel) RunOnce(conn *net.TCPConn) bool {
 	defer conn.Close()
 
 	closedCh := make(chan bool)
 
 	go func() {
 		for {
-			msg := ReceiveMessage(conn)
+			msg := proto.ReceiveMessage(conn)
 			if msg == nil {
 				close(closedCh)
 				return
 			}
-			log.Info("channel recv message:", Command(msg.cmd))
-			if msg.cmd == MSG_PUBLISH {
-				amsg := msg.body.(*AppMessage)
+			log.Info("channel recv message:", proto.Command(msg.Cmd))
+			if msg.Cmd == proto.MSG_PUBLISH {
+				amsg := msg.Body.(*proto.AppMessage)
 				if channel.dispatch != nil {
 					channel.dispatch(amsg)
 				}
-			} else if msg.cmd == MSG_PUBLISH_GROUP {
-				amsg := msg.body.(*AppMessage)
+			} else if msg.Cmd == proto.MSG_PUBLISH_GROUP {
+				amsg := msg.Body.(*proto.AppMessage)
 				if channel.dispatchGroup != nil {
 					channel.dispatchGroup(amsg)
 				}
@@ -88,10 +98,14 @@ func (channel *Channel) RunOnce(conn *net.TCPConn) {
 		select {
 		case _ = <-closedCh:
 			log.Info("channel closed")
-			return
+			return false
 		case msg := <-channel.wt:
+			if msg == nil {
+				log.WithField("addr", channel.addr).Info("channel shutdown")
+				return true
+			}
 			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			err := SendMessage(conn, msg)
+			err := proto.SendMessage(conn, msg)
 			if err != nil {
 				log.Info("channel send message err: ", err)
 			}
@@ -99,8 +113,22 @@ func (channel *Channel) RunOnce(conn *net.TCPConn) {
 	}
 }
 
-func (channel *Channel) Publish(amsg *AppMessage) {
-	msg := &Message{cmd: MSG_PUBLISH, body: amsg}
+// 发送完wt中已有的消息之后关闭连接, 超时之后直接返回
+func (channel *Channel) Close(timeout time.Duration) {
+	select {
+	case channel.wt <- nil:
+	case <-time.After(timeout):
+		return
+	}
+	select {
+	case <-channel.done:
+	case <-time.After(timeout):
+		log.WithField("addr", channel.addr).Warning("channel关闭超时")
+	}
+}
+
+func (channel *Channel) Publish(amsg *proto.AppMessage) {
+	msg := &proto.Message{Cmd: proto.MSG_PUBLISH, Body: amsg}
 	channel.wt <- msg
 }
 
@@ -115,13 +143,13 @@ func (channel *Channel) Subscribe(uid int64, online bool) {
 		if online {
 			on = 1
 		}
-		id := &SubscribeMessage{uid: uid, online: int8(on)}
-		msg := &Message{cmd: MSG_SUBSCRIBE, body: id}
+		id := &proto.SubscribeMessage{Uid: uid, Online: int8(on)}
+		msg := &proto.Message{Cmd: proto.MSG_SUBSCRIBE, Body: id}
 		channel.wt <- msg
 	} else if onlineCount == 0 && online {
 		// 手机端上线
-		id := &SubscribeMessage{uid: uid, online: 1}
-		msg := &Message{cmd: MSG_SUBSCRIBE, body: id}
+		id := &proto.SubscribeMessage{Uid: uid, Online: 1}
+		msg := &proto.Message{Cmd: proto.MSG_SUBSCRIBE, Body: id}
 		channel.wt <- msg
 	}
 }
@@ -131,13 +159,13 @@ func (channel *Channel) Unsubscribe(uid int64, online bool) {
 	log.Info("unsub count:", count, onlineCount)
 	if count == 1 {
 		// 用户断开全部连接
-		id := &UserID{uid: uid}
-		msg := &Message{cmd: MSG_UNSUBSCRIBE, body: id}
+		id := &proto.UserID{Uid: uid}
+		msg := &proto.Message{Cmd: proto.MSG_UNSUBSCRIBE, Body: id}
 		channel.wt <- msg
 	} else if count > 1 && onlineCount == 1 && online {
 		//手机端断开连接,pc/web端还未断开连接
-		id := &SubscribeMessage{ uid: uid, online: 0}
-		msg := &Message{cmd: MSG_SUBSCRIBE, body: id}
+		id := &proto.SubscribeMessage{ Uid: uid, Online: 0}
+		msg := &proto.Message{Cmd: proto.MSG_SUBSCRIBE, Body: id}
 		channel.wt <- msg
 	}
 }
@@ -188,7 +216,7 @@ func (channel *Channel) RemoveSubscribe(uid int64, online bool) (int, int) {
 	return count & 0xffff, count >> 16 & 0xffff
 }
 
-func (channel *Channel) PublishGroup(amsg *AppMessage) {
-	msg := &Message{cmd: MSG_PUBLISH_GROUP, body: amsg}
+func (channel *Channel) PublishGroup(amsg *proto.AppMessage) {
+	msg := &proto.Message{Cmd: proto.MSG_PUBLISH_GROUP, Body: amsg}
 	channel.wt <- msg
 }
@@ -2,16 +2,14 @@ package main
 
 import (
 	"fmt"
+	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"sx-chat/proto"
+	"sync/atomic"
 	"time"
 )
 
-//平台号
-const PLATFORM_IOS = 1
-const PLATFORM_ANDROID = 2
-const PLATFORM_WEB = 3
-
 type Client struct {
 	Connection
 	*PeerClient
@@ -23,9 +21,11 @@ func NewClient(conn interface{}) *Client {
 
 	client.conn = conn //初始化 connection
 
-	client.wt = make(chan *Message, 300) // write的Message chan，client close的时候需要将wt中的消息发送完
+	client.wt = make(chan *proto.Message, 300) // write的Message chan，client close的时候需要将wt中的消息发送完
+
+	client.pwt = make(chan []*proto.Message, 10)
 
-	client.pwt = make(chan []*Message, 10)
+	client.limiter = NewConnectionLimiter(GetRateLimitTier(DEFAULT_RATE_TIER), time.Now())
 
 	client.PeerClient = &PeerClient{&client.Connection}
 	client.GroupClient = &GroupClient{Connection: &client.Connection}
@@ -44,11 +44,16 @@ func ListenClient(port int) {
 		log.Error("监听端口失败")
 		return
 	}
+	clientListener = tcpListener
 
 	for {
 		conn, err := tcpListener.AcceptTCP()
 		if err != nil {
-			log.WithField("err", err).Error("accept err")
+			if IsShuttingDown() {
+				log.Info("停止接受新连接")
+			} else {
+				log.WithField("err", err).Error("accept err")
+			}
 			return
 		}
 		log.WithField("客户端地址", conn.RemoteAddr()).Info("接收到新连接", )
@@ -63,10 +68,19 @@ func handlerClient(conn interface{}) {
 }
 
 func (client *Client) Run() {
+	client.authTimer = time.AfterFunc(time.Duration(config.authTimeout)*time.Second, client.onAuthTimeout)
 	go client.Read()
 	go client.Write()
 }
 
+// 连接之后没有在规定的时间内完成鉴权, 关闭socket之后Read会退出并清理连接
+func (client *Client) onAuthTimeout() {
+	if client.setState(CLIENT_STATE_UNAUTHENTICATED, CLIENT_STATE_CLOSED) {
+		log.Info("客户端鉴权超时, 关闭连接")
+		client.close()
+	}
+}
+
 func (client *Client) Read() {
 	for {
 		msg := client.read()
@@ -78,129 +92,253 @@ func (client *Client) Read() {
 	}
 }
 
+// 阻塞等待第一个消息, 之后把队列中已有的消息合并到一次写入
 func (client *Client) Write() {
+	w := &FrameWriter{}
 	running := true
 	for running {
+		closing := false
 		select {
 		case msg := <-client.wt:
 			if msg == nil {
-				client.close()
 				running = false
-				log.Infof("client:%d socket closed", client.uid)
 				break
 			}
-			if msg.meta != nil {
-				metaMsg := &Message{cmd: MSG_METADATA, version: client.version, body: msg.meta}
-				client.send(metaMsg)
-			}
-			client.send(msg)
+			closing = client.pack(w, msg)
 		case msgs := <-client.pwt:
 			for _, msg := range msgs {
-				if msg.meta != nil {
-					metaMsg := &Message{cmd: MSG_METADATA, version: client.version, body: msg.meta}
-					client.send(metaMsg)
+				client.pack(w, msg)
+			}
+		}
+
+	drain:
+		for running && !closing && w.Len() < WRITE_BATCH_SIZE {
+			select {
+			case msg := <-client.wt:
+				if msg == nil {
+					running = false
+					break drain
 				}
-				client.send(msg)
+				closing = client.pack(w, msg)
+			case msgs := <-client.pwt:
+				for _, msg := range msgs {
+					client.pack(w, msg)
+				}
+			default:
+				break drain
 			}
 		}
+
+		client.flush(w)
+
+		if !running {
+			client.close()
+			log.Infof("client:%d socket closed", client.uid)
+		} else if closing {
+			// 被踢下线或者服务器关闭, 关闭socket之后Read会退出并清理连接
+			client.close()
+		}
+	}
+}
+
+// 返回发送这个消息之后是否需要关闭连接
+func (client *Client) pack(w *FrameWriter, msg *proto.Message) bool {
+	if msg.Meta != nil {
+		metaMsg := &proto.Message{Cmd: proto.MSG_METADATA, Version: client.version, Body: msg.Meta}
+		client.send(w, metaMsg)
 	}
+	client.send(w, msg)
+	return msg.Cmd == proto.MSG_KICKED || msg.Cmd == proto.MSG_SERVER_CLOSE
 }
 
-func (client *Client) send(m *Message) {
+func (client *Client) send(w *FrameWriter, m *proto.Message) {
 	client.sequence++
-	msg := m
 
-	msg.seq = client.sequence
+	// 同一个消息可能投递给多个连接, 复制之后按照当前连接协商的协议版本编码
+	msg := new(proto.Message)
+	*msg = *m
+	msg.Seq = client.sequence
+	msg.Version = client.version
+
+	if client.capabilities&proto.CAPABILITY_DEFLATE != 0 {
+		w.compressThreshold = config.compressThreshold
+	}
+	w.Add(msg)
+}
 
+func (client *Client) flush(w *FrameWriter) {
 	if conn, ok := client.conn.(net.Conn); ok {
 		conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
-		err := SendMessage(conn, msg)
-		if err != nil {
-			log.Info("send msg:", Command(msg.cmd), " tcp err:", err)
-		}
+	} else if conn, ok := client.conn.(*websocket.Conn); ok {
+		conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	}
+	err := w.Flush(client.conn)
+	if err != nil {
+		log.WithFields(log.Fields{"uid": client.uid, "err": err}).Info("发送消息失败")
 	}
 }
 
 func (client *Client) HandleClientClosed() {
+	if client.authTimer != nil {
+		client.authTimer.Stop()
+	}
+	atomic.StoreInt32(&client.state, CLIENT_STATE_CLOSED)
 
 	client.RemoveClient()
 	close(client.wt)
 
+	if client.userLimiter != nil {
+		rateLimiter.ReleaseUser(client.uid)
+	}
+
+	if client.uid > 0 {
+		err := RemoveDeviceSession(client.uid, client.sessionId)
+		if err != nil {
+			log.WithFields(log.Fields{"uid": client.uid, "err": err}).Warning("删除登录设备失败")
+		}
+	}
+
 	client.PeerClient.Logout()
 }
 
-func (client *Client) HandleMessage(msg *Message) {
-	log.Info("msg cmd:", Command(msg.cmd))
+func (client *Client) HandleMessage(msg *proto.Message) {
+	log.Info("msg cmd:", proto.Command(msg.Cmd))
+
+	if !client.checkState(msg) {
+		return
+	}
+
+	if !client.checkRateLimit(msg) {
+		return
+	}
 
-	switch msg.cmd {
-	case MSG_AUTH_TOKEN:
-		client.HandleAuthToken(msg.body.(*AuthenticationToken), msg.version)
-	case MSG_PING:
+	switch msg.Cmd {
+	case proto.MSG_AUTH_TOKEN:
+		client.HandleAuthToken(msg.Body.(*proto.AuthenticationToken), msg.Version)
+	case proto.MSG_PING:
 		client.HandlePing()
+	case proto.MSG_LOAD_DEVICES:
+		client.HandleLoadDevices()
+	case proto.MSG_KICK_DEVICE:
+		client.HandleKickDevice(msg.Body.(*proto.SessionID))
+	case proto.MSG_SEARCH:
+		client.HandleSearch(msg)
 	}
 
 	client.PeerClient.HandleMessage(msg)
 	client.GroupClient.HandleMessage(msg)
 }
 
+// 鉴权之前只处理鉴权和心跳, 鉴权之后不能重复鉴权
+func (client *Client) checkState(msg *proto.Message) bool {
+	switch client.State() {
+	case CLIENT_STATE_UNAUTHENTICATED:
+		if msg.Cmd == proto.MSG_AUTH_TOKEN || msg.Cmd == proto.MSG_PING {
+			return true
+		}
+		log.WithField("cmd", msg.Cmd).Warning("客户端还没有完成认证")
+		return false
+	case CLIENT_STATE_AUTHENTICATED:
+		if msg.Cmd == proto.MSG_AUTH_TOKEN {
+			log.WithField("uid", client.uid).Warning("客户端重复鉴权")
+			return false
+		}
+		return true
+	}
+	return false
+}
+
 func (client *Client) HandlePing() {
-	m := &Message{cmd: MSG_PONG}
+	m := &proto.Message{Cmd: proto.MSG_PONG}
 	client.EnqueueMessage(m)
 	if client.uid == 0 {
 		log.Warning("client has't been authenticated")
 	}
 }
 
-func (client *Client) HandleAuthToken(login *AuthenticationToken, version int) {
+func (client *Client) HandleAuthToken(login *proto.AuthenticationToken, version int) {
 	var err error
-	uid, _, on, err := client.AuthToken(login.token)
+
+	// 之后发给客户端的消息都使用协商后的版本编码
+	version = proto.NegotiateVersion(version)
+	client.version = version
+	uid, _, on, err := client.AuthToken(login.Token)
 
 	// 鉴权没通过
 	if err != nil {
-		log.WithFields(log.Fields{"token": login.token, "err": err}).Info("验证token失败")
-		msg := &Message{cmd: MSG_AUTH_STATUS, version: version, body: &AuthenticationStatus{status: 1}}
+		log.WithFields(log.Fields{"token": login.Token, "err": err}).Info("验证token失败")
+		msg := &proto.Message{Cmd: proto.MSG_AUTH_STATUS, Version: version, Body: &proto.AuthenticationStatus{Status: 1}}
 		client.EnqueueMessage(msg)
 		return
 	}
 
 	if uid == 0 {
-		log.WithFields(log.Fields{"token": login.token}).Info("验证token失败 uid = 0")
-		msg := &Message{cmd: MSG_AUTH_STATUS, version: version, body: &AuthenticationStatus{status: 1}}
+		log.WithFields(log.Fields{"token": login.Token}).Info("验证token失败 uid = 0")
+		msg := &proto.Message{Cmd: proto.MSG_AUTH_STATUS, Version: version, Body: &proto.AuthenticationStatus{Status: 1}}
 		client.EnqueueMessage(msg)
 		return
 	}
 
-	if login.platformId != PLATFORM_WEB && len(login.deviceId) > 0 {
-		client.deviceID, err = GetDeviceID(login.deviceId, int(login.platformId))
+	if login.PlatformId != proto.PLATFORM_WEB && len(login.DeviceId) > 0 {
+		client.deviceID, err = GetDeviceID(login.DeviceId, int(login.PlatformId))
 		if err != nil {
-			msg := &Message{cmd: MSG_AUTH_STATUS, version: version, body: &AuthenticationStatus{1}}
+			msg := &proto.Message{Cmd: proto.MSG_AUTH_STATUS, Version: version, Body: &proto.AuthenticationStatus{Status: 1}}
 			client.EnqueueMessage(msg)
 			return
 		}
 	}
 
-	isMobile := login.platformId == PLATFORM_IOS || login.platformId == PLATFORM_ANDROID
+	sessionId, err := NewSessionID()
+	if err != nil {
+		log.WithField("err", err).Warning("生成session id失败")
+		msg := &proto.Message{Cmd: proto.MSG_AUTH_STATUS, Version: version, Body: &proto.AuthenticationStatus{Status: 1}}
+		client.EnqueueMessage(msg)
+		return
+	}
+
+	isMobile := login.PlatformId == proto.PLATFORM_IOS || login.PlatformId == proto.PLATFORM_ANDROID
 	online := true
 	if on && !isMobile {
 		online = false
 	}
 
+	// 服务端关闭压缩时不启用客户端声明的压缩能力
+	if config.compressThreshold > 0 {
+		client.capabilities = login.Capabilities & proto.CAPABILITY_DEFLATE
+	}
+
+	// 和鉴权超时竞争, 超时之后连接已经关闭
+	if !client.setState(CLIENT_STATE_UNAUTHENTICATED, CLIENT_STATE_AUTHENTICATED) {
+		log.WithField("uid", uid).Info("鉴权超时, 忽略鉴权结果")
+		return
+	}
+	if client.authTimer != nil {
+		client.authTimer.Stop()
+	}
+
 	client.uid = uid
-	client.deviceId = login.deviceId
-	client.platformId = login.platformId
-	client.version = version
+	client.deviceId = login.DeviceId
+	client.platformId = login.PlatformId
 	client.online = online
+	client.sessionId = sessionId
+	client.loginTime = time.Now().Unix()
+
+	tier := GetRateLimitTier(LoadUserRateTier(uid))
+	client.limiter = NewConnectionLimiter(tier, time.Now())
+	client.userLimiter = rateLimiter.AcquireUser(uid, tier)
 
-	msg := &Message{cmd: MSG_AUTH_STATUS, version: version, body: &AuthenticationStatus{0}}
+	msg := &proto.Message{Cmd: proto.MSG_AUTH_STATUS, Version: version, Body: &proto.AuthenticationStatus{Status: 0, Capabilities: client.capabilities}}
 	client.EnqueueMessage(msg)
 
 	client.AddClient()
 
+	client.ApplyDevicePolicy()
+
 	client.PeerClient.Login()
 }
 
 func (client *Client) AuthToken(token string) (int64, int, bool, error) {
-	uid, err := LoadUserAccessToken(token)
+	uid, err := tokenValidator.Validate(token)
 	if err != nil {
 		return 0, 0, false, err
 	}
@@ -10,7 +10,9 @@ type Config struct {
 	redisPassword string
 	redisDB       int
 
+	//管理接口, 请求需要在X-Admin-Secret中带上httpAdminSecret, 没有配置密钥时不启动
 	httpListenAddress string
+	httpAdminSecret   string
 
 	//websocket listen address
 	wsAddress string
@@ -31,6 +33,60 @@ type Config struct {
 
 	memoryLimit int64 //rss超过limit，不接受新的链接
 
+	compressThreshold int //客户端支持压缩时, 超过这个大小的消息体使用deflate压缩, 0表示不压缩
+
+	shutdownTimeout int //关闭时等待客户端断开的最长时间, 单位秒
+
+	//同类设备同时在线的数量限制, 0表示不限制, 超过限制时最早登录的设备被踢下线
+	mobileDeviceLimit  int
+	desktopDeviceLimit int
+	webDeviceLimit     int
+
+	authTimeout int //连接之后需要在这个时间内完成鉴权, 单位秒
+
+	//验证token的方式: redis, jwt, http
+	authValidator    string
+	jwtAlgorithm     string //HS256, RS256
+	jwtKey           string //HS256的密钥或者RS256的公钥文件
+	jwtIssuer        string //不为空时检查iss
+	introspectionURL string
+
+	//限流配置, 用户按照rate_tier使用不同的限制, 没有设置时使用default
+	rateLimitTiers map[string]*RateLimitTier
+	groupSendLimit RateLimit //单个群组在当前im实例上的发送速率
+
+	//连接在rateLimitWindow秒内超过限制rateLimitViolations次之后断开, 0表示不断开
+	rateLimitViolations int
+	rateLimitWindow     int
+
+	//按照发送者和客户端消息id去重, 缓存的数量和时间(秒)
+	dedupCacheSize int
+	dedupTTL       int
+
+	//调用ims的超时时间(毫秒), 同步消息失败之后的重试次数
+	//连续storageBreakerFailures次超时或者连接失败之后熔断storageBreakerCooldown秒
+	storageCallTimeout     int
+	storageSyncRetries     int
+	storageBreakerFailures int
+	storageBreakerCooldown int
+
+	//附件服务, attachmentListenAddress为空时不启动
+	attachmentListenAddress string
+	attachmentRoot          string //上传中的文件和本地存储的附件
+	attachmentStore         string //local, s3
+	attachmentSecret        string //下载地址的签名密钥, 多个im实例需要相同
+	attachmentURLPrefix     string //下载地址的前缀, 比如https://files.example.com
+	attachmentMaxSize       int64
+	attachmentChunkSize     int64
+	attachmentUrlTTL        int //下载地址的有效期, 单位秒
+	attachmentUploadTTL     int //没有完成的上传保留的时间, 单位秒
+
+	s3Endpoint  string
+	s3Bucket    string
+	s3Region    string
+	s3AccessKey string
+	s3SecretKey string
+
 	logFilename string
 	logLevel    string
 	logBackup   int //log files
@@ -53,6 +109,49 @@ func readConfig() *Config {
 	config.routeAddrs = []string{"sx-imr:4444"}
 	config.groupRouteAddrs = []string{"sx-imgr:4444"}
 
+	config.httpListenAddress = "127.0.0.1:6666"
+
+	config.mobileDeviceLimit = 1
+	config.desktopDeviceLimit = 1
+	config.webDeviceLimit = 5
+
+	config.compressThreshold = 1024
+	config.shutdownTimeout = 10
+
+	config.authTimeout = 30
+	config.authValidator = "redis"
+
+	config.rateLimitTiers = map[string]*RateLimitTier{
+		DEFAULT_RATE_TIER: {
+			conn: [RATE_CLASS_COUNT]RateLimit{RATE_SEND: {10, 20}, RATE_SYNC: {2, 10}, RATE_PING: {1, 5}},
+			user: [RATE_CLASS_COUNT]RateLimit{RATE_SEND: {20, 40}, RATE_SYNC: {5, 20}},
+		},
+		//机器人和客服等服务账号
+		"service": {
+			conn: [RATE_CLASS_COUNT]RateLimit{RATE_SEND: {100, 200}, RATE_SYNC: {10, 50}, RATE_PING: {1, 5}},
+			user: [RATE_CLASS_COUNT]RateLimit{RATE_SEND: {200, 400}, RATE_SYNC: {20, 100}},
+		},
+	}
+	config.groupSendLimit = RateLimit{20, 50}
+	config.rateLimitViolations = 20
+	config.rateLimitWindow = 10
+
+	config.dedupCacheSize = 100000
+	config.dedupTTL = 300
+
+	config.storageCallTimeout = 3000
+	config.storageSyncRetries = 2
+	config.storageBreakerFailures = 5
+	config.storageBreakerCooldown = 10
+
+	config.attachmentListenAddress = ":6667"
+	config.attachmentRoot = "/data/im/attachments"
+	config.attachmentStore = "local"
+	config.attachmentMaxSize = 100 * 1024 * 1024
+	config.attachmentChunkSize = 4 * 1024 * 1024
+	config.attachmentUrlTTL = 3600
+	config.attachmentUploadTTL = 24 * 3600
+
 	config.groupDeliverCount = 1
 	config.pendingRoot = "/data/im/pending"
 
@@ -4,35 +4,53 @@ import (
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"sx-chat/proto"
+	"sync/atomic"
 	"time"
 	"unsafe"
 )
 
 const CLIENT_TIMEOUT = 6 * 60
 
+//连接的状态, 只能按照这个顺序变化
+const CLIENT_STATE_UNAUTHENTICATED = 0 //等待客户端鉴权, 只处理MSG_AUTH_TOKEN和MSG_PING
+const CLIENT_STATE_AUTHENTICATED = 1
+const CLIENT_STATE_CLOSED = 2 //鉴权超时或者连接已经关闭, 不再处理客户端的消息
+
 type Connection struct {
 	conn interface{}
 
+	state     int32 //CLIENT_STATE_*, 原子操作
+	authTimer *time.Timer
+
 	online bool
 
-	wt chan *Message
+	wt chan *proto.Message
 
 	// 离线消息
-	pwt chan []*Message
+	pwt chan []*proto.Message
 
 	sequence int // 发送给客户端的消息序号
 	version  int //客户端协议版本号
 
+	capabilities uint8 //鉴权时协商启用的能力, 比如压缩
+
 	uid        int64
 	deviceId   string
 	deviceID   int64
 	platformId int8
+
+	sessionId int64 //登录会话id, 用于查询和踢掉登录设备
+	loginTime int64
+
+	limiter     *ConnectionLimiter
+	userLimiter *UserLimiter //登录之后才有
 }
 
-func (client *Connection) read() *Message {
+func (client *Connection) read() *proto.Message {
 	if conn, ok := client.conn.(net.Conn); ok {
 		conn.SetReadDeadline(time.Now().Add(CLIENT_TIMEOUT * time.Second))
-		return ReceiveClientMessage(conn)
+		return proto.ReceiveClientMessage(conn)
 	} else if conn, ok := client.conn.(*websocket.Conn); ok {
 		conn.SetReadDeadline(time.Now().Add(CLIENT_TIMEOUT * time.Second))
 		return ReadWebsocketMessage(conn)
@@ -40,7 +58,7 @@ func (client *Connection) read() *Message {
 	return nil
 }
 
-func (client *Connection) EnqueueMessage(msg *Message) bool {
+func (client *Connection) EnqueueMessage(msg *proto.Message) bool {
 	select {
 	case client.wt <- msg:
 		return true
@@ -50,7 +68,27 @@ func (client *Connection) EnqueueMessage(msg *Message) bool {
 	}
 }
 
-func (client *Connection) EnqueueMessages(msgs []*Message) bool {
+// 消息没有发送时返回失败的原因
+func (client *Connection) sendACK(seq int, status int8) {
+	ack := &proto.Message{Cmd: proto.MSG_ACK, Body: &proto.MessageACK{Seq: int32(seq), Status: status}}
+	client.EnqueueMessage(ack)
+}
+
+// 检查消息的类型和content, 不合法的消息不保存
+func (client *Connection) checkContent(seq int, msg *proto.IMMessage) bool {
+	c, err := proto.ParseContent(msg.MessageType, msg.Content)
+	if err == nil {
+		err = checkAttachment(c)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"sender": msg.Sender, "receiver": msg.Receiver, "type": msg.MessageType, "err": err}).Warning("消息内容不合法")
+		client.sendACK(seq, proto.ACK_INVALID_CONTENT)
+		return false
+	}
+	return true
+}
+
+func (client *Connection) EnqueueMessages(msgs []*proto.Message) bool {
 	select {
 	case client.pwt <- msgs:
 		return true
@@ -60,20 +98,20 @@ func (client *Connection) EnqueueMessages(msgs []*Message) bool {
 	}
 }
 
-func (client *Connection) SendMessage(uid int64, msg *Message) {
+func (client *Connection) SendMessage(uid int64, msg *proto.Message) {
 	PublishMessage(uid, msg)
 	DispatchMessageToPeer(msg, uid, client.Client())
 }
 
-func (client *Connection) sendGroupMessage(group *Group, msg *Message) {
+func (client *Connection) sendGroupMessage(group *Group, msg *proto.Message) {
 	PublishGroupMessage(group.gid, msg)
 	DispatchMessageToGroup(msg, group, client.Client())
 }
 
-func (client *Connection) isSender(msg *Message, deviceID int64) bool {
-	if msg.cmd == MSG_IM || msg.cmd == MSG_GROUP_IM {
-		m := msg.body.(*IMMessage)
-		if m.sender == client.uid && deviceID == client.deviceID {
+func (client *Connection) isSender(msg *proto.Message, deviceID int64) bool {
+	if msg.Cmd == proto.MSG_IM || msg.Cmd == proto.MSG_GROUP_IM {
+		m := msg.Body.(*proto.IMMessage)
+		if m.Sender == client.uid && deviceID == client.deviceID {
 			return true
 		}
 	}
@@ -81,6 +119,14 @@ func (client *Connection) isSender(msg *Message, deviceID int64) bool {
 	return false
 }
 
+func (client *Connection) State() int32 {
+	return atomic.LoadInt32(&client.state)
+}
+
+func (client *Connection) setState(from, to int32) bool {
+	return atomic.CompareAndSwapInt32(&client.state, from, to)
+}
+
 func (client *Connection) Client() *Client {
 	p := unsafe.Pointer(client)
 	return (*Client)(p)
@@ -89,7 +135,7 @@ func (client *Connection) Client() *Client {
 func (client *Connection) close() {
 	if conn, ok := client.conn.(net.Conn); ok {
 		conn.Close()
-	} else if conn, ok := client.conn.(*websocket.Conn); !ok {
+	} else if conn, ok := client.conn.(*websocket.Conn); ok {
 		conn.Close()
 	}
 }
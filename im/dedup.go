@@ -0,0 +1,126 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sx-chat/lru"
+	"sx-chat/proto"
+	"sync"
+	"time"
+)
+
+//重复的消息等待第一次发送完成的最长时间
+const DEDUP_WAIT_TIMEOUT = 10 * time.Second
+
+type dedupKey struct {
+	sender      int64
+	clientMsgId string
+}
+
+// 同一个发送者的同一个clientMsgId只保存一次, 客户端重发时返回第一次保存的消息id
+type dedupEntry struct {
+	done   chan struct{} //发送完成或者失败之后关闭
+	meta   *proto.Metadata
+	failed bool
+	ts     time.Time
+
+	//已经保存到接收者收件箱中的消息id, 发送者的收件箱保存失败时重发只保存发送者的
+	//只通过SetSaved和Saved在mutex内读写
+	saved          *proto.Metadata
+	savedTimestamp int32
+}
+
+type DedupCache struct {
+	mutex sync.Mutex
+	cache *lru.Cache
+	ttl   time.Duration
+}
+
+func NewDedupCache(size int, ttl time.Duration) *DedupCache {
+	return &DedupCache{cache: lru.New(size), ttl: ttl}
+}
+
+// 返回的dup为true时表示这个消息正在发送或者已经发送过
+// 上次发送只保存了接收者的消息时返回新的entry, saved是上次保存的消息id
+func (dc *DedupCache) Begin(sender int64, clientMsgId string) (*dedupEntry, bool) {
+	key := dedupKey{sender, clientMsgId}
+	now := time.Now()
+
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+
+	if v, ok := dc.cache.Get(key); ok {
+		e := v.(*dedupEntry)
+		if now.Sub(e.ts) < dc.ttl && !e.failed {
+			return e, true
+		}
+		if now.Sub(e.ts) < dc.ttl && e.saved != nil {
+			e = &dedupEntry{done: make(chan struct{}), ts: e.ts, saved: e.saved, savedTimestamp: e.savedTimestamp}
+			dc.cache.Add(key, e)
+			return e, false
+		}
+	}
+	e := &dedupEntry{done: make(chan struct{}), ts: now}
+	dc.cache.Add(key, e)
+	return e, false
+}
+
+// 接收者的消息保存成功之后记录消息id和发送时间
+func (dc *DedupCache) SetSaved(e *dedupEntry, meta *proto.Metadata, timestamp int32) {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	e.saved = meta
+	e.savedTimestamp = timestamp
+}
+
+// 上次发送已经保存的接收者的消息id, 没有保存时返回nil
+func (dc *DedupCache) Saved(e *dedupEntry) (*proto.Metadata, int32) {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	return e.saved, e.savedTimestamp
+}
+
+func (dc *DedupCache) Finish(e *dedupEntry, meta *proto.Metadata) {
+	e.meta = meta
+	close(e.done)
+}
+
+// 发送失败之后删除, 客户端重发时重新保存
+// 已经保存了接收者的消息时保留, 客户端重发时从发送者的收件箱继续
+func (dc *DedupCache) Abort(sender int64, clientMsgId string, e *dedupEntry) {
+	key := dedupKey{sender, clientMsgId}
+
+	dc.mutex.Lock()
+	if v, ok := dc.cache.Get(key); ok && v.(*dedupEntry) == e && e.saved == nil {
+		dc.cache.Remove(key)
+	}
+	e.failed = true
+	dc.mutex.Unlock()
+
+	close(e.done)
+}
+
+// 等待第一次发送的结果, 第一次发送失败或者超时返回false
+func (dc *DedupCache) Wait(e *dedupEntry) (*proto.Metadata, bool) {
+	select {
+	case <-e.done:
+		return e.meta, !e.failed
+	case <-time.After(DEDUP_WAIT_TIMEOUT):
+		return nil, false
+	}
+}
+
+// 重复的消息不再保存, 使用第一次保存的消息id回复ack
+func (client *Connection) ackDuplicate(seq int, msg *proto.IMMessage, e *dedupEntry) {
+	meta, ok := dedupCache.Wait(e)
+	if !ok {
+		log.WithFields(log.Fields{"sender": msg.Sender, "clientMsgId": msg.ClientMsgId}).Warning("重复消息的第一次发送没有成功")
+		client.sendACK(seq, proto.ACK_SERVER_ERROR)
+		return
+	}
+
+	ack := &proto.Message{Cmd: proto.MSG_ACK, Body: &proto.MessageACK{Seq: int32(seq)}, Meta: meta}
+	if !client.EnqueueMessage(ack) {
+		log.Warning("发送重复消息ack失败")
+	}
+	log.WithFields(log.Fields{"sender": msg.Sender, "receiver": msg.Receiver, "clientMsgId": msg.ClientMsgId}).Info("忽略重复的消息")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sx-chat/proto"
+	"testing"
+	"time"
+)
+
+func TestDedupCache(t *testing.T) {
+	dc := NewDedupCache(10, time.Minute)
+
+	e, dup := dc.Begin(1, "a")
+	if dup {
+		t.Fatal("first send is duplicate")
+	}
+	e2, dup := dc.Begin(1, "a")
+	if !dup || e2 != e {
+		t.Fatal("retry is not duplicate")
+	}
+	if _, dup := dc.Begin(2, "a"); dup {
+		t.Error("different sender is duplicate")
+	}
+
+	meta := &proto.Metadata{SyncKey: 10, PrevSyncKey: 9}
+	dc.Finish(e, meta)
+	if m, ok := dc.Wait(e2); !ok || m != meta {
+		t.Errorf("wait: %v %v", m, ok)
+	}
+
+	//失败之后客户端重发时重新保存
+	e, _ = dc.Begin(1, "b")
+	dc.Abort(1, "b", e)
+	if _, ok := dc.Wait(e); ok {
+		t.Error("aborted send succeeded")
+	}
+	if _, dup := dc.Begin(1, "b"); dup {
+		t.Error("aborted send is duplicate")
+	}
+
+	//只保存了接收者的消息时保留, 重发时从发送者继续
+	e, _ = dc.Begin(1, "c")
+	saved := &proto.Metadata{SyncKey: 20, PrevSyncKey: 19}
+	dc.SetSaved(e, saved, 100)
+	dc.Abort(1, "c", e)
+	if _, ok := dc.Wait(e); ok {
+		t.Error("partial send succeeded")
+	}
+	e2, dup = dc.Begin(1, "c")
+	if m, ts := dc.Saved(e2); dup || e2 == e || m != saved || ts != 100 {
+		t.Fatalf("resume partial send: %v %+v", dup, e2)
+	}
+	if _, dup := dc.Begin(1, "c"); !dup {
+		t.Error("resumed send is not duplicate")
+	}
+}
@@ -3,6 +3,11 @@ package main
 import (
 	"fmt"
 	"github.com/gomodule/redigo/redis"
+	"sort"
+	"strconv"
+	"strings"
+	"sx-chat/proto"
+	"time"
 )
 
 func GetDeviceID(deviceId string, platformId int) (int64, error) {
@@ -24,3 +29,133 @@ func GetDeviceID(deviceId string, platformId int) (int64, error) {
 	}
 	return deviceID, nil
 }
+
+func NewSessionID() (int64, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	return redis.Int64(conn.Do("INCR", "sessions_id"))
+}
+
+//登录会话记录保留的时间(秒), 每次登录时刷新
+//im异常退出时没有删除的会话超过这个时间之后清除, 在线超过这个时间的会话也不再计入设备数量
+const DEVICE_SESSION_TTL = 30 * 24 * 3600
+
+//并发登录修改了会话记录时重试的次数
+const DEVICE_SESSION_RETRIES = 5
+
+func deviceSessionsKey(uid int64) string {
+	return fmt.Sprintf("user_devices_%d", uid)
+}
+
+// 记录新的登录会话, 同时删除需要踢下线的会话和过期的会话, 返回需要踢下线的会话
+// 使用WATCH保证同一个用户并发登录时都按照对方登录之后的会话计算
+func AddDeviceSession(uid int64, current *proto.DeviceSession) ([]*proto.DeviceSession, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	key := deviceSessionsKey(uid)
+	value := fmt.Sprintf("%d,%d,%s", current.PlatformId, current.LoginTime, current.DeviceId)
+	for i := 0; i < DEVICE_SESSION_RETRIES; i++ {
+		if _, err := conn.Do("WATCH", key); err != nil {
+			return nil, err
+		}
+		values, err := redis.StringMap(conn.Do("HGETALL", key))
+		if err != nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+		sessions, stale := parseDeviceSessions(values, current.LoginTime-DEVICE_SESSION_TTL)
+		evicted := EvictSessions(sessions, current)
+
+		conn.Send("MULTI")
+		conn.Send("HSET", key, current.SessionId, value)
+		for _, s := range evicted {
+			conn.Send("HDEL", key, s.SessionId)
+		}
+		for _, field := range stale {
+			conn.Send("HDEL", key, field)
+		}
+		conn.Send("EXPIRE", key, DEVICE_SESSION_TTL)
+		r, err := conn.Do("EXEC")
+		if err != nil {
+			return nil, err
+		}
+		//nil表示WATCH之后会话被修改, 重新计算
+		if r != nil {
+			return evicted, nil
+		}
+	}
+	return nil, fmt.Errorf("user:%d sessions changed concurrently", uid)
+}
+
+func RemoveDeviceSession(uid int64, sessionId int64) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("HDEL", deviceSessionsKey(uid), sessionId)
+	return err
+}
+
+// 按登录时间从早到晚排序
+func LoadDeviceSessions(uid int64) ([]*proto.DeviceSession, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	values, err := redis.StringMap(conn.Do("HGETALL", deviceSessionsKey(uid)))
+	if err != nil {
+		return nil, err
+	}
+	sessions, _ := parseDeviceSessions(values, time.Now().Unix()-DEVICE_SESSION_TTL)
+	return sessions, nil
+}
+
+// 解析HGETALL的结果, 按登录时间从早到晚排序
+// 登录时间早于before的会话和格式不对的记录作为过期的会话返回field
+func parseDeviceSessions(values map[string]string, before int64) ([]*proto.DeviceSession, []string) {
+	sessions := make([]*proto.DeviceSession, 0, len(values))
+	var stale []string
+	for field, value := range values {
+		s, ok := parseDeviceSession(field, value)
+		if !ok || s.LoginTime < before {
+			stale = append(stale, field)
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].LoginTime == sessions[j].LoginTime {
+			return sessions[i].SessionId < sessions[j].SessionId
+		}
+		return sessions[i].LoginTime < sessions[j].LoginTime
+	})
+	return sessions, stale
+}
+
+// platformId,loginTime,deviceId
+func parseDeviceSession(field, value string) (*proto.DeviceSession, bool) {
+	sessionId, err := strconv.ParseInt(field, 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	parts := strings.SplitN(value, ",", 3)
+	if len(parts) != 3 {
+		return nil, false
+	}
+	platformId, err := strconv.ParseInt(parts[0], 10, 8)
+	if err != nil {
+		return nil, false
+	}
+	loginTime, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	s := &proto.DeviceSession{
+		SessionId:  sessionId,
+		DeviceId:   parts[2],
+		PlatformId: int8(platformId),
+		LoginTime:  loginTime,
+	}
+	return s, true
+}
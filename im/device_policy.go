@@ -0,0 +1,154 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sx-chat/proto"
+)
+
+//设备类型, 每种类型可以配置同时在线的设备数量
+const DEVICE_CLASS_MOBILE = 1
+const DEVICE_CLASS_DESKTOP = 2
+const DEVICE_CLASS_WEB = 3
+
+func DeviceClass(platformId int8) int {
+	switch platformId {
+	case proto.PLATFORM_IOS, proto.PLATFORM_ANDROID:
+		return DEVICE_CLASS_MOBILE
+	case proto.PLATFORM_DESKTOP:
+		return DEVICE_CLASS_DESKTOP
+	default:
+		return DEVICE_CLASS_WEB
+	}
+}
+
+// 同类设备同时在线的最大数量, 0表示不限制
+func DeviceLimit(class int) int {
+	switch class {
+	case DEVICE_CLASS_MOBILE:
+		return config.mobileDeviceLimit
+	case DEVICE_CLASS_DESKTOP:
+		return config.desktopDeviceLimit
+	default:
+		return config.webDeviceLimit
+	}
+}
+
+// 新会话登录后需要踢下线的会话
+// sessions按登录时间排序, 不包含新登录的会话
+func EvictSessions(sessions []*proto.DeviceSession, current *proto.DeviceSession) []*proto.DeviceSession {
+	class := DeviceClass(current.PlatformId)
+	limit := DeviceLimit(class)
+
+	evicted := make([]*proto.DeviceSession, 0)
+	remain := make([]*proto.DeviceSession, 0, len(sessions))
+	for _, s := range sessions {
+		if s.SessionId == current.SessionId || DeviceClass(s.PlatformId) != class {
+			continue
+		}
+		// 同一台设备重新登录, 旧的连接一定是无效的
+		if len(current.DeviceId) > 0 && s.DeviceId == current.DeviceId && s.PlatformId == current.PlatformId {
+			evicted = append(evicted, s)
+			continue
+		}
+		remain = append(remain, s)
+	}
+
+	if limit > 0 && len(remain)+1 > limit {
+		evicted = append(evicted, remain[:len(remain)+1-limit]...)
+	}
+	return evicted
+}
+
+// 记录新的登录会话, 按照设备策略踢掉多余的会话
+func (client *Client) ApplyDevicePolicy() {
+	current := &proto.DeviceSession{
+		SessionId:  client.sessionId,
+		DeviceId:   client.deviceId,
+		PlatformId: client.platformId,
+		LoginTime:  client.loginTime,
+	}
+
+	evicted, err := AddDeviceSession(client.uid, current)
+	if err != nil {
+		log.WithFields(log.Fields{"uid": client.uid, "err": err}).Warning("保存登录设备失败")
+	}
+
+	for _, s := range evicted {
+		log.WithFields(log.Fields{
+			"uid":        client.uid,
+			"sessionId":  s.SessionId,
+			"platformId": s.PlatformId,
+			"deviceId":   s.DeviceId,
+		}).Info("新设备登录, 踢掉旧的登录设备")
+		KickUserSession(client.uid, s.SessionId, proto.KICK_REASON_LOGIN)
+	}
+}
+
+// 踢掉用户的某个登录会话, 会话可能在任意一台im上
+func KickUserSession(uid int64, sessionId int64, reason int32) {
+	err := RemoveDeviceSession(uid, sessionId)
+	if err != nil {
+		log.WithFields(log.Fields{"uid": uid, "sessionId": sessionId, "err": err}).Warning("删除登录设备失败")
+	}
+
+	msg := &proto.Message{Cmd: proto.MSG_KICK_SESSION, Body: &proto.KickSession{SessionId: sessionId, Reason: reason}}
+	PublishMessage(uid, msg)
+
+	KickLocalSession(uid, sessionId, reason)
+}
+
+func KickLocalSession(uid int64, sessionId int64, reason int32) bool {
+	clients := route.FindClientSet(uid)
+	for c := range clients {
+		if c.sessionId == sessionId {
+			c.Kick(reason)
+			return true
+		}
+	}
+	return false
+}
+
+// 通知客户端被踢下线, 消息发送之后关闭连接
+func (client *Client) Kick(reason int32) {
+	msg := &proto.Message{Cmd: proto.MSG_KICKED, Version: client.version, Body: &proto.KickedMessage{Reason: reason}}
+	client.EnqueueMessage(msg)
+}
+
+func (client *Client) HandleLoadDevices() {
+	if client.uid == 0 {
+		log.Warning("客户端还没有完成认证")
+		return
+	}
+	sessions, err := LoadDeviceSessions(client.uid)
+	if err != nil {
+		log.WithFields(log.Fields{"uid": client.uid, "err": err}).Warning("加载登录设备失败")
+		return
+	}
+	msg := &proto.Message{Cmd: proto.MSG_DEVICES, Version: client.version, Body: &proto.DeviceList{Devices: sessions}}
+	client.EnqueueMessage(msg)
+}
+
+func (client *Client) HandleKickDevice(id *proto.SessionID) {
+	if client.uid == 0 {
+		log.Warning("客户端还没有完成认证")
+		return
+	}
+	if id.SessionId == client.sessionId {
+		log.WithField("uid", client.uid).Warning("不能踢掉当前登录的设备")
+		return
+	}
+
+	sessions, err := LoadDeviceSessions(client.uid)
+	if err != nil {
+		log.WithFields(log.Fields{"uid": client.uid, "err": err}).Warning("加载登录设备失败")
+		return
+	}
+	for _, s := range sessions {
+		if s.SessionId == id.SessionId {
+			log.WithFields(log.Fields{"uid": client.uid, "sessionId": s.SessionId}).Info("用户踢掉登录设备")
+			KickUserSession(client.uid, s.SessionId, proto.KICK_REASON_USER)
+			return
+		}
+	}
+	log.WithFields(log.Fields{"uid": client.uid, "sessionId": id.SessionId}).Warning("登录设备不存在")
+}
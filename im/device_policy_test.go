@@ -0,0 +1,52 @@
+package main
+
+import (
+	"reflect"
+	"sx-chat/proto"
+	"testing"
+)
+
+func TestEvictSessions(t *testing.T) {
+	old := config
+	config = &Config{mobileDeviceLimit: 1, desktopDeviceLimit: 2, webDeviceLimit: 0}
+	defer func() { config = old }()
+
+	ios := &proto.DeviceSession{SessionId: 1, DeviceId: "a", PlatformId: proto.PLATFORM_IOS, LoginTime: 1}
+	android := &proto.DeviceSession{SessionId: 2, DeviceId: "b", PlatformId: proto.PLATFORM_ANDROID, LoginTime: 2}
+	desktop1 := &proto.DeviceSession{SessionId: 3, DeviceId: "c", PlatformId: proto.PLATFORM_DESKTOP, LoginTime: 3}
+	desktop2 := &proto.DeviceSession{SessionId: 4, DeviceId: "d", PlatformId: proto.PLATFORM_DESKTOP, LoginTime: 4}
+	web := &proto.DeviceSession{SessionId: 5, DeviceId: "e", PlatformId: proto.PLATFORM_WEB, LoginTime: 5}
+	all := []*proto.DeviceSession{ios, android, desktop1, desktop2, web}
+
+	cases := []struct {
+		name     string
+		sessions []*proto.DeviceSession
+		current  *proto.DeviceSession
+		evicted  []*proto.DeviceSession
+	}{
+		{"first login", nil, ios, []*proto.DeviceSession{}},
+		{"mobile limit", []*proto.DeviceSession{ios}, android, []*proto.DeviceSession{ios}},
+		{"other class", []*proto.DeviceSession{ios, web}, desktop1, []*proto.DeviceSession{}},
+		{"desktop limit", []*proto.DeviceSession{desktop1, desktop2}, &proto.DeviceSession{SessionId: 6, DeviceId: "f", PlatformId: proto.PLATFORM_DESKTOP}, []*proto.DeviceSession{desktop1}},
+		{"same device", []*proto.DeviceSession{desktop1}, &proto.DeviceSession{SessionId: 6, DeviceId: "c", PlatformId: proto.PLATFORM_DESKTOP}, []*proto.DeviceSession{desktop1}},
+		{"current session", []*proto.DeviceSession{ios}, ios, []*proto.DeviceSession{}},
+		{"no limit", all, &proto.DeviceSession{SessionId: 6, DeviceId: "e", PlatformId: proto.PLATFORM_WEB}, []*proto.DeviceSession{web}},
+	}
+	for _, c := range cases {
+		if evicted := EvictSessions(c.sessions, c.current); !reflect.DeepEqual(evicted, c.evicted) {
+			t.Errorf("%s: evicted %v expect %v", c.name, evicted, c.evicted)
+		}
+	}
+}
+
+// 格式不对和过期的会话返回field, 调用者从redis中删除
+func TestParseDeviceSessions(t *testing.T) {
+	values := map[string]string{"1": "1,100,a", "2": "2,50,b", "3": "3,10,c", "x": "1,100,d", "4": "bad"}
+	sessions, stale := parseDeviceSessions(values, 20)
+	if len(sessions) != 2 || sessions[0].SessionId != 2 || sessions[1].SessionId != 1 || sessions[1].DeviceId != "a" {
+		t.Errorf("sessions:%v", sessions)
+	}
+	if len(stale) != 3 {
+		t.Errorf("stale:%v", stale)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"sx-chat/proto"
+	"time"
+)
+
+// 阅后即焚: 保存消息之后在redis中记录接收者的消息id对应的发送者的消息id
+// 接收者第一次阅读时删除记录, 设置双方收件箱中的过期时间, 并且给双方发送MSG_MESSAGE_EXPIRE
+// 已经收到消息的设备收到事件之后删除本地的消息, 其它设备同步时ims不再返回过期的消息
+// 按发送时间过期的消息不发送事件, 由客户端根据消息中的Timestamp和Ttl删除, 见proto.IMMessage
+
+//接收者一直没有阅读时记录保留的时间
+const BURN_PENDING_TTL = 30 * 24 * 3600
+
+func burnKey(receiver, msgId int64) string {
+	return fmt.Sprintf("burn_%d_%d", receiver, msgId)
+}
+
+// 检查过期时间, 只有点对点消息可以阅后即焚
+func (client *Connection) checkExpire(seq int, msg *proto.IMMessage, group bool) bool {
+	if msg.Ttl < 0 || (msg.BurnAfterRead && (group || msg.Ttl == 0)) {
+		log.WithFields(log.Fields{"sender": msg.Sender, "receiver": msg.Receiver, "ttl": msg.Ttl, "burn": msg.BurnAfterRead}).Warning("消息过期时间不合法")
+		client.sendACK(seq, proto.ACK_INVALID_CONTENT)
+		return false
+	}
+	return true
+}
+
+// msgId和senderMsgId分别是消息在接收者和发送者收件箱中的id
+func saveBurnMessage(msg *proto.IMMessage, msgId, senderMsgId int64) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	value := fmt.Sprintf("%d,%d,%d", msg.Sender, senderMsgId, msg.Ttl)
+	_, err := conn.Do("SET", burnKey(msg.Receiver, msgId), value, "EX", BURN_PENDING_TTL)
+	return err
+}
+
+// 取出并且删除记录, 只有第一次阅读时返回ok
+func takeBurnMessage(receiver, msgId int64) (sender, senderMsgId int64, ttl int32, ok bool) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	key := burnKey(receiver, msgId)
+	value, err := redis.String(conn.Do("GET", key))
+	if err != nil {
+		return
+	}
+	n, err := redis.Int(conn.Do("DEL", key))
+	if err != nil || n != 1 {
+		return
+	}
+
+	fields := strings.Split(value, ",")
+	if len(fields) != 3 {
+		log.WithFields(log.Fields{"key": key, "value": value}).Warning("阅后即焚的记录不合法")
+		return
+	}
+	sender, _ = strconv.ParseInt(fields[0], 10, 64)
+	senderMsgId, _ = strconv.ParseInt(fields[1], 10, 64)
+	t, _ := strconv.ParseInt(fields[2], 10, 32)
+	return sender, senderMsgId, int32(t), sender > 0 && senderMsgId > 0 && t > 0
+}
+
+// 客户端阅读了一条消息, 不是阅后即焚的消息或者已经阅读过时忽略
+func (client *PeerClient) HandleMessageRead(syncKey *proto.SyncKey) {
+	msgId := syncKey.SyncKey
+	sender, senderMsgId, ttl, ok := takeBurnMessage(client.uid, msgId)
+	if !ok {
+		return
+	}
+
+	expireAt := int32(time.Now().Unix()) + ttl
+	log.WithFields(log.Fields{"uid": client.uid, "msgId": msgId, "sender": sender, "expireAt": expireAt}).Info("阅后即焚")
+	expireMessage(client.uid, msgId, expireAt)
+	expireMessage(sender, senderMsgId, expireAt)
+}
+
+// 设置ims中的过期时间之后通知用户的所有设备
+func expireMessage(uid, msgId int64, expireAt int32) {
+	dc := GetStorageRPCClient(uid)
+	resp, err := dc.CallIdempotent("ExpireMessage", &ExpireRequest{UID: uid, MsgId: msgId, ExpireAt: expireAt})
+	if err != nil {
+		log.WithFields(log.Fields{"uid": uid, "msgId": msgId, "err": err}).Error("设置消息过期时间失败")
+		return
+	}
+	expireAt = resp.(int32)
+	if expireAt == 0 {
+		log.WithFields(log.Fields{"uid": uid, "msgId": msgId}).Warning("收件箱中没有阅后即焚的消息")
+		return
+	}
+
+	m := &proto.Message{Cmd: proto.MSG_MESSAGE_EXPIRE, Body: &proto.MessageExpire{MsgId: msgId, ExpireAt: expireAt}}
+	if _, err := SendPeerGroupMessage([]int64{uid}, 0, 0, m); err != nil {
+		log.WithFields(log.Fields{"uid": uid, "msgId": msgId, "err": err}).Error("发送消息过期事件失败")
+	}
+}
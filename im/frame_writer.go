@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"github.com/gorilla/websocket"
+	"io"
+	"sx-chat/proto"
+)
+
+//一次合并写入的最大字节数, 超过之后先写入socket
+const WRITE_BATCH_SIZE = 64 * 1024
+
+// 把多个消息帧合并到一次写入, 减少write系统调用
+// websocket的每个消息只能包含一个消息帧, 需要分别写入
+type FrameWriter struct {
+	frames [][]byte
+	size   int
+
+	buf bytes.Buffer
+
+	//大于这个大小的消息体需要压缩, 0表示不压缩
+	compressThreshold int
+}
+
+func (w *FrameWriter) Add(msg *proto.Message) {
+	var frame []byte
+	if w.compressThreshold > 0 {
+		frame = proto.EncodeCompressedMessage(msg, w.compressThreshold)
+	} else {
+		frame = proto.EncodeMessage(msg)
+	}
+	w.frames = append(w.frames, frame)
+	w.size += len(frame)
+}
+
+// 缓存的消息帧的总字节数
+func (w *FrameWriter) Len() int {
+	return w.size
+}
+
+func (w *FrameWriter) Flush(conn interface{}) error {
+	if len(w.frames) == 0 {
+		return nil
+	}
+	defer w.reset()
+
+	if conn, ok := conn.(*websocket.Conn); ok {
+		for _, frame := range w.frames {
+			err := conn.WriteMessage(websocket.BinaryMessage, frame)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	writer, ok := conn.(io.Writer)
+	if !ok {
+		return nil
+	}
+	if len(w.frames) == 1 {
+		_, err := writer.Write(w.frames[0])
+		return err
+	}
+	w.buf.Grow(w.size)
+	for _, frame := range w.frames {
+		w.buf.Write(frame)
+	}
+	_, err := writer.Write(w.buf.Bytes())
+	return err
+}
+
+func (w *FrameWriter) reset() {
+	for i := range w.frames {
+		w.frames[i] = nil
+	}
+	w.frames = w.frames[:0]
+	w.size = 0
+	// 偶尔的大批量写入之后不长期占用内存
+	if w.buf.Cap() > 4*WRITE_BATCH_SIZE {
+		w.buf = bytes.Buffer{}
+	} else {
+		w.buf.Reset()
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sx-chat/proto"
+	"testing"
+)
+
+// 统计write调用次数, 每次调用对应一次系统调用
+type countWriter struct {
+	writes int
+	bytes  int
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.writes++
+	w.bytes += len(p)
+	return len(p), nil
+}
+
+// 模拟一次同步1000条历史消息, 每条消息带有meta
+// repeat控制消息内容的长度, 比如图文卡片之类的长消息
+func syncMessages(repeat int) []*proto.Message {
+	text := strings.Repeat("内容和普通的聊天消息差不多长", repeat)
+	msgs := make([]*proto.Message, 0, 2000)
+	for i := 0; i < 1000; i++ {
+		content := fmt.Sprintf(`{"text":"这是第%d条消息, %s","uuid":"6a2f0c4e-3b8d-4d5a-9c1e-%012d"}`, i, text, i)
+		meta := &proto.Metadata{SyncKey: int64(i + 1), PrevSyncKey: int64(i)}
+		msgs = append(msgs, &proto.Message{Cmd: proto.MSG_METADATA, Version: 2, Body: meta})
+		msgs = append(msgs, &proto.Message{Cmd: proto.MSG_IM, Version: 2, Body: &proto.IMMessage{Sender: 1, Receiver: 2, Content: content}})
+	}
+	return msgs
+}
+
+func BenchmarkSendEach(b *testing.B) {
+	msgs := syncMessages(1)
+	w := &countWriter{}
+	for i := 0; i < b.N; i++ {
+		for _, msg := range msgs {
+			proto.SendMessage(w, msg)
+		}
+	}
+	b.ReportMetric(float64(w.writes)/float64(b.N), "writes/sync")
+	b.ReportMetric(float64(w.bytes)/float64(b.N), "bytes/sync")
+}
+
+func BenchmarkFrameWriter(b *testing.B) {
+	benchmarkFrameWriter(b, syncMessages(1), 0)
+}
+
+func BenchmarkFrameWriterLarge(b *testing.B) {
+	benchmarkFrameWriter(b, syncMessages(40), 0)
+}
+
+func BenchmarkFrameWriterLargeCompressed(b *testing.B) {
+	benchmarkFrameWriter(b, syncMessages(40), 1024)
+}
+
+func benchmarkFrameWriter(b *testing.B, msgs []*proto.Message, threshold int) {
+	w := &countWriter{}
+	fw := &FrameWriter{compressThreshold: threshold}
+	for i := 0; i < b.N; i++ {
+		for _, msg := range msgs {
+			fw.Add(msg)
+			if fw.Len() >= WRITE_BATCH_SIZE {
+				fw.Flush(w)
+			}
+		}
+		fw.Flush(w)
+	}
+	b.ReportMetric(float64(w.writes)/float64(b.N), "writes/sync")
+	b.ReportMetric(float64(w.bytes)/float64(b.N), "bytes/sync")
+}
@@ -8,53 +8,129 @@ import (
 	"time"
 )
 
+//成员的角色, 群主由t_discuss_group.owner_id确定
+const GROUP_ROLE_MEMBER = 0
+const GROUP_ROLE_ADMIN = 1
+const GROUP_ROLE_OWNER = 2
+
+type GroupMember struct {
+	timestamp int //入群时间
+	mute      bool
+	role      int
+}
+
 type Group struct {
 	gid   int64
+	super bool //超级群的消息保存在群组的消息队列中, 普通群的消息保存到每个成员的收件箱
+	owner int64
 	mutex sync.Mutex
 
-	members map[int64]int64 //key:成员id value:入群时间|(mute<<31)
-	ts      int             //访问时间
+	muteAll    bool //全员禁言, 只有群主和管理员可以发言
+	inviteOnly bool //只有群主和管理员可以添加成员
+	maxMembers int  //0表示不限制
+
+	members map[int64]*GroupMember
+	ts      int //访问时间
 }
 
 func (group *Group) GetMemberMute(uid int64) bool {
-	t, _ := group.members[uid]
-	return int((t>>31)&0x01) != 0
+	if m, ok := group.members[uid]; ok {
+		return m.mute
+	}
+	return false
 }
 
-func (group *Group) Members() map[int64]int64 {
+func (group *Group) IsMember(uid int64) bool {
+	_, ok := group.members[uid]
+	return ok
+}
+
+func (group *Group) Members() map[int64]*GroupMember {
 	return group.members
 }
 
 func (group *Group) GetMemberTimestamp(uid int64) int {
-	ts, _ := group.members[uid]
-	return int(ts & 0x7FFFFFFF)
+	if m, ok := group.members[uid]; ok {
+		return m.timestamp
+	}
+	return 0
 }
 
-func NewSuperGroup(gid int64, members map[int64]int64) *Group {
+func (group *Group) GetMemberRole(uid int64) int {
+	if uid == group.owner {
+		return GROUP_ROLE_OWNER
+	}
+	if m, ok := group.members[uid]; ok {
+		return m.role
+	}
+	return GROUP_ROLE_MEMBER
+}
+
+// 群主或者管理员
+func (group *Group) IsManager(uid int64) bool {
+	return group.IsMember(uid) && group.GetMemberRole(uid) >= GROUP_ROLE_ADMIN
+}
+
+// 成员可以在群组中发言, 全员禁言时只有群主和管理员可以发言
+func (group *Group) CanPost(uid int64) bool {
+	if !group.IsMember(uid) || group.GetMemberMute(uid) {
+		return false
+	}
+	return !group.muteAll || group.IsManager(uid)
+}
+
+// 成员id列表
+func (group *Group) MemberIds() []int64 {
+	members := make([]int64, 0, len(group.members))
+	for uid := range group.members {
+		members = append(members, uid)
+	}
+	return members
+}
+
+func NewGroup(gid int64, super bool, owner int64, members map[int64]*GroupMember) *Group {
 	return &Group{
 		gid:     gid,
+		super:   super,
+		owner:   owner,
 		members: members,
 		ts:      int(time.Now().Unix()),
 	}
 }
 
+func NewSuperGroup(gid int64, members map[int64]*GroupMember) *Group {
+	return NewGroup(gid, true, 0, members)
+}
+
 func LoadGroup(db *sql.DB, groupId int64) (*Group, error) {
+	var super, muteAll, inviteOnly, maxMembers int
+	var owner int64
+	err := db.QueryRow("SELECT super, owner_id, mute_all, invite_only, max_members FROM `t_discuss_group` WHERE id = ? AND deleted_at is null",
+		groupId).Scan(&super, &owner, &muteAll, &inviteOnly, &maxMembers)
+	if err != nil {
+		log.Info("error:", err)
+		return nil, err
+	}
+
 	members, err := LoadGroupMember(db, groupId)
 	if err != nil {
 		log.Info("error:", err)
 		return nil, err
 	}
 
-	group := NewSuperGroup(groupId, members)
-	log.Info("load group success:", groupId)
+	group := NewGroup(groupId, super != 0, owner, members)
+	group.muteAll = muteAll != 0
+	group.inviteOnly = inviteOnly != 0
+	group.maxMembers = maxMembers
+	log.WithFields(log.Fields{"gid": groupId, "super": group.super}).Info("load group success")
 	return group, nil
 }
 
-func LoadGroupMember(db *sql.DB, groupId int64) (map[int64]int64, error) {
-	stmtIns, err := db.Prepare("SELECT member_id, timestamp, mute FROM `t_discuss_group_member` WHERE group_id = ? AND deleted_at is null ")
+func LoadGroupMember(db *sql.DB, groupId int64) (map[int64]*GroupMember, error) {
+	stmtIns, err := db.Prepare("SELECT member_id, timestamp, mute, role FROM `t_discuss_group_member` WHERE group_id = ? AND deleted_at is null ")
 	if err == mysql.ErrInvalidConn {
 		log.Info("db prepare error:", err)
-		stmtIns, err = db.Prepare("SELECT member_id, timestamp, mute FROM `t_discuss_group_member` WHERE group_id = ? AND deleted_at is null ")
+		stmtIns, err = db.Prepare("SELECT member_id, timestamp, mute, role FROM `t_discuss_group_member` WHERE group_id = ? AND deleted_at is null ")
 	}
 	if err != nil {
 		log.Info("db prepare error:", err)
@@ -62,14 +138,154 @@ func LoadGroupMember(db *sql.DB, groupId int64) (map[int64]int64, error) {
 	}
 
 	defer stmtIns.Close()
-	members := make(map[int64]int64)
+	members := make(map[int64]*GroupMember)
 	rows, err := stmtIns.Query(groupId)
+	if err != nil {
+		log.Info("db query error:", err)
+		return nil, err
+	}
+	defer rows.Close()
 	for rows.Next() {
 		var uid int64
 		var timestamp int64
-		var mute int64
-		rows.Scan(&uid, &timestamp, &mute)
-		members[uid] = timestamp | (mute << 31)
+		var mute int
+		var role int
+		rows.Scan(&uid, &timestamp, &mute, &role)
+		members[uid] = &GroupMember{timestamp: int(timestamp), mute: mute != 0, role: role}
 	}
 	return members, nil
 }
+
+// 创建群组和初始的成员, 返回群组id
+func CreateGroup(db *sql.DB, owner int64, name string, super bool, members []int64) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	r, err := tx.Exec("INSERT INTO `t_discuss_group`(name, owner_id, super, created_at) VALUES(?, ?, ?, NOW())", name, owner, boolToInt(super))
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	gid, err := r.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	err = insertGroupMembers(tx, gid, members)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return gid, tx.Commit()
+}
+
+// 已经退出的成员重新加入时恢复原来的记录, 依赖(group_id, member_id)上的唯一索引
+func AddGroupMembers(db *sql.DB, gid int64, members []int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	err = insertGroupMembers(tx, gid, members)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertGroupMembers(tx *sql.Tx, gid int64, members []int64) error {
+	stmt, err := tx.Prepare("INSERT INTO `t_discuss_group_member`(group_id, member_id, timestamp, mute) VALUES(?, ?, ?, 0) " +
+		"ON DUPLICATE KEY UPDATE timestamp = VALUES(timestamp), mute = 0, role = 0, deleted_at = NULL")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	now := time.Now().Unix()
+	for _, member := range members {
+		_, err = stmt.Exec(gid, member, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func RemoveGroupMembers(db *sql.DB, gid int64, members []int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		_, err = tx.Exec("UPDATE `t_discuss_group_member` SET deleted_at = NOW() WHERE group_id = ? AND member_id = ? AND deleted_at is null", gid, member)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func SetGroupMemberRole(db *sql.DB, gid int64, uid int64, role int) error {
+	_, err := db.Exec("UPDATE `t_discuss_group_member` SET role = ? WHERE group_id = ? AND member_id = ? AND deleted_at is null", role, gid, uid)
+	return err
+}
+
+// 转让之后原来的群主是普通成员, 新群主原来可能是管理员, 清除成员记录中的角色
+func SetGroupOwner(db *sql.DB, gid int64, owner int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE `t_discuss_group` SET owner_id = ? WHERE id = ?", owner, gid)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("UPDATE `t_discuss_group_member` SET role = ? WHERE group_id = ? AND member_id = ?", GROUP_ROLE_MEMBER, gid, owner)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func SetGroupSettings(db *sql.DB, gid int64, muteAll bool, inviteOnly bool, maxMembers int) error {
+	_, err := db.Exec("UPDATE `t_discuss_group` SET mute_all = ?, invite_only = ?, max_members = ? WHERE id = ?",
+		boolToInt(muteAll), boolToInt(inviteOnly), maxMembers, gid)
+	return err
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func SetGroupMemberMute(db *sql.DB, gid int64, uid int64, mute bool) error {
+	_, err := db.Exec("UPDATE `t_discuss_group_member` SET mute = ? WHERE group_id = ? AND member_id = ? AND deleted_at is null", boolToInt(mute), gid, uid)
+	return err
+}
+
+// 解散群组, 同时移除所有的成员
+func DissolveGroup(db *sql.DB, gid int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE `t_discuss_group` SET deleted_at = NOW() WHERE id = ? AND deleted_at is null", gid)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("UPDATE `t_discuss_group_member` SET deleted_at = NOW() WHERE group_id = ? AND deleted_at is null", gid)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
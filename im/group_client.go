@@ -2,83 +2,212 @@ package main
 
 import (
 	log "github.com/sirupsen/logrus"
+	"sx-chat/proto"
 	"time"
 )
 
+//等待普通群消息保存到发送者收件箱的最长时间
+const GROUP_MESSAGE_CALLBACK_TIMEOUT = time.Second
+
 type GroupClient struct {
 	*Connection
 }
 
-func (client *GroupClient) HandleMessage(msg *Message) {
-	switch msg.cmd {
-	case MSG_GROUP_IM:
+func (client *GroupClient) HandleMessage(msg *proto.Message) {
+	switch msg.Cmd {
+	case proto.MSG_GROUP_IM:
 		client.HandleGroupIMMessage(msg)
-	case MSG_SYNC_GROUP:
-		client.HandleGroupSync(msg.body.(*GroupSyncKey))
-	case MSG_GROUP_SYNC_KEY:
-		client.HandleGroupSyncKey(msg.body.(*GroupSyncKey))
+	case proto.MSG_SYNC_GROUP:
+		client.HandleGroupSync(msg.Seq, msg.Body.(*proto.GroupSyncKey))
+	case proto.MSG_GROUP_SYNC_KEY:
+		client.HandleGroupSyncKey(msg.Body.(*proto.GroupSyncKey))
+	case proto.MSG_GROUP_COMMAND:
+		client.HandleGroupCommand(msg)
 	}
 }
 
-func (client *GroupClient) HandleGroupIMMessage(message *Message) {
-	msg := message.body.(*IMMessage)
-	seq := message.seq
+func (client *GroupClient) HandleGroupCommand(msg *proto.Message) {
+	if client.uid == 0 {
+		log.Warning("客户端还没有完成认证")
+		return
+	}
+
+	cmd := msg.Body.(*proto.GroupCommand)
+	gid, status := ExecGroupCommand(client.uid, cmd)
+
+	result := &proto.GroupResult{Seq: int32(msg.Seq), Op: cmd.Op, Status: status, GroupId: gid}
+	client.EnqueueMessage(&proto.Message{Cmd: proto.MSG_GROUP_RESULT, Body: result})
+	log.WithFields(log.Fields{"uid": client.uid, "op": cmd.Op, "gid": gid, "status": status}).Info("群组管理命令")
+}
+
+func (client *GroupClient) HandleGroupIMMessage(message *proto.Message) {
+	msg := message.Body.(*proto.IMMessage)
+	seq := message.Seq
 
 	if client.uid == 0 {
 		log.Warning("客户端还没有完成认证")
 		return
 	}
 
-	msg.timestamp = int32(time.Now().Unix())
+	//发送者和时间都以服务端为准
+	msg.Sender = client.uid
+	msg.Timestamp = int32(time.Now().Unix())
 
-	deliver := GetGroupMessageDeliver(msg.receiver)
-	group := deliver.LoadGroup(msg.receiver)
+	deliver := GetGroupMessageDeliver(msg.Receiver)
+	group := deliver.LoadGroup(msg.Receiver)
 	if group == nil {
-		log.Warning("查找不到Group:", msg.receiver)
+		log.Warning("查找不到Group:", msg.Receiver)
+		client.sendACK(seq, proto.ACK_GROUP_NONEXIST)
+		return
+	}
+
+	if !group.IsMember(msg.Sender) {
+		log.Warningf("sender:%d不是群组:%d的成员", msg.Sender, msg.Receiver)
+		client.sendACK(seq, proto.ACK_NOT_GROUP_MEMBER)
+		return
+	}
+
+	if !group.CanPost(msg.Sender) {
+		log.Warningf("sender:%d被禁言", msg.Sender)
+		client.sendACK(seq, proto.ACK_GROUP_MUTED)
 		return
 	}
 
-	if group.GetMemberMute(msg.sender) {
-		log.Warningf("sender:%d被禁言", msg.sender)
+	client.checkMentions(msg, group)
+
+	if !client.checkContent(seq, msg) || !client.checkExpire(seq, msg, true) {
 		return
 	}
 
-	var meta *Metadata
-	msgId, prevMsgId, err := client.HandleSuperGroupMessage(msg, group)
-	if err == nil {
-		meta = &Metadata{syncKey: msgId, prevSyncKey: prevMsgId}
+	var entry *dedupEntry
+	if msg.ClientMsgId != "" {
+		var dup bool
+		entry, dup = dedupCache.Begin(msg.Sender, msg.ClientMsgId)
+		if dup {
+			client.ackDuplicate(seq, msg, entry)
+			return
+		}
 	}
 
-	ack := &Message{cmd: MSG_ACK, body: &MessageACK{seq: int32(seq)}, meta: meta}
+	var meta *proto.Metadata
+	if group.super {
+		msgId, prevMsgId, err := client.HandleSuperGroupMessage(msg, group)
+		if err != nil {
+			if entry != nil {
+				dedupCache.Abort(msg.Sender, msg.ClientMsgId, entry)
+			}
+			client.sendACK(seq, storageACKStatus(err))
+			return
+		}
+		meta = &proto.Metadata{SyncKey: msgId, PrevSyncKey: prevMsgId}
+	} else {
+		//等待超时的消息已经保存在待发送文件中, 之后仍然会发送给所有成员
+		meta = client.HandleNormalGroupMessage(msg, group, deliver)
+	}
+	if entry != nil {
+		dedupCache.Finish(entry, meta)
+	}
+
+	ack := &proto.Message{Cmd: proto.MSG_ACK, Body: &proto.MessageACK{Seq: int32(seq)}, Meta: meta}
 	r := client.EnqueueMessage(ack)
 	if !r {
 		log.Warning("发送群组消息ack失败")
 	}
-	log.WithFields(log.Fields{"sender": msg.sender, "receiver": msg.receiver}).Info("发送群组消息成功")
+	log.WithFields(log.Fields{"sender": msg.Sender, "receiver": msg.Receiver}).Info("发送群组消息成功")
 	if meta != nil {
-		log.WithFields(log.Fields{"syncKey": meta.syncKey, "prevSyncKey": meta.prevSyncKey}).Info("发送群组消息ack meta数据")
+		log.WithFields(log.Fields{"syncKey": meta.SyncKey, "prevSyncKey": meta.PrevSyncKey}).Info("发送群组消息ack meta数据")
+	}
+}
+
+// 只保留群组中的其它成员, 只有群主和管理员可以@所有人
+func (client *GroupClient) checkMentions(msg *proto.IMMessage, group *Group) {
+	if msg.AtAll && !group.IsManager(msg.Sender) {
+		log.WithFields(log.Fields{"sender": msg.Sender, "gid": msg.Receiver}).Warning("没有@所有人的权限")
+		msg.AtAll = false
+	}
+
+	var mentions []int64
+	for _, uid := range uniqueMembers(msg.Mentions) {
+		if uid != msg.Sender && group.IsMember(uid) {
+			mentions = append(mentions, uid)
+		}
 	}
+	msg.Mentions = mentions
 }
 
-func (client *GroupClient) HandleSuperGroupMessage(msg *IMMessage, group *Group) (int64, int64, error) {
-	m := &Message{cmd: MSG_GROUP_IM, version: DEFAULT_VERSION, body: msg}
-	msgId, prevMsgId, err := SaveGroupMessage(msg.receiver, client.deviceID, m)
+func (client *GroupClient) HandleSuperGroupMessage(msg *proto.IMMessage, group *Group) (int64, int64, error) {
+	m := &proto.Message{Cmd: proto.MSG_GROUP_IM, Version: msg.MinVersion(), Body: msg}
+	msgId, prevMsgId, err := SaveGroupMessage(msg.Receiver, client.deviceID, m)
 	if err != nil {
-		log.WithFields(log.Fields{"sender:": msg.sender, "receiver": msg.receiver, "err": err}).Error("保存群组消息失败")
-		return 0, 0, nil
+		log.WithFields(log.Fields{"sender:": msg.Sender, "receiver": msg.Receiver, "err": err}).Error("保存群组消息失败")
+		return 0, 0, err
 	}
 
-	m.meta = &Metadata{syncKey: msgId, prevSyncKey: prevMsgId}
-	m.flag = MESSAGE_FLAG_PUSH | MESSAGE_FLAG_SUPER_GROUP
+	m.Meta = &proto.Metadata{SyncKey: msgId, PrevSyncKey: prevMsgId}
+	m.Flag = proto.MESSAGE_FLAG_PUSH | proto.MESSAGE_FLAG_SUPER_GROUP
 	client.sendGroupMessage(group, m)
 
-	notify := &Message{cmd: MSG_SYNC_GROUP_NOTIFY, body: &GroupSyncKey{groupId: msg.receiver, syncKey: msgId}}
+	notify := &proto.Message{Cmd: proto.MSG_SYNC_GROUP_NOTIFY, Body: &proto.GroupSyncKey{GroupId: msg.Receiver, SyncKey: msgId}}
 	client.sendGroupMessage(group, notify)
+
+	client.sendMentions(msg, group, msgId)
 	return msgId, prevMsgId, nil
 }
 
-func (client *GroupClient) HandleGroupSync(groupSyncKey *GroupSyncKey) {
-	groupId := groupSyncKey.groupId
+// 超级群的消息只保存在群组的消息队列中, 被@的成员另外在自己的消息队列中保存一条MSG_GROUP_MENTION
+// 客户端即使设置了群组免打扰也可以根据这个消息提醒用户
+// @所有人时不逐个保存, 只推送给在线的成员
+func (client *GroupClient) sendMentions(msg *proto.IMMessage, group *Group, msgId int64) {
+	if !msg.AtAll && len(msg.Mentions) == 0 {
+		return
+	}
+
+	mention := &proto.GroupMention{GroupId: group.gid, MsgId: msgId, Sender: msg.Sender, Timestamp: msg.Timestamp}
+	m := &proto.Message{Cmd: proto.MSG_GROUP_MENTION, Body: mention}
+	if msg.AtAll {
+		m.Flag = proto.MESSAGE_FLAG_PUSH
+		client.sendGroupMessage(group, m)
+		return
+	}
+
+	_, err := SendPeerGroupMessage(msg.Mentions, msg.Sender, client.deviceID, m)
+	if err != nil {
+		log.WithFields(log.Fields{"gid": group.gid, "msgId": msgId, "err": err}).Warning("保存@消息失败")
+	}
+}
+
+// 普通群消息先保存到deliver的待发送文件, 由deliver保存到每个成员的收件箱
+// 被@的成员从收件箱中的消息就可以知道自己被@, 不需要另外保存
+// 在超时之前发送完成时返回发送者收件箱中的消息id
+func (client *GroupClient) HandleNormalGroupMessage(msg *proto.IMMessage, group *Group, deliver *GroupMessageDeliver) *proto.Metadata {
+	gm := &PendingGroupMessage{
+		sender:      msg.Sender,
+		deviceID:    client.deviceID,
+		gid:         msg.Receiver,
+		timestamp:   msg.Timestamp,
+		messageType: msg.MessageType,
+		members:     group.MemberIds(),
+		atAll:       msg.AtAll,
+		mentions:    msg.Mentions,
+		clientMsgId: msg.ClientMsgId,
+		ttl:         msg.Ttl,
+		content:     msg.Content,
+	}
+
+	ch := make(chan *proto.Metadata, 1)
+	callbackId := deliver.SaveMessage(gm, ch)
+	select {
+	case meta := <-ch:
+		return meta
+	case <-time.After(GROUP_MESSAGE_CALLBACK_TIMEOUT):
+		deliver.ClearCallback(callbackId)
+		log.WithFields(log.Fields{"sender": msg.Sender, "receiver": msg.Receiver}).Warning("等待普通群消息发送超时")
+		return nil
+	}
+}
+
+func (client *GroupClient) HandleGroupSync(seq int, groupSyncKey *proto.GroupSyncKey) {
+	groupId := groupSyncKey.GroupId
 	group := groupManager.LoadGroup(groupId)
 	if group == nil {
 		log.WithField("groupId", groupId).Warning("不能找到群组")
@@ -87,7 +216,7 @@ func (client *GroupClient) HandleGroupSync(groupSyncKey *GroupSyncKey) {
 
 	ts := group.GetMemberTimestamp(client.uid)
 
-	lastId := groupSyncKey.syncKey
+	lastId := groupSyncKey.SyncKey
 
 	syncGroupHistory := &SyncGroupHistory{
 		UID:       client.uid,
@@ -95,42 +224,45 @@ func (client *GroupClient) HandleGroupSync(groupSyncKey *GroupSyncKey) {
 		GroupId:   groupId,
 		LastMsgId: lastId,
 		Timestamp: int32(ts),
+		Version:   int32(client.version),
 	}
 
-	rpc := GetGroupStorageRPCClient(groupId)
-	resp, err := rpc.Call("SyncGroupMessage", syncGroupHistory)
+	gh, err := LoadGroupHistory(syncGroupHistory)
 	if err != nil {
 		log.WithField("err", err).Warning("同步群组消息失败")
+		client.sendACK(seq, storageACKStatus(err))
 		return
 	}
 
-	gh := resp.(*GroupHistoryMessage)
 	messages := gh.Messages
 
-	sk := &GroupSyncKey{syncKey: lastId, groupId: groupId}
-	client.EnqueueMessage(&Message{cmd: MSG_SYNC_GROUP_BEGIN, body: sk})
+	sk := &proto.GroupSyncKey{SyncKey: lastId, GroupId: groupId}
+	client.EnqueueMessage(&proto.Message{Cmd: proto.MSG_SYNC_GROUP_BEGIN, Body: sk})
 
 	for i := len(messages) - 1; i >= 0; i-- {
 		msg := messages[i]
-		m := &Message{cmd: int(msg.Cmd), version: DEFAULT_VERSION}
-		m.FromData(msg.Raw)
-		sk.syncKey = msg.MsgID
+		m := &proto.Message{Cmd: int(msg.Cmd), Version: client.version}
+		if !m.FromData(msg.Raw) {
+			log.WithFields(log.Fields{"msgId": msg.MsgID, "cmd": msg.Cmd}).Warning("解析群组历史消息失败")
+			continue
+		}
+		sk.SyncKey = msg.MsgID
 		if client.isSender(m, msg.DeviceID) {
-			m.flag |= MESSAGE_FLAG_SELF
+			m.Flag |= proto.MESSAGE_FLAG_SELF
 		}
 		client.EnqueueMessage(m)
 	}
 
 	if gh.LastMsgId < lastId && gh.LastMsgId > 0 {
-		sk.syncKey = gh.LastMsgId
+		sk.SyncKey = gh.LastMsgId
 		log.WithFields(log.Fields{"groupId": groupId, "lastId": lastId, "lastMsgId": gh.LastMsgId}).Warning("群组同步消息的最新id大于服务端消息的最新id")
 	}
-	client.EnqueueMessage(&Message{cmd: MSG_SYNC_GROUP_END, body: sk})
+	client.EnqueueMessage(&proto.Message{Cmd: proto.MSG_SYNC_GROUP_END, Body: sk})
 }
 
-func (client *GroupClient) HandleGroupSyncKey(groupSyncKey *GroupSyncKey) {
-	groupId := groupSyncKey.groupId
-	lastId := groupSyncKey.syncKey
+func (client *GroupClient) HandleGroupSyncKey(groupSyncKey *proto.GroupSyncKey) {
+	groupId := groupSyncKey.GroupId
+	lastId := groupSyncKey.SyncKey
 
 	if lastId > 0 {
 		s := &SyncGroupHistory{
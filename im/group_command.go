@@ -0,0 +1,289 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sx-chat/proto"
+	"time"
+)
+
+// 执行群组管理命令, 客户端和http接口共用, 返回群组id和执行结果
+// 群主可以执行所有的命令, 管理员可以管理普通成员和修改群组设置
+// 普通成员只能在群组不需要邀请确认时添加成员和退出群组
+func ExecGroupCommand(operator int64, cmd *proto.GroupCommand) (int64, int32) {
+	if cmd.Op == proto.GROUP_OP_CREATE {
+		return createGroup(operator, cmd)
+	}
+
+	group := groupManager.LoadGroup(cmd.GroupId)
+	if group == nil {
+		return cmd.GroupId, proto.GROUP_STATUS_NOT_FOUND
+	}
+	if !group.IsMember(operator) {
+		return group.gid, proto.GROUP_STATUS_PERMISSION
+	}
+
+	var status int32
+	switch cmd.Op {
+	case proto.GROUP_OP_ADD_MEMBER:
+		status = addGroupMembers(group, operator, cmd)
+	case proto.GROUP_OP_REMOVE_MEMBER:
+		status = removeGroupMembers(group, operator, cmd)
+	case proto.GROUP_OP_TRANSFER:
+		status = transferGroup(group, operator, cmd)
+	case proto.GROUP_OP_MUTE, proto.GROUP_OP_UNMUTE:
+		status = muteGroupMember(group, operator, cmd)
+	case proto.GROUP_OP_SET_ADMIN, proto.GROUP_OP_UNSET_ADMIN:
+		status = setGroupAdmin(group, operator, cmd)
+	case proto.GROUP_OP_SETTINGS:
+		status = updateGroupSettings(group, operator, cmd)
+	case proto.GROUP_OP_DISSOLVE:
+		status = dissolveGroup(group, operator, cmd)
+	default:
+		status = proto.GROUP_STATUS_INVALID
+	}
+	return group.gid, status
+}
+
+func createGroup(operator int64, cmd *proto.GroupCommand) (int64, int32) {
+	members := uniqueMembers(append([]int64{operator}, cmd.Members...))
+	gid, err := CreateGroup(groupManager.db, operator, cmd.Name, cmd.Super, members)
+	if err != nil {
+		log.WithFields(log.Fields{"operator": operator, "err": err}).Error("创建群组失败")
+		return 0, proto.GROUP_STATUS_ERROR
+	}
+	log.WithFields(log.Fields{"gid": gid, "operator": operator, "super": cmd.Super}).Info("创建群组")
+
+	groupManager.PublishGroupEvent(cmd.Op, gid)
+	group := groupManager.LoadGroup(gid)
+	if group != nil {
+		sendGroupNotification(group, members, operator, cmd.Op, members[1:], cmd.Name, nil)
+	}
+	return gid, proto.GROUP_STATUS_OK
+}
+
+func addGroupMembers(group *Group, operator int64, cmd *proto.GroupCommand) int32 {
+	if group.inviteOnly && !group.IsManager(operator) {
+		return proto.GROUP_STATUS_PERMISSION
+	}
+
+	var members []int64
+	for _, member := range uniqueMembers(cmd.Members) {
+		if !group.IsMember(member) {
+			members = append(members, member)
+		}
+	}
+	if len(members) == 0 {
+		return proto.GROUP_STATUS_INVALID
+	}
+	if group.maxMembers > 0 && len(group.members)+len(members) > group.maxMembers {
+		return proto.GROUP_STATUS_FULL
+	}
+
+	err := AddGroupMembers(groupManager.db, group.gid, members)
+	if err != nil {
+		log.WithFields(log.Fields{"gid": group.gid, "err": err}).Error("添加群成员失败")
+		return proto.GROUP_STATUS_ERROR
+	}
+	log.WithFields(log.Fields{"gid": group.gid, "operator": operator, "members": members}).Info("添加群成员")
+
+	//新成员需要收到通知, 先更新缓存
+	groupManager.PublishGroupEvent(cmd.Op, group.gid)
+	if g := groupManager.LoadGroup(group.gid); g != nil {
+		sendGroupNotification(g, g.MemberIds(), operator, cmd.Op, members, "", nil)
+	}
+	return proto.GROUP_STATUS_OK
+}
+
+// 成员可以退出群组, 移除其它成员需要有管理权限, 群主需要先转让群组才能退出
+func removeGroupMembers(group *Group, operator int64, cmd *proto.GroupCommand) int32 {
+	members := uniqueMembers(cmd.Members)
+	if len(members) == 0 {
+		return proto.GROUP_STATUS_INVALID
+	}
+	for _, member := range members {
+		if !group.IsMember(member) || member == group.owner {
+			return proto.GROUP_STATUS_INVALID
+		}
+		if member != operator && !canManageMember(group, operator, member) {
+			return proto.GROUP_STATUS_PERMISSION
+		}
+	}
+
+	err := RemoveGroupMembers(groupManager.db, group.gid, members)
+	if err != nil {
+		log.WithFields(log.Fields{"gid": group.gid, "err": err}).Error("移除群成员失败")
+		return proto.GROUP_STATUS_ERROR
+	}
+	log.WithFields(log.Fields{"gid": group.gid, "operator": operator, "members": members}).Info("移除群成员")
+
+	//被移除的成员也需要收到通知, 先发送通知再更新缓存
+	sendGroupNotification(group, group.MemberIds(), operator, cmd.Op, members, "", nil)
+	groupManager.PublishGroupEvent(cmd.Op, group.gid)
+	return proto.GROUP_STATUS_OK
+}
+
+func transferGroup(group *Group, operator int64, cmd *proto.GroupCommand) int32 {
+	if operator != group.owner {
+		return proto.GROUP_STATUS_PERMISSION
+	}
+	if !group.IsMember(cmd.Uid) || cmd.Uid == group.owner {
+		return proto.GROUP_STATUS_INVALID
+	}
+
+	err := SetGroupOwner(groupManager.db, group.gid, cmd.Uid)
+	if err != nil {
+		log.WithFields(log.Fields{"gid": group.gid, "err": err}).Error("转让群组失败")
+		return proto.GROUP_STATUS_ERROR
+	}
+	log.WithFields(log.Fields{"gid": group.gid, "operator": operator, "owner": cmd.Uid}).Info("转让群组")
+
+	groupManager.PublishGroupEvent(cmd.Op, group.gid)
+	sendGroupNotification(group, group.MemberIds(), operator, cmd.Op, []int64{cmd.Uid}, "", nil)
+	return proto.GROUP_STATUS_OK
+}
+
+func muteGroupMember(group *Group, operator int64, cmd *proto.GroupCommand) int32 {
+	if !group.IsMember(cmd.Uid) || cmd.Uid == group.owner {
+		return proto.GROUP_STATUS_INVALID
+	}
+	if !canManageMember(group, operator, cmd.Uid) {
+		return proto.GROUP_STATUS_PERMISSION
+	}
+
+	mute := cmd.Op == proto.GROUP_OP_MUTE
+	err := SetGroupMemberMute(groupManager.db, group.gid, cmd.Uid, mute)
+	if err != nil {
+		log.WithFields(log.Fields{"gid": group.gid, "err": err}).Error("设置群成员禁言失败")
+		return proto.GROUP_STATUS_ERROR
+	}
+	log.WithFields(log.Fields{"gid": group.gid, "operator": operator, "uid": cmd.Uid, "mute": mute}).Info("设置群成员禁言")
+
+	groupManager.PublishGroupEvent(cmd.Op, group.gid)
+	sendGroupNotification(group, group.MemberIds(), operator, cmd.Op, []int64{cmd.Uid}, "", nil)
+	return proto.GROUP_STATUS_OK
+}
+
+func setGroupAdmin(group *Group, operator int64, cmd *proto.GroupCommand) int32 {
+	if operator != group.owner {
+		return proto.GROUP_STATUS_PERMISSION
+	}
+	if !group.IsMember(cmd.Uid) || cmd.Uid == group.owner {
+		return proto.GROUP_STATUS_INVALID
+	}
+
+	role := GROUP_ROLE_MEMBER
+	if cmd.Op == proto.GROUP_OP_SET_ADMIN {
+		role = GROUP_ROLE_ADMIN
+	}
+	err := SetGroupMemberRole(groupManager.db, group.gid, cmd.Uid, role)
+	if err != nil {
+		log.WithFields(log.Fields{"gid": group.gid, "err": err}).Error("设置群管理员失败")
+		return proto.GROUP_STATUS_ERROR
+	}
+	log.WithFields(log.Fields{"gid": group.gid, "operator": operator, "uid": cmd.Uid, "role": role}).Info("设置群管理员")
+
+	groupManager.PublishGroupEvent(cmd.Op, group.gid)
+	sendGroupNotification(group, group.MemberIds(), operator, cmd.Op, []int64{cmd.Uid}, "", nil)
+	return proto.GROUP_STATUS_OK
+}
+
+func updateGroupSettings(group *Group, operator int64, cmd *proto.GroupCommand) int32 {
+	if !group.IsManager(operator) {
+		return proto.GROUP_STATUS_PERMISSION
+	}
+	settings := cmd.GroupSettings
+	if settings.MaxMembers < 0 {
+		return proto.GROUP_STATUS_INVALID
+	}
+
+	err := SetGroupSettings(groupManager.db, group.gid, settings.MuteAll, settings.InviteOnly, int(settings.MaxMembers))
+	if err != nil {
+		log.WithFields(log.Fields{"gid": group.gid, "err": err}).Error("修改群组设置失败")
+		return proto.GROUP_STATUS_ERROR
+	}
+	log.WithFields(log.Fields{"gid": group.gid, "operator": operator, "muteAll": settings.MuteAll,
+		"inviteOnly": settings.InviteOnly, "maxMembers": settings.MaxMembers}).Info("修改群组设置")
+
+	groupManager.PublishGroupEvent(cmd.Op, group.gid)
+	sendGroupNotification(group, group.MemberIds(), operator, cmd.Op, nil, "", &settings)
+	return proto.GROUP_STATUS_OK
+}
+
+// 群主可以管理所有的成员, 管理员只能管理普通成员
+func canManageMember(group *Group, operator int64, uid int64) bool {
+	role := group.GetMemberRole(operator)
+	if role == GROUP_ROLE_OWNER {
+		return uid != operator
+	}
+	return role == GROUP_ROLE_ADMIN && group.GetMemberRole(uid) == GROUP_ROLE_MEMBER
+}
+
+func dissolveGroup(group *Group, operator int64, cmd *proto.GroupCommand) int32 {
+	if operator != group.owner {
+		return proto.GROUP_STATUS_PERMISSION
+	}
+
+	err := DissolveGroup(groupManager.db, group.gid)
+	if err != nil {
+		log.WithFields(log.Fields{"gid": group.gid, "err": err}).Error("解散群组失败")
+		return proto.GROUP_STATUS_ERROR
+	}
+	log.WithFields(log.Fields{"gid": group.gid, "operator": operator}).Info("解散群组")
+
+	sendGroupNotification(group, group.MemberIds(), operator, cmd.Op, nil, "", nil)
+	groupManager.PublishGroupEvent(cmd.Op, group.gid)
+	return proto.GROUP_STATUS_OK
+}
+
+// 把系统通知作为群消息发送, 超级群保存到群组的消息队列, 普通群保存到receivers的收件箱
+func sendGroupNotification(group *Group, receivers []int64, operator int64, op int8, members []int64, name string,
+	settings *proto.GroupSettings) {
+	n := &proto.GroupNotification{
+		Op:        op,
+		GroupId:   group.gid,
+		Operator:  operator,
+		Timestamp: int32(time.Now().Unix()),
+		Members:   members,
+		Name:      name,
+	}
+	if settings != nil {
+		n.GroupSettings = *settings
+	}
+	m := &proto.Message{Cmd: proto.MSG_GROUP_NOTIFICATION, Version: proto.DEFAULT_VERSION, Body: n}
+
+	if !group.super {
+		_, err := SendPeerGroupMessage(receivers, 0, 0, m)
+		if err != nil {
+			log.WithFields(log.Fields{"gid": group.gid, "op": op, "err": err}).Warning("发送群组通知失败")
+		}
+		return
+	}
+
+	msgId, prevMsgId, err := SaveGroupMessage(group.gid, 0, m)
+	if err != nil || msgId == 0 {
+		log.WithFields(log.Fields{"gid": group.gid, "op": op, "err": err}).Warning("发送群组通知失败")
+		return
+	}
+	m.Meta = &proto.Metadata{SyncKey: msgId, PrevSyncKey: prevMsgId}
+	m.Flag = proto.MESSAGE_FLAG_PUSH | proto.MESSAGE_FLAG_SUPER_GROUP
+	PublishGroupMessage(group.gid, m)
+	DispatchMessageToGroup(m, group, nil)
+
+	notify := &proto.Message{Cmd: proto.MSG_SYNC_GROUP_NOTIFY, Body: &proto.GroupSyncKey{GroupId: group.gid, SyncKey: msgId}}
+	PublishGroupMessage(group.gid, notify)
+	DispatchMessageToGroup(notify, group, nil)
+}
+
+// 去掉重复和无效的成员id, 保持原来的顺序
+func uniqueMembers(members []int64) []int64 {
+	seen := make(map[int64]bool, len(members))
+	r := make([]int64, 0, len(members))
+	for _, member := range members {
+		if member <= 0 || seen[member] {
+			continue
+		}
+		seen[member] = true
+		r = append(r, member)
+	}
+	return r
+}
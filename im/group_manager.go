@@ -2,15 +2,25 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
 	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+//群组变更的通知, 所有的im实例收到之后丢弃缓存的群组, 下次使用时从数据库重新加载
+const GROUP_MANAGER_CHANNEL = "group_manager"
+
 type GroupManager struct {
 	mutex  sync.Mutex
 	groups map[int64]*Group
 	db     *sql.DB
+
+	//每次丢弃缓存时加1, 避免把丢弃之前从数据库读取的旧数据放入缓存
+	version int64
 }
 
 func NewGroupManager() *GroupManager {
@@ -35,8 +45,82 @@ func (groupManager *GroupManager) Start() {
 func (groupManager *GroupManager) load() {
 }
 
+// 订阅群组变更的通知, 连接断开期间可能错过通知, 重新订阅之后丢弃所有的缓存
 func (groupManager *GroupManager) Run() {
+	for {
+		groupManager.subscribe()
+		groupManager.ClearGroups()
+		time.Sleep(time.Second)
+	}
+}
+
+func (groupManager *GroupManager) subscribe() {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	psc := redis.PubSubConn{Conn: conn}
+	err := psc.Subscribe(GROUP_MANAGER_CHANNEL)
+	if err != nil {
+		log.WithField("err", err).Warning("订阅群组变更失败")
+		return
+	}
 
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			groupManager.handleEvent(string(v.Data))
+		case redis.Subscription:
+			log.WithFields(log.Fields{"channel": v.Channel, "kind": v.Kind}).Info("订阅群组变更")
+		case error:
+			log.WithField("err", v).Warning("接收群组变更失败")
+			return
+		}
+	}
+}
+
+// op,gid
+func (groupManager *GroupManager) handleEvent(data string) {
+	parts := strings.Split(data, ",")
+	if len(parts) != 2 {
+		log.WithField("data", data).Warning("群组变更的格式错误")
+		return
+	}
+	gid, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		log.WithField("data", data).Warning("群组变更的格式错误")
+		return
+	}
+	log.WithFields(log.Fields{"op": parts[0], "gid": gid}).Info("群组变更")
+	groupManager.RemoveGroup(gid)
+}
+
+// 通知所有的im实例群组已经变更, 当前实例直接丢弃缓存
+func (groupManager *GroupManager) PublishGroupEvent(op int8, gid int64) {
+	groupManager.RemoveGroup(gid)
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("PUBLISH", GROUP_MANAGER_CHANNEL, fmt.Sprintf("%d,%d", op, gid))
+	if err != nil {
+		log.WithFields(log.Fields{"gid": gid, "err": err}).Warning("发布群组变更失败")
+	}
+}
+
+func (groupManager *GroupManager) RemoveGroup(gid int64) {
+	groupManager.mutex.Lock()
+	defer groupManager.mutex.Unlock()
+
+	groupManager.version++
+	delete(groupManager.groups, gid)
+}
+
+func (groupManager *GroupManager) ClearGroups() {
+	groupManager.mutex.Lock()
+	defer groupManager.mutex.Unlock()
+
+	groupManager.version++
+	groupManager.groups = make(map[int64]*Group)
 }
 
 func (groupManager *GroupManager) RecycleLoop() {
@@ -66,6 +150,7 @@ func (groupManager *GroupManager) LoadGroup(gid int64) *Group {
 		return group
 	}
 
+	version := groupManager.version
 	groupManager.mutex.Unlock()
 
 	group, err := LoadGroup(groupManager.db, gid)
@@ -75,7 +160,9 @@ func (groupManager *GroupManager) LoadGroup(gid int64) *Group {
 	}
 
 	groupManager.mutex.Lock()
-	groupManager.groups[gid] = group
+	if groupManager.version == version {
+		groupManager.groups[gid] = group
+	}
 	groupManager.mutex.Unlock()
 	return group
 }
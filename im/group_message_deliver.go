@@ -1,18 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"hash/crc32"
 	"io"
 	"os"
+	"sx-chat/proto"
 	"sync"
+	"time"
 )
 
 const HEADER_SIZE = 32
 const MAGIC = 0x494d494d
 const F_VERSION = 1 << 16 //1.0
 
+//一条消息一直有ims保存失败时, 超过这个时间放弃没有保存的成员, 继续发送之后的消息
+const GROUP_DELIVER_TIMEOUT = 10 * time.Minute
+
 type GroupLoader struct {
 	gid int64
 	c   chan *Group
@@ -25,15 +32,25 @@ type GroupMessageDeliver struct {
 	mutex sync.Mutex
 	file  *os.File
 
+	//保存latestSentMsgId和正在发送的消息的进度, 重启之后从下一条消息继续发送
+	cursorFile *os.File
+
 	latestMsgId     int64 //最近保存的消息id
 	latestSentMsgId int64 //最近发送出去的消息id
 
+	//正在发送的消息已经保存到收件箱的成员, 重试时跳过, 只在发送线程中访问
+	progressMsgId int64
+	progress      map[int64]*proto.Metadata
+	failedAt      time.Time //第一次保存失败的时间
+
+	wt chan int64 //通知发送线程有新的消息
+
 	//保证单个群组结构只会在一个线程中被加载
 	lt chan *GroupLoader //加载group结构到内存
 
 	callbackMutex    sync.Mutex               // callback变量的锁
 	id               int64                    //自增的callback id
-	callbacks        map[int64]chan *Metadata //返回保存到ims的消息id
+	callbacks        map[int64]chan *proto.Metadata //返回保存到ims的消息id
 	callbackId2msgId map[int64]int64          //callback -> msgId
 }
 
@@ -51,9 +68,12 @@ func NewGroupMessageDeliver(root string) *GroupMessageDeliver {
 	}
 
 	storage.openWriteFile()
+	storage.openCursorFile()
+	storage.readLatestMessageID()
 
+	storage.wt = make(chan int64, 10)
 	storage.lt = make(chan *GroupLoader)
-	storage.callbacks = make(map[int64]chan *Metadata)
+	storage.callbacks = make(map[int64]chan *proto.Metadata)
 	storage.callbackId2msgId = make(map[int64]int64)
 
 	return storage
@@ -84,6 +104,103 @@ func (storage *GroupMessageDeliver) openWriteFile() {
 	storage.file = file
 }
 
+func (storage *GroupMessageDeliver) openCursorFile() {
+	path := fmt.Sprintf("%s/pending_group_messages_cursor", storage.root)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		log.WithField("err", err).Fatal("open file:", err)
+	}
+	storage.cursorFile = file
+}
+
+// 读取最后一条待发送的消息和已经发送的消息
+func (storage *GroupMessageDeliver) readLatestMessageID() {
+	fi, err := storage.cursorFile.Stat()
+	if err != nil {
+		log.WithField("err", err).Fatal("stat cursor file")
+	}
+	buf := make([]byte, fi.Size())
+	n, _ := storage.cursorFile.ReadAt(buf, 0)
+	if n >= 8 {
+		storage.latestSentMsgId = int64(binary.BigEndian.Uint64(buf))
+		storage.readProgress(buf[:n])
+	}
+
+	offset := int64(HEADER_SIZE)
+	for {
+		_, size := storage.readMessage(offset)
+		if size == 0 {
+			break
+		}
+		storage.latestMsgId = offset
+		offset += size
+	}
+	//丢弃最后写入不完整的消息
+	if err := storage.file.Truncate(offset); err != nil {
+		log.WithField("err", err).Fatal("truncate file")
+	}
+
+	if storage.latestMsgId == 0 && storage.latestSentMsgId > 0 {
+		storage.latestSentMsgId = 0
+		storage.clearProgress()
+		storage.saveCursor()
+	}
+	log.WithFields(log.Fields{"latestMsgId": storage.latestMsgId, "latestSentMsgId": storage.latestSentMsgId,
+		"progress": len(storage.progress)}).Info("待发送的群组消息")
+}
+
+// cursor文件: latestSentMsgId | progressMsgId | 成员数量 | (uid, syncKey, prevSyncKey) | crc32
+// 旧的cursor文件只有latestSentMsgId, 写入不完整时crc32不一致, 都当作没有进度
+func (storage *GroupMessageDeliver) readProgress(buf []byte) {
+	if len(buf) < 8+8+4+4 {
+		return
+	}
+	count := int(binary.BigEndian.Uint32(buf[16:]))
+	size := 8 + 8 + 4 + count*24
+	if len(buf) < size+4 {
+		return
+	}
+	if crc32.ChecksumIEEE(buf[:size]) != binary.BigEndian.Uint32(buf[size:]) {
+		log.Warning("群组消息发送进度不完整")
+		return
+	}
+	msgId := int64(binary.BigEndian.Uint64(buf[8:]))
+	if msgId == 0 {
+		return
+	}
+	progress := make(map[int64]*proto.Metadata, count)
+	for i := 0; i < count; i++ {
+		b := buf[20+i*24:]
+		uid := int64(binary.BigEndian.Uint64(b))
+		progress[uid] = &proto.Metadata{SyncKey: int64(binary.BigEndian.Uint64(b[8:])), PrevSyncKey: int64(binary.BigEndian.Uint64(b[16:]))}
+	}
+	storage.progressMsgId = msgId
+	storage.progress = progress
+}
+
+func (storage *GroupMessageDeliver) clearProgress() {
+	storage.progressMsgId = 0
+	storage.progress = nil
+	storage.failedAt = time.Time{}
+}
+
+func (storage *GroupMessageDeliver) saveCursor() {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, storage.latestSentMsgId)
+	binary.Write(buffer, binary.BigEndian, storage.progressMsgId)
+	binary.Write(buffer, binary.BigEndian, int32(len(storage.progress)))
+	for uid, meta := range storage.progress {
+		binary.Write(buffer, binary.BigEndian, uid)
+		binary.Write(buffer, binary.BigEndian, meta.SyncKey)
+		binary.Write(buffer, binary.BigEndian, meta.PrevSyncKey)
+	}
+	binary.Write(buffer, binary.BigEndian, crc32.ChecksumIEEE(buffer.Bytes()))
+	_, err := storage.cursorFile.WriteAt(buffer.Bytes(), 0)
+	if err != nil {
+		log.WithField("err", err).Fatal("write cursor file")
+	}
+}
+
 func (storage *GroupMessageDeliver) WriteHeader(file *os.File) {
 	var m int32 = MAGIC
 	err := binary.Write(file, binary.BigEndian, m)
@@ -104,9 +221,201 @@ func (storage *GroupMessageDeliver) WriteHeader(file *os.File) {
 }
 
 func (storage *GroupMessageDeliver) Start() {
+	go storage.run()
 	go storage.run2()
 }
 
+// 保存待发送的普通群消息, 返回callback id
+// 消息发送之后通过ch返回发送者收件箱中的消息id, 不再等待时需要调用ClearCallback
+func (storage *GroupMessageDeliver) SaveMessage(gm *PendingGroupMessage, ch chan *proto.Metadata) int64 {
+	msgId, callbackId := storage.saveMessage(gm, ch)
+
+	select {
+	case storage.wt <- msgId:
+	default:
+	}
+	return callbackId
+}
+
+func (storage *GroupMessageDeliver) ClearCallback(callbackId int64) {
+	storage.callbackMutex.Lock()
+	defer storage.callbackMutex.Unlock()
+
+	if msgId, ok := storage.callbackId2msgId[callbackId]; ok {
+		delete(storage.callbacks, msgId)
+		delete(storage.callbackId2msgId, callbackId)
+	}
+}
+
+func (storage *GroupMessageDeliver) doCallback(msgId int64, meta *proto.Metadata) {
+	storage.callbackMutex.Lock()
+	defer storage.callbackMutex.Unlock()
+
+	ch, ok := storage.callbacks[msgId]
+	if !ok {
+		return
+	}
+	delete(storage.callbacks, msgId)
+	for callbackId, id := range storage.callbackId2msgId {
+		if id == msgId {
+			delete(storage.callbackId2msgId, callbackId)
+			break
+		}
+	}
+	// ch的缓冲大小为1, 不会阻塞
+	select {
+	case ch <- meta:
+	default:
+	}
+}
+
+// 消息格式和ims的消息文件一致: MAGIC | 消息 | MAGIC
+// 在更新latestMsgId之前注册callback, 发送线程看到这条消息时callback已经存在
+func (storage *GroupMessageDeliver) saveMessage(gm *PendingGroupMessage, ch chan *proto.Metadata) (int64, int64) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	msgId, err := storage.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		log.WithField("err", err).Fatal("seek file")
+	}
+
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, int32(MAGIC))
+	proto.WriteMessage(buffer, &proto.Message{Cmd: proto.MSG_PENDING_GROUP_MESSAGE, Version: PENDING_VERSION, Body: gm})
+	binary.Write(buffer, binary.BigEndian, int32(MAGIC))
+	buf := buffer.Bytes()
+
+	n, err := storage.file.Write(buf)
+	if err != nil || n != len(buf) {
+		log.WithField("err", err).Fatal("写入待发送的群组消息失败")
+	}
+
+	var callbackId int64
+	if ch != nil {
+		storage.callbackMutex.Lock()
+		storage.id += 1
+		callbackId = storage.id
+		storage.callbacks[msgId] = ch
+		storage.callbackId2msgId[callbackId] = msgId
+		storage.callbackMutex.Unlock()
+	}
+	storage.latestMsgId = msgId
+	return msgId, callbackId
+}
+
+// 读取offset处的消息, 返回消息和占用的字节数, 没有完整的消息时返回0
+func (storage *GroupMessageDeliver) readMessage(offset int64) (*PendingGroupMessage, int64) {
+	var header [4 + proto.MSG_HEADER_SIZE]byte
+	if n, _ := storage.file.ReadAt(header[:], offset); n < len(header) {
+		return nil, 0
+	}
+	if binary.BigEndian.Uint32(header[:]) != MAGIC {
+		return nil, 0
+	}
+
+	length, _, _, _, _ := proto.ReadHeader(header[4:])
+	if length < 0 || length > 1024*1024 {
+		return nil, 0
+	}
+	buf := make([]byte, proto.MSG_HEADER_SIZE+length+4)
+	copy(buf, header[4:])
+	if n, _ := storage.file.ReadAt(buf[proto.MSG_HEADER_SIZE:], offset+int64(len(header))); n < length+4 {
+		return nil, 0
+	}
+	if binary.BigEndian.Uint32(buf[proto.MSG_HEADER_SIZE+length:]) != MAGIC {
+		return nil, 0
+	}
+
+	msg, err := proto.DecodeMessage(buf[:proto.MSG_HEADER_SIZE+length], length)
+	if err != nil || msg.Cmd != proto.MSG_PENDING_GROUP_MESSAGE {
+		return nil, 0
+	}
+	return msg.Body.(*PendingGroupMessage), int64(len(header) + length + 4)
+}
+
+// 按照保存的顺序发送消息, 发送失败之后等待一段时间重试
+func (storage *GroupMessageDeliver) run() {
+	log.Info("group message deliver running loop")
+	ticker := time.NewTicker(time.Second)
+	for {
+		select {
+		case <-storage.wt:
+		case <-ticker.C:
+		}
+		storage.sendPendingMessages()
+	}
+}
+
+func (storage *GroupMessageDeliver) sendPendingMessages() {
+	storage.mutex.Lock()
+	latestMsgId := storage.latestMsgId
+	storage.mutex.Unlock()
+
+	offset := int64(HEADER_SIZE)
+	if storage.latestSentMsgId > 0 {
+		_, size := storage.readMessage(storage.latestSentMsgId)
+		if size == 0 {
+			log.WithField("msgId", storage.latestSentMsgId).Fatal("读取已经发送的群组消息失败")
+		}
+		offset = storage.latestSentMsgId + size
+	}
+
+	for offset <= latestMsgId {
+		gm, size := storage.readMessage(offset)
+		if gm == nil {
+			log.WithField("msgId", offset).Fatal("读取待发送的群组消息失败")
+		}
+		if !storage.sendGroupMessage(offset, gm) {
+			return
+		}
+		storage.latestSentMsgId = offset
+		storage.clearProgress()
+		storage.saveCursor()
+		offset += size
+	}
+
+	storage.mutex.Lock()
+	if storage.latestSentMsgId == storage.latestMsgId && storage.latestMsgId > 0 {
+		storage.truncateFile()
+		storage.saveCursor()
+	}
+	storage.mutex.Unlock()
+}
+
+func (storage *GroupMessageDeliver) sendGroupMessage(msgId int64, gm *PendingGroupMessage) bool {
+	im := &proto.IMMessage{Sender: gm.sender, Receiver: gm.gid, Timestamp: gm.timestamp, MessageType: gm.messageType,
+		Content: gm.content, AtAll: gm.atAll, Mentions: gm.mentions, ClientMsgId: gm.clientMsgId, Ttl: gm.ttl}
+	m := &proto.Message{Cmd: proto.MSG_GROUP_IM, Version: im.MinVersion(), Body: im}
+
+	//重试时只保存上次失败的ims上的成员, 每台ims保存之后记录进度, 重启之后也不会重复保存
+	if storage.progressMsgId != msgId {
+		storage.clearProgress()
+		storage.progressMsgId = msgId
+		storage.progress = make(map[int64]*proto.Metadata, len(gm.members))
+	}
+	metas := storage.progress
+	err := SavePeerGroupMessageShards(gm.members, gm.deviceID, m, metas, storage.saveCursor)
+	if err != nil {
+		if storage.failedAt.IsZero() {
+			storage.failedAt = time.Now()
+		}
+		if time.Since(storage.failedAt) < GROUP_DELIVER_TIMEOUT {
+			log.WithFields(log.Fields{"gid": gm.gid, "saved": len(metas), "members": len(gm.members), "err": err}).Warning("保存普通群消息失败, 稍后重试")
+			return false
+		}
+		log.WithFields(log.Fields{"gid": gm.gid, "saved": len(metas), "members": len(gm.members), "err": err}).Error("保存普通群消息超时, 放弃没有保存的成员")
+	}
+	PushPeerGroupMessage(gm.members, gm.sender, gm.deviceID, m, metas)
+
+	if meta, ok := metas[gm.sender]; ok {
+		storage.doCallback(msgId, meta)
+	} else {
+		storage.doCallback(msgId, nil)
+	}
+	return true
+}
+
 func (storage *GroupMessageDeliver) run2() {
 	log.Info("group message deliver running loop2")
 	for {
@@ -123,6 +432,7 @@ func (storage *GroupMessageDeliver) loadGroup(groupLoader *GroupLoader) {
 }
 
 
+// 所有消息都已经发送, 在mutex内调用
 func (storage *GroupMessageDeliver) truncateFile() {
 	err := storage.file.Truncate(HEADER_SIZE)
 	if err != nil {
@@ -135,29 +445,6 @@ func (storage *GroupMessageDeliver) truncateFile() {
 }
 
 
-// 推送给群中的成员
-//device_ID 发送者的设备ID
-func (storage *GroupMessageDeliver) sendMessage(uid, sender, deviceID int64, msg *Message) bool {
-
-	// publish只是发送给群成员不在当前im机器上连接
-	PublishMessage(uid, msg)
-
-	// 这里是处理连接在当前im机器上的群成员消息推送
-	clients := route.FindClientSet(uid)
-	if len(clients) == 0 {
-		return false
-	}
-
-	for c, _ := range clients {
-		// 不发送给自己
-		if c.deviceID == deviceID && sender == uid {
-			continue
-		}
-		c.EnqueueMessage(msg)
-	}
-	return true
-}
-
 func (storage *GroupMessageDeliver) LoadGroup(groupId int64) *Group {
 	group := groupManager.FindGroup(groupId)
 	if group != nil {
@@ -171,11 +458,11 @@ func (storage *GroupMessageDeliver) LoadGroup(groupId int64) *Group {
 	return group
 }
 
-func (storage *GroupMessageDeliver) DispatchMessage(msg *AppMessage) {
-	group := groupManager.LoadGroup(msg.receiver)
+func (storage *GroupMessageDeliver) DispatchMessage(msg *proto.AppMessage) {
+	group := groupManager.LoadGroup(msg.Receiver)
 	if group == nil {
 		log.Warning("加载Group为空，不能分发Group消息")
 		return
 	}
-	DispatchMessageToGroup(msg.msg, group, nil)
+	DispatchMessageToGroup(msg.Msg, group, nil)
 }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sx-chat/proto"
+	"testing"
+	"time"
+)
+
+// 重启之后从latestSentMsgId之后继续发送, 最后写入不完整的消息被丢弃
+func TestGroupMessageDeliverResume(t *testing.T) {
+	root, err := ioutil.TempDir("", "im")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	deliver := NewGroupMessageDeliver(root)
+	var ids []int64
+	for i := 0; i < 3; i++ {
+		gm := &PendingGroupMessage{sender: 1, deviceID: 2, gid: 3, timestamp: int32(i), members: []int64{1, 4}, content: "hi"}
+		deliver.SaveMessage(gm, nil)
+		ids = append(ids, deliver.latestMsgId)
+	}
+	deliver.latestSentMsgId = ids[0]
+	deliver.saveCursor()
+	deliver.file.Write([]byte{0x49, 0x4d})
+	deliver.file.Close()
+	deliver.cursorFile.Close()
+
+	deliver = NewGroupMessageDeliver(root)
+	if deliver.latestMsgId != ids[2] || deliver.latestSentMsgId != ids[0] {
+		t.Fatalf("latest:%d sent:%d expect:%d %d", deliver.latestMsgId, deliver.latestSentMsgId, ids[2], ids[0])
+	}
+
+	_, size := deliver.readMessage(ids[0])
+	gm, _ := deliver.readMessage(ids[0] + size)
+	expect := &PendingGroupMessage{sender: 1, deviceID: 2, gid: 3, timestamp: 1, members: []int64{1, 4}, content: "hi"}
+	if !reflect.DeepEqual(gm, expect) {
+		t.Fatalf("next message:%+v expect:%+v", gm, expect)
+	}
+
+	// 不完整的消息被截断, 新的消息紧接着最后一条完整的消息
+	deliver.SaveMessage(expect, nil)
+	if deliver.latestMsgId != ids[2]+size {
+		t.Fatalf("new message id:%d expect:%d", deliver.latestMsgId, ids[2]+size)
+	}
+}
+
+// 普通群消息的ttl经过待发送文件保存到成员的收件箱
+func TestGroupMessageDeliverTtl(t *testing.T) {
+	root, err := ioutil.TempDir("", "im")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	f := newFakeStorage(t, "")
+	defer f.server.Stop()
+	rpcClients = []*StorageClient{newTestStorageClient(f.addr, 5, time.Second)}
+	peerShards = NewShardTable(PEER_SHARD_KEY, 1)
+	routeChannels = []*Channel{NewChannel("", nil, nil)}
+
+	deliver := NewGroupMessageDeliver(root)
+	gm := &PendingGroupMessage{sender: 1, deviceID: 2, gid: 3, timestamp: 4, members: []int64{1, 4}, ttl: 60, content: "hi"}
+	deliver.SaveMessage(gm, nil)
+	gm, _ = deliver.readMessage(deliver.latestMsgId)
+	if !deliver.sendGroupMessage(deliver.latestMsgId, gm) {
+		t.Fatal("send failed")
+	}
+
+	pm := <-f.saved
+	m := &proto.Message{Cmd: int(pm.Cmd), Version: int(pm.Version)}
+	if !m.FromData(pm.Raw) {
+		t.Fatal("decode failed")
+	}
+	if im := m.Body.(*proto.IMMessage); im.Ttl != 60 || im.ExpireAt() != 64 {
+		t.Errorf("ttl:%d expireAt:%d", im.Ttl, im.ExpireAt())
+	}
+}
+
+// 一台ims保存失败之后重试和重启, 只保存失败的ims上的成员
+func TestGroupMessageDeliverPartialRetry(t *testing.T) {
+	root, err := ioutil.TempDir("", "im")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	f0 := newFakeStorage(t, "")
+	defer f0.server.Stop()
+	f1 := newFakeStorage(t, "")
+	f1.server.Stop()
+	rpcClients = []*StorageClient{newTestStorageClient(f0.addr, 5, time.Second), newTestStorageClient(f1.addr, 5, time.Second)}
+	peerShards = NewShardTable(PEER_SHARD_KEY, 2)
+	routeChannels = []*Channel{NewChannel("", nil, nil)}
+
+	deliver := NewGroupMessageDeliver(root)
+	gm := &PendingGroupMessage{sender: 1, deviceID: 2, gid: 3, timestamp: 4, members: []int64{1, 4}, content: "hi"}
+	deliver.SaveMessage(gm, nil)
+	msgId := deliver.latestMsgId
+	gm, _ = deliver.readMessage(msgId)
+	if deliver.sendGroupMessage(msgId, gm) {
+		t.Fatal("send should fail")
+	}
+	if pm := <-f0.saved; !reflect.DeepEqual(pm.Members, []int64{4}) {
+		t.Fatalf("saved members:%v", pm.Members)
+	}
+	deliver.file.Close()
+	deliver.cursorFile.Close()
+
+	deliver = NewGroupMessageDeliver(root)
+	if deliver.progressMsgId != msgId || len(deliver.progress) != 1 || deliver.progress[4] == nil {
+		t.Fatalf("progress msgId:%d members:%d", deliver.progressMsgId, len(deliver.progress))
+	}
+	f1 = newFakeStorage(t, f1.addr)
+	defer f1.server.Stop()
+	//等待rpc客户端重新连接
+	for i := 0; !deliver.sendGroupMessage(msgId, gm); i++ {
+		if i == 50 {
+			t.Fatal("retry failed")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if pm := <-f1.saved; !reflect.DeepEqual(pm.Members, []int64{1}) {
+		t.Fatalf("retry members:%v", pm.Members)
+	}
+	if len(f0.saved) != 0 {
+		t.Error("saved again on the healthy storage")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+)
+
+func newTestGroup() *Group {
+	members := map[int64]*GroupMember{
+		1: {role: GROUP_ROLE_MEMBER},
+		2: {role: GROUP_ROLE_ADMIN},
+		3: {role: GROUP_ROLE_ADMIN},
+		4: {role: GROUP_ROLE_MEMBER},
+		5: {role: GROUP_ROLE_MEMBER, mute: true},
+	}
+	return NewGroup(1, false, 1, members)
+}
+
+func TestGroupCanPost(t *testing.T) {
+	group := newTestGroup()
+	if !group.CanPost(4) || group.CanPost(5) || group.CanPost(6) {
+		t.Fatal("member mute")
+	}
+
+	group.muteAll = true
+	if !group.CanPost(1) || !group.CanPost(2) || group.CanPost(4) {
+		t.Fatal("mute all")
+	}
+}
+
+func TestGroupManageMember(t *testing.T) {
+	group := newTestGroup()
+	cases := []struct {
+		operator int64
+		uid      int64
+		expect   bool
+	}{
+		{1, 2, true},  //群主管理管理员
+		{1, 4, true},  //群主管理成员
+		{1, 1, false}, //群主不能管理自己
+		{2, 4, true},  //管理员管理成员
+		{2, 3, false}, //管理员不能管理管理员
+		{2, 1, false}, //管理员不能管理群主
+		{4, 5, false}, //成员没有管理权限
+	}
+	for _, c := range cases {
+		if canManageMember(group, c.operator, c.uid) != c.expect {
+			t.Errorf("operator:%d uid:%d expect:%v", c.operator, c.uid, c.expect)
+		}
+	}
+}
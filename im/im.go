@@ -1,18 +1,19 @@
 package main
 
 import (
+	"fmt"
 	log "github.com/sirupsen/logrus"
-	"github.com/valyala/gorpc"
-	"sync/atomic"
+	"sx-chat/proto"
 )
 
-func SaveMessage(uid, deviceID int64, m *Message) (int64, int64, error) {
+func SaveMessage(uid, deviceID int64, m *proto.Message) (int64, int64, error) {
 	dc := GetStorageRPCClient(uid)
 
 	pm := &PeerMessage{
 		UID:      uid,
 		DeviceID: deviceID,
-		Cmd:      int32(m.cmd),
+		Cmd:      int32(m.Cmd),
+		Version:  int32(m.Version),
 		Raw:      m.ToData(),
 	}
 
@@ -29,7 +30,7 @@ func SaveMessage(uid, deviceID int64, m *Message) (int64, int64, error) {
 	return msgId, prevMsgId, nil
 }
 
-func SavePeerGroupMessage(members []int64, deviceID int64, m *Message) ([]int64, error) {
+func SavePeerGroupMessage(members []int64, deviceID int64, m *proto.Message) ([]int64, error) {
 	if len(members) == 0 {
 		return nil, nil
 	}
@@ -40,7 +41,8 @@ func SavePeerGroupMessage(members []int64, deviceID int64, m *Message) ([]int64,
 	pm := &PeerGroupMessage{
 		Members:  members,
 		DeviceID: deviceID,
-		Cmd:      int32(m.cmd),
+		Cmd:      int32(m.Cmd),
+		Version:  int32(m.Version),
 		Raw:      m.ToData(),
 	}
 
@@ -55,20 +57,99 @@ func SavePeerGroupMessage(members []int64, deviceID int64, m *Message) ([]int64,
 	return r, nil
 }
 
-func SaveGroupMessage( gid int64, deviceID int64, msg *Message) (int64, int64, error) {
+// 按照ims分组保存到每个成员的收件箱, 之后推送给在线的成员, 返回每个成员收件箱中的消息id
+// 部分ims保存失败时返回错误, 需要重试的调用者使用SavePeerGroupMessageShards记录已经保存的成员
+func SendPeerGroupMessage(members []int64, sender, deviceID int64, m *proto.Message) (map[int64]*proto.Metadata, error) {
+	metas := make(map[int64]*proto.Metadata, len(members))
+	if err := SavePeerGroupMessageShards(members, deviceID, m, metas, nil); err != nil {
+		return nil, err
+	}
+	PushPeerGroupMessage(members, sender, deviceID, m, metas)
+	return metas, nil
+}
+
+// 按照ims分组保存metas中还没有的成员, 每台ims保存成功之后把结果加入metas并且调用saved
+// 一台ims失败时继续保存其它ims, 返回第一个错误, 用同一个metas重试时只保存失败的ims上的成员
+func SavePeerGroupMessageShards(members []int64, deviceID int64, m *proto.Message, metas map[int64]*proto.Metadata, saved func()) error {
+	shards := make(map[int64][]int64)
+	for _, member := range members {
+		if _, ok := metas[member]; ok {
+			continue
+		}
+		index := GetStorageRPCIndex(member)
+		shards[index] = append(shards[index], member)
+	}
+
+	var firstErr error
+	for _, ms := range shards {
+		r, err := SavePeerGroupMessage(ms, deviceID, m)
+		if err == nil && len(r) != len(ms)*2 {
+			err = fmt.Errorf("invalid response length:%d", len(r))
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for i, member := range ms {
+			metas[member] = &proto.Metadata{SyncKey: r[2*i], PrevSyncKey: r[2*i+1]}
+		}
+		if saved != nil {
+			saved()
+		}
+	}
+	return firstErr
+}
+
+// 推送给metas中已经保存的成员
+func PushPeerGroupMessage(members []int64, sender, deviceID int64, m *proto.Message, metas map[int64]*proto.Metadata) {
+	for _, member := range members {
+		meta, ok := metas[member]
+		if !ok {
+			continue
+		}
+		mm := &proto.Message{Cmd: m.Cmd, Version: m.Version, Flag: proto.MESSAGE_FLAG_PUSH, Body: m.Body, Meta: meta}
+		PushMessageToPeer(member, sender, deviceID, mm)
+
+		notify := &proto.Message{Cmd: proto.MSG_SYNC_NOTIFY, Body: &proto.SyncKey{SyncKey: meta.SyncKey}}
+		PushMessageToPeer(member, sender, deviceID, notify)
+	}
+}
+
+// 推送给其它im实例和当前im实例上的连接, 不发送给发送消息的设备
+func PushMessageToPeer(uid, sender, deviceID int64, msg *proto.Message) bool {
+	PublishMessage(uid, msg)
+
+	clients := route.FindClientSet(uid)
+	if len(clients) == 0 {
+		return false
+	}
+
+	for c, _ := range clients {
+		if c.deviceID == deviceID && sender == uid {
+			continue
+		}
+		c.EnqueueMessage(msg)
+	}
+	return true
+}
+
+func SaveGroupMessage( gid int64, deviceID int64, msg *proto.Message) (int64, int64, error) {
 	dc := GetGroupStorageRPCClient(gid)
 
 	gm := &GroupMessage{
 		GroupId:  gid,
 		DeviceID: deviceID,
-		Cmd:      int32(msg.cmd),
+		Cmd:      int32(msg.Cmd),
+		Version:  int32(msg.Version),
 		Raw:      msg.ToData(),
 	}
 
 	resp, err := dc.Call("SaveGroupMessage", gm)
 	if err != nil {
 		log.WithField("err", err).Warning("保存群组消息失败")
-		return 0, 0, nil
+		return 0, 0, err
 	}
 	r := resp.([2]int64)
 	msgId := r[0]
@@ -77,26 +158,25 @@ func SaveGroupMessage( gid int64, deviceID int64, msg *Message) (int64, int64, e
 	return msgId, prevMsgId, nil
 }
 
-func GetGroupStorageRPCClient(gid int64) *gorpc.DispatcherClient {
-	index := gid % int64(len(groupRpcClients))
-	return groupRpcClients[index]
+func GetGroupStorageRPCClient(gid int64) *StorageClient {
+	return groupRpcClients[groupShards.Get().Node(gid)]
 }
 
-func PublishMessage(uid int64, msg *Message) {
-	amsg := &AppMessage{receiver: uid, msg: msg}
-	if msg.meta != nil {
-		amsg.msgId = msg.meta.syncKey
-		amsg.prevMsgId = msg.meta.prevSyncKey
+func PublishMessage(uid int64, msg *proto.Message) {
+	amsg := &proto.AppMessage{Receiver: uid, Msg: msg}
+	if msg.Meta != nil {
+		amsg.MsgId = msg.Meta.SyncKey
+		amsg.PrevMsgId = msg.Meta.PrevSyncKey
 	}
 	channel := GetChannel(uid)
 	channel.Publish(amsg)
 }
 
-func PublishGroupMessage(gid int64, msg *Message) {
-	amsg := &AppMessage{receiver: gid, msg: msg}
-	if msg.meta != nil {
-		amsg.msgId = msg.meta.syncKey
-		amsg.prevMsgId = msg.meta.prevSyncKey
+func PublishGroupMessage(gid int64, msg *proto.Message) {
+	amsg := &proto.AppMessage{Receiver: gid, Msg: msg}
+	if msg.Meta != nil {
+		amsg.MsgId = msg.Meta.SyncKey
+		amsg.PrevMsgId = msg.Meta.PrevSyncKey
 	}
 	channel := GetGroupChannel(gid)
 	channel.PublishGroup(amsg)
@@ -107,7 +187,7 @@ func GetGroupChannel(gid int64) *Channel {
 	return groupRouteChannels[index]
 }
 
-func DispatchMessageToPeer(msg *Message, uid int64, client *Client) bool {
+func DispatchMessageToPeer(msg *proto.Message, uid int64, client *Client) bool {
 	clients := route.FindClientSet(uid)
 	if len(clients) == 0 {
 		return false
@@ -127,51 +207,95 @@ func GetChannel(receiver int64) *Channel {
 	return routeChannels[index]
 }
 
-func GetStorageRPCClient(uid int64) *gorpc.DispatcherClient {
-	index := uid % int64(len(rpcClients))
-	return rpcClients[index]
+func GetStorageRPCClient(uid int64) *StorageClient {
+	return rpcClients[peerShards.Get().Node(uid)]
 }
 
 func GetStorageRPCIndex(uid int64) int64 {
-	index := uid % int64(len(rpcClients))
-	return index
+	return int64(peerShards.Get().Node(uid))
+}
+
+// 迁移中的用户同时读取两台ims, 新的ims读取失败时只使用原来的ims的结果
+func LoadPeerHistory(s *SyncHistory) (*PeerHistoryMessage, error) {
+	ph := &PeerHistoryMessage{}
+	for i, node := range peerShards.Get().ReadNodes(s.UID) {
+		resp, err := rpcClients[node].CallIdempotent("SyncMessage", s)
+		if err != nil && i == 0 {
+			return nil, err
+		} else if err != nil {
+			log.WithFields(log.Fields{"uid": s.UID, "err": err}).Warning("读取迁移中的消息失败")
+			continue
+		}
+		r := resp.(*PeerHistoryMessage)
+		ph.Messages = mergeHistoryMessages(ph.Messages, r.Messages)
+		if r.LastMsgId > ph.LastMsgId {
+			ph.LastMsgId = r.LastMsgId
+		}
+		ph.HasMore = ph.HasMore || r.HasMore
+	}
+	return ph, nil
 }
 
+func LoadGroupHistory(s *SyncGroupHistory) (*GroupHistoryMessage, error) {
+	gh := &GroupHistoryMessage{}
+	for i, node := range groupShards.Get().ReadNodes(s.GroupId) {
+		resp, err := groupRpcClients[node].CallIdempotent("SyncGroupMessage", s)
+		if err != nil && i == 0 {
+			return nil, err
+		} else if err != nil {
+			log.WithFields(log.Fields{"gid": s.GroupId, "err": err}).Warning("读取迁移中的群组消息失败")
+			continue
+		}
+		r := resp.(*GroupHistoryMessage)
+		gh.Messages = mergeHistoryMessages(gh.Messages, r.Messages)
+		if r.LastMsgId > gh.LastMsgId {
+			gh.LastMsgId = r.LastMsgId
+		}
+	}
+	return gh, nil
+}
+
+// 同一个群组的消息由同一个deliver按顺序发送
 func GetGroupMessageDeliver(groupId int64) *GroupMessageDeliver {
-	deliverIndex := atomic.AddUint64(&currentDeliverIndex, 1)
-	index := deliverIndex % uint64(len(groupMessageDelivers))
+	index := uint64(groupId) % uint64(len(groupMessageDelivers))
 	return groupMessageDelivers[index]
 }
 
-func DispatchAppMessage(amsg *AppMessage) {
-	if amsg.msgId > 0 {
-		if amsg.msg.flag&MESSAGE_FLAG_PUSH == 0 {
-			log.Fatal("invalid message flag", amsg.msg.flag)
+func DispatchAppMessage(amsg *proto.AppMessage) {
+	if amsg.Msg.Cmd == proto.MSG_KICK_SESSION {
+		kick := amsg.Msg.Body.(*proto.KickSession)
+		KickLocalSession(amsg.Receiver, kick.SessionId, kick.Reason)
+		return
+	}
+
+	if amsg.MsgId > 0 {
+		if amsg.Msg.Flag&proto.MESSAGE_FLAG_PUSH == 0 {
+			log.Fatal("invalid message flag", amsg.Msg.Flag)
 		}
-		meta := &Metadata{syncKey: amsg.msgId, prevSyncKey: amsg.prevMsgId}
-		amsg.msg.meta = meta
+		meta := &proto.Metadata{SyncKey: amsg.MsgId, PrevSyncKey: amsg.PrevMsgId}
+		amsg.Msg.Meta = meta
 	}
-	DispatchMessageToPeer(amsg.msg, amsg.receiver, nil)
+	DispatchMessageToPeer(amsg.Msg, amsg.Receiver, nil)
 }
 
-func DispatchGroupMessage(amsg *AppMessage) {
-	if amsg.msgId > 0 {
-		if amsg.msg.flag&MESSAGE_FLAG_PUSH == 0 {
-			log.Fatal("invalid message flag", amsg.msg.flag)
+func DispatchGroupMessage(amsg *proto.AppMessage) {
+	if amsg.MsgId > 0 {
+		if amsg.Msg.Flag&proto.MESSAGE_FLAG_PUSH == 0 {
+			log.Fatal("invalid message flag", amsg.Msg.Flag)
 		}
-		if (amsg.msg.flag & MESSAGE_FLAG_SUPER_GROUP) == 0 {
-			log.Fatal("invalid message flag", amsg.msg.flag)
+		if (amsg.Msg.Flag & proto.MESSAGE_FLAG_SUPER_GROUP) == 0 {
+			log.Fatal("invalid message flag", amsg.Msg.Flag)
 		}
 
-		meta := &Metadata{syncKey: amsg.msgId, prevSyncKey: amsg.prevMsgId}
-		amsg.msg.meta = meta
+		meta := &proto.Metadata{SyncKey: amsg.MsgId, PrevSyncKey: amsg.PrevMsgId}
+		amsg.Msg.Meta = meta
 	}
 
-	deliver := GetGroupMessageDeliver(amsg.receiver)
+	deliver := GetGroupMessageDeliver(amsg.Receiver)
 	deliver.DispatchMessage(amsg)
 }
 
-func DispatchMessageToGroup(msg *Message, group *Group, client *Client) bool {
+func DispatchMessageToGroup(msg *proto.Message, group *Group, client *Client) bool {
 	if group == nil {
 		return false
 	}
@@ -5,6 +5,8 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/valyala/gorpc"
 	"gopkg.in/natefinch/lumberjack.v2"
+	"math/rand"
+	"os"
 	"path"
 	"time"
 )
@@ -13,18 +15,30 @@ import "github.com/gomodule/redigo/redis"
 var config *Config
 var redisPool *redis.Pool
 
-var rpcClients []*gorpc.DispatcherClient
-var groupRpcClients []*gorpc.DispatcherClient
+var rpcClients []*StorageClient
+var groupRpcClients []*StorageClient
+
+//ims的分片表, 从redis中定时加载
+var peerShards *ShardTable
+var groupShards *ShardTable
 
 var syncChan chan *SyncHistory
 var syncGroupChan chan *SyncGroupHistory
 
 //round-robin
-var currentDeliverIndex uint64
 var groupMessageDelivers []*GroupMessageDeliver
 
 var groupManager *GroupManager
 
+var rateLimiter *RateLimiter
+
+var tokenValidator TokenValidator
+
+var dedupCache *DedupCache
+
+//没有配置附件服务时为nil
+var attachmentService *AttachmentService
+
 //route server
 var routeChannels []*Channel
 var groupRouteChannels []*Channel
@@ -32,49 +46,46 @@ var route *Route
 
 func init() {
 	route = NewRoute()
+	rateLimiter = NewRateLimiter()
 	syncChan = make(chan *SyncHistory, 100)
 	syncGroupChan = make(chan *SyncGroupHistory, 100)
 }
 
 func main() {
+	rand.Seed(time.Now().UnixNano())
 	config = readConfig()
 
-	initLog()
-
 	redisPool = NewRedisPool(config.redisAddress, config.redisPassword, config.redisDB)
+	if len(os.Args) > 1 && os.Args[1] == "shard" {
+		os.Exit(ShardMain(os.Args[2:]))
+	}
 
-	rpcClients = make([]*gorpc.DispatcherClient, 0)
-
-	if len(config.storageRpcAddrs) > 0 {
-		for _, addr := range config.storageRpcAddrs {
-			c := &gorpc.Client{Conns: 4, Addr: addr}
-			c.Start()
-
-			dispatcher := gorpc.NewDispatcher()
-			dispatcher.AddFunc("SyncMessage", SyncMessageInterface)
-			dispatcher.AddFunc("SavePeerMessage", SavePeerMessageInterface)
-			dispatcher.AddFunc("SavePeerGroupMessage", SavePeerGroupMessageInterface)
+	initLog()
 
-			dc := dispatcher.NewFuncClient(c)
-			rpcClients = append(rpcClients, dc)
-		}
+	var err error
+	tokenValidator, err = NewTokenValidator(config)
+	if err != nil {
+		log.WithField("err", err).Fatal("初始化token验证失败")
 	}
 
-	if len(config.groupStorageRpcAddrs) > 0 {
-		groupRpcClients = make([]*gorpc.DispatcherClient, 0)
-		for _, addr := range config.groupStorageRpcAddrs {
-			c := &gorpc.Client{
-				Addr:  addr,
-				Conns: 4,
-			}
-			c.Start()
+	dedupCache = NewDedupCache(config.dedupCacheSize, time.Duration(config.dedupTTL)*time.Second)
 
-			dispatcher := gorpc.NewDispatcher()
-			dispatcher.AddFunc("SaveGroupMessage", SaveGroupMessageInterface)
+	rpcClients = NewStorageRPCClients(config.storageRpcAddrs)
+	groupRpcClients = NewGroupStorageRPCClients(config.groupStorageRpcAddrs)
 
-			dc := dispatcher.NewFuncClient(c)
-			groupRpcClients = append(groupRpcClients, dc)
+	peerShards = NewShardTable(PEER_SHARD_KEY, len(rpcClients))
+	groupShards = NewShardTable(GROUP_SHARD_KEY, len(groupRpcClients))
+	hostname, _ := os.Hostname()
+	for _, t := range []*ShardTable{peerShards, groupShards} {
+		if t.nodes == 0 {
+			continue
 		}
+		t.instance = fmt.Sprintf("%s:%d", hostname, config.port)
+		//分片表已经修改过时按照默认的分配会找不到迁移过的消息
+		if err := t.Reload(); err != nil {
+			log.WithFields(log.Fields{"key": t.key, "err": err}).Fatal("加载ims分片表失败")
+		}
+		go t.ReloadLoop()
 	}
 
 	if len(config.routeAddrs) > 0 {
@@ -112,10 +123,75 @@ func main() {
 	}
 	go SyncKeyService()
 
-	ListenClient(config.port)
+	if len(config.httpListenAddress) > 0 && len(config.httpAdminSecret) > 0 {
+		go StartHttpServer(config.httpListenAddress, config.httpAdminSecret)
+	} else if len(config.httpListenAddress) > 0 {
+		log.Warning("没有配置管理接口的密钥, 不启动管理接口")
+	}
+
+	if len(config.attachmentListenAddress) > 0 {
+		store, err := NewAttachmentStore(config)
+		if err != nil {
+			log.WithField("err", err).Fatal("初始化附件存储失败")
+		}
+		attachmentService = NewAttachmentService(config, store)
+		go StartAttachmentServer(config.attachmentListenAddress, attachmentService)
+		go attachmentService.RecycleLoop()
+	}
+
+	go rateLimiter.RecycleLoop()
+
+	go ListenClient(config.port)
+
+	WaitSignal()
+	Shutdown()
 	log.Info("exit")
 }
 
+func NewStorageRPCClients(addrs []string) []*StorageClient {
+	clients := make([]*StorageClient, 0, len(addrs))
+	for _, addr := range addrs {
+		dispatcher := gorpc.NewDispatcher()
+		dispatcher.AddFunc("SyncMessage", SyncMessageInterface)
+		dispatcher.AddFunc("SavePeerMessage", SavePeerMessageInterface)
+		dispatcher.AddFunc("SavePeerGroupMessage", SavePeerGroupMessageInterface)
+		dispatcher.AddFunc("SearchMessages", SearchMessagesInterface)
+		dispatcher.AddFunc("ExpireMessage", ExpireMessageInterface)
+		addMigrateFuncs(dispatcher)
+
+		clients = append(clients, newStorageClient(addr, dispatcher))
+	}
+	return clients
+}
+
+func NewGroupStorageRPCClients(addrs []string) []*StorageClient {
+	clients := make([]*StorageClient, 0, len(addrs))
+	for _, addr := range addrs {
+		dispatcher := gorpc.NewDispatcher()
+		dispatcher.AddFunc("SaveGroupMessage", SaveGroupMessageInterface)
+		dispatcher.AddFunc("SyncGroupMessage", SyncGroupMessageInterface)
+		dispatcher.AddFunc("SearchMessages", SearchMessagesInterface)
+		addMigrateFuncs(dispatcher)
+
+		clients = append(clients, newStorageClient(addr, dispatcher))
+	}
+	return clients
+}
+
+func newStorageClient(addr string, dispatcher *gorpc.Dispatcher) *StorageClient {
+	breaker := NewCircuitBreaker(config.storageBreakerFailures, time.Duration(config.storageBreakerCooldown)*time.Second)
+	timeout := time.Duration(config.storageCallTimeout) * time.Millisecond
+	return NewStorageClient(addr, dispatcher, timeout, config.storageSyncRetries, breaker)
+}
+
+// 迁移工具使用的接口
+func addMigrateFuncs(dispatcher *gorpc.Dispatcher) {
+	dispatcher.AddFunc("ExportMessages", ExportMessagesInterface)
+	dispatcher.AddFunc("ImportMessages", ImportMessagesInterface)
+	dispatcher.AddFunc("FreezeMessages", FreezeMessagesInterface)
+	dispatcher.AddFunc("ListIds", ListIdsInterface)
+}
+
 func NewRedisPool(server, password string, db int) *redis.Pool {
 	return &redis.Pool{
 		MaxIdle:     100,
@@ -1,6 +1,10 @@
 package main
 
-import log "github.com/sirupsen/logrus"
+import (
+	log "github.com/sirupsen/logrus"
+	"sx-chat/proto"
+	"time"
+)
 
 type PeerClient struct {
 	*Connection
@@ -11,19 +15,21 @@ func (client *PeerClient) Login() {
 	channel.Subscribe(client.uid, client.online)
 }
 
-func (client *PeerClient) HandleMessage(msg *Message) {
-	switch msg.cmd {
-	case MSG_IM:
+func (client *PeerClient) HandleMessage(msg *proto.Message) {
+	switch msg.Cmd {
+	case proto.MSG_IM:
 		client.HandleIMMessage(msg)
-	case MSG_SYNC:
-		client.HandleSync(msg.body.(*SyncKey))
-	case MSG_SYNC_KEY: //客服端->服务端,更新服务器的syncKey
-		client.HandleSyncKey(msg.body.(*SyncKey))
+	case proto.MSG_SYNC:
+		client.HandleSync(msg.Seq, msg.Body.(*proto.SyncKey))
+	case proto.MSG_SYNC_KEY: //客服端->服务端,更新服务器的syncKey
+		client.HandleSyncKey(msg.Body.(*proto.SyncKey))
+	case proto.MSG_MESSAGE_READ:
+		client.HandleMessageRead(msg.Body.(*proto.SyncKey))
 	}
 }
 
-func (client *PeerClient) HandleSyncKey(syncKey *SyncKey) {
-	lastId := syncKey.syncKey
+func (client *PeerClient) HandleSyncKey(syncKey *proto.SyncKey) {
+	lastId := syncKey.SyncKey
 	log.WithFields(log.Fields{
 		"uid":      client.uid,
 		"deviceID": client.deviceID,
@@ -39,15 +45,15 @@ func (client *PeerClient) HandleSyncKey(syncKey *SyncKey) {
 	}
 }
 
-func (client *PeerClient) HandleSync(syncKey *SyncKey) {
-	lastId := syncKey.syncKey
-
-	rpc := GetStorageRPCClient(client.uid)
+// 读取ims失败时发送失败的ack, 客户端稍后重新同步
+func (client *PeerClient) HandleSync(seq int, syncKey *proto.SyncKey) {
+	lastId := syncKey.SyncKey
 
 	s := &SyncHistory{
 		UID:       client.uid,
 		DeviceID:  client.deviceID,
 		LastMsgID: lastId,
+		Version:   int32(client.version),
 	}
 
 	log.WithFields(log.Fields{
@@ -56,72 +62,126 @@ func (client *PeerClient) HandleSync(syncKey *SyncKey) {
 		"lastId":   lastId,
 	}).Info("syncing message")
 
-	resp, err := rpc.Call("SyncMessage", s)
+	ph, err := LoadPeerHistory(s)
 	if err != nil {
 		log.WithField("err", err).Warning("sync message")
+		client.sendACK(seq, storageACKStatus(err))
 		return
 	}
 
-	ph := resp.(*PeerHistoryMessage)
 	messages := ph.Messages
 
-	msgs := make([]*Message, 0, len(messages)+2)
+	msgs := make([]*proto.Message, 0, len(messages)+2)
 
-	sk := &SyncKey{syncKey: lastId}
-	msgs = append(msgs, &Message{cmd: MSG_SYNC_BEGIN, body: sk})
+	sk := &proto.SyncKey{SyncKey: lastId}
+	msgs = append(msgs, &proto.Message{Cmd: proto.MSG_SYNC_BEGIN, Body: sk})
 
 	for i := len(messages) - 1; i >= 0; i-- {
 		msg := messages[i]
-		log.Info("message:", msg.MsgID, Command(msg.Cmd))
-		m := &Message{cmd: int(msg.Cmd), version: DEFAULT_VERSION}
-		m.FromData(msg.Raw)
-		sk.syncKey = msg.MsgID
+		log.Info("message:", msg.MsgID, proto.Command(msg.Cmd))
+		m := &proto.Message{Cmd: int(msg.Cmd), Version: client.version}
+		if !m.FromData(msg.Raw) {
+			log.WithFields(log.Fields{"msgId": msg.MsgID, "cmd": msg.Cmd}).Warning("解析历史消息失败")
+			continue
+		}
+		sk.SyncKey = msg.MsgID
 		msgs = append(msgs, m)
 	}
 
-	msgs = append(msgs, &Message{cmd: MSG_SYNC_END, body: sk})
+	msgs = append(msgs, &proto.Message{Cmd: proto.MSG_SYNC_END, Body: sk})
 
 	client.EnqueueMessages(msgs)
 
 	if ph.HasMore {
-		notify := &Message{cmd: MSG_SYNC_NOTIFY, body: &SyncKey{ph.LastMsgId + 1}}
+		notify := &proto.Message{Cmd: proto.MSG_SYNC_NOTIFY, Body: &proto.SyncKey{SyncKey: ph.LastMsgId + 1}}
 		client.EnqueueMessage(notify)
 	}
 }
 
-func (client *PeerClient) HandleIMMessage(message *Message) {
-	msg := message.body.(*IMMessage)
-	seq := message.seq
+func (client *PeerClient) HandleIMMessage(message *proto.Message) {
+	msg := message.Body.(*proto.IMMessage)
+	seq := message.Seq
 
-	m := &Message{cmd: MSG_IM, version: DEFAULT_VERSION, body: msg}
-	msgId, prevMsgId, err := SaveMessage(msg.receiver, client.deviceID, m)
-	if err != nil {
-		log.WithFields(log.Fields{"sender": msg.sender, "receiver": msg.receiver, "err": err}).Error("保存peer消息失败")
+	//发送者和时间都以服务端为准
+	msg.Sender = client.uid
+	msg.Timestamp = int32(time.Now().Unix())
+
+	if !client.checkContent(seq, msg) || !client.checkExpire(seq, msg, false) {
 		return
 	}
 
+	var entry *dedupEntry
+	if msg.ClientMsgId != "" {
+		var dup bool
+		entry, dup = dedupCache.Begin(msg.Sender, msg.ClientMsgId)
+		if dup {
+			client.ackDuplicate(seq, msg, entry)
+			return
+		}
+	}
+
+	m := &proto.Message{Cmd: proto.MSG_IM, Version: msg.MinVersion(), Body: msg}
+	var msgId, prevMsgId int64
+	var saved *proto.Metadata
+	var savedTimestamp int32
+	if entry != nil {
+		saved, savedTimestamp = dedupCache.Saved(entry)
+	}
+	if saved != nil {
+		//上次只保存了接收者的消息, 发送者的消息使用相同的时间
+		msgId, prevMsgId = saved.SyncKey, saved.PrevSyncKey
+		msg.Timestamp = savedTimestamp
+	} else {
+		var err error
+		msgId, prevMsgId, err = SaveMessage(msg.Receiver, client.deviceID, m)
+		if err != nil {
+			log.WithFields(log.Fields{"sender": msg.Sender, "receiver": msg.Receiver, "err": err}).Error("保存peer消息失败")
+			if entry != nil {
+				dedupCache.Abort(msg.Sender, msg.ClientMsgId, entry)
+			}
+			client.sendACK(seq, storageACKStatus(err))
+			return
+		}
+		if entry != nil {
+			dedupCache.SetSaved(entry, &proto.Metadata{SyncKey: msgId, PrevSyncKey: prevMsgId}, msg.Timestamp)
+		}
+	}
+
 	// 保存到自己的消息队列，用户的其他登录点也能接受到自己发出的消息
-	msgId2, prevMsgId2, err := SaveMessage(msg.sender, client.deviceID, m)
+	msgId2, prevMsgId2, err := SaveMessage(msg.Sender, client.deviceID, m)
 	if err != nil {
-		log.WithFields(log.Fields{"sender": msg.sender, "receiver": msg.receiver, "err": err}).Error("保存peer消息失败")
+		log.WithFields(log.Fields{"sender": msg.Sender, "receiver": msg.Receiver, "err": err}).Error("保存peer消息失败")
+		if entry != nil {
+			dedupCache.Abort(msg.Sender, msg.ClientMsgId, entry)
+		}
+		client.sendACK(seq, storageACKStatus(err))
 		return
 	}
 
+	if msg.BurnAfterRead {
+		if err := saveBurnMessage(msg, msgId, msgId2); err != nil {
+			log.WithFields(log.Fields{"sender": msg.Sender, "receiver": msg.Receiver, "err": err}).Error("保存阅后即焚的记录失败")
+		}
+	}
+
 	// 推送给接受方
-	meta := &Metadata{syncKey: msgId, prevSyncKey: prevMsgId}
-	m1 := &Message{cmd: MSG_IM, version: DEFAULT_VERSION, flag: message.flag | MESSAGE_FLAG_PUSH, body: msg, meta: meta}
-	client.SendMessage(msg.receiver, m1)
-	notify := &Message{cmd: MSG_SYNC_NOTIFY, body: &SyncKey{syncKey: msgId}}
-	client.SendMessage(msg.receiver, notify)
+	meta := &proto.Metadata{SyncKey: msgId, PrevSyncKey: prevMsgId}
+	m1 := &proto.Message{Cmd: proto.MSG_IM, Version: msg.MinVersion(), Flag: message.Flag | proto.MESSAGE_FLAG_PUSH, Body: msg, Meta: meta}
+	client.SendMessage(msg.Receiver, m1)
+	notify := &proto.Message{Cmd: proto.MSG_SYNC_NOTIFY, Body: &proto.SyncKey{SyncKey: msgId}}
+	client.SendMessage(msg.Receiver, notify)
 
 	// 给发送发发送ack
-	meta = &Metadata{syncKey: msgId2, prevSyncKey: prevMsgId2}
-	ack := &Message{cmd: MSG_ACK, body: &MessageACK{seq: int32(seq)}, meta: meta}
+	meta = &proto.Metadata{SyncKey: msgId2, PrevSyncKey: prevMsgId2}
+	if entry != nil {
+		dedupCache.Finish(entry, meta)
+	}
+	ack := &proto.Message{Cmd: proto.MSG_ACK, Body: &proto.MessageACK{Seq: int32(seq)}, Meta: meta}
 	r := client.EnqueueMessage(ack)
 	if !r {
 		log.Warning("发送peer message ack失败")
 	}
-	log.WithFields(log.Fields{"sender": msg.sender, "receiver": msg.receiver, "msgId": msgId}).Infof("保存peer消息成功")
+	log.WithFields(log.Fields{"sender": msg.Sender, "receiver": msg.Receiver, "msgId": msgId}).Infof("保存peer消息成功")
 }
 
 func (client *PeerClient) Logout() {
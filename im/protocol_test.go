@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sx-chat/proto"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+func FuzzReceiveLimitMessage(f *testing.F) {
+	seeds := []*proto.Message{
+		{Cmd: proto.MSG_PING},
+		{Cmd: proto.MSG_AUTH_TOKEN, Body: &proto.AuthenticationToken{Token: "token", PlatformId: proto.PLATFORM_IOS, DeviceId: "device"}},
+		{Cmd: proto.MSG_IM, Version: 2, Body: &proto.IMMessage{Sender: 1, Receiver: 2, Content: "hello"}},
+		{Cmd: proto.MSG_PENDING_GROUP_MESSAGE, Body: &PendingGroupMessage{members: []int64{1, 2}, content: "c"}},
+	}
+	for _, m := range seeds {
+		f.Add(proto.EncodeMessage(m))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := proto.ReceiveLimitMessage(bytes.NewReader(data), 32*1024, true)
+		if err != nil {
+			return
+		}
+		// 解析成功的消息重新编码之后必须还能解析
+		buf := proto.EncodeMessage(m)
+		if _, err := proto.DecodeMessage(buf, len(buf)); err != nil {
+			t.Fatalf("re-decode cmd:%d err:%s", m.Cmd, err)
+		}
+	})
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+	"sx-chat/proto"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//限流的请求类型
+const RATE_SEND = 0 //发送消息和群组管理命令
+const RATE_SYNC = 1 //同步消息和查询登录设备
+const RATE_PING = 2
+const RATE_CLASS_COUNT = 3
+
+const DEFAULT_RATE_TIER = "default"
+
+//群组的限流状态超过这个时间没有使用之后回收
+const GROUP_LIMIT_IDLE = 5 * time.Minute
+
+// 令牌桶的速率和容量, Rate为0表示不限制
+type RateLimit struct {
+	Rate  float64 //每秒补充的令牌数
+	Burst int
+}
+
+// 一类用户的限流配置, 用户的等级保存在redis的users_{uid}.rate_tier
+type RateLimitTier struct {
+	conn [RATE_CLASS_COUNT]RateLimit //单个连接
+	user [RATE_CLASS_COUNT]RateLimit //同一个用户在当前im实例上的所有连接
+}
+
+// 调用者负责加锁
+type TokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(limit RateLimit, now time.Time) *TokenBucket {
+	return &TokenBucket{limit: limit, tokens: float64(limit.Burst), last: now}
+}
+
+func (b *TokenBucket) Allow(now time.Time) bool {
+	if b.limit.Rate <= 0 {
+		return true
+	}
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+		if b.tokens > float64(b.limit.Burst) {
+			b.tokens = float64(b.limit.Burst)
+		}
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// 限流的计数, 通过http接口查询
+type RateLimitStats struct {
+	Limited      [RATE_CLASS_COUNT]int64 //按照请求类型
+	UserLimited  int64                   //超过用户的限制
+	GroupLimited int64                   //超过群组的限制
+	Disconnected int64                   //多次超过限制被断开的连接
+}
+
+var rateLimitStats RateLimitStats
+
+func GetRateLimitStats() map[string]interface{} {
+	return map[string]interface{}{
+		"send_limited":  atomic.LoadInt64(&rateLimitStats.Limited[RATE_SEND]),
+		"sync_limited":  atomic.LoadInt64(&rateLimitStats.Limited[RATE_SYNC]),
+		"ping_limited":  atomic.LoadInt64(&rateLimitStats.Limited[RATE_PING]),
+		"user_limited":  atomic.LoadInt64(&rateLimitStats.UserLimited),
+		"group_limited": atomic.LoadInt64(&rateLimitStats.GroupLimited),
+		"disconnected":  atomic.LoadInt64(&rateLimitStats.Disconnected),
+	}
+}
+
+// 单个连接的限流状态, 只在连接的读协程中使用
+type ConnectionLimiter struct {
+	buckets [RATE_CLASS_COUNT]*TokenBucket
+
+	//最近一个窗口内超过限制的次数
+	violations  int
+	windowStart time.Time
+}
+
+func NewConnectionLimiter(tier *RateLimitTier, now time.Time) *ConnectionLimiter {
+	limiter := &ConnectionLimiter{windowStart: now}
+	for i := 0; i < RATE_CLASS_COUNT; i++ {
+		limiter.buckets[i] = NewTokenBucket(tier.conn[i], now)
+	}
+	return limiter
+}
+
+// 记录一次超过限制, 返回是否需要断开连接
+func (limiter *ConnectionLimiter) Violate(now time.Time) bool {
+	window := time.Duration(config.rateLimitWindow) * time.Second
+	if now.Sub(limiter.windowStart) > window {
+		limiter.windowStart = now
+		limiter.violations = 0
+	}
+	limiter.violations++
+	return config.rateLimitViolations > 0 && limiter.violations >= config.rateLimitViolations
+}
+
+type UserLimiter struct {
+	buckets [RATE_CLASS_COUNT]*TokenBucket
+	refs    int //当前im实例上这个用户的连接数量
+}
+
+type groupLimiter struct {
+	bucket *TokenBucket
+	last   time.Time
+}
+
+// 用户和群组的限流状态, 只在当前im实例内共享
+type RateLimiter struct {
+	mutex  sync.Mutex
+	users  map[int64]*UserLimiter
+	groups map[int64]*groupLimiter
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		users:  make(map[int64]*UserLimiter),
+		groups: make(map[int64]*groupLimiter),
+	}
+}
+
+// 用户登录之后获取, 连接关闭时释放
+func (r *RateLimiter) AcquireUser(uid int64, tier *RateLimitTier) *UserLimiter {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	u, ok := r.users[uid]
+	if !ok {
+		now := time.Now()
+		u = &UserLimiter{}
+		for i := 0; i < RATE_CLASS_COUNT; i++ {
+			u.buckets[i] = NewTokenBucket(tier.user[i], now)
+		}
+		r.users[uid] = u
+	}
+	u.refs++
+	return u
+}
+
+func (r *RateLimiter) ReleaseUser(uid int64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	u, ok := r.users[uid]
+	if !ok {
+		return
+	}
+	u.refs--
+	if u.refs <= 0 {
+		delete(r.users, uid)
+	}
+}
+
+func (r *RateLimiter) AllowUser(u *UserLimiter, class int, now time.Time) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return u.buckets[class].Allow(now)
+}
+
+func (r *RateLimiter) AllowGroup(gid int64, now time.Time) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	g, ok := r.groups[gid]
+	if !ok {
+		g = &groupLimiter{bucket: NewTokenBucket(config.groupSendLimit, now)}
+		r.groups[gid] = g
+	}
+	g.last = now
+	return g.bucket.Allow(now)
+}
+
+// 回收长时间没有发送消息的群组
+func (r *RateLimiter) RecycleLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		r.mutex.Lock()
+		for gid, g := range r.groups {
+			if now.Sub(g.last) > GROUP_LIMIT_IDLE {
+				delete(r.groups, gid)
+			}
+		}
+		r.mutex.Unlock()
+	}
+}
+
+func GetRateLimitTier(name string) *RateLimitTier {
+	if tier, ok := config.rateLimitTiers[name]; ok {
+		return tier
+	}
+	return config.rateLimitTiers[DEFAULT_RATE_TIER]
+}
+
+func LoadUserRateTier(uid int64) string {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	key := fmt.Sprintf("users_%d", uid)
+	tier, err := redis.String(conn.Do("HGET", key, "rate_tier"))
+	if err != nil {
+		if err != redis.ErrNil {
+			log.WithFields(log.Fields{"uid": uid, "err": err}).Warning("查询用户限流等级失败")
+		}
+		return DEFAULT_RATE_TIER
+	}
+	return tier
+}
+
+func rateClass(cmd int) int {
+	switch cmd {
+	case proto.MSG_IM, proto.MSG_GROUP_IM, proto.MSG_GROUP_COMMAND, proto.MSG_MESSAGE_READ:
+		return RATE_SEND
+	case proto.MSG_SYNC, proto.MSG_SYNC_GROUP, proto.MSG_LOAD_DEVICES, proto.MSG_SEARCH:
+		return RATE_SYNC
+	case proto.MSG_PING:
+		return RATE_PING
+	}
+	return -1
+}
+
+// 依次检查连接, 用户和群组的限制
+// 超过限制时返回否定的ack, 一个窗口内多次超过限制的连接被断开
+func (client *Client) checkRateLimit(msg *proto.Message) bool {
+	class := rateClass(msg.Cmd)
+	if class == -1 {
+		return true
+	}
+
+	now := time.Now()
+	allowed := client.limiter.buckets[class].Allow(now)
+	if allowed && client.userLimiter != nil && !rateLimiter.AllowUser(client.userLimiter, class, now) {
+		atomic.AddInt64(&rateLimitStats.UserLimited, 1)
+		allowed = false
+	}
+	if allowed && msg.Cmd == proto.MSG_GROUP_IM {
+		gid := msg.Body.(*proto.IMMessage).Receiver
+		if !rateLimiter.AllowGroup(gid, now) {
+			atomic.AddInt64(&rateLimitStats.GroupLimited, 1)
+			allowed = false
+		}
+	}
+	if allowed {
+		return true
+	}
+
+	atomic.AddInt64(&rateLimitStats.Limited[class], 1)
+	ack := &proto.Message{Cmd: proto.MSG_ACK, Body: &proto.MessageACK{Seq: int32(msg.Seq), Status: proto.ACK_RATE_LIMITED}}
+	client.EnqueueMessage(ack)
+
+	if client.limiter.Violate(now) {
+		atomic.AddInt64(&rateLimitStats.Disconnected, 1)
+		log.WithFields(log.Fields{"uid": client.uid, "cmd": msg.Cmd}).Warning("多次超过限流, 断开连接")
+		client.close()
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := NewTokenBucket(RateLimit{Rate: 2, Burst: 3}, now)
+	for i := 0; i < 3; i++ {
+		if !b.Allow(now) {
+			t.Fatalf("burst %d", i)
+		}
+	}
+	if b.Allow(now) {
+		t.Fatal("allowed over burst")
+	}
+
+	//每秒补充2个令牌, 不超过容量
+	now = now.Add(500 * time.Millisecond)
+	if !b.Allow(now) || b.Allow(now) {
+		t.Fatal("refill")
+	}
+	now = now.Add(time.Hour)
+	n := 0
+	for b.Allow(now) {
+		n++
+	}
+	if n != 3 {
+		t.Fatalf("refill over burst:%d", n)
+	}
+
+	unlimited := NewTokenBucket(RateLimit{}, now)
+	for i := 0; i < 100; i++ {
+		if !unlimited.Allow(now) {
+			t.Fatal("zero rate should be unlimited")
+		}
+	}
+}
+
+func TestConnectionLimiterViolate(t *testing.T) {
+	old := config
+	config = &Config{rateLimitViolations: 3, rateLimitWindow: 10}
+	defer func() { config = old }()
+
+	now := time.Now()
+	limiter := NewConnectionLimiter(&RateLimitTier{}, now)
+	if limiter.Violate(now) || limiter.Violate(now) {
+		t.Fatal("disconnect before threshold")
+	}
+
+	//窗口过期之后重新计数
+	now = now.Add(11 * time.Second)
+	if limiter.Violate(now) || limiter.Violate(now) {
+		t.Fatal("window not reset")
+	}
+	if !limiter.Violate(now) {
+		t.Fatal("threshold")
+	}
+}
+
+func TestRateLimiterUserRefs(t *testing.T) {
+	r := NewRateLimiter()
+	tier := &RateLimitTier{}
+	u1 := r.AcquireUser(1, tier)
+	u2 := r.AcquireUser(1, tier)
+	if u1 != u2 {
+		t.Fatal("devices of the same user should share limiter")
+	}
+	r.ReleaseUser(1)
+	if _, ok := r.users[1]; !ok {
+		t.Fatal("released while still referenced")
+	}
+	r.ReleaseUser(1)
+	if _, ok := r.users[1]; ok {
+		t.Fatal("not released")
+	}
+}
@@ -53,3 +53,22 @@ func (r *Route) FindClientSet(uid int64) ClientSet {
 	}
 	return nil
 }
+
+// 持有锁时调用f, f不能阻塞
+// 连接从route中删除之后才会关闭wt, 所以f中可以安全的向wt写入
+func (r *Route) ForEachClient(f func(*Client)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, set := range r.clients {
+		for c := range set {
+			f(c)
+		}
+	}
+}
+
+func (r *Route) GetUserCount() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.clients)
+}
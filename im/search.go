@@ -0,0 +1,69 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sx-chat/proto"
+)
+
+// 在ims中搜索历史消息, 超级群的消息在群组的ims中搜索, 其它消息在用户自己的收件箱中搜索
+// 搜索到的消息逐条发送MSG_SEARCH_HIT, 最后发送MSG_SEARCH_END
+func (client *Client) HandleSearch(message *proto.Message) {
+	q := message.Body.(*proto.SearchQuery)
+	seq := int32(message.Seq)
+
+	if strings.TrimSpace(q.Query) == "" {
+		client.sendSearchEnd(&proto.SearchEnd{Seq: seq, Status: proto.ACK_INVALID_QUERY})
+		return
+	}
+
+	req := &SearchRequest{
+		UID:         client.uid,
+		PeerUID:     q.PeerUid,
+		GroupId:     q.GroupId,
+		BeforeMsgId: q.BeforeMsgId,
+		Limit:       q.Limit,
+		Version:     int32(client.version),
+		Query:       q.Query,
+	}
+
+	rpc := GetStorageRPCClient(client.uid)
+	if q.GroupId != 0 {
+		group := groupManager.LoadGroup(q.GroupId)
+		if group == nil {
+			client.sendSearchEnd(&proto.SearchEnd{Seq: seq, Status: proto.ACK_GROUP_NONEXIST})
+			return
+		}
+		if !group.IsMember(client.uid) {
+			client.sendSearchEnd(&proto.SearchEnd{Seq: seq, Status: proto.ACK_NOT_GROUP_MEMBER})
+			return
+		}
+		//只能搜索到入群之后的消息
+		req.Timestamp = int32(group.GetMemberTimestamp(client.uid))
+		if group.super {
+			req.Super = true
+			rpc = GetGroupStorageRPCClient(q.GroupId)
+		}
+	}
+
+	resp, err := rpc.CallIdempotent("SearchMessages", req)
+	if err != nil {
+		log.WithFields(log.Fields{"uid": client.uid, "err": err}).Warning("搜索消息失败")
+		client.sendSearchEnd(&proto.SearchEnd{Seq: seq, Status: storageACKStatus(err)})
+		return
+	}
+	result := resp.(*SearchResult)
+
+	msgs := make([]*proto.Message, 0, len(result.Messages))
+	for _, hm := range result.Messages {
+		hit := &proto.SearchHit{Seq: seq, MsgId: hm.MsgID, Cmd: hm.Cmd, Raw: hm.Raw}
+		msgs = append(msgs, &proto.Message{Cmd: proto.MSG_SEARCH_HIT, Body: hit})
+	}
+	client.EnqueueMessages(msgs)
+	client.sendSearchEnd(&proto.SearchEnd{Seq: seq, HasMore: result.HasMore, NextMsgId: result.NextMsgId})
+	log.WithFields(log.Fields{"uid": client.uid, "peer": q.PeerUid, "gid": q.GroupId, "count": len(msgs)}).Info("搜索消息")
+}
+
+func (client *Client) sendSearchEnd(end *proto.SearchEnd) {
+	client.EnqueueMessage(&proto.Message{Cmd: proto.MSG_SEARCH_END, Body: end})
+}
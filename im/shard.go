@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ims的分片表保存在redis中, 运行时修改之后所有的im定时重新加载
+// id % len(buckets)得到bucket, bucket的值是storageRpcAddrs(超级群是groupStorageRpcAddrs)中的序号
+// redis中没有分片表时buckets是[0, 1, ..., n-1], 和之前uid % n的分配方式一致
+// 增加ims时先把bucket的数量扩大整数倍(分配不变), 再用迁移工具把bucket迁移到新的ims
+//
+// redis中的格式:
+// {key} hash: version 每次修改加1, buckets 逗号分隔的序号
+// {key}_moves hash: id -> "from,to,state" 正在迁移或者已经迁移但是bucket还没有修改的用户或者群组
+//   迁移回bucket所在的ims或者bucket迁移到同一台ims时删除
+// {key}_loaded hash: im -> "version,time" 每个im最后一次检查时使用的版本, 迁移工具等待所有的im加载新的版本
+const PEER_SHARD_KEY = "ims_shards"
+const GROUP_SHARD_KEY = "ims_group_shards"
+
+//重新加载分片表的间隔
+const SHARD_RELOAD_INTERVAL = 5 * time.Second
+
+//超过这个时间没有更新{key}_loaded的im认为已经停止
+const SHARD_INSTANCE_TTL = time.Minute
+
+const (
+	SHARD_MOVE_COPYING = "copying" //写入原来的ims, 同时读取两台ims
+	SHARD_MOVE_DONE    = "done"    //读写都使用新的ims
+)
+
+type ShardMove struct {
+	From  int
+	To    int
+	State string
+}
+
+// 加载之后不再修改, 重新加载时整个替换
+type ShardMap struct {
+	version int64
+	buckets []int
+	moves   map[int64]*ShardMove
+}
+
+func DefaultShardMap(nodes int) *ShardMap {
+	buckets := make([]int, nodes)
+	for i := range buckets {
+		buckets[i] = i
+	}
+	return &ShardMap{buckets: buckets, moves: make(map[int64]*ShardMove)}
+}
+
+func (m *ShardMap) Bucket(id int64) int {
+	return int(uint64(id) % uint64(len(m.buckets)))
+}
+
+// 保存消息使用的ims
+func (m *ShardMap) Node(id int64) int {
+	if move, ok := m.moves[id]; ok {
+		if move.State == SHARD_MOVE_DONE {
+			return move.To
+		}
+		return move.From
+	}
+	return m.buckets[m.Bucket(id)]
+}
+
+// 同步消息使用的ims, 迁移中的用户或者群组读取两台ims之后合并, 第一个是保存消息的ims
+func (m *ShardMap) ReadNodes(id int64) []int {
+	if move, ok := m.moves[id]; ok && move.State == SHARD_MOVE_COPYING {
+		return []int{move.From, move.To}
+	}
+	return []int{m.Node(id)}
+}
+
+func (m *ShardMap) encodeBuckets() string {
+	s := make([]string, len(m.buckets))
+	for i, node := range m.buckets {
+		s[i] = strconv.Itoa(node)
+	}
+	return strings.Join(s, ",")
+}
+
+func encodeShardMove(move *ShardMove) string {
+	return fmt.Sprintf("%d,%d,%s", move.From, move.To, move.State)
+}
+
+func parseShardMove(value string, nodes int) (*ShardMove, error) {
+	fields := strings.Split(value, ",")
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("invalid shard move:%s", value)
+	}
+	from, err1 := strconv.Atoi(fields[0])
+	to, err2 := strconv.Atoi(fields[1])
+	if err1 != nil || err2 != nil || from < 0 || from >= nodes || to < 0 || to >= nodes ||
+		(fields[2] != SHARD_MOVE_COPYING && fields[2] != SHARD_MOVE_DONE) {
+		return nil, fmt.Errorf("invalid shard move:%s", value)
+	}
+	return &ShardMove{From: from, To: to, State: fields[2]}, nil
+}
+
+// 从redis中读取分片表, 分片表中的序号超过nodes时返回错误, 避免配置的ims数量和分片表不一致
+func LoadShardMap(conn redis.Conn, key string, nodes int) (*ShardMap, error) {
+	values, err := redis.StringMap(conn.Do("HGETALL", key))
+	if err != nil {
+		return nil, err
+	}
+	m := DefaultShardMap(nodes)
+	m.version, _ = strconv.ParseInt(values["version"], 10, 64)
+	if s := values["buckets"]; s != "" {
+		fields := strings.Split(s, ",")
+		m.buckets = make([]int, len(fields))
+		for i, f := range fields {
+			node, err := strconv.Atoi(f)
+			if err != nil || node < 0 || node >= nodes {
+				return nil, fmt.Errorf("invalid shard bucket:%d node:%s nodes:%d", i, f, nodes)
+			}
+			m.buckets[i] = node
+		}
+	}
+
+	moves, err := redis.StringMap(conn.Do("HGETALL", key+"_moves"))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range moves {
+		id, err := strconv.ParseInt(k, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shard move id:%s", k)
+		}
+		move, err := parseShardMove(v, nodes)
+		if err != nil {
+			return nil, err
+		}
+		m.moves[id] = move
+	}
+	return m, nil
+}
+
+// 当前使用的分片表
+type ShardTable struct {
+	key   string
+	nodes int
+
+	//记录在{key}_loaded中的名称, 为空时不记录
+	instance string
+
+	mutex sync.RWMutex
+	m     *ShardMap
+}
+
+func NewShardTable(key string, nodes int) *ShardTable {
+	return &ShardTable{key: key, nodes: nodes, m: DefaultShardMap(nodes)}
+}
+
+func (t *ShardTable) Get() *ShardMap {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.m
+}
+
+// 版本号没有变化时不重新读取, 每次都在{key}_loaded中记录当前的版本
+func (t *ShardTable) Reload() error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	version, err := redis.Int64(conn.Do("HGET", t.key, "version"))
+	if err == redis.ErrNil {
+		version, err = 0, nil
+	}
+	if err != nil {
+		return err
+	}
+	if version != t.Get().version {
+		m, err := LoadShardMap(conn, t.key, t.nodes)
+		if err != nil {
+			return err
+		}
+		t.mutex.Lock()
+		t.m = m
+		t.mutex.Unlock()
+		log.WithFields(log.Fields{"key": t.key, "version": m.version, "buckets": len(m.buckets),
+			"moves": len(m.moves)}).Info("加载ims分片表")
+	}
+
+	if t.instance == "" {
+		return nil
+	}
+	value := fmt.Sprintf("%d,%d", t.Get().version, time.Now().Unix())
+	_, err = conn.Do("HSET", t.key+"_loaded", t.instance, value)
+	return err
+}
+
+func (t *ShardTable) ReloadLoop() {
+	ticker := time.NewTicker(SHARD_RELOAD_INTERVAL)
+	for range ticker.C {
+		if err := t.Reload(); err != nil {
+			log.WithFields(log.Fields{"key": t.key, "err": err}).Warning("加载ims分片表失败")
+		}
+	}
+}
+
+// 合并两台ims返回的消息, 按照消息id从新到旧排列
+// 两边都是连续的一段消息, 合并之后只保留数量较多的一边的长度, 超过的是较旧的消息
+func mergeHistoryMessages(a, b []*HistoryMessage) []*HistoryMessage {
+	limit := len(a)
+	if len(b) > limit {
+		limit = len(b)
+	}
+	seen := make(map[int64]struct{}, len(a)+len(b))
+	messages := make([]*HistoryMessage, 0, len(a)+len(b))
+	for _, ms := range [][]*HistoryMessage{a, b} {
+		for _, m := range ms {
+			if _, ok := seen[m.MsgID]; ok {
+				continue
+			}
+			seen[m.MsgID] = struct{}{}
+			messages = append(messages, m)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].MsgID > messages[j].MsgID })
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages
+}
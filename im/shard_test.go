@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// 默认的分片表和uid % n一致, 扩大bucket的数量之后分配不变
+func TestShardMap(t *testing.T) {
+	m := DefaultShardMap(3)
+	for id := int64(0); id < 100; id++ {
+		if m.Node(id) != int(id%3) {
+			t.Fatalf("default node id:%d node:%d", id, m.Node(id))
+		}
+	}
+
+	split := &ShardMap{buckets: make([]int, 12), moves: make(map[int64]*ShardMove)}
+	for i := range split.buckets {
+		split.buckets[i] = m.buckets[i%len(m.buckets)]
+	}
+	for id := int64(0); id < 100; id++ {
+		if split.Node(id) != m.Node(id) {
+			t.Fatalf("split node id:%d", id)
+		}
+	}
+
+	split.moves[4] = &ShardMove{From: 1, To: 2, State: SHARD_MOVE_COPYING}
+	split.moves[7] = &ShardMove{From: 1, To: 2, State: SHARD_MOVE_DONE}
+	if split.Node(4) != 1 || !reflect.DeepEqual(split.ReadNodes(4), []int{1, 2}) {
+		t.Errorf("copying node:%d read:%v", split.Node(4), split.ReadNodes(4))
+	}
+	if split.Node(7) != 2 || !reflect.DeepEqual(split.ReadNodes(7), []int{2}) {
+		t.Errorf("done node:%d read:%v", split.Node(7), split.ReadNodes(7))
+	}
+
+	if _, err := parseShardMove("1,3,done", 3); err == nil {
+		t.Error("invalid node accepted")
+	}
+}
+
+func TestMergeHistoryMessages(t *testing.T) {
+	history := func(ids ...int64) []*HistoryMessage {
+		messages := make([]*HistoryMessage, len(ids))
+		for i, id := range ids {
+			messages[i] = &HistoryMessage{MsgID: id}
+		}
+		return messages
+	}
+	ids := func(messages []*HistoryMessage) []int64 {
+		r := make([]int64, len(messages))
+		for i, m := range messages {
+			r[i] = m.MsgID
+		}
+		return r
+	}
+
+	//原来的ims有全部的消息, 新的ims只复制了一部分
+	merged := mergeHistoryMessages(history(5, 4, 3), history(4, 3))
+	if !reflect.DeepEqual(ids(merged), []int64{5, 4, 3}) {
+		t.Errorf("merged:%v", ids(merged))
+	}
+	//切换之后新的ims上的消息
+	merged = mergeHistoryMessages(history(5, 4, 3), history(9, 8, 5, 4))
+	if !reflect.DeepEqual(ids(merged), []int64{9, 8, 5, 4}) {
+		t.Errorf("merged:%v", ids(merged))
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"time"
+)
+
+// im shard show [-group]
+// im shard split -factor n [-group]           bucket的数量扩大n倍, 分配不变
+// im shard move -id id -to node [-group]      迁移一个用户或者超级群
+// im shard move-bucket -bucket b -to node [-group]  迁移一个bucket中的所有用户或者超级群
+//
+// 迁移的步骤:
+// 1. 在分片表中标记为迁移中, 等待所有的im加载(见{key}_loaded), 之后同步消息时读取两台ims
+// 2. 把消息从原来的ims复制到新的ims
+// 3. 在原来的ims冻结写入, 复制冻结之前新保存的消息
+// 4. 在分片表中标记为迁移完成(move-bucket直接修改bucket), 之后读写都使用新的ims
+// 5. 等待所有的im加载之后解冻原来的ims, 删除不再需要的迁移记录
+// 中途失败时重新执行同样的命令, 已经复制过的消息不会重复复制
+func ShardMain(args []string) int {
+	if len(args) == 0 {
+		fmt.Println("usage: im shard show|split|move|move-bucket [options]")
+		return 2
+	}
+	fs := flag.NewFlagSet("shard "+args[0], flag.ExitOnError)
+	group := fs.Bool("group", false, "group storage")
+	factor := fs.Int("factor", 2, "split factor")
+	id := fs.Int64("id", 0, "uid or group id")
+	bucket := fs.Int("bucket", -1, "bucket")
+	to := fs.Int("to", -1, "target storage node")
+	fs.Parse(args[1:])
+
+	var migrator *ShardMigrator
+	if *group {
+		migrator = NewShardMigrator(GROUP_SHARD_KEY, NewGroupStorageRPCClients(config.groupStorageRpcAddrs), true)
+	} else {
+		migrator = NewShardMigrator(PEER_SHARD_KEY, NewStorageRPCClients(config.storageRpcAddrs), false)
+	}
+
+	var err error
+	switch args[0] {
+	case "show":
+		err = migrator.Show()
+	case "split":
+		err = migrator.Split(*factor)
+	case "move":
+		err = migrator.Move(*id, *to)
+	case "move-bucket":
+		err = migrator.MoveBucket(*bucket, *to)
+	default:
+		err = fmt.Errorf("unknown command:%s", args[0])
+	}
+	if err != nil {
+		fmt.Println("shard error:", err)
+		return 1
+	}
+	return 0
+}
+
+//导出和导入一批消息的时间比较长, 不使用im保存和同步消息的超时时间
+const SHARD_CALL_TIMEOUT = time.Minute
+
+//等待所有的im加载新的分片表的最长时间
+const SHARD_WAIT_TIMEOUT = 5 * time.Minute
+
+type ShardMigrator struct {
+	key     string
+	clients []*StorageClient
+	group   bool
+}
+
+func NewShardMigrator(key string, clients []*StorageClient, group bool) *ShardMigrator {
+	return &ShardMigrator{key: key, clients: clients, group: group}
+}
+
+func (s *ShardMigrator) load() (*ShardMap, error) {
+	if len(s.clients) == 0 {
+		return nil, errors.New("storage rpc addrs is empty")
+	}
+	conn := redisPool.Get()
+	defer conn.Close()
+	return LoadShardMap(conn, s.key, len(s.clients))
+}
+
+// 在一个事务中修改分片表并且增加版本号, im加载时看到的是完整的修改, 返回新的版本号
+func (s *ShardMigrator) update(f func(conn redis.Conn)) (int64, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	f(conn)
+	conn.Send("HINCRBY", s.key, "version", 1)
+	values, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, err
+	}
+	if len(values) == 0 {
+		return 0, errors.New("empty exec reply")
+	}
+	return redis.Int64(values[len(values)-1], nil)
+}
+
+// 等待所有的im加载version之后的分片表
+// 超过SHARD_INSTANCE_TTL没有检查分片表的im认为已经停止, 删除记录之后不再等待
+func (s *ShardMigrator) waitReload(version int64) error {
+	deadline := time.Now().Add(SHARD_WAIT_TIMEOUT)
+	for {
+		pending, err := s.pendingInstances(version)
+		if err != nil {
+			return err
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("im not reloaded version:%d instances:%s", version, strings.Join(pending, ","))
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// 返回还没有加载version的im
+func (s *ShardMigrator) pendingInstances(version int64) ([]string, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	key := s.key + "_loaded"
+	values, err := redis.StringMap(conn.Do("HGETALL", key))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	pending := make([]string, 0)
+	for instance, value := range values {
+		var v, t int64
+		if _, err := fmt.Sscanf(value, "%d,%d", &v, &t); err != nil || now-t > int64(SHARD_INSTANCE_TTL/time.Second) {
+			log.WithFields(log.Fields{"key": key, "instance": instance, "value": value}).Warning("im已经停止, 删除分片表的加载记录")
+			if _, err := conn.Do("HDEL", key, instance); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if v < version {
+			pending = append(pending, instance)
+		}
+	}
+	sort.Strings(pending)
+	return pending, nil
+}
+
+func (s *ShardMigrator) Show() error {
+	m, err := s.load()
+	if err != nil {
+		return err
+	}
+	counts := make([]int, len(s.clients))
+	for _, node := range m.buckets {
+		counts[node]++
+	}
+	fmt.Printf("version:%d buckets:%d\n", m.version, len(m.buckets))
+	for node, count := range counts {
+		fmt.Printf("node:%d buckets:%d\n", node, count)
+	}
+	ids := make([]int64, 0, len(m.moves))
+	for id := range m.moves {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		move := m.moves[id]
+		fmt.Printf("move id:%d from:%d to:%d state:%s\n", id, move.From, move.To, move.State)
+	}
+	return nil
+}
+
+// (id % (n*factor)) % n == id % n, 扩大之后每个id的分配不变
+func (s *ShardMigrator) Split(factor int) error {
+	if factor < 2 {
+		return fmt.Errorf("invalid factor:%d", factor)
+	}
+	m, err := s.load()
+	if err != nil {
+		return err
+	}
+	buckets := make([]int, len(m.buckets)*factor)
+	for i := range buckets {
+		buckets[i] = m.buckets[i%len(m.buckets)]
+	}
+	m2 := &ShardMap{buckets: buckets}
+	_, err = s.update(func(conn redis.Conn) {
+		conn.Send("HSET", s.key, "buckets", m2.encodeBuckets())
+	})
+	return err
+}
+
+func (s *ShardMigrator) Move(id int64, to int) error {
+	m, err := s.load()
+	if err != nil {
+		return err
+	}
+	if to < 0 || to >= len(s.clients) {
+		return fmt.Errorf("invalid target node:%d", to)
+	}
+	home := m.buckets[m.Bucket(id)]
+	from := home
+	if move, ok := m.moves[id]; ok {
+		if move.State == SHARD_MOVE_DONE && move.To == to {
+			//上次迁移在解冻之前中断
+			return s.finishMove(id, move, home, m.version)
+		}
+		if move.State == SHARD_MOVE_DONE {
+			from = move.To
+		} else if move.To != to {
+			return fmt.Errorf("id:%d is moving to node:%d", id, move.To)
+		} else {
+			from = move.From
+		}
+	} else if from == to {
+		return nil
+	}
+
+	move := &ShardMove{From: from, To: to, State: SHARD_MOVE_COPYING}
+	version, err := s.setMoves([]int64{id}, move)
+	if err != nil {
+		return err
+	}
+	if err := s.waitReload(version); err != nil {
+		return err
+	}
+
+	if _, err := s.copy(id, from, to); err != nil {
+		return err
+	}
+	freeze := &FreezeRequest{Id: id, Group: s.group, Frozen: true}
+	if err := s.freeze(from, freeze); err != nil {
+		return s.abort(from, freeze, err)
+	}
+	last, err := s.copy(id, from, to)
+	if err != nil {
+		//继续读取两台ims, 重新执行时从这里继续
+		return s.abort(from, freeze, err)
+	}
+
+	move.State = SHARD_MOVE_DONE
+	version, err = s.setMoves([]int64{id}, move)
+	if err != nil {
+		return s.abort(from, freeze, err)
+	}
+	if err := s.finishMove(id, move, home, version); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"id": id, "from": from, "to": to, "last": last}).Info("迁移完成")
+	return nil
+}
+
+// 所有的im都加载迁移完成的分片表之后解冻原来的ims
+// 迁移回bucket所在的ims时最后删除迁移记录, 其它情况下迁移记录一直保留, 直到bucket迁移到同一台ims
+func (s *ShardMigrator) finishMove(id int64, move *ShardMove, home int, version int64) error {
+	if err := s.waitReload(version); err != nil {
+		return err
+	}
+	if err := s.freeze(move.From, &FreezeRequest{Id: id, Group: s.group, Frozen: false}); err != nil {
+		return err
+	}
+	if move.To != home {
+		return nil
+	}
+	_, err := s.update(func(conn redis.Conn) {
+		conn.Send("HDEL", s.key+"_moves", id)
+	})
+	return err
+}
+
+// 迁移bucket中所有有消息的id, 最后修改bucket并且删除这些id的迁移记录
+// 冻结整个bucket之后再列出一次id, 包括迁移期间第一次保存消息的用户或者群组
+// 已经单独迁移完成的id不在原来的ims中, 不需要复制, 迁移到同一台ims的迁移记录一起删除
+func (s *ShardMigrator) MoveBucket(bucket, to int) error {
+	m, err := s.load()
+	if err != nil {
+		return err
+	}
+	if bucket < 0 || bucket >= len(m.buckets) {
+		return fmt.Errorf("invalid bucket:%d", bucket)
+	}
+	if to < 0 || to >= len(s.clients) {
+		return fmt.Errorf("invalid target node:%d", to)
+	}
+	from := m.buckets[bucket]
+	//上次中断的迁移可以继续
+	moved := make(map[int64]*ShardMove)
+	for id, move := range m.moves {
+		if m.Bucket(id) != bucket {
+			continue
+		}
+		if move.State == SHARD_MOVE_DONE {
+			moved[id] = move
+		} else if move.From != from || move.To != to {
+			return fmt.Errorf("id:%d in bucket is moving to node:%d", id, move.To)
+		}
+	}
+	buckets := int64(len(m.buckets))
+	if from == to {
+		//上次迁移在解冻之前中断, 解冻其它ims中的这个bucket
+		return s.unfreezeBucket(to, buckets, int64(bucket))
+	}
+
+	ids, err := s.listIds(from, buckets, int64(bucket), moved)
+	if err != nil {
+		return err
+	}
+	move := &ShardMove{From: from, To: to, State: SHARD_MOVE_COPYING}
+	version, err := s.setMoves(ids, move)
+	if err != nil {
+		return err
+	}
+	if err := s.waitReload(version); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := s.copy(id, from, to); err != nil {
+			return err
+		}
+	}
+
+	freeze := &FreezeRequest{Group: s.group, Buckets: buckets, Bucket: int64(bucket), Frozen: true}
+	if err := s.freeze(from, freeze); err != nil {
+		return s.abort(from, freeze, err)
+	}
+	frozenIds, err := s.listIds(from, buckets, int64(bucket), moved)
+	if err == nil {
+		for _, id := range frozenIds {
+			if _, err = s.copy(id, from, to); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		m.buckets[bucket] = to
+		version, err = s.update(func(conn redis.Conn) {
+			conn.Send("HSET", s.key, "buckets", m.encodeBuckets())
+			for _, id := range append(ids, frozenIds...) {
+				conn.Send("HDEL", s.key+"_moves", id)
+			}
+			for id, move := range moved {
+				if move.To == to {
+					conn.Send("HDEL", s.key+"_moves", id)
+				}
+			}
+		})
+	}
+	if err != nil {
+		return s.abort(from, freeze, err)
+	}
+	if err := s.waitReload(version); err != nil {
+		return err
+	}
+	freeze.Frozen = false
+	if err := s.freeze(from, freeze); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"bucket": bucket, "from": from, "to": to, "ids": len(frozenIds)}).Info("迁移bucket完成")
+	return nil
+}
+
+// bucket所在的ims以外的ims都解冻这个bucket, 没有冻结时不变
+func (s *ShardMigrator) unfreezeBucket(node int, buckets, bucket int64) error {
+	for i := range s.clients {
+		if i == node {
+			continue
+		}
+		if err := s.freeze(i, &FreezeRequest{Group: s.group, Buckets: buckets, Bucket: bucket, Frozen: false}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ShardMigrator) setMoves(ids []int64, move *ShardMove) (int64, error) {
+	return s.update(func(conn redis.Conn) {
+		for _, id := range ids {
+			conn.Send("HSET", s.key+"_moves", id, encodeShardMove(move))
+		}
+	})
+}
+
+func (s *ShardMigrator) freeze(node int, req *FreezeRequest) error {
+	if _, err := s.clients[node].Call("FreezeMessages", req); err != nil {
+		log.WithFields(log.Fields{"node": node, "id": req.Id, "bucket": req.Bucket, "frozen": req.Frozen, "err": err}).Error("冻结消息写入失败")
+		return err
+	}
+	return nil
+}
+
+// 迁移失败时解冻原来的ims, 继续读取两台ims, 重新执行同样的命令时从这里继续
+// 冻结的请求超时的时候ims可能已经冻结, 也要解冻. 解冻失败时一起返回, 重新执行的命令会再次冻结和解冻
+func (s *ShardMigrator) abort(node int, req *FreezeRequest, err error) error {
+	unfreeze := *req
+	unfreeze.Frozen = false
+	if e := s.freeze(node, &unfreeze); e != nil {
+		return fmt.Errorf("%v, unfreeze node:%d err:%v", err, node, e)
+	}
+	return err
+}
+
+// 跳过moved中已经迁移完成的id, 原来的ims中还有迁移之前的消息
+func (s *ShardMigrator) listIds(node int, buckets, bucket int64, moved map[int64]*ShardMove) ([]int64, error) {
+	resp, err := s.clients[node].CallTimeout("ListIds", &ListIdsRequest{Group: s.group, Buckets: buckets, Bucket: bucket}, SHARD_CALL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	ids, _ := resp.([]int64)
+	result := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := moved[id]; !ok {
+			result = append(result, id)
+		}
+	}
+	return result, nil
+}
+
+// 从新的ims中最后一条消息之后继续复制, 返回复制之后最后一条消息的id
+func (s *ShardMigrator) copy(id int64, from, to int) (int64, error) {
+	resp, err := s.clients[to].CallTimeout("ImportMessages", &ImportRequest{Id: id, Group: s.group}, SHARD_CALL_TIMEOUT)
+	if err != nil {
+		return 0, err
+	}
+	last := resp.(int64)
+	for {
+		resp, err := s.clients[from].CallTimeout("ExportMessages", &ExportRequest{Id: id, Group: s.group, AfterMsgId: last}, SHARD_CALL_TIMEOUT)
+		if err != nil {
+			return last, err
+		}
+		r := resp.(*ExportResult)
+		if len(r.Messages) > 0 {
+			resp, err = s.clients[to].CallTimeout("ImportMessages", &ImportRequest{Id: id, Group: s.group, Messages: r.Messages}, SHARD_CALL_TIMEOUT)
+			if err != nil {
+				return last, err
+			}
+			last = resp.(int64)
+		}
+		if !r.HasMore || len(r.Messages) == 0 {
+			return last, nil
+		}
+	}
+}
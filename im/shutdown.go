@@ -0,0 +1,76 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"sx-chat/proto"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+//客户端收到MSG_SERVER_CLOSE之后在这个时间范围内随机等待再重连, 单位毫秒
+const MAX_RECONNECT_DELAY = 5000
+
+var clientListener net.Listener
+
+var shuttingDown int32
+
+func IsShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// 阻塞直到收到SIGTERM或者SIGINT
+func WaitSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-c
+	log.WithField("signal", sig).Info("收到退出信号")
+}
+
+// 停止接受新连接, 通知客户端重连到其它服务器,
+// 等待客户端的消息发送完并且从imr取消订阅之后关闭route连接
+func Shutdown() {
+	atomic.StoreInt32(&shuttingDown, 1)
+
+	if clientListener != nil {
+		clientListener.Close()
+	}
+
+	log.WithField("count", route.GetUserCount()).Info("通知客户端服务器关闭")
+	route.ForEachClient(func(c *Client) {
+		c.ServerClose()
+	})
+
+	timeout := time.Duration(config.shutdownTimeout) * time.Second
+	deadline := time.Now().Add(timeout)
+	for route.GetUserCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if count := route.GetUserCount(); count > 0 {
+		log.WithField("count", count).Warning("等待客户端断开超时")
+	}
+
+	for _, channel := range routeChannels {
+		channel.Close(time.Second)
+	}
+	for _, channel := range groupRouteChannels {
+		channel.Close(time.Second)
+	}
+}
+
+// 通知客户端服务器即将关闭, wt中已有的消息和这个消息发送之后关闭连接
+// wt已满时直接关闭连接, 客户端重连之后可以同步到没有收到的消息
+func (client *Client) ServerClose() {
+	delay := rand.Int31n(MAX_RECONNECT_DELAY)
+	msg := &proto.Message{Cmd: proto.MSG_SERVER_CLOSE, Version: client.version, Body: &proto.ServerClose{Delay: delay}}
+	select {
+	case client.wt <- msg:
+	default:
+		log.WithField("uid", client.uid).Warning("wt已满, 直接关闭连接")
+		client.close()
+	}
+}
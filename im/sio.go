@@ -1,12 +1,12 @@
 package main
 
 import (
-	"bytes"
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
+	"sx-chat/proto"
 )
 
-func ReadWebsocketMessage(conn *websocket.Conn) *Message {
+func ReadWebsocketMessage(conn *websocket.Conn) *proto.Message {
 	messageType, p, err := conn.ReadMessage()
 	if err != nil {
 		log.WithField("err", err).Info("读取wesocket失败")
@@ -20,7 +20,7 @@ func ReadWebsocketMessage(conn *websocket.Conn) *Message {
 	}
 }
 
-func ReadBinaryMessage(p []byte) *Message  {
-	reader := bytes.NewBuffer(p)
-	return ReceiveClientMessage(reader)
+func ReadBinaryMessage(p []byte) *proto.Message  {
+	m, _ := proto.DecodeMessage(p, 32*1024)
+	return m
 }
\ No newline at end of file
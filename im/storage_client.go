@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/gorpc"
+	"sx-chat/proto"
+	"sync"
+	"time"
+)
+
+// 调用ims的rpc: 每次调用都有超时时间, 幂等的调用(同步和搜索)失败之后有限次重试
+// 每台ims一个熔断器, 连续失败之后一段时间内直接返回错误, 不再等待超时
+// 保存消息不重试, 超时的消息可能已经保存, 由客户端用clientMsgId重发
+
+//重试之间的等待时间, 第n次重试等待n倍
+const STORAGE_RETRY_BACKOFF = 100 * time.Millisecond
+
+var errStorageUnavailable = errors.New("storage unavailable")
+
+const (
+	BREAKER_CLOSED    = 0
+	BREAKER_OPEN      = 1
+	BREAKER_HALF_OPEN = 2 //冷却时间之后只放行一个请求, 成功之后关闭
+)
+
+type CircuitBreaker struct {
+	failures int           //连续失败这么多次之后打开, 0表示不熔断
+	cooldown time.Duration //打开之后等待这个时间再尝试
+
+	mutex    sync.Mutex
+	state    int
+	count    int //连续失败的次数
+	openedAt time.Time
+	probing  bool
+	//每次状态变化加1, 状态变化之前开始的调用的结果不再计入
+	generation uint64
+}
+
+func NewCircuitBreaker(failures int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{failures: failures, cooldown: cooldown}
+}
+
+// 返回是否允许调用和调用开始时的generation, 调用完成之后用这个generation报告结果
+func (b *CircuitBreaker) Allow(now time.Time) (uint64, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case BREAKER_OPEN:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return b.generation, false
+		}
+		b.setState(BREAKER_HALF_OPEN)
+		b.probing = true
+		return b.generation, true
+	case BREAKER_HALF_OPEN:
+		if b.probing {
+			return b.generation, false
+		}
+		b.probing = true
+		return b.generation, true
+	}
+	return b.generation, true
+}
+
+// 调用完成之后报告结果, ok为false表示ims不可用
+// 打开或者半开之前开始的调用的结果忽略, 半开时只有探测的调用可以关闭或者重新打开
+func (b *CircuitBreaker) Done(generation uint64, ok bool, now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if generation != b.generation {
+		return
+	}
+	b.probing = false
+	if ok {
+		b.count = 0
+		if b.state != BREAKER_CLOSED {
+			b.setState(BREAKER_CLOSED)
+		}
+		return
+	}
+	b.count++
+	if b.state == BREAKER_HALF_OPEN || (b.failures > 0 && b.count >= b.failures) {
+		b.setState(BREAKER_OPEN)
+		b.openedAt = now
+	}
+}
+
+// 在mutex内调用
+func (b *CircuitBreaker) setState(state int) {
+	b.state = state
+	b.generation++
+}
+
+func (b *CircuitBreaker) State() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state
+}
+
+type StorageClient struct {
+	addr    string
+	dc      *gorpc.DispatcherClient
+	breaker *CircuitBreaker
+	timeout time.Duration
+	retries int //幂等的调用失败之后最多重试的次数
+}
+
+func NewStorageClient(addr string, dispatcher *gorpc.Dispatcher, timeout time.Duration, retries int, breaker *CircuitBreaker) *StorageClient {
+	c := &gorpc.Client{Conns: 4, Addr: addr}
+	c.Start()
+	return &StorageClient{addr: addr, dc: dispatcher.NewFuncClient(c), breaker: breaker, timeout: timeout, retries: retries}
+}
+
+func (c *StorageClient) Call(name string, req interface{}) (interface{}, error) {
+	return c.CallTimeout(name, req, c.timeout)
+}
+
+func (c *StorageClient) CallTimeout(name string, req interface{}, timeout time.Duration) (interface{}, error) {
+	generation, ok := c.breaker.Allow(time.Now())
+	if !ok {
+		return nil, errStorageUnavailable
+	}
+	resp, err := c.dc.CallTimeout(name, req, timeout)
+	unavailable := isStorageUnavailable(err)
+	c.breaker.Done(generation, !unavailable, time.Now())
+	if unavailable && c.breaker.State() == BREAKER_OPEN {
+		log.WithFields(log.Fields{"addr": c.addr, "func": name, "err": err}).Warning("ims不可用, 熔断")
+	}
+	return resp, err
+}
+
+// 只用于幂等的调用, ims返回的错误不重试, 熔断之后不再重试
+func (c *StorageClient) CallIdempotent(name string, req interface{}) (interface{}, error) {
+	resp, err := c.Call(name, req)
+	for i := 1; i <= c.retries && err != nil && err != errStorageUnavailable && isStorageUnavailable(err); i++ {
+		time.Sleep(time.Duration(i) * STORAGE_RETRY_BACKOFF)
+		log.WithFields(log.Fields{"addr": c.addr, "func": name, "retry": i, "err": err}).Warning("重试ims调用")
+		resp, err = c.Call(name, req)
+	}
+	return resp, err
+}
+
+// 超时, 连接失败和熔断, ims的函数返回的错误不算
+func isStorageUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == errStorageUnavailable {
+		return true
+	}
+	if e, ok := err.(*gorpc.ClientError); ok {
+		return e.Timeout || e.Connection || e.Overflow
+	}
+	return false
+}
+
+// 调用ims失败时给客户端的ack状态
+func storageACKStatus(err error) int8 {
+	if isStorageUnavailable(err) {
+		return proto.ACK_STORAGE_UNAVAILABLE
+	}
+	return proto.ACK_SERVER_ERROR
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"github.com/valyala/gorpc"
+	"net"
+	"sx-chat/proto"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testStorageTimeout = 50 * time.Millisecond
+
+// 进程内的假ims, hangs大于0时接下来的调用卡住直到超时
+type fakeStorage struct {
+	addr   string
+	server *gorpc.Server
+	hangs  int32
+	calls  int32
+	saved  chan *PeerGroupMessage
+}
+
+func newFakeStorage(t *testing.T, addr string) *fakeStorage {
+	if addr == "" {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = l.Addr().String()
+		l.Close()
+	}
+	f := &fakeStorage{addr: addr, saved: make(chan *PeerGroupMessage, 10)}
+	dispatcher := gorpc.NewDispatcher()
+	dispatcher.AddFunc("SyncMessage", func(addr string, s *SyncHistory) (*PeerHistoryMessage, error) {
+		f.call()
+		return &PeerHistoryMessage{LastMsgId: s.LastMsgID}, nil
+	})
+	dispatcher.AddFunc("SavePeerMessage", func(addr string, m *PeerMessage) ([2]int64, error) {
+		f.call()
+		return [2]int64{2, 1}, nil
+	})
+	dispatcher.AddFunc("SavePeerGroupMessage", func(addr string, m *PeerGroupMessage) ([]int64, error) {
+		f.call()
+		f.saved <- m
+		ids := make([]int64, 0, len(m.Members)*2)
+		for range m.Members {
+			ids = append(ids, 2, 1)
+		}
+		return ids, nil
+	})
+	f.server = &gorpc.Server{Addr: addr, Handler: dispatcher.NewHandlerFunc(), LogError: func(string, ...interface{}) {}}
+	if err := f.server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func (f *fakeStorage) call() {
+	atomic.AddInt32(&f.calls, 1)
+	if atomic.AddInt32(&f.hangs, -1) >= 0 {
+		time.Sleep(4 * testStorageTimeout)
+	}
+}
+
+func newTestStorageClient(addr string, failures int, cooldown time.Duration) *StorageClient {
+	dispatcher := gorpc.NewDispatcher()
+	dispatcher.AddFunc("SyncMessage", SyncMessageInterface)
+	dispatcher.AddFunc("SavePeerMessage", SavePeerMessageInterface)
+	dispatcher.AddFunc("SavePeerGroupMessage", SavePeerGroupMessageInterface)
+	return NewStorageClient(addr, dispatcher, testStorageTimeout, 2, NewCircuitBreaker(failures, cooldown))
+}
+
+// 同步消息超时之后重试, 保存消息不重试
+func TestStorageClientRetry(t *testing.T) {
+	f := newFakeStorage(t, "")
+	defer f.server.Stop()
+	c := newTestStorageClient(f.addr, 5, time.Second)
+
+	atomic.StoreInt32(&f.hangs, 1)
+	resp, err := c.CallIdempotent("SyncMessage", &SyncHistory{UID: 1, LastMsgID: 10})
+	if err != nil || resp.(*PeerHistoryMessage).LastMsgId != 10 {
+		t.Fatalf("sync resp:%v err:%v", resp, err)
+	}
+	if n := atomic.LoadInt32(&f.calls); n != 2 {
+		t.Errorf("sync calls:%d", n)
+	}
+
+	atomic.StoreInt32(&f.calls, 0)
+	atomic.StoreInt32(&f.hangs, 1)
+	_, err = c.Call("SavePeerMessage", &PeerMessage{UID: 1})
+	if storageACKStatus(err) != proto.ACK_STORAGE_UNAVAILABLE {
+		t.Errorf("save err:%v", err)
+	}
+	if n := atomic.LoadInt32(&f.calls); n != 1 {
+		t.Errorf("save calls:%d", n)
+	}
+}
+
+// ims停止之后连续失败熔断, 直接返回错误, 恢复之后冷却时间过后重新可用
+func TestStorageClientBreaker(t *testing.T) {
+	f := newFakeStorage(t, "")
+	c := newTestStorageClient(f.addr, 2, 100*time.Millisecond)
+	if _, err := c.Call("SavePeerMessage", &PeerMessage{UID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	f.server.Stop()
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.Call("SavePeerMessage", &PeerMessage{UID: 1}); !isStorageUnavailable(err) {
+			t.Fatalf("outage err:%v", err)
+		}
+	}
+	if c.breaker.State() != BREAKER_OPEN {
+		t.Fatal("breaker is not open")
+	}
+	begin := time.Now()
+	if _, err := c.CallIdempotent("SyncMessage", &SyncHistory{UID: 1}); err != errStorageUnavailable {
+		t.Fatalf("open err:%v", err)
+	}
+	if time.Since(begin) >= testStorageTimeout {
+		t.Error("open breaker does not fail fast")
+	}
+
+	//模拟客户端收到的ack
+	rpcClients = []*StorageClient{c}
+	peerShards = NewShardTable(PEER_SHARD_KEY, 1)
+	client := &PeerClient{&Connection{uid: 1, wt: make(chan *proto.Message, 10)}}
+	client.HandleIMMessage(&proto.Message{Cmd: proto.MSG_IM, Seq: 7, Body: &proto.IMMessage{Receiver: 2, Content: "hello"}})
+	ack := (<-client.wt).Body.(*proto.MessageACK)
+	if ack.Seq != 7 || ack.Status != proto.ACK_STORAGE_UNAVAILABLE {
+		t.Errorf("ack seq:%d status:%d", ack.Seq, ack.Status)
+	}
+
+	f = newFakeStorage(t, f.addr)
+	defer f.server.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := c.Call("SavePeerMessage", &PeerMessage{UID: 1})
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("not recovered err:%v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if c.breaker.State() != BREAKER_CLOSED {
+		t.Error("breaker is not closed")
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	now := time.Now()
+	b := NewCircuitBreaker(1, time.Second)
+	allow := func(now time.Time) bool {
+		_, ok := b.Allow(now)
+		return ok
+	}
+	g0, _ := b.Allow(now)
+	b.Done(g0, false, now)
+	if allow(now.Add(500 * time.Millisecond)) {
+		t.Fatal("open breaker allows")
+	}
+	now = now.Add(time.Second)
+	g1, ok := b.Allow(now)
+	if !ok || allow(now) {
+		t.Fatal("half open allows one probe")
+	}
+	//打开之前开始的调用的结果不影响探测
+	b.Done(g0, true, now)
+	if b.State() != BREAKER_HALF_OPEN {
+		t.Fatal("stale success closed breaker")
+	}
+	//探测失败之后重新打开
+	b.Done(g1, false, now)
+	if allow(now) {
+		t.Fatal("reopen")
+	}
+	g2, ok := b.Allow(now.Add(time.Second))
+	if !ok {
+		t.Fatal("probe after reopen")
+	}
+	b.Done(g1, false, now)
+	if b.State() != BREAKER_HALF_OPEN {
+		t.Fatal("stale failure reopened breaker")
+	}
+	b.Done(g2, true, now)
+	if !allow(now) || !allow(now) {
+		t.Error("closed")
+	}
+}
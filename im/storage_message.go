@@ -1,71 +1,174 @@
 package main
 
 import (
-	"bytes"
 	"encoding/binary"
+	"math"
+	"sx-chat/proto"
 )
 
-//im实例使用
-const MSG_PENDING_GROUP_MESSAGE = 251
+//待发送文件中消息的版本, 版本1增加了消息类型和@的成员, 版本2增加了客户端的消息id, 版本3增加了过期时间
+const PENDING_VERSION = 3
 
 func init() {
-	messageCreators[MSG_PENDING_GROUP_MESSAGE] = func() IMessage { return new(PendingGroupMessage) }
+	proto.RegisterVersionMessage(proto.MSG_PENDING_GROUP_MESSAGE, func() proto.IVersionMessage { return new(PendingGroupMessage) })
 }
 
 //待发送的群组消息临时存储结构
 type PendingGroupMessage struct {
-	sender    int64
-	deviceID  int64 //发送者的设备id
-	gid       int64
-	timestamp int32
+	sender      int64
+	deviceID    int64 //发送者的设备id
+	gid         int64
+	timestamp   int32
+	messageType int32
 
-	members []int64 //需要接受此消息的成员列表
-	content string
-}
+	members  []int64 //需要接受此消息的成员列表
+	atAll    bool
+	mentions []int64
 
-func (gm *PendingGroupMessage) ToData() []byte {
-	buffer := new(bytes.Buffer)
-	binary.Write(buffer, binary.BigEndian, gm.sender)
-	binary.Write(buffer, binary.BigEndian, gm.deviceID)
-	binary.Write(buffer, binary.BigEndian, gm.gid)
-	binary.Write(buffer, binary.BigEndian, gm.timestamp)
+	clientMsgId string
+	ttl         int32 //按发送时间过期的秒数, 0表示不过期
+	content  string
+}
 
-	count := int16(len(gm.members))
-	binary.Write(buffer, binary.BigEndian, count)
-	for _, uid := range gm.members {
-		binary.Write(buffer, binary.BigEndian, uid)
+// v0: sender(8) deviceID(8) gid(8) timestamp(4) 成员数量(2) 成员id(8*n) content
+// v1: sender(8) deviceID(8) gid(8) timestamp(4) 成员数量(2) 成员id(8*n) messageType(4) atAll(1) @数量(2) @成员id(8*n) content
+// v2: 在content之前增加clientMsgId长度(1) clientMsgId
+// v3: 在clientMsgId之后增加ttl(4)
+func (gm *PendingGroupMessage) ToData(version int) []byte {
+	members := truncateInt64s(gm.members)
+	mentions := truncateInt64s(gm.mentions)
+	clientMsgId := gm.clientMsgId
+	if len(clientMsgId) > math.MaxUint8 {
+		clientMsgId = clientMsgId[:math.MaxUint8]
 	}
 
-	buffer.Write([]byte(gm.content))
-	buf := buffer.Bytes()
+	size := 30 + len(members)*8 + len(gm.content)
+	if version >= 1 {
+		size += 7 + len(mentions)*8
+	}
+	if version >= 2 {
+		size += 1 + len(clientMsgId)
+	}
+	if version >= 3 {
+		size += 4
+	}
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint64(buf[0:], uint64(gm.sender))
+	binary.BigEndian.PutUint64(buf[8:], uint64(gm.deviceID))
+	binary.BigEndian.PutUint64(buf[16:], uint64(gm.gid))
+	binary.BigEndian.PutUint32(buf[24:], uint32(gm.timestamp))
+	off := 28 + putInt64s(buf[28:], members)
+	if version >= 1 {
+		binary.BigEndian.PutUint32(buf[off:], uint32(gm.messageType))
+		if gm.atAll {
+			buf[off+4] = 1
+		}
+		off += 5 + putInt64s(buf[off+5:], mentions)
+	}
+	if version >= 2 {
+		buf[off] = byte(len(clientMsgId))
+		off += 1 + copy(buf[off+1:], clientMsgId)
+	}
+	if version >= 3 {
+		binary.BigEndian.PutUint32(buf[off:], uint32(gm.ttl))
+		off += 4
+	}
+	copy(buf[off:], gm.content)
 	return buf
 }
 
-func (gm *PendingGroupMessage) FromData(buff []byte) bool {
-	if len(buff) < 38 {
+func (gm *PendingGroupMessage) FromData(version int, buff []byte) bool {
+	if len(buff) < 30 {
 		return false
 	}
-	buffer := bytes.NewBuffer(buff)
-	binary.Read(buffer, binary.BigEndian, &gm.sender)
-	binary.Read(buffer, binary.BigEndian, &gm.deviceID)
-	binary.Read(buffer, binary.BigEndian, &gm.gid)
-	binary.Read(buffer, binary.BigEndian, &gm.timestamp)
-
-	var count int16
-	binary.Read(buffer, binary.BigEndian, &count)
 
-	if len(buff) < int(38+count*8) {
+	members, n, ok := getInt64s(buff[28:])
+	if !ok {
 		return false
 	}
+	off := 28 + n
+
+	var messageType int32
+	var atAll bool
+	var mentions []int64
+	if version >= 1 {
+		if off+5 > len(buff) {
+			return false
+		}
+		messageType = int32(binary.BigEndian.Uint32(buff[off:]))
+		atAll = buff[off+4] != 0
+		mentions, n, ok = getInt64s(buff[off+5:])
+		if !ok {
+			return false
+		}
+		off += 5 + n
+	}
+
+	var clientMsgId string
+	if version >= 2 {
+		if off+1 > len(buff) || off+1+int(buff[off]) > len(buff) {
+			return false
+		}
+		l := int(buff[off])
+		clientMsgId = string(buff[off+1 : off+1+l])
+		off += 1 + l
+	}
 
-	gm.members = make([]int64, count)
-	for i := 0; i < int(count); i++ {
-		var uid int64
-		binary.Read(buffer, binary.BigEndian, &uid)
-		gm.members[i] = uid
+	var ttl int32
+	if version >= 3 {
+		if off+4 > len(buff) {
+			return false
+		}
+		ttl = int32(binary.BigEndian.Uint32(buff[off:]))
+		off += 4
 	}
-	offset := 38 + count*8
-	gm.content = string(buff[offset:])
 
+	gm.sender = int64(binary.BigEndian.Uint64(buff[0:]))
+	gm.deviceID = int64(binary.BigEndian.Uint64(buff[8:]))
+	gm.gid = int64(binary.BigEndian.Uint64(buff[16:]))
+	gm.timestamp = int32(binary.BigEndian.Uint32(buff[24:]))
+	gm.messageType = messageType
+	gm.members = members
+	gm.atAll = atAll
+	if len(mentions) > 0 {
+		gm.mentions = mentions
+	}
+	gm.clientMsgId = clientMsgId
+	gm.ttl = ttl
+	gm.content = string(buff[off:])
 	return true
 }
+
+func truncateInt64s(a []int64) []int64 {
+	if len(a) > math.MaxInt16 {
+		return a[:math.MaxInt16]
+	}
+	return a
+}
+
+// 数量(2) id(8*n), 返回写入的字节数
+func putInt64s(buf []byte, a []int64) int {
+	binary.BigEndian.PutUint16(buf, uint16(len(a)))
+	off := 2
+	for _, v := range a {
+		binary.BigEndian.PutUint64(buf[off:], uint64(v))
+		off += 8
+	}
+	return off
+}
+
+// 返回读取的id和字节数
+func getInt64s(buff []byte) ([]int64, int, bool) {
+	if len(buff) < 2 {
+		return nil, 0, false
+	}
+	count := int(int16(binary.BigEndian.Uint16(buff)))
+	if count < 0 || 2+count*8 > len(buff) {
+		return nil, 0, false
+	}
+	a := make([]int64, count)
+	for i := 0; i < count; i++ {
+		a[i] = int64(binary.BigEndian.Uint64(buff[2+i*8:]))
+	}
+	return a, 2 + count*8, true
+}
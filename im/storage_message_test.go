@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"sx-chat/proto"
+	"testing"
+	"testing/quick"
+)
+
+func TestPendingGroupMessageRoundTrip(t *testing.T) {
+	f := func(gid int64, members []int64, content string) bool {
+		gm := &PendingGroupMessage{sender: 1, deviceID: 2, gid: gid, timestamp: 3, members: members, content: content}
+		if gm.members == nil {
+			gm.members = []int64{}
+		}
+		buf := proto.EncodeMessage(&proto.Message{Cmd: proto.MSG_PENDING_GROUP_MESSAGE, Body: gm})
+		m, err := proto.DecodeMessage(buf, len(buf))
+		return err == nil && reflect.DeepEqual(gm, m.Body)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+
+	m := &proto.Message{Cmd: proto.MSG_PENDING_GROUP_MESSAGE}
+	if m.FromData(append(make([]byte, 28), 0x80, 0x00)) {
+		t.Error("accepted negative member count")
+	}
+}
+
+func TestPendingGroupMessageMentionRoundTrip(t *testing.T) {
+	f := func(messageType int32, atAll bool, mentions []int64, clientMsgId string, ttl int32, content string) bool {
+		if len(mentions) == 0 {
+			mentions = nil
+		}
+		if len(clientMsgId) > 255 {
+			clientMsgId = clientMsgId[:255]
+		}
+		gm := &PendingGroupMessage{sender: 1, deviceID: 2, gid: 3, timestamp: 4, messageType: messageType,
+			members: []int64{5, 6}, atAll: atAll, mentions: mentions, clientMsgId: clientMsgId, ttl: ttl, content: content}
+		buf := proto.EncodeMessage(&proto.Message{Cmd: proto.MSG_PENDING_GROUP_MESSAGE, Version: PENDING_VERSION, Body: gm})
+		m, err := proto.DecodeMessage(buf, len(buf))
+		return err == nil && reflect.DeepEqual(gm, m.Body)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// 带有过期时间的普通群消息从待发送文件中读出之后保留ttl, 旧版本的记录没有ttl
+func TestPendingGroupMessageTtl(t *testing.T) {
+	gm := &PendingGroupMessage{sender: 1, deviceID: 2, gid: 3, timestamp: 4, members: []int64{5}, ttl: 60, content: "hello"}
+	buf := proto.EncodeMessage(&proto.Message{Cmd: proto.MSG_PENDING_GROUP_MESSAGE, Version: PENDING_VERSION, Body: gm})
+	m, err := proto.DecodeMessage(buf, len(buf))
+	if err != nil || m.Body.(*PendingGroupMessage).ttl != 60 {
+		t.Fatalf("decode:%v %v", m, err)
+	}
+
+	buf = proto.EncodeMessage(&proto.Message{Cmd: proto.MSG_PENDING_GROUP_MESSAGE, Version: 2, Body: gm})
+	m, err = proto.DecodeMessage(buf, len(buf))
+	if err != nil || m.Body.(*PendingGroupMessage).ttl != 0 || m.Body.(*PendingGroupMessage).content != "hello" {
+		t.Fatalf("decode v2:%v %v", m, err)
+	}
+}
@@ -3,10 +3,11 @@ package main
 import (
 	log "github.com/sirupsen/logrus"
 	"net"
+	"sx-chat/proto"
 )
 
 type Client struct {
-	wt chan *Message
+	wt chan *proto.Message
 
 	conn *net.TCPConn
 
@@ -16,12 +17,13 @@ type Client struct {
 func NewClient(conn *net.TCPConn) *Client {
 	client := new(Client)
 	client.conn = conn
-	client.wt = make(chan *Message, 10)
+	client.wt = make(chan *proto.Message, 10)
 	client.route = NewRoute()
 	return client
 }
 
 func (client *Client) Run() {
+	writers.Add(1)
 	go client.Write()
 	go client.Read()
 }
@@ -39,53 +41,58 @@ func (client *Client) Read() {
 	}
 }
 
-func (client *Client) read() *Message {
-	return ReceiveMessage(client.conn)
+func (client *Client) read() *proto.Message {
+	return proto.ReceiveMessage(client.conn)
 }
 
-func (client *Client) HandleMessage(msg *Message) {
-	log.Info("msg cmd:", Command(msg.cmd))
-
-	switch msg.cmd {
-	case MSG_SUBSCRIBE:
-		client.HandleSubscribe(msg.body.(*SubscribeMessage))
-	case MSG_UNSUBSCRIBE:
-		client.HandleUnsubscribe(msg.body.(*UserID))
-	case MSG_PUBLISH:
-		client.HandlePublish(msg.body.(*AppMessage))
-	case MSG_PUBLISH_GROUP:
-		client.HandlePublishGroup(msg.body.(*AppMessage))
+func (client *Client) HandleMessage(msg *proto.Message) {
+	log.Info("msg cmd:", proto.Command(msg.Cmd))
+
+	switch msg.Cmd {
+	case proto.MSG_SUBSCRIBE:
+		client.HandleSubscribe(msg.Body.(*proto.SubscribeMessage))
+	case proto.MSG_UNSUBSCRIBE:
+		client.HandleUnsubscribe(msg.Body.(*proto.UserID))
+	case proto.MSG_PUBLISH:
+		client.HandlePublish(msg.Body.(*proto.AppMessage))
+	case proto.MSG_PUBLISH_GROUP:
+		client.HandlePublishGroup(msg.Body.(*proto.AppMessage))
 	default:
-		log.Warning("unknown message cmd:", msg.cmd)
+		log.Warning("unknown message cmd:", msg.Cmd)
 	}
 }
 
-func (client *Client) IsAppUserOnline(id *UserID) bool {
+func (client *Client) IsAppUserOnline(id *proto.UserID) bool {
 	route := client.route
-	return route.IsUserOnline(id.uid)
+	return route.IsUserOnline(id.Uid)
 }
 
-func (client *Client) HandlePublish(amsg *AppMessage) {
-	log.Infof("publish message uid:%d msgid:%d cmd:%d", amsg.receiver, amsg.msgId, Command(amsg.msg.cmd))
+func (client *Client) HandlePublish(amsg *proto.AppMessage) {
+	log.Infof("publish message uid:%d msgid:%d cmd:%d", amsg.Receiver, amsg.MsgId, proto.Command(amsg.Msg.Cmd))
 
-	receiver := &UserID{uid: amsg.receiver}
+	receiver := &proto.UserID{Uid: amsg.Receiver}
 	s := FindClientSet(receiver)
 
-	msg := &Message{cmd: MSG_PUBLISH, body: amsg}
+	msg := &proto.Message{Cmd: proto.MSG_PUBLISH, Body: amsg}
 	for c := range s {
 		if client == c { // 如果从im过来的，消息已经从im发送出去了，这里是发送给其他im机器上的
 			continue
 		}
 		c.wt <- msg
 	}
+
+	if config.isPushSystem && !IsUserOnline(receiver.Uid) {
+		PushOfflineMessage(amsg)
+	}
 }
 
-func (client *Client) ContainAppUserID(id *UserID) bool {
+func (client *Client) ContainAppUserID(id *proto.UserID) bool {
 	route := client.route
-	return route.ContainUserID(id.uid)
+	return route.ContainUserID(id.Uid)
 }
 
 func (client *Client) Write() {
+	defer writers.Done()
 	seq := 0
 	for {
 		msg := <-client.wt
@@ -95,7 +102,7 @@ func (client *Client) Write() {
 			break
 		}
 		seq++
-		msg.seq = seq
+		msg.Seq = seq
 		client.send(msg)
 	}
 }
@@ -104,30 +111,30 @@ func (client *Client) close() {
 	client.conn.Close()
 }
 
-func (client *Client) send(msg *Message) {
-	SendMessage(client.conn, msg)
+func (client *Client) send(msg *proto.Message) {
+	proto.SendMessage(client.conn, msg)
 }
 
-func (client *Client) HandleSubscribe(id *SubscribeMessage) {
-	log.Infof("subscribe uid:%d online:%d", id.uid, id.online)
+func (client *Client) HandleSubscribe(id *proto.SubscribeMessage) {
+	log.Infof("subscribe uid:%d online:%d", id.Uid, id.Online)
 	route := client.route
-	on := id.online != 0
-	route.AddUserID(id.uid, on)
+	on := id.Online != 0
+	route.AddUserID(id.Uid, on)
 }
 
-func (client *Client) HandleUnsubscribe(id *UserID) {
-	log.Infof("unsubscribe uid:%d", id.uid)
+func (client *Client) HandleUnsubscribe(id *proto.UserID) {
+	log.Infof("unsubscribe uid:%d", id.Uid)
 
 	route := client.route
-	route.RemoveUserID(id.uid)
+	route.RemoveUserID(id.Uid)
 }
 
-func (client *Client) HandlePublishGroup(amsg *AppMessage) {
-	log.WithFields(log.Fields{ "msgId": amsg.msgId, "receiver": amsg.receiver, "cmd": amsg.msg.cmd}).Info("分发群组消息")
+func (client *Client) HandlePublishGroup(amsg *proto.AppMessage) {
+	log.WithFields(log.Fields{ "msgId": amsg.MsgId, "receiver": amsg.Receiver, "cmd": amsg.Msg.Cmd}).Info("分发群组消息")
 	// 群发给所有接入服务器
 	s := GetClientSet()
 
-	msg := &Message{cmd: MSG_PUBLISH_GROUP, body: amsg}
+	msg := &proto.Message{Cmd: proto.MSG_PUBLISH_GROUP, Body: amsg}
 	for c := range s {
 		//不发送给自身
 		if client == c {
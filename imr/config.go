@@ -5,9 +5,12 @@ type RouteConfig struct {
 	redisAddr     string
 	redisPassword string
 	redisDB       int
-	isPushSystem  bool
+	isPushSystem  bool //用户不在线时把消息放到推送队列
 	httpListenAddress string
 
+	//退出时等待im断开连接的时间, 单位秒
+	shutdownTimeout int
+
 
 	logFilename        string
 	logLevel           string
@@ -20,6 +23,7 @@ func readConfig() *RouteConfig  {
 	config := new(RouteConfig)
 
 	config.listen = ":4444"
+	config.shutdownTimeout = 10
 
 
 	//config.logFilename = "/Users/zengqiang96/logs/imr.log"
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"sx-chat/proto"
+)
+
+//推送服务从这两个队列中读取需要推送给离线用户的消息
+const PUSH_QUEUE = "push_queue"
+const GROUP_PUSH_QUEUE = "group_push_queue"
+
+type PushMessage struct {
+	Sender   int64  `json:"sender"`
+	Receiver int64  `json:"receiver"`
+	GroupId  int64  `json:"group_id,omitempty"`
+	Content  string `json:"content,omitempty"` //消息的纯文本, 用于推送的预览
+	Mention  bool   `json:"mention,omitempty"` //用户在群组消息中被@
+}
+
+// 用户不在线时把消息交给推送服务
+// 超级群的消息不会逐个用户发布, 只有被@的成员通过MSG_GROUP_MENTION推送
+func PushOfflineMessage(amsg *proto.AppMessage) {
+	msg := amsg.Msg
+	var queue string
+	var pm *PushMessage
+	switch msg.Cmd {
+	case proto.MSG_IM:
+		im := msg.Body.(*proto.IMMessage)
+		queue = PUSH_QUEUE
+		pm = &PushMessage{Sender: im.Sender, Receiver: amsg.Receiver, Content: proto.ContentPlainText(im.MessageType, im.Content)}
+	case proto.MSG_GROUP_IM:
+		im := msg.Body.(*proto.IMMessage)
+		queue = GROUP_PUSH_QUEUE
+		pm = &PushMessage{Sender: im.Sender, Receiver: amsg.Receiver, GroupId: im.Receiver, Content: proto.ContentPlainText(im.MessageType, im.Content),
+			Mention: im.IsMentioned(amsg.Receiver)}
+	case proto.MSG_GROUP_MENTION:
+		mention := msg.Body.(*proto.GroupMention)
+		queue = GROUP_PUSH_QUEUE
+		pm = &PushMessage{Sender: mention.Sender, Receiver: amsg.Receiver, GroupId: mention.GroupId, Mention: true}
+	default:
+		return
+	}
+
+	//发送者自己的其它设备
+	if pm.Sender == pm.Receiver {
+		return
+	}
+
+	b, err := json.Marshal(pm)
+	if err != nil {
+		return
+	}
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("RPUSH", queue, b)
+	if err != nil {
+		log.WithFields(log.Fields{"receiver": amsg.Receiver, "err": err}).Warning("保存推送消息失败")
+	}
+}
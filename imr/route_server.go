@@ -8,6 +8,7 @@ import (
 	"math/rand"
 	"net"
 	"runtime"
+	"sx-chat/proto"
 	"sync"
 	"time"
 )
@@ -30,7 +31,11 @@ func main() {
 
 	redisPool = NewRedisPool(config.redisAddr, config.redisPassword, config.redisDB)
 
-	ListenClient()
+	go ListenClient()
+
+	WaitSignal()
+	Shutdown()
+	log.Info("exit")
 }
 
 func ListenClient() {
@@ -50,9 +55,14 @@ func Listen(f func(conn *net.TCPConn), listenAddr string) {
 		return
 	}
 
+	clientListener = tcpListener
+
 	for {
 		client, err := tcpListener.AcceptTCP()
 		if err != nil {
+			if IsShuttingDown() {
+				log.Info("停止接受新连接")
+			}
 			return
 		}
 		f(client)
@@ -95,8 +105,12 @@ func NewRedisPool(server, password string, db int) *redis.Pool {
 	}
 }
 
+// 推送离线消息时在每个im连接的goroutine中调用, clients需要加锁
 func IsUserOnline(uid int64) bool {
-	id := &UserID{ uid: uid}
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	id := &proto.UserID{ Uid: uid}
 	for c := range clients {
 		if c.IsAppUserOnline(id) {
 			return true
@@ -105,7 +119,7 @@ func IsUserOnline(uid int64) bool {
 	return false
 }
 
-func FindClientSet(id *UserID) ClientSet {
+func FindClientSet(id *proto.UserID) ClientSet {
 	mutex.Lock()
 	defer mutex.Unlock()
 
@@ -145,6 +159,13 @@ func GetClientSet() ClientSet {
 	return s
 }
 
+func GetClientCount() int {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return len(clients)
+}
+
 func initLog() {
 	if config.logFilename != "" {
 		writer := &lumberjack.Logger{
@@ -0,0 +1,60 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var clientListener net.Listener
+
+var shuttingDown int32
+
+//所有客户端的Write, 退出之后连接已经关闭
+var writers sync.WaitGroup
+
+func IsShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// 阻塞直到收到SIGTERM或者SIGINT
+func WaitSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-c
+	log.WithField("signal", sig).Info("收到退出信号")
+}
+
+// 停止接受新连接, 关闭im连接的读端,
+// Read退出之后移除client并关闭wt, Write发送完wt中的消息之后关闭连接
+func Shutdown() {
+	atomic.StoreInt32(&shuttingDown, 1)
+
+	if clientListener != nil {
+		clientListener.Close()
+	}
+
+	s := GetClientSet()
+	log.WithField("count", len(s)).Info("关闭im连接")
+	for c := range s {
+		c.conn.CloseRead()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		writers.Wait()
+		close(done)
+	}()
+
+	timeout := time.Duration(config.shutdownTimeout) * time.Second
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.WithField("count", GetClientCount()).Warning("等待im断开超时")
+	}
+}
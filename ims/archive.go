@@ -0,0 +1,296 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 冷数据归档: 超过一定时间没有写入的消息文件压缩之后上传到对象存储, 然后删除本地文件
+// 读取已经归档的消息时下载到本地的缓存目录, 缓存的文件数量超过限制时删除最久没有使用的
+
+const ARCHIVE_SUFFIX = ".gz"
+const ARCHIVE_CACHE_DIR = "archive_cache"
+
+//检查是否有需要归档的文件的间隔
+const ARCHIVE_CHECK_INTERVAL = time.Hour
+
+var errArchiveNotFound = errors.New("archive not found")
+
+// 归档使用的对象存储, Put需要是原子的, 不能读到上传到一半的对象
+type ArchiveStore interface {
+	Put(name string, r io.Reader) error
+	Get(name string) (io.ReadCloser, error) //不存在时返回errArchiveNotFound
+	Exists(name string) (bool, error)
+}
+
+// 保存在本地目录的对象存储, 用于测试或者挂载的网络文件系统
+type LocalArchiveStore struct {
+	root string
+}
+
+func NewLocalArchiveStore(root string) *LocalArchiveStore {
+	return &LocalArchiveStore{root: root}
+}
+
+func (s *LocalArchiveStore) Put(name string, r io.Reader) error {
+	if err := os.MkdirAll(s.root, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(s.root, name+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = io.Copy(tmp, r); err == nil {
+		err = tmp.Sync()
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.root, name))
+}
+
+func (s *LocalArchiveStore) Get(name string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(s.root, name))
+	if os.IsNotExist(err) {
+		return nil, errArchiveNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *LocalArchiveStore) Exists(name string) (bool, error) {
+	_, err := os.Stat(filepath.Join(s.root, name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+type BlockArchive struct {
+	store       ArchiveStore
+	cacheDir    string
+	cacheBlocks int //缓存目录中最多保留的文件数量
+
+	//同时只下载一个文件, 保护缓存目录
+	mutex sync.Mutex
+}
+
+func NewBlockArchive(store ArchiveStore, cacheDir string, cacheBlocks int) *BlockArchive {
+	if cacheBlocks <= 0 {
+		cacheBlocks = 1
+	}
+	return &BlockArchive{store: store, cacheDir: cacheDir, cacheBlocks: cacheBlocks}
+}
+
+func archiveName(blockNo int) string {
+	return fmt.Sprintf("message_%d%s", blockNo, ARCHIVE_SUFFIX)
+}
+
+// 压缩上传一个block, 下载校验内容一致之后才可以删除本地文件
+func (a *BlockArchive) archiveBlock(path string, blockNo int) error {
+	name := archiveName(blockNo)
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	h := crc32.New(crcTable)
+	var size int64
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		n, err := io.Copy(zw, io.TeeReader(file, h))
+		if err == nil {
+			err = zw.Close()
+		}
+		size = n
+		pw.CloseWithError(err)
+	}()
+	err = a.store.Put(name, pr)
+	//上传失败时结束压缩的goroutine
+	pr.Close()
+	if err != nil {
+		return err
+	}
+
+	r, err := a.store.Get(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	h2 := crc32.New(crcTable)
+	n, err := io.Copy(h2, zr)
+	if err != nil {
+		return err
+	}
+	if n != size || h2.Sum32() != h.Sum32() {
+		return fmt.Errorf("archive %s mismatch size:%d expect:%d", name, n, size)
+	}
+	return nil
+}
+
+// 下载归档的block到缓存目录, 返回本地文件的路径
+func (a *BlockArchive) fetch(blockNo int) (string, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.fetchLocked(blockNo)
+}
+
+func (a *BlockArchive) fetchLocked(blockNo int) (string, error) {
+	path := filepath.Join(a.cacheDir, fmt.Sprintf("message_%d", blockNo))
+	if _, err := os.Stat(path); err == nil {
+		//修改时间作为最近使用的时间
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		return path, nil
+	}
+
+	r, err := a.store.Get(archiveName(blockNo))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(a.cacheDir, 0755); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(a.cacheDir, "fetch")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(tmp, zr)
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	a.evictCache(path)
+	return path, nil
+}
+
+// 清零已经归档的block中的记录之后重新上传, 返回已经清零的消息id
+// 缓存文件在原地修改, 已经打开的缓存文件也读不到清零的记录
+// 上传失败时返回错误, 保留过期时间下次重试, 这之前读取时按过期时间过滤
+func (a *BlockArchive) purgeArchived(blockNo int, ids []int64) ([]int64, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	path, err := a.fetchLocked(blockNo)
+	if err != nil {
+		return nil, err
+	}
+	purged, err := purgeRecords(path, ids)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.archiveBlock(path, blockNo); err != nil {
+		return nil, err
+	}
+	return purged, nil
+}
+
+// 删除多余的缓存文件, 已经打开的文件删除之后仍然可以读取
+// 在mutex内调用, 这时其它的文件都是上次下载到一半的临时文件
+func (a *BlockArchive) evictCache(keep string) {
+	infos, err := ioutil.ReadDir(a.cacheDir)
+	if err != nil {
+		log.WithField("err", err).Warning("读取归档缓存目录失败")
+		return
+	}
+	var files []os.FileInfo
+	for _, info := range infos {
+		path := filepath.Join(a.cacheDir, info.Name())
+		if !strings.HasPrefix(info.Name(), "message_") {
+			os.Remove(path)
+			continue
+		}
+		if path != keep {
+			files = append(files, info)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for i := 0; i < len(files)+1-a.cacheBlocks; i++ {
+		os.Remove(filepath.Join(a.cacheDir, files[i].Name()))
+	}
+}
+
+// 归档修改时间早于before的block, 当前写入的block不归档, 返回归档的文件数量
+func (storage *StorageFile) archiveBlocks(before time.Time) int {
+	blocks, err := listBlocks(storage.root)
+	if err != nil {
+		log.WithField("err", err).Warning("查找消息文件失败")
+		return 0
+	}
+	storage.mutex.Lock()
+	current := storage.blockNo
+	storage.mutex.Unlock()
+
+	storage.maintainMutex.Lock()
+	defer storage.maintainMutex.Unlock()
+
+	count := 0
+	for _, blockNo := range blocks {
+		if blockNo >= current {
+			break
+		}
+		path := blockPath(storage.root, blockNo)
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().After(before) {
+			continue
+		}
+		//上传之前清零已经过期的记录, 之后过期的记录由purgeExpired重写归档
+		if ids := storage.expiry.expiredInBlock(blockNo, int32(time.Now().Unix())); len(ids) > 0 {
+			purged, err := purgeRecords(path, ids)
+			if err != nil {
+				log.WithFields(log.Fields{"block": blockNo, "err": err}).Warning("归档之前清除过期消息失败")
+				continue
+			}
+			storage.expiry.remove(purged)
+		}
+		begin := time.Now()
+		if err := storage.archive.archiveBlock(path, blockNo); err != nil {
+			log.WithFields(log.Fields{"block": blockNo, "err": err}).Warning("归档消息文件失败")
+			continue
+		}
+		//已经打开的文件删除之后仍然可以读取, 之后的读取从归档下载
+		if err := os.Remove(path); err != nil {
+			log.WithFields(log.Fields{"block": blockNo, "err": err}).Warning("删除已归档的消息文件失败")
+			continue
+		}
+		count++
+		log.WithFields(log.Fields{"block": blockNo, "size": info.Size(), "used": time.Since(begin)}).Info("归档消息文件")
+	}
+	return count
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sx-chat/proto"
+	"testing"
+	"time"
+)
+
+// 归档之后删除本地文件, 读取旧的消息时从归档下载
+func TestArchiveBlocks(t *testing.T) {
+	root, err := ioutil.TempDir("", "ims")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	file := NewStorageFile(root, SYNC_NONE)
+	save := func(content string) int64 {
+		im := &proto.IMMessage{Sender: 1, Receiver: 2, Content: content}
+		return file.saveMessage(&proto.Message{Cmd: proto.MSG_IM, Version: STORAGE_VERSION, Body: im})
+	}
+	id0 := save("block 0")
+	file.mutex.Lock()
+	file.nextBlock()
+	file.mutex.Unlock()
+	id1 := save("block 1")
+
+	store := NewLocalArchiveStore(filepath.Join(root, "archive"))
+	file.archive = NewBlockArchive(store, filepath.Join(root, ARCHIVE_CACHE_DIR), 1)
+	if n := file.archiveBlocks(time.Now().Add(-time.Hour)); n != 0 {
+		t.Fatalf("archive recent blocks:%d", n)
+	}
+	if n := file.archiveBlocks(time.Now().Add(time.Hour)); n != 1 {
+		t.Fatalf("archive blocks:%d", n)
+	}
+	if _, err := os.Stat(blockPath(root, 0)); !os.IsNotExist(err) {
+		t.Fatalf("archived block still exists:%v", err)
+	}
+	if exists, _ := store.Exists(archiveName(0)); !exists {
+		t.Fatal("archive not uploaded")
+	}
+
+	load := func(msgId int64) string {
+		msg := file.LoadMessage(msgId)
+		if msg == nil {
+			return ""
+		}
+		return msg.Body.(*proto.IMMessage).Content
+	}
+	if c := load(id0); c != "block 0" {
+		t.Errorf("load archived message:%q", c)
+	}
+	if c := load(id1); c != "block 1" {
+		t.Errorf("load message:%q", c)
+	}
+	if _, err := os.Stat(filepath.Join(root, ARCHIVE_CACHE_DIR, "message_0")); err != nil {
+		t.Errorf("archived block not cached:%v", err)
+	}
+}
@@ -15,6 +15,13 @@ type StorageConfig struct {
 	Limit         int //单次离线消息的数量限制
 	hardLimit     int //离线消息总的数量限制
 
+	syncMode     int //消息文件同步到磁盘的方式 SYNC_NONE/SYNC_INTERVAL/SYNC_WRITE
+	syncInterval int //SYNC_INTERVAL模式下的同步间隔, 单位毫秒
+
+	archiveRoot        string //归档使用的对象存储目录, 为空时不归档
+	archiveAfter       int    //超过多少天没有写入的消息文件归档
+	archiveCacheBlocks int    //本地缓存的已归档文件数量
+
 	logFilename string
 	logLevel    string
 	logBackup   int //log files
@@ -27,6 +34,11 @@ func readStorageConf() *StorageConfig {
 
 	config.rpcListen = ":13333"
 	config.storageRoot = "/data/ims"
+	config.syncMode = SYNC_WRITE
+	config.syncInterval = 1000
+
+	config.archiveAfter = 30
+	config.archiveCacheBlocks = 8
 
 	//config.logFilename = "/Users/zengqiang96/logs/ims.log"
 	config.logAge = 30
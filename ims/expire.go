@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"sort"
+	"sx-chat/proto"
+	"sync"
+	"time"
+)
+
+// 消息过期: 带有Ttl的消息在过期之后同步和搜索时跳过, 定时把过期的消息记录清零
+// 过期时间按照消息本体的id保存在内存中, 按发送时间过期的消息在保存时加入
+// 阅后即焚的消息在接收者第一次阅读之后由im设置, 同时写入一条MSG_EXPIRE_RECORD, 修复索引时恢复
+// 已经归档的block清零之后重新上传, 上传成功之前保留过期时间继续在读取时过滤
+const EXPIRE_INDEX_FILE_NAME = "expire_index.v1"
+
+//清除过期消息的间隔
+const EXPIRE_PURGE_INTERVAL = 10 * time.Minute
+
+const EXPIRE_INDEX_SIZE = 12
+
+var errPurgedRecord = errors.New("purged record")
+
+func init() {
+	proto.RegisterMessage(proto.MSG_EXPIRE_RECORD, func() proto.IMessage { return new(ExpireRecord) })
+}
+
+// msgId(8) expireAt(4)
+type ExpireRecord struct {
+	msgId    int64
+	expireAt int32
+}
+
+func (r *ExpireRecord) ToData() []byte {
+	buf := make([]byte, EXPIRE_INDEX_SIZE)
+	binary.BigEndian.PutUint64(buf[0:], uint64(r.msgId))
+	binary.BigEndian.PutUint32(buf[8:], uint32(r.expireAt))
+	return buf
+}
+
+func (r *ExpireRecord) FromData(buff []byte) bool {
+	if len(buff) < EXPIRE_INDEX_SIZE {
+		return false
+	}
+	r.msgId = int64(binary.BigEndian.Uint64(buff[0:]))
+	r.expireAt = int32(binary.BigEndian.Uint32(buff[8:]))
+	return true
+}
+
+type ExpireIndex struct {
+	mutex   sync.Mutex
+	entries map[int64]int32 //消息本体的id -> 过期时间
+	dirty   bool
+}
+
+func NewExpireIndex() *ExpireIndex {
+	return &ExpireIndex{entries: make(map[int64]int32)}
+}
+
+// 已经有过期时间时保留较早的
+func (index *ExpireIndex) Add(msgId int64, expireAt int32) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	if e, ok := index.entries[msgId]; ok && e <= expireAt {
+		return
+	}
+	index.entries[msgId] = expireAt
+	index.dirty = true
+}
+
+// 保存消息本体时调用, 只处理按发送时间过期的消息
+func (index *ExpireIndex) AddMessage(msgId int64, msg *proto.Message) {
+	if im, ok := msg.Body.(*proto.IMMessage); ok && im.ExpireAt() > 0 {
+		index.Add(msgId, im.ExpireAt())
+	}
+}
+
+func (index *ExpireIndex) Get(msgId int64) (int32, bool) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	e, ok := index.entries[msgId]
+	return e, ok
+}
+
+func (index *ExpireIndex) IsExpired(msgId int64, now int32) bool {
+	e, ok := index.Get(msgId)
+	return ok && e <= now
+}
+
+// 返回已经过期的消息id, 从小到大排列
+func (index *ExpireIndex) expired(now int32) []int64 {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	ids := make([]int64, 0, 16)
+	for msgId, e := range index.entries {
+		if e <= now {
+			ids = append(ids, msgId)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (index *ExpireIndex) expiredInBlock(blockNo int, now int32) []int64 {
+	ids := index.expired(now)
+	n := 0
+	for _, msgId := range ids {
+		if int(msgId/BLOCK_SIZE) == blockNo {
+			ids[n] = msgId
+			n++
+		}
+	}
+	return ids[:n]
+}
+
+func (index *ExpireIndex) remove(ids []int64) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	for _, msgId := range ids {
+		delete(index.entries, msgId)
+	}
+	if len(ids) > 0 {
+		index.dirty = true
+	}
+}
+
+// 有修改时返回所有的过期时间, 在indexMutex的写锁内调用
+func (index *ExpireIndex) takeDirty() map[int64]int32 {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	if !index.dirty {
+		return nil
+	}
+	index.dirty = false
+	entries := make(map[int64]int32, len(index.entries))
+	for msgId, e := range index.entries {
+		entries[msgId] = e
+	}
+	return entries
+}
+
+// 修复索引时恢复最后一次保存之后的过期时间
+func (index *ExpireIndex) execMessage(msg *proto.Message, msgId int64) {
+	if r, ok := msg.Body.(*ExpireRecord); ok {
+		index.Add(r.msgId, r.expireAt)
+		return
+	}
+	index.AddMessage(msgId, msg)
+}
+
+// 过期时间的数量比较少, 每次保存完整的文件
+func (storage *Storage) flushExpireIndex(entries map[int64]int32) {
+	if entries == nil {
+		return
+	}
+	writeIndexFile(storage.indexPath(EXPIRE_INDEX_FILE_NAME), func(w io.Writer) {
+		var buf [EXPIRE_INDEX_SIZE]byte
+		for msgId, e := range entries {
+			binary.BigEndian.PutUint64(buf[0:], uint64(msgId))
+			binary.BigEndian.PutUint32(buf[8:], uint32(e))
+			w.Write(buf[:])
+		}
+	})
+	log.WithField("count", len(entries)).Info("保存过期时间索引")
+}
+
+func (storage *Storage) loadExpireIndex(index *ExpireIndex) {
+	readIndexFile(storage.indexPath(EXPIRE_INDEX_FILE_NAME), func(r io.Reader) error {
+		var buf [EXPIRE_INDEX_SIZE]byte
+		for {
+			_, err := io.ReadFull(r, buf[:])
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			index.Add(int64(binary.BigEndian.Uint64(buf[0:])), int32(binary.BigEndian.Uint32(buf[8:])))
+		}
+	})
+	//加载的索引已经保存过了
+	index.takeDirty()
+}
+
+// 设置阅后即焚的消息的过期时间, 已经设置过时不再修改
+// 返回生效的过期时间, 消息不在用户的收件箱中或者不是阅后即焚的消息时返回0
+func (storage *Storage) ExpireMessage(uid, syncId int64, expireAt int32) int32 {
+	msgId, msg := storage.findPeerMessage(uid, syncId)
+	if msg == nil {
+		return 0
+	}
+	im, ok := msg.Body.(*proto.IMMessage)
+	if !ok || !im.BurnAfterRead || im.Ttl <= 0 {
+		return 0
+	}
+	if e, ok := storage.expiry.Get(msgId); ok {
+		return e
+	}
+
+	storage.indexMutex.RLock()
+	defer storage.indexMutex.RUnlock()
+	storage.saveMessage(&proto.Message{Cmd: proto.MSG_EXPIRE_RECORD, Body: &ExpireRecord{msgId: msgId, expireAt: expireAt}})
+	storage.expiry.Add(msgId, expireAt)
+	e, _ := storage.expiry.Get(msgId)
+	return e
+}
+
+// 查找用户收件箱中同步id是syncId的点对点消息, 返回消息本体的id和消息
+// 本地保存的消息同步id就是消息本体的id, 迁移过来的消息需要沿着队列查找
+func (storage *Storage) findPeerMessage(uid, syncId int64) (int64, *proto.Message) {
+	if msg := storage.LoadMessage(syncId); msg != nil && msg.Cmd == proto.MSG_IM {
+		if im := msg.Body.(*proto.IMMessage); im.Receiver == uid || im.Sender == uid {
+			return syncId, msg
+		}
+	}
+
+	index := storage.getPeerIndex(uid)
+	for id := index.lastId; id > 0; {
+		msg := storage.LoadMessage(id)
+		if msg == nil {
+			return 0, nil
+		}
+		off, ok := msg.Body.(*OfflineMessage)
+		if !ok || off.syncId() < syncId {
+			return 0, nil
+		}
+		if off.syncId() == syncId {
+			m := storage.LoadMessage(off.msgId)
+			if m == nil || m.Cmd != proto.MSG_IM {
+				return 0, nil
+			}
+			return off.msgId, m
+		}
+		id = off.prevMsgId
+	}
+	return 0, nil
+}
+
+// 把过期的消息记录清零, 返回清除的数量
+// 离线消息队列中的记录不修改, 读取时跳过清零的消息本体
+func (storage *Storage) purgeExpired(now int32) int {
+	ids := storage.expiry.expired(now)
+	if len(ids) == 0 {
+		return 0
+	}
+
+	//和归档互斥, 不会上传清零之前的内容之后删除本地文件
+	storage.maintainMutex.Lock()
+	defer storage.maintainMutex.Unlock()
+
+	purged := make([]int64, 0, len(ids))
+	for i := 0; i < len(ids); {
+		blockNo := storage.getBlockNo(ids[i])
+		j := i
+		for j < len(ids) && storage.getBlockNo(ids[j]) == blockNo {
+			j++
+		}
+		n, err := storage.purgeBlock(blockNo, ids[i:j])
+		if err != nil {
+			log.WithFields(log.Fields{"block": blockNo, "err": err}).Warning("清除过期消息失败")
+		}
+		purged = append(purged, n...)
+		i = j
+	}
+	storage.expiry.remove(purged)
+	if len(purged) > 0 {
+		log.WithFields(log.Fields{"expired": len(ids), "purged": len(purged)}).Info("清除过期消息")
+	}
+	return len(purged)
+}
+
+// 本地文件不存在时清零归档中的记录, 没有归档的记录直接丢弃
+func (storage *Storage) purgeBlock(blockNo int, ids []int64) ([]int64, error) {
+	n, err := purgeRecords(blockPath(storage.root, blockNo), ids)
+	if !os.IsNotExist(err) {
+		return n, err
+	}
+	if storage.archive != nil {
+		n, err = storage.archive.purgeArchived(blockNo, ids)
+		if err != errArchiveNotFound {
+			return n, err
+		}
+	}
+	log.WithFields(log.Fields{"block": blockNo, "count": len(ids)}).Warning("过期消息所在的消息文件不存在")
+	return ids, nil
+}
+
+// 清零一个block中的记录, 返回已经清零的消息id, 已经清零的记录也算在内
+func purgeRecords(path string, ids []int64) ([]int64, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	version := readFileVersion(file)
+
+	purged := make([]int64, 0, len(ids))
+	for _, msgId := range ids {
+		offset := msgId % BLOCK_SIZE
+		_, n, err := readRecord(file, offset, version)
+		if err == errPurgedRecord {
+			purged = append(purged, msgId)
+			continue
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"msgId": msgId, "err": err}).Warning("过期消息的记录无效")
+			continue
+		}
+		if _, err := file.WriteAt(make([]byte, n), offset); err != nil {
+			return purged, err
+		}
+		purged = append(purged, msgId)
+	}
+	return purged, file.Sync()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sx-chat/proto"
+	"testing"
+	"time"
+)
+
+// 过期的消息同步和搜索时跳过, 清除之后记录清零, 重启之后阅后即焚的过期时间仍然有效
+func TestExpireMessages(t *testing.T) {
+	s, root := newTestStorage(t)
+	defer os.RemoveAll(root)
+
+	now := int32(time.Now().Unix())
+	save := func(im *proto.IMMessage) int64 {
+		im.Sender, im.Receiver = 1, 2
+		msgId, _ := s.SavePeerMessage(2, 1, &proto.Message{Cmd: proto.MSG_IM, Version: STORAGE_VERSION, Body: im})
+		return msgId
+	}
+	keepId := save(&proto.IMMessage{Timestamp: now, Content: "keep"})
+	expiredId := save(&proto.IMMessage{Timestamp: now - 100, Ttl: 10, Content: "expired"})
+	liveId := save(&proto.IMMessage{Timestamp: now, Ttl: 3600, Content: "live"})
+	burnId := save(&proto.IMMessage{Timestamp: now, Ttl: 10, BurnAfterRead: true, Content: "burn"})
+
+	history := func(s *Storage) []int64 {
+		messages, _, _ := s.LoadHistoryMessages(2, 0, 0, 0)
+		ids := make([]int64, 0, len(messages))
+		for _, m := range messages {
+			ids = append(ids, m.msgId)
+		}
+		return ids
+	}
+	if ids := history(s); len(ids) != 3 || ids[0] != burnId || ids[1] != liveId || ids[2] != keepId {
+		t.Fatalf("history:%v", ids)
+	}
+	if r, _, _ := s.SearchMessages(2, false, "expired", 0, 10, func(*proto.Message) bool { return true }); len(r) != 0 {
+		t.Errorf("search expired:%d", len(r))
+	}
+
+	//只有阅后即焚的消息可以设置过期时间, 第一次设置之后不再修改
+	if e := s.ExpireMessage(2, liveId, now); e != 0 {
+		t.Errorf("expire live:%d", e)
+	}
+	if e := s.ExpireMessage(3, burnId, now); e != 0 {
+		t.Errorf("expire other user:%d", e)
+	}
+	if e := s.ExpireMessage(2, burnId, now-1); e != now-1 {
+		t.Errorf("expire burn:%d", e)
+	}
+	if e := s.ExpireMessage(2, burnId, now+100); e != now-1 {
+		t.Errorf("expire burn again:%d", e)
+	}
+	if ids := history(s); len(ids) != 2 || ids[0] != liveId {
+		t.Errorf("history after read:%v", ids)
+	}
+
+	if n := s.purgeExpired(now); n != 2 {
+		t.Errorf("purged:%d", n)
+	}
+	if s.LoadMessage(expiredId) != nil || s.LoadMessage(burnId) != nil {
+		t.Error("purged message readable")
+	}
+	if _, ok := s.expiry.Get(burnId); ok {
+		t.Error("purged expire entry")
+	}
+	s.file.Close()
+
+	//没有保存索引时从消息文件中恢复
+	s2 := NewStorage(root, SYNC_NONE)
+	if ids := history(s2); len(ids) != 2 || ids[0] != liveId || ids[1] != keepId {
+		t.Errorf("history after restart:%v", ids)
+	}
+	if e, ok := s2.expiry.Get(liveId); !ok || e != now+3600 {
+		t.Errorf("live expire:%d %v", e, ok)
+	}
+}
+
+// 已经归档的消息过期之后清零归档中的记录, 重新下载之后也读不到
+func TestPurgeArchivedMessages(t *testing.T) {
+	s, root := newTestStorage(t)
+	defer os.RemoveAll(root)
+
+	now := int32(time.Now().Unix())
+	im := &proto.IMMessage{Sender: 1, Receiver: 2, Timestamp: now, Ttl: 10, BurnAfterRead: true, Content: "burn"}
+	burnId, _ := s.SavePeerMessage(2, 1, &proto.Message{Cmd: proto.MSG_IM, Version: STORAGE_VERSION, Body: im})
+	keepId, _ := s.SavePeerMessage(2, 1, &proto.Message{Cmd: proto.MSG_IM, Version: STORAGE_VERSION, Body: &proto.IMMessage{Sender: 1, Receiver: 2, Content: "keep"}})
+	s.mutex.Lock()
+	s.nextBlock()
+	s.mutex.Unlock()
+
+	cacheDir := filepath.Join(root, ARCHIVE_CACHE_DIR)
+	s.archive = NewBlockArchive(NewLocalArchiveStore(filepath.Join(root, "archive")), cacheDir, 1)
+	if n := s.archiveBlocks(time.Now().Add(time.Hour)); n != 1 {
+		t.Fatalf("archive blocks:%d", n)
+	}
+	if e := s.ExpireMessage(2, burnId, now-1); e != now-1 {
+		t.Fatalf("expire burn:%d", e)
+	}
+	if n := s.purgeExpired(now); n != 1 {
+		t.Fatalf("purged:%d", n)
+	}
+	if _, ok := s.expiry.Get(burnId); ok {
+		t.Error("purged expire entry")
+	}
+
+	os.RemoveAll(cacheDir)
+	s.archive = NewBlockArchive(s.archive.store, cacheDir, 1)
+	if _, err := s.archive.fetch(s.getBlockNo(burnId)); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(filepath.Join(cacheDir, "message_0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	version := readFileVersion(file)
+	if r, _, err := readRecord(file, burnId%BLOCK_SIZE, version); err != errPurgedRecord {
+		t.Errorf("archived record:%v %v", r, err)
+	}
+	if r, _, err := readRecord(file, keepId%BLOCK_SIZE, version); err != nil || r == nil {
+		t.Errorf("archived keep record:%v", err)
+	}
+}
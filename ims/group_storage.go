@@ -1,14 +1,14 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
-	"fmt"
 	log "github.com/sirupsen/logrus"
-	"os"
+	"sx-chat/proto"
+	"sync"
+	"time"
 )
 
-const GROUP_INDEX_FILE_NAME = "group_index.v2"
+//group_index.v2没有正确保存, 启动时不再读取
+const GROUP_INDEX_FILE_NAME = "group_index.v3"
 
 type GroupId struct {
 	gid   int64
@@ -21,24 +21,68 @@ type GroupIndex struct {
 	lastSeqId   int64
 }
 
+type groupIndexShard struct {
+	mutex        sync.Mutex
+	messageIndex map[GroupId]*GroupIndex
+
+	//上次保存索引之后修改过的群组
+	dirty map[GroupId]*GroupIndex
+}
+
+func (shard *groupIndexShard) get(gid int64) *GroupIndex {
+	if groupIndex, ok := shard.messageIndex[GroupId{gid: gid}]; ok {
+		return groupIndex
+	}
+	return &GroupIndex{}
+}
+
+func (shard *groupIndexShard) set(gid int64, index *GroupIndex) {
+	id := GroupId{gid: gid}
+	shard.messageIndex[id] = index
+	shard.dirty[id] = index
+}
+
 type GroupStorage struct {
 	*StorageFile
-	messageIndex map[GroupId]*GroupIndex
+	shards [INDEX_SHARDS]*groupIndexShard
+
+	search *SearchIndex
 }
 
 func NewGroupStorage(f *StorageFile) *GroupStorage {
 	storage := &GroupStorage{StorageFile: f}
-	storage.messageIndex = make(map[GroupId]*GroupIndex)
+	for i := range storage.shards {
+		storage.shards[i] = &groupIndexShard{
+			messageIndex: make(map[GroupId]*GroupIndex),
+			dirty:        make(map[GroupId]*GroupIndex),
+		}
+	}
 	return storage
 }
 
-func (storage *GroupStorage) SaveGroupMessage(gid, deviceID int64, msg *Message) (int64, int64) {
-	storage.mutex.Lock()
-	defer storage.mutex.Unlock()
+func (storage *GroupStorage) shard(gid int64) *groupIndexShard {
+	return storage.shards[uint64(gid)%INDEX_SHARDS]
+}
+
+func (storage *GroupStorage) SaveGroupMessage(gid, deviceID int64, msg *proto.Message) (int64, int64) {
+	storage.indexMutex.RLock()
+	defer storage.indexMutex.RUnlock()
+
+	shard := storage.shard(gid)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	return storage.appendGroupMessage(shard, gid, deviceID, msg, 0)
+}
 
+// 在分片锁内调用, originId不为0时是迁移过来的消息, 返回同步使用的id和上一条消息的id
+func (storage *GroupStorage) appendGroupMessage(shard *groupIndexShard, gid, deviceID int64,
+	msg *proto.Message, originId int64) (int64, int64) {
 	msgId := storage.saveMessage(msg)
+	storage.search.Add([]int64{gid}, true, msgId, msg)
+	storage.expiry.AddMessage(msgId, msg)
 
-	index := storage.getGroupIndex(gid)
+	index := shard.get(gid)
 
 	lastId := index.lastId
 	lastBatchId := index.lastBatchId
@@ -52,95 +96,75 @@ func (storage *GroupStorage) SaveGroupMessage(gid, deviceID int64, msg *Message)
 	off.prevMsgId = lastId
 	off.prevPeerMsgId = 0
 	off.prevBatchMsgId = lastBatchId
+	off.originId = originId
 
-	m := &Message{cmd: MSG_GROUP_OFFLINE, body: off}
+	m := &proto.Message{Cmd: proto.MSG_GROUP_OFFLINE, Body: &off}
 	lastId = storage.saveMessage(m)
 
 	lastSeqId += 1
 	if lastSeqId%BATCH_SIZE == 0 {
 		lastBatchId = lastId
 	}
-	groupIndex := &GroupIndex{lastMsgId: msgId, lastId: lastId, lastBatchId: lastBatchId, lastSeqId: lastSeqId}
-	storage.setGroupIndex(gid, groupIndex)
-	return msgId, index.lastMsgId
+	groupIndex := &GroupIndex{lastMsgId: off.syncId(), lastId: lastId, lastBatchId: lastBatchId, lastSeqId: lastSeqId}
+	shard.set(gid, groupIndex)
+	storage.updateLastId(lastId)
+	return off.syncId(), index.lastMsgId
 }
 
 func (storage *GroupStorage) getGroupIndex(gid int64) *GroupIndex {
-	id := GroupId{gid: gid}
-	if groupIndex, ok := storage.messageIndex[id]; ok {
-		return groupIndex
-	}
-	return &GroupIndex{}
-
+	shard := storage.shard(gid)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	return shard.get(gid)
 }
 
 func (storage *GroupStorage) setGroupIndex(gid int64, index *GroupIndex) {
-	id := GroupId{gid: gid}
-	storage.messageIndex[id] = index
-	if index.lastId > storage.lastId {
-		storage.lastId = index.lastId
-	}
+	shard := storage.shard(gid)
+	shard.mutex.Lock()
+	shard.set(gid, index)
+	shard.mutex.Unlock()
+
+	storage.updateLastId(index.lastId)
 }
 
-func (storage *GroupStorage) cloneGroupIndex() map[GroupId]*GroupIndex {
-	messageIndex := make(map[GroupId]*GroupIndex)
-	for k, v := range storage.messageIndex {
-		messageIndex[k] = v
+// 启动时加载的索引, 不需要再保存
+func (storage *GroupStorage) initGroupIndex(messageIndex map[GroupId]*GroupIndex) {
+	for id, index := range messageIndex {
+		storage.shard(id.gid).messageIndex[id] = index
+		storage.updateLastId(index.lastId)
 	}
-	return messageIndex
 }
 
-func (storage *Storage) saveGroupIndex(messageIndex map[GroupId]*GroupIndex) {
-	path := fmt.Sprintf("%s/group_index_t", storage.root)
-	log.WithField("path", path).Info("持久化群组消息索引")
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		log.WithField("err", err).Fatal("打开文件失败")
-	}
-	defer file.Close()
-
-	buffer := new(bytes.Buffer)
-	index := 0
-	for id, value := range messageIndex {
-		binary.Write(buffer, binary.BigEndian, id.gid)
-		binary.Write(buffer, binary.BigEndian, value.lastMsgId)
-		binary.Write(buffer, binary.BigEndian, value.lastId)
-		binary.Write(buffer, binary.BigEndian, value.lastBatchId)
-		binary.Write(buffer, binary.BigEndian, value.lastSeqId)
-
-		index += 1
-		if index%1000 == 0 {
-			buf := buffer.Bytes()
-			n, err := file.Write(buf)
-			if err != nil {
-				log.WithField("err", err).Fatal("写入群组消息索引文件失败")
-			}
-			if n != len(buf) {
-				log.WithFields(log.Fields{"len": len(buf), "all": n}).Fatal("写入群组消息索引文件丢失数据")
-			}
+// 取出上次保存索引之后修改过的群组索引, 只交换每个分片的dirty
+func (storage *GroupStorage) takeDirtyGroupIndex() []map[GroupId]*GroupIndex {
+	dirty := make([]map[GroupId]*GroupIndex, 0, INDEX_SHARDS)
+	for _, shard := range storage.shards {
+		shard.mutex.Lock()
+		if len(shard.dirty) > 0 {
+			dirty = append(dirty, shard.dirty)
+			shard.dirty = make(map[GroupId]*GroupIndex)
 		}
-		buffer.Reset()
+		shard.mutex.Unlock()
 	}
+	return dirty
+}
 
-	buf := buffer.Bytes()
-	n, err := file.Write(buf)
-	if err != nil {
-		log.WithField("err", err).Fatal("写入群组消息索引文件失败")
-	}
-	if n != len(buf) {
-		log.WithFields(log.Fields{"len": len(buf), "all": n}).Fatal("写入群组消息索引文件丢失数据")
+func (storage *GroupStorage) execMessage(msg *proto.Message, msgId int64) {
+	if msg.Cmd != proto.MSG_GROUP_OFFLINE {
+		return
 	}
-	err = file.Sync()
-	if err != nil {
-		log.WithField("err", err).Fatal("sync群组消息索引文件失败")
+	off := msg.Body.(*OfflineMessage)
+	index := storage.getGroupIndex(off.receiver)
+	lastBatchId := index.lastBatchId
+	lastSeqId := index.lastSeqId + 1
+	if lastSeqId%BATCH_SIZE == 0 {
+		lastBatchId = msgId
 	}
+	storage.setGroupIndex(off.receiver, &GroupIndex{off.syncId(), msgId, lastBatchId, lastSeqId})
 
-	rename := fmt.Sprintf("%s/%s", storage.root, GROUP_INDEX_FILE_NAME)
-	err = os.Rename(path, rename)
-	if err != nil {
-		log.WithField("err", err).Fatal("重命名群组消息索引文件失败")
+	if m := storage.LoadMessage(off.msgId); m != nil {
+		storage.search.Add([]int64{off.receiver}, true, off.msgId, m)
 	}
-	log.Info("群组消息索引文件刷入到磁盘成功")
 }
 
 //获取所有消息id大于msgid的消息
@@ -151,6 +175,7 @@ func (storage *GroupStorage) LoadGroupHistoryMessage(uid, gid, msgId int64, ts i
 	lastId := messageIndex.lastId
 
 	var lastMsgId int64
+	now := int32(time.Now().Unix())
 	c := make([]*EMessage, 0, 10)
 
 	for ; lastId > 0; {
@@ -160,26 +185,30 @@ func (storage *GroupStorage) LoadGroupHistoryMessage(uid, gid, msgId int64, ts i
 			break
 		}
 
-		off := msg.body.(*OfflineMessage)
+		off := msg.Body.(*OfflineMessage)
 
 		if lastMsgId == 0 {
-			lastMsgId = off.msgId
+			lastMsgId = off.syncId()
 		}
 
-		if off.msgId == 0 || off.msgId <= msgId {
+		if off.msgId == 0 || off.syncId() <= msgId {
 			break
 		}
 
+		lastId = off.prevMsgId
+
+		//过期或者已经清除的消息跳过
 		m  := storage.LoadMessage(off.msgId)
-		if msgId == 0 && m.cmd == MSG_GROUP_IM {
-			im := m.body.(*IMMessage)
-			if im.timestamp < ts {
+		if m == nil || storage.expiry.IsExpired(off.msgId, now) {
+			continue
+		}
+		if msgId == 0 && m.Cmd == proto.MSG_GROUP_IM {
+			im := m.Body.(*proto.IMMessage)
+			if im.Timestamp < ts {
 				break
 			}
 		}
-		c = append(c, &EMessage{msgId:off.msgId, deviceId:off.deviceID, msg:m})
-
-		lastId = off.prevMsgId
+		c = append(c, &EMessage{msgId:off.syncId(), deviceId:off.deviceID, msg:m})
 
 		if len(c) >= limit {
 			break
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// 分片迁移: im的迁移工具从原来的ims按照从旧到新的顺序导出用户或者群组的消息, 再导入到新的ims
+// 导入的消息保留原来同步使用的id, 新的ims跳过这些id之前的位置, 客户端的syncKey在迁移之后仍然有效
+// 切换路由之前在原来的ims冻结写入, 没有及时更新分片表的im保存消息会失败, 由客户端重试
+// 冻结状态保存在storageRoot中的freeze文件, ims重启之后仍然有效
+// 搜索结果中导入的消息使用新的ims中的id
+
+var errFrozen = errors.New("messages are migrating")
+
+//保存冻结状态的文件, 在storageRoot中
+const FREEZE_FILE = "freeze"
+
+var freezer = NewFreezer()
+
+type freezeKey struct {
+	group bool
+	id    int64
+}
+
+type freezeBucket struct {
+	group   bool
+	buckets int64
+	bucket  int64
+}
+
+// 迁移中冻结写入的用户, 群组和bucket
+// 每次修改都重写整个文件, ims重启之后迁移中的id仍然冻结, 否则没有更新分片表的im可以继续写入原来的ims
+type Freezer struct {
+	mutex   sync.RWMutex
+	path    string
+	ids     map[freezeKey]struct{}
+	buckets map[freezeBucket]struct{}
+}
+
+func NewFreezer() *Freezer {
+	return &Freezer{
+		ids:     make(map[freezeKey]struct{}),
+		buckets: make(map[freezeBucket]struct{}),
+	}
+}
+
+// 读取之前保存的冻结状态, 之后的修改写入path
+func (f *Freezer) Load(path string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.path = path
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return f.decode(bytes.NewReader(data))
+}
+
+// buckets大于0时冻结id % buckets == bucket的所有用户或者群组, 包括还没有消息的
+// 写入文件失败时恢复原来的状态, 由迁移工具重试
+func (f *Freezer) Set(req *FreezeRequest) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var undo func()
+	if req.Buckets > 0 {
+		key := freezeBucket{req.Group, req.Buckets, req.Bucket}
+		_, frozen := f.buckets[key]
+		if req.Frozen {
+			f.buckets[key] = struct{}{}
+		} else {
+			delete(f.buckets, key)
+		}
+		undo = func() {
+			if frozen {
+				f.buckets[key] = struct{}{}
+			} else {
+				delete(f.buckets, key)
+			}
+		}
+	} else {
+		key := freezeKey{req.Group, req.Id}
+		_, frozen := f.ids[key]
+		if req.Frozen {
+			f.ids[key] = struct{}{}
+		} else {
+			delete(f.ids, key)
+		}
+		undo = func() {
+			if frozen {
+				f.ids[key] = struct{}{}
+			} else {
+				delete(f.ids, key)
+			}
+		}
+	}
+
+	if err := f.save(); err != nil {
+		undo()
+		return err
+	}
+	return nil
+}
+
+func (f *Freezer) save() error {
+	if f.path == "" {
+		return nil
+	}
+	buf := new(bytes.Buffer)
+	f.encode(buf)
+
+	tmp := f.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(buf.Bytes()); err == nil {
+		err = file.Sync()
+	}
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+// id数量 | (group, id) | bucket数量 | (group, buckets, bucket)
+func (f *Freezer) encode(w io.Writer) {
+	binary.Write(w, binary.BigEndian, int32(len(f.ids)))
+	for key := range f.ids {
+		binary.Write(w, binary.BigEndian, key.group)
+		binary.Write(w, binary.BigEndian, key.id)
+	}
+	binary.Write(w, binary.BigEndian, int32(len(f.buckets)))
+	for key := range f.buckets {
+		binary.Write(w, binary.BigEndian, key.group)
+		binary.Write(w, binary.BigEndian, key.buckets)
+		binary.Write(w, binary.BigEndian, key.bucket)
+	}
+}
+
+func (f *Freezer) decode(r io.Reader) error {
+	var count int32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return err
+	}
+	for i := int32(0); i < count; i++ {
+		var key freezeKey
+		if err := binary.Read(r, binary.BigEndian, &key.group); err != nil {
+			return err
+		}
+		if err := binary.Read(r, binary.BigEndian, &key.id); err != nil {
+			return err
+		}
+		f.ids[key] = struct{}{}
+	}
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return err
+	}
+	for i := int32(0); i < count; i++ {
+		var key freezeBucket
+		if err := binary.Read(r, binary.BigEndian, &key.group); err != nil {
+			return err
+		}
+		if err := binary.Read(r, binary.BigEndian, &key.buckets); err != nil {
+			return err
+		}
+		if err := binary.Read(r, binary.BigEndian, &key.bucket); err != nil {
+			return err
+		}
+		if key.buckets <= 0 {
+			return errors.New("invalid freeze bucket")
+		}
+		f.buckets[key] = struct{}{}
+	}
+	return nil
+}
+
+func (f *Freezer) IsFrozen(group bool, id int64) bool {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	if _, ok := f.ids[freezeKey{group, id}]; ok {
+		return true
+	}
+	for b := range f.buckets {
+		if b.group == group && uint64(id)%uint64(b.buckets) == uint64(b.bucket) {
+			return true
+		}
+	}
+	return false
+}
+
+// 返回afterId之后最早的一段消息, 按照从旧到新排列, 不超过BATCH_SIZE条
+// 先沿着batch队列找到afterId之后最早的batch, 再从这个位置向前读取, 不需要遍历整个队列
+func (storage *StorageFile) exportMessages(lastId, lastBatchId, afterId int64) ([]*EMessage, bool) {
+	start := lastId
+	for batchId := lastBatchId; batchId > 0; {
+		msg := storage.LoadMessage(batchId)
+		if msg == nil {
+			break
+		}
+		off, ok := msg.Body.(*OfflineMessage)
+		if !ok || off.syncId() <= afterId {
+			break
+		}
+		start = batchId
+		batchId = off.prevBatchMsgId
+	}
+
+	now := int32(time.Now().Unix())
+	messages := make([]*EMessage, 0, 16)
+	for id := start; id > 0; {
+		msg := storage.LoadMessage(id)
+		if msg == nil {
+			break
+		}
+		off, ok := msg.Body.(*OfflineMessage)
+		if !ok || off.syncId() <= afterId {
+			break
+		}
+		id = off.prevMsgId
+
+		//过期的消息不再迁移
+		m := storage.LoadMessage(off.msgId)
+		if m == nil || storage.expiry.IsExpired(off.msgId, now) {
+			continue
+		}
+		messages = append(messages, &EMessage{msgId: off.syncId(), deviceId: off.deviceID, msg: m})
+	}
+
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, start != lastId
+}
+
+// 导出用户收件箱或者超级群的消息, hasMore为true时用最后一条消息的id继续导出
+func (storage *Storage) ExportMessages(id int64, group bool, afterId int64) ([]*EMessage, bool) {
+	if group {
+		index := storage.getGroupIndex(id)
+		return storage.exportMessages(index.lastId, index.lastBatchId, afterId)
+	}
+	index := storage.getPeerIndex(id)
+	return storage.exportMessages(index.lastId, index.lastBatchId, afterId)
+}
+
+// 按照从旧到新的顺序导入消息, 已经导入过的消息跳过, 返回最后一条消息同步使用的id
+// messages为空时只返回当前最后一条消息的id, 迁移中断之后从这里继续
+func (storage *Storage) ImportMessages(id int64, group bool, messages []*EMessage) int64 {
+	if len(messages) > 0 {
+		storage.skipTo(messages[len(messages)-1].msgId)
+	}
+
+	storage.indexMutex.RLock()
+	defer storage.indexMutex.RUnlock()
+
+	if group {
+		shard := storage.GroupStorage.shard(id)
+		shard.mutex.Lock()
+		defer shard.mutex.Unlock()
+
+		last := shard.get(id).lastMsgId
+		for _, emsg := range messages {
+			if emsg.msgId <= last {
+				continue
+			}
+			last, _ = storage.appendGroupMessage(shard, id, emsg.deviceId, emsg.msg, emsg.msgId)
+		}
+		return last
+	}
+
+	shard := storage.PeerStorage.shard(id)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	last := shard.get(id).lastMsgId
+	for _, emsg := range messages {
+		if emsg.msgId <= last {
+			continue
+		}
+		last, _ = storage.appendPeerMessage(shard, id, emsg.deviceId, emsg.msg, emsg.msgId)
+	}
+	return last
+}
+
+// 返回id % buckets == bucket并且有消息的用户或者群组
+func (storage *Storage) ListIds(group bool, buckets, bucket int64) []int64 {
+	ids := make([]int64, 0, 1024)
+	match := func(id int64) bool {
+		return uint64(id)%uint64(buckets) == uint64(bucket)
+	}
+	if group {
+		for _, shard := range storage.GroupStorage.shards {
+			shard.mutex.Lock()
+			for id := range shard.messageIndex {
+				if match(id.gid) {
+					ids = append(ids, id.gid)
+				}
+			}
+			shard.mutex.Unlock()
+		}
+		return ids
+	}
+	for _, shard := range storage.PeerStorage.shards {
+		shard.mutex.Lock()
+		for id := range shard.messageIndex {
+			if match(id.uid) {
+				ids = append(ids, id.uid)
+			}
+		}
+		shard.mutex.Unlock()
+	}
+	return ids
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sx-chat/proto"
+	"testing"
+)
+
+func newTestStorage(t *testing.T) (*Storage, string) {
+	root, err := ioutil.TempDir("", "ims")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewStorage(root, SYNC_NONE), root
+}
+
+// 迁移之后消息保留原来的id, 新的消息id更大, 重启之后索引不变
+func TestMigrateMessages(t *testing.T) {
+	s1, root1 := newTestStorage(t)
+	defer os.RemoveAll(root1)
+	s2, root2 := newTestStorage(t)
+	defer os.RemoveAll(root2)
+
+	const count = BATCH_SIZE + 500
+	var lastId int64
+	for i := 0; i < count; i++ {
+		im := &proto.IMMessage{Sender: 1, Receiver: 2, Content: "hello"}
+		lastId, _ = s1.SavePeerMessage(2, 1, &proto.Message{Cmd: proto.MSG_IM, Version: STORAGE_VERSION, Body: im})
+	}
+	group := &proto.IMMessage{Sender: 1, Receiver: 10, Content: "group"}
+	groupId, _ := s1.SaveGroupMessage(10, 1, &proto.Message{Cmd: proto.MSG_GROUP_IM, Version: STORAGE_VERSION, Body: group})
+
+	var exported []*EMessage
+	var after int64
+	for {
+		messages, hasMore := s1.ExportMessages(2, false, after)
+		if len(messages) == 0 {
+			t.Fatalf("export empty after:%d", after)
+		}
+		for _, m := range messages {
+			if m.msgId <= after {
+				t.Fatalf("export order:%d after:%d", m.msgId, after)
+			}
+			after = m.msgId
+		}
+		exported = append(exported, messages...)
+		if last := s2.ImportMessages(2, false, messages); last != after {
+			t.Fatalf("import last:%d expect:%d", last, after)
+		}
+		if !hasMore {
+			break
+		}
+	}
+	if len(exported) != count || after != lastId {
+		t.Fatalf("exported:%d last:%d expect:%d %d", len(exported), after, count, lastId)
+	}
+	//重复导入的消息跳过
+	if last := s2.ImportMessages(2, false, exported[count-10:]); last != lastId {
+		t.Errorf("reimport last:%d", last)
+	}
+
+	messages, _ := s1.ExportMessages(10, true, 0)
+	s2.ImportMessages(10, true, messages)
+
+	im := &proto.IMMessage{Sender: 1, Receiver: 2, Content: "new"}
+	msgId, prevMsgId := s2.SavePeerMessage(2, 1, &proto.Message{Cmd: proto.MSG_IM, Version: STORAGE_VERSION, Body: im})
+	if msgId <= lastId || prevMsgId != lastId {
+		t.Fatalf("new message id:%d prev:%d last:%d", msgId, prevMsgId, lastId)
+	}
+	s2.file.Close()
+
+	s3 := NewStorage(root2, SYNC_NONE)
+	for _, s := range []*Storage{s2, s3} {
+		history, last, _ := s.LoadHistoryMessages(2, exported[count-3].msgId, 0, 0)
+		if len(history) != 3 || last != msgId || history[0].msgId != msgId || history[1].msgId != lastId {
+			t.Errorf("history:%d last:%d", len(history), last)
+		}
+		groupHistory, last := s.LoadGroupHistoryMessage(1, 10, 0, 0, GROUP_OFFLINE_LIMIT)
+		if len(groupHistory) != 1 || last != groupId || groupHistory[0].msgId != groupId {
+			t.Errorf("group history:%d last:%d", len(groupHistory), last)
+		}
+	}
+}
+
+func TestFreezer(t *testing.T) {
+	f := NewFreezer()
+	f.Set(&FreezeRequest{Id: 5, Frozen: true})
+	f.Set(&FreezeRequest{Group: true, Buckets: 4, Bucket: 1, Frozen: true})
+	if !f.IsFrozen(false, 5) || !f.IsFrozen(true, 5) || f.IsFrozen(true, 6) || f.IsFrozen(false, 9) {
+		t.Error("frozen")
+	}
+	f.Set(&FreezeRequest{Id: 5})
+	if f.IsFrozen(false, 5) {
+		t.Error("unfrozen")
+	}
+}
+
+func TestFreezerLoad(t *testing.T) {
+	root, err := ioutil.TempDir("", "ims")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	path := filepath.Join(root, FREEZE_FILE)
+
+	f := NewFreezer()
+	if err := f.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	f.Set(&FreezeRequest{Id: 5, Frozen: true})
+	f.Set(&FreezeRequest{Id: 7, Group: true, Frozen: true})
+	f.Set(&FreezeRequest{Group: true, Buckets: 4, Bucket: 1, Frozen: true})
+	f.Set(&FreezeRequest{Id: 7, Group: true})
+
+	f2 := NewFreezer()
+	if err := f2.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if !f2.IsFrozen(false, 5) || f2.IsFrozen(true, 7) || !f2.IsFrozen(true, 9) || f2.IsFrozen(false, 9) {
+		t.Error("reloaded freezer")
+	}
+}
@@ -1,12 +1,9 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
-	"fmt"
 	log "github.com/sirupsen/logrus"
-	"io"
-	"os"
+	"sx-chat/proto"
+	"sync"
 	"time"
 )
 
@@ -27,28 +24,78 @@ type UserIndex struct {
 	lastSeqId   int64 // 纯粹用于计数，用于计算得到lastBatchId
 }
 
+//索引按照uid分片, 不同用户的消息可以并发保存
+const INDEX_SHARDS = 64
+
+type peerIndexShard struct {
+	mutex        sync.Mutex
+	messageIndex map[UserId]*UserIndex
+
+	//上次保存索引之后修改过的用户, 只有这些用户的索引需要写入增量文件
+	//UserIndex保存之后不会再修改, 直接引用
+	dirty map[UserId]*UserIndex
+}
+
+func (shard *peerIndexShard) get(receiver int64) *UserIndex {
+	if ui, ok := shard.messageIndex[UserId{receiver}]; ok {
+		return ui
+	}
+	return &UserIndex{}
+}
+
+func (shard *peerIndexShard) set(receiver int64, ui *UserIndex) {
+	id := UserId{receiver}
+	shard.messageIndex[id] = ui
+	shard.dirty[id] = ui
+}
+
 //在取离线消息时，可以对群组消息和点对点消息分别获取，
 //这样可以做到分别控制点对点消息和群组消息读取量，避免单次读取超量的离线消息
 type PeerStorage struct {
 	*StorageFile
 
-	//消息索引全部放在内存中,在程序退出时,再全部保存到文件中，
-	//如果索引文件不存在或上次保存失败，则在程序启动的时候，从消息DB中重建索引，这需要遍历每一条消息
-	messageIndex map[UserId]*UserIndex
+	//消息索引全部放在内存中,定时把修改过的索引保存到增量文件中,增量文件在后台合并到索引文件，
+	//程序启动的时候读取索引文件和增量文件，再从消息DB中重建最后一次保存之后的索引
+	shards [INDEX_SHARDS]*peerIndexShard
+
+	search *SearchIndex
 }
 
 func NewPeerStorage(f *StorageFile) *PeerStorage {
 	storage := &PeerStorage{StorageFile: f}
-	storage.messageIndex = make(map[UserId]*UserIndex)
+	for i := range storage.shards {
+		storage.shards[i] = &peerIndexShard{
+			messageIndex: make(map[UserId]*UserIndex),
+			dirty:        make(map[UserId]*UserIndex),
+		}
+	}
 	return storage
 }
 
-func (storage *PeerStorage) SavePeerMessage(receiver, deviceID int64, msg *Message) (int64, int64) {
-	storage.mutex.Lock()
-	defer storage.mutex.Unlock()
+func (storage *PeerStorage) shard(receiver int64) *peerIndexShard {
+	return storage.shards[uint64(receiver)%INDEX_SHARDS]
+}
+
+// 同一个用户的消息在分片锁内保存, 保证离线消息链表的顺序
+func (storage *PeerStorage) SavePeerMessage(receiver, deviceID int64, msg *proto.Message) (int64, int64) {
+	storage.indexMutex.RLock()
+	defer storage.indexMutex.RUnlock()
+
+	shard := storage.shard(receiver)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	return storage.appendPeerMessage(shard, receiver, deviceID, msg, 0)
+}
+
+// 在分片锁内调用, originId不为0时是迁移过来的消息, 返回同步使用的id和上一条消息的id
+func (storage *PeerStorage) appendPeerMessage(shard *peerIndexShard, receiver, deviceID int64,
+	msg *proto.Message, originId int64) (int64, int64) {
 	msgId := storage.saveMessage(msg)
+	storage.search.Add([]int64{receiver}, false, msgId, msg)
+	storage.expiry.AddMessage(msgId, msg)
 
-	userIndex := storage.getPeerIndex(receiver)
+	userIndex := shard.get(receiver)
 
 	lastId := userIndex.lastId
 	lastPeerId := userIndex.lastPeerId
@@ -63,14 +110,15 @@ func (storage *PeerStorage) SavePeerMessage(receiver, deviceID int64, msg *Messa
 		prevMsgId:      lastId,
 		prevPeerMsgId:  lastPeerId,
 		prevBatchMsgId: lastBatchId,
+		originId:       originId,
 	}
 
 	var flag int
 	if storage.isGroupMessage(msg) {
-		flag = MESSAGE_FLAG_GROUP
+		flag = proto.MESSAGE_FLAG_GROUP
 	}
 
-	m := &Message{cmd: MSG_OFFLINE, flag: flag, body: off}
+	m := &proto.Message{Cmd: proto.MSG_OFFLINE, Flag: flag, Body: off}
 	lastId = storage.saveMessage(m)
 
 	if !storage.isGroupMessage(m) {
@@ -82,39 +130,127 @@ func (storage *PeerStorage) SavePeerMessage(receiver, deviceID int64, msg *Messa
 		lastBatchId = lastId
 	}
 
-	ui := &UserIndex{lastMsgId: msgId, lastId: lastId, lastPeerId: lastPeerId, lastBatchId: lastBatchId, lastSeqId: lastSeqId}
+	ui := &UserIndex{lastMsgId: off.syncId(), lastId: lastId, lastPeerId: lastPeerId, lastBatchId: lastBatchId, lastSeqId: lastSeqId}
 	log.Info("receiver: ", receiver, " userIndex: ", ui)
-	storage.setPeerIndex(receiver, ui)
-	return msgId, userIndex.lastMsgId
+	shard.set(receiver, ui)
+	storage.updateLastId(lastId)
+	return off.syncId(), userIndex.lastMsgId
 }
 
-func (storage *PeerStorage) SavePeerGroupMessage(members []int64, deviceID int64, msg *Message) []int64 {
+// 普通群消息只保存一次消息内容, 每个成员只写入一条离线消息
+// 所有成员的离线消息在一个请求中写入, 期间持有这些成员所在的分片锁
+// 返回值和逐个调用SavePeerMessage一致, 每个成员依次是msgId和prevMsgId
+func (storage *PeerStorage) SavePeerGroupMessage(members []int64, deviceID int64, msg *proto.Message) []int64 {
+	if len(members) == 0 {
+		return []int64{}
+	}
+
+	storage.indexMutex.RLock()
+	defer storage.indexMutex.RUnlock()
+
+	receivers := make([]int64, 0, len(members))
+	seen := make(map[int64]struct{}, len(members))
+	for _, receiver := range members {
+		if _, ok := seen[receiver]; ok {
+			continue
+		}
+		seen[receiver] = struct{}{}
+		receivers = append(receivers, receiver)
+	}
+
+	//按照分片的顺序加锁, 不会死锁
+	var locked [INDEX_SHARDS]bool
+	for _, receiver := range receivers {
+		locked[uint64(receiver)%INDEX_SHARDS] = true
+	}
+	for i, shard := range storage.shards {
+		if locked[i] {
+			shard.mutex.Lock()
+			defer shard.mutex.Unlock()
+		}
+	}
+
+	msgId := storage.saveMessage(msg)
+	storage.search.Add(receivers, false, msgId, msg)
+	storage.expiry.AddMessage(msgId, msg)
+
+	var flag int
+	if storage.isGroupMessage(msg) {
+		flag = proto.MESSAGE_FLAG_GROUP
+	}
+
+	indexes := make([]*UserIndex, len(receivers))
+	offs := make([]*proto.Message, len(receivers))
+	for i, receiver := range receivers {
+		userIndex := storage.shard(receiver).get(receiver)
+		indexes[i] = userIndex
+		off := &OfflineMessage{
+			receiver:       receiver,
+			msgId:          msgId,
+			deviceID:       deviceID,
+			seqId:          userIndex.lastSeqId + 1,
+			prevMsgId:      userIndex.lastId,
+			prevPeerMsgId:  userIndex.lastPeerId,
+			prevBatchMsgId: userIndex.lastBatchId,
+		}
+		offs[i] = &proto.Message{Cmd: proto.MSG_OFFLINE, Flag: flag, Body: off}
+	}
+	ids := storage.saveMessages(offs)
+
+	prevMsgIds := make(map[int64]int64, len(receivers))
+	for i, receiver := range receivers {
+		userIndex := indexes[i]
+		lastId := ids[i]
+		lastPeerId := userIndex.lastPeerId
+		if flag == 0 {
+			lastPeerId = lastId
+		}
+		lastBatchId := userIndex.lastBatchId
+		lastSeqId := userIndex.lastSeqId + 1
+		if lastSeqId%BATCH_SIZE == 0 {
+			lastBatchId = lastId
+		}
+
+		ui := &UserIndex{lastMsgId: msgId, lastId: lastId, lastPeerId: lastPeerId, lastBatchId: lastBatchId, lastSeqId: lastSeqId}
+		storage.shard(receiver).set(receiver, ui)
+		storage.updateLastId(lastId)
+		prevMsgIds[receiver] = userIndex.lastMsgId
+	}
+	log.Infof("save peer group message:%d members:%d", msgId, len(receivers))
+
 	r := make([]int64, 0, len(members)*2)
 	for _, receiver := range members {
-		msgId, prevMsgId := storage.SavePeerMessage(receiver, deviceID, msg)
 		r = append(r, msgId)
-		r = append(r, prevMsgId)
+		r = append(r, prevMsgIds[receiver])
 	}
 	return r
 }
 
-func (storage *PeerStorage) isGroupMessage(msg *Message) bool {
-	return msg.cmd == MSG_GROUP_IM || msg.flag&MESSAGE_FLAG_GROUP != 0
+func (storage *PeerStorage) isGroupMessage(msg *proto.Message) bool {
+	return msg.Cmd == proto.MSG_GROUP_IM || msg.Flag&proto.MESSAGE_FLAG_GROUP != 0
 }
 
 func (storage *PeerStorage) getPeerIndex(receiver int64) *UserIndex {
-	id := UserId{receiver}
-	if ui, ok := storage.messageIndex[id]; ok {
-		return ui
-	}
-	return &UserIndex{}
+	shard := storage.shard(receiver)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	return shard.get(receiver)
 }
+
 func (storage *PeerStorage) setPeerIndex(receiver int64, ui *UserIndex) {
-	id := UserId{receiver}
-	storage.messageIndex[id] = ui
+	shard := storage.shard(receiver)
+	shard.mutex.Lock()
+	shard.set(receiver, ui)
+	shard.mutex.Unlock()
+
+	storage.updateLastId(ui.lastId)
+}
 
-	if ui.lastId > storage.lastId {
-		storage.lastId = ui.lastId
+// 启动时加载的索引, 不需要再保存
+func (storage *PeerStorage) initPeerIndex(messageIndex map[UserId]*UserIndex) {
+	for id, ui := range messageIndex {
+		storage.shard(id.uid).messageIndex[id] = ui
+		storage.updateLastId(ui.lastId)
 	}
 }
 
@@ -142,13 +278,13 @@ func (storage *PeerStorage) LoadHistoryMessages(receiver int64, syncMsgId int64,
 			break
 		}
 
-		off, ok := msg.body.(*OfflineMessage)
+		off, ok := msg.Body.(*OfflineMessage)
 		if !ok {
-			log.Warning("invalid message cmd:", msg.cmd)
+			log.Warning("invalid message cmd:", msg.Cmd)
 			break
 		}
 
-		if off.msgId <= syncMsgId {
+		if off.syncId() <= syncMsgId {
 			break
 		}
 
@@ -164,6 +300,7 @@ func (storage *PeerStorage) LoadHistoryMessages(receiver int64, syncMsgId int64,
 		lastId = msgIndex.lastId
 	}
 
+	now := int32(time.Now().Unix())
 	messages := make([]*EMessage, 0, 10)
 	for {
 		msg := storage.LoadMessage(lastId)
@@ -171,32 +308,34 @@ func (storage *PeerStorage) LoadHistoryMessages(receiver int64, syncMsgId int64,
 			break
 		}
 
-		off, ok := msg.body.(*OfflineMessage)
+		off, ok := msg.Body.(*OfflineMessage)
 		if !ok {
-			log.Warning("invalid message cmd:", msg.cmd)
+			log.Warning("invalid message cmd:", msg.Cmd)
 			break
 		}
 
 		if lastMsgId == 0 {
-			lastMsgId = off.msgId
+			lastMsgId = off.syncId()
 			lastOfflineMsgId = lastId
 		}
 
-		if off.msgId <= syncMsgId {
+		if off.syncId() <= syncMsgId {
 			break
 		}
 
+		lastId = off.prevMsgId
+
+		//过期或者已经清除的消息跳过
 		msg = storage.LoadMessage(off.msgId)
-		if msg == nil {
-			break
+		if msg == nil || storage.expiry.IsExpired(off.msgId, now) {
+			continue
 		}
 
-		emsg := &EMessage{msgId: off.msgId, deviceId: off.deviceID, msg: msg}
+		emsg := &EMessage{msgId: off.syncId(), deviceId: off.deviceID, msg: msg}
 		messages = append(messages, emsg)
 		if limit > 0 && len(messages) >= limit {
 			break
 		}
-		lastId = off.prevMsgId
 	}
 
 	if len(messages) > 1000 {
@@ -211,126 +350,27 @@ func (storage *PeerStorage) LoadHistoryMessages(receiver int64, syncMsgId int64,
 	return messages, lastMsgId, hasMore
 }
 
-func (storage *PeerStorage) clonePeerIndex() map[UserId]*UserIndex {
-	messageIndex := make(map[UserId]*UserIndex)
-	for k, v := range storage.messageIndex {
-		messageIndex[k] = v
-	}
-	return messageIndex
-}
-
-func (storage *PeerStorage) savePeerIndex(messageIndex map[UserId]*UserIndex) {
-	path := fmt.Sprintf("%s/peer_index_t", storage.root)
-	log.Info("write peer message index path:", path)
-	begin := time.Now().UnixNano()
-	log.Info("flush peer index begin:", begin)
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		log.Fatal("open file:", err)
-	}
-	defer file.Close()
-
-	buffer := new(bytes.Buffer)
-	index := 0
-	for id, value := range messageIndex {
-		binary.Write(buffer, binary.BigEndian, id.uid)
-		binary.Write(buffer, binary.BigEndian, value.lastMsgId)
-		binary.Write(buffer, binary.BigEndian, value.lastId)
-		binary.Write(buffer, binary.BigEndian, value.lastPeerId)
-		binary.Write(buffer, binary.BigEndian, value.lastBatchId)
-		binary.Write(buffer, binary.BigEndian, value.lastSeqId)
-
-		index += 1
-
-		if index%1000 == 0 {
-			buf := buffer.Bytes()
-			n, err := file.Write(buf)
-			if err != nil {
-				log.Fatal("write file:", err)
-			}
-			if n != len(buf) {
-				log.Fatal("can't write file:", len(buf), n)
-			}
-			buffer.Reset()
-		}
-	}
-
-	buf := buffer.Bytes()
-	n, err := file.Write(buf)
-	if err != nil {
-		log.Fatal("write file:", err)
-	}
-	if n != len(buf) {
-		log.Fatal("can't write file:", len(buf), n)
-	}
-
-	err = file.Sync()
-	if err != nil {
-		log.Info("sync file err:", err)
-	}
-
-	path2 := fmt.Sprintf("%s/%s", storage.root, PEER_INDEX_FILE_NAME)
-	err = os.Rename(path, path2)
-	if err != nil {
-		log.Fatal("rename peer index file err:", err)
-	}
-
-	end := time.Now().UnixNano()
-	log.Info("flush peer index end:", end, " used:", end-begin)
-}
-
-func (storage *PeerStorage) repairPeerIndex() {
-	log.Info("修复message index开始:", storage.lastId, time.Now().UnixNano())
-	first := storage.getBlockNo(storage.lastId)
-	off := storage.getBlockOffset(storage.lastId)
-
-	for i := first; i <= storage.blockNo; i++ {
-		file := storage.openReadFile(i)
-		if file == nil {
-			//历史消息被删除
-			continue
-		}
-
-		offset := HEADER_SIZE
-		if i == first {
-			offset = off
-		}
-		_, err := file.Seek(int64(offset), io.SeekStart)
-		if err != nil {
-			log.Warning("seek file err:", err)
-			file.Close()
-			break
-		}
-		for {
-			msgId, err := file.Seek(0, io.SeekCurrent)
-			if err != nil {
-				log.Info("seek file err:", err)
-				break
-			}
-			msg := storage.ReadMessage(file)
-			if msg == nil {
-				break
-			}
-			blockNo := i
-			msgId = int64(blockNo)*BLOCK_SIZE + msgId
-			if msgId == storage.lastId {
-				continue
-			}
-			storage.execMessage(msg, msgId)
+// 取出上次保存索引之后修改过的用户索引, 只交换每个分片的dirty
+func (storage *PeerStorage) takeDirtyPeerIndex() []map[UserId]*UserIndex {
+	dirty := make([]map[UserId]*UserIndex, 0, INDEX_SHARDS)
+	for _, shard := range storage.shards {
+		shard.mutex.Lock()
+		if len(shard.dirty) > 0 {
+			dirty = append(dirty, shard.dirty)
+			shard.dirty = make(map[UserId]*UserIndex)
 		}
-		file.Close()
+		shard.mutex.Unlock()
 	}
-	log.Info("修复message index结束:", storage.lastId, time.Now().UnixNano())
-
+	return dirty
 }
 
-func (storage *PeerStorage) execMessage(msg *Message, msgId int64) {
-	if msg.cmd == MSG_OFFLINE {
-		off := msg.body.(*OfflineMessage)
+func (storage *PeerStorage) execMessage(msg *proto.Message, msgId int64) {
+	if msg.Cmd == proto.MSG_OFFLINE {
+		off := msg.Body.(*OfflineMessage)
 		lastPeerId := msgId
 
 		index := storage.getPeerIndex(off.receiver)
-		if (msg.flag & MESSAGE_FLAG_GROUP) != 0 {
+		if (msg.Flag & proto.MESSAGE_FLAG_GROUP) != 0 {
 			lastPeerId = index.lastPeerId
 		}
 		lastBatchId := index.lastBatchId
@@ -339,52 +379,13 @@ func (storage *PeerStorage) execMessage(msg *Message, msgId int64) {
 			lastBatchId = msgId
 		}
 
-		ui := &UserIndex{off.msgId, msgId, lastPeerId, lastBatchId, lastSeqId}
+		ui := &UserIndex{off.syncId(), msgId, lastPeerId, lastBatchId, lastSeqId}
 		storage.setPeerIndex(off.receiver, ui)
-	}
-
-}
 
-func (storage *PeerStorage) readPeerIndex() bool {
-	path := fmt.Sprintf("%s/%s", storage.root, PEER_INDEX_FILE_NAME)
-	log.Info("read message index path:", path)
-	file, err := os.Open(path)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			log.Fatal("open file:", err)
+		if m := storage.LoadMessage(off.msgId); m != nil {
+			storage.search.Add([]int64{off.receiver}, false, off.msgId, m)
 		}
-		return false
 	}
-	defer file.Close()
-	const INDEX_SIZE = 56
-	data := make([]byte, INDEX_SIZE*1000)
 
-	for {
-		n, err := file.Read(data)
-		if err != nil {
-			if err != io.EOF {
-				log.Fatal("read err:", err)
-			}
-			break
-		}
-		n = n - n%INDEX_SIZE
-		buffer := bytes.NewBuffer(data[:n])
-		for i := 0; i < n/INDEX_SIZE; i++ {
-			id := UserId{}
-			var lastMsgId int64
-			var lastId int64
-			var peerMsgId int64
-			var batchId int64
-			var seqId int64
-			binary.Read(buffer, binary.BigEndian, &id.uid)
-			binary.Read(buffer, binary.BigEndian, &lastMsgId)
-			binary.Read(buffer, binary.BigEndian, &lastId)
-			binary.Read(buffer, binary.BigEndian, &peerMsgId)
-			binary.Read(buffer, binary.BigEndian, &batchId)
-			binary.Read(buffer, binary.BigEndian, &seqId)
-			ui := &UserIndex{lastMsgId, lastId, peerMsgId, batchId, seqId}
-			storage.setPeerIndex(id.uid, ui)
-		}
-	}
-	return true
 }
+
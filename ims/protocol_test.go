@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"sx-chat/proto"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+func FuzzReceiveLimitMessage(f *testing.F) {
+	seeds := []*proto.Message{
+		{Cmd: proto.MSG_IM, Version: 0, Body: &proto.IMMessage{Sender: 1, Receiver: 2, Timestamp: 3, MessageType: 4, Content: "hello"}},
+		{Cmd: proto.MSG_GROUP_IM, Version: 2, Body: &proto.IMMessage{Sender: 1, Receiver: 2, Timestamp: 3, MessageType: 4, Content: "你好"}},
+		{Cmd: proto.MSG_OFFLINE, Body: &OfflineMessage{receiver: 1, msgId: 2, seqId: 3}},
+		{Cmd: proto.MSG_GROUP_OFFLINE, Body: &OfflineMessage{receiver: 1, msgId: 2, prevBatchMsgId: 3}},
+	}
+	for _, m := range seeds {
+		f.Add(proto.EncodeMessage(m))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := proto.ReceiveLimitMessage(bytes.NewReader(data), 32*1024, true)
+		if err != nil {
+			return
+		}
+		// 解析成功的消息重新编码之后必须得到同样的消息
+		buf := proto.EncodeMessage(m)
+		m2, err := proto.DecodeMessage(buf, len(buf))
+		if err != nil {
+			t.Fatalf("re-decode cmd:%d err:%s", m.Cmd, err)
+		}
+		if !reflect.DeepEqual(m.Body, m2.Body) {
+			t.Fatalf("cmd:%d body mismatch", m.Cmd)
+		}
+	})
+}
+
+func FuzzEMessage(f *testing.F) {
+	emsg := &EMessage{msgId: 1, deviceId: 2, msg: &proto.Message{Cmd: proto.MSG_IM, Body: &proto.IMMessage{Content: "a"}}}
+	f.Add(emsg.ToData())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		emsg := &EMessage{}
+		emsg.FromData(data)
+	})
+}
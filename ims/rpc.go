@@ -1,13 +1,55 @@
 package main
 
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sx-chat/proto"
+	"sync"
+	"sync/atomic"
+)
+
+//处理中的rpc持有读锁, 退出时获取写锁等待这些rpc完成
+var rpcMutex sync.RWMutex
+
+//开始退出之后不再接受写入的rpc, im收到错误之后可以安全地重试
+var rpcStopping int32
+
+var errStopping = errors.New("ims is stopping")
+
+// 写入的rpc获取读锁, 成功时由调用者释放
+func beginWriteRPC() error {
+	rpcMutex.RLock()
+	if atomic.LoadInt32(&rpcStopping) != 0 {
+		rpcMutex.RUnlock()
+		return errStopping
+	}
+	return nil
+}
+
 func SavePeerMessage(addr string, m *PeerMessage) ([2]int64, error) {
-	msg := &Message{cmd: int(m.Cmd), version: DEFAULT_VERSION}
+	if err := beginWriteRPC(); err != nil {
+		return [2]int64{}, err
+	}
+	defer rpcMutex.RUnlock()
+
+	if freezer.IsFrozen(false, m.UID) {
+		return [2]int64{}, errFrozen
+	}
+
+	msg := &proto.Message{Cmd: int(m.Cmd), Version: int(m.Version)}
 	msg.FromData(m.Raw)
+	// 按照im编码时的版本解析, 统一用STORAGE_VERSION保存到文件
+	msg.Version = STORAGE_VERSION
 	msgId, prevMsgId := storage.SavePeerMessage(m.UID, m.DeviceID, msg)
+	storage.Commit()
 	return [2]int64{msgId, prevMsgId}, nil
 }
 
 func SyncMessage(addr string, syncKey *SyncHistory) *PeerHistoryMessage {
+	rpcMutex.RLock()
+	defer rpcMutex.RUnlock()
+
 	messages, lastMsgId, hasMore := storage.LoadHistoryMessages( syncKey.UID, syncKey.LastMsgID, config.Limit, config.hardLimit)
 
 	historyMessages := make([]*HistoryMessage, 0, 10)
@@ -16,9 +58,10 @@ func SyncMessage(addr string, syncKey *SyncHistory) *PeerHistoryMessage {
 		hm := &HistoryMessage{
 			MsgID:    emsg.msgId,
 			DeviceID: emsg.deviceId,
-			Cmd:      int32(emsg.msg.cmd),
+			Cmd:      int32(emsg.msg.Cmd),
+			Version:  syncKey.Version,
 		}
-		emsg.msg.version = DEFAULT_VERSION
+		emsg.msg.Version = int(syncKey.Version)
 		hm.Raw = emsg.msg.ToData()
 		historyMessages = append(historyMessages, hm)
 	}
@@ -27,21 +70,49 @@ func SyncMessage(addr string, syncKey *SyncHistory) *PeerHistoryMessage {
 }
 
 func SavePeerGroupMessage(addr string, m *PeerGroupMessage) ([]int64, error) {
-	msg := &Message{cmd: int(m.Cmd), version: DEFAULT_VERSION}
+	if err := beginWriteRPC(); err != nil {
+		return nil, err
+	}
+	defer rpcMutex.RUnlock()
+
+	//有成员正在迁移时整个请求失败, 不保存一部分成员的消息
+	for _, member := range m.Members {
+		if freezer.IsFrozen(false, member) {
+			return nil, errFrozen
+		}
+	}
+
+	msg := &proto.Message{Cmd: int(m.Cmd), Version: int(m.Version)}
 	msg.FromData(m.Raw)
+	msg.Version = STORAGE_VERSION
 	r := storage.SavePeerGroupMessage(m.Members, m.DeviceID, msg)
+	storage.Commit()
 	return r, nil
 }
 
 func SaveGroupMessage(addr string, m *GroupMessage) ([2]int64, error) {
-	msg := &Message{cmd: int(m.Cmd), version: DEFAULT_VERSION}
+	if err := beginWriteRPC(); err != nil {
+		return [2]int64{}, err
+	}
+	defer rpcMutex.RUnlock()
+
+	if freezer.IsFrozen(true, m.GroupId) {
+		return [2]int64{}, errFrozen
+	}
+
+	msg := &proto.Message{Cmd: int(m.Cmd), Version: int(m.Version)}
 	msg.FromData(m.Raw)
+	msg.Version = STORAGE_VERSION
 
 	msgId, prevMsgId := storage.SaveGroupMessage(m.GroupId, m.DeviceID, msg)
+	storage.Commit()
 	return [2]int64{msgId, prevMsgId}, nil
 }
 
 func SyncGroupMessage(addr string, syncKey *SyncGroupHistory) *GroupHistoryMessage {
+	rpcMutex.RLock()
+	defer rpcMutex.RUnlock()
+
 	messages, lastMsgId := storage.LoadGroupHistoryMessage(syncKey.UID, syncKey.GroupId, syncKey.LastMsgId, syncKey.Timestamp, GROUP_OFFLINE_LIMIT)
 
 	historyMessages := make([]*HistoryMessage, 0, 10)
@@ -49,11 +120,136 @@ func SyncGroupMessage(addr string, syncKey *SyncGroupHistory) *GroupHistoryMessa
 		hm := &HistoryMessage{}
 		hm.MsgID = emsg.msgId
 		hm.DeviceID = emsg.deviceId
-		hm.Cmd = int32(emsg.msg.cmd)
+		hm.Cmd = int32(emsg.msg.Cmd)
+		hm.Version = syncKey.Version
 
-		emsg.msg.version = DEFAULT_VERSION
+		emsg.msg.Version = int(syncKey.Version)
 		hm.Raw = emsg.msg.ToData()
 		historyMessages = append(historyMessages, hm)
 	}
 	return &GroupHistoryMessage{Messages:historyMessages, LastMsgId:lastMsgId, HasMore:false}
 }
+
+func SearchMessages(addr string, req *SearchRequest) *SearchResult {
+	rpcMutex.RLock()
+	defer rpcMutex.RUnlock()
+
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = SEARCH_DEFAULT_LIMIT
+	} else if limit > SEARCH_LIMIT {
+		limit = SEARCH_LIMIT
+	}
+
+	var messages []*EMessage
+	var hasMore bool
+	var nextMsgId int64
+	if req.Super {
+		messages, hasMore, nextMsgId = storage.SearchMessages(req.GroupId, true, req.Query, req.BeforeMsgId, limit,
+			func(msg *proto.Message) bool {
+				im := msg.Body.(*proto.IMMessage)
+				return im.Timestamp >= req.Timestamp
+			})
+	} else {
+		messages, hasMore, nextMsgId = storage.SearchMessages(req.UID, false, req.Query, req.BeforeMsgId, limit,
+			func(msg *proto.Message) bool {
+				im := msg.Body.(*proto.IMMessage)
+				if req.GroupId != 0 {
+					return msg.Cmd == proto.MSG_GROUP_IM && im.Receiver == req.GroupId && im.Timestamp >= req.Timestamp
+				}
+				if req.PeerUID != 0 {
+					return msg.Cmd == proto.MSG_IM && ((im.Sender == req.PeerUID && im.Receiver == req.UID) ||
+						(im.Sender == req.UID && im.Receiver == req.PeerUID))
+				}
+				return true
+			})
+	}
+
+	historyMessages := make([]*HistoryMessage, 0, len(messages))
+	for _, emsg := range messages {
+		hm := &HistoryMessage{
+			MsgID:   emsg.msgId,
+			Cmd:     int32(emsg.msg.Cmd),
+			Version: req.Version,
+		}
+		emsg.msg.Version = int(req.Version)
+		hm.Raw = emsg.msg.ToData()
+		historyMessages = append(historyMessages, hm)
+	}
+	return &SearchResult{Messages: historyMessages, HasMore: hasMore, NextMsgId: nextMsgId}
+}
+
+func ExportMessages(addr string, req *ExportRequest) *ExportResult {
+	rpcMutex.RLock()
+	defer rpcMutex.RUnlock()
+
+	messages, hasMore := storage.ExportMessages(req.Id, req.Group, req.AfterMsgId)
+	historyMessages := make([]*HistoryMessage, 0, len(messages))
+	for _, emsg := range messages {
+		emsg.msg.Version = STORAGE_VERSION
+		historyMessages = append(historyMessages, &HistoryMessage{
+			MsgID:    emsg.msgId,
+			DeviceID: emsg.deviceId,
+			Cmd:      int32(emsg.msg.Cmd),
+			Version:  STORAGE_VERSION,
+			Raw:      emsg.msg.ToData(),
+		})
+	}
+	return &ExportResult{Messages: historyMessages, HasMore: hasMore}
+}
+
+func ImportMessages(addr string, req *ImportRequest) (int64, error) {
+	if err := beginWriteRPC(); err != nil {
+		return 0, err
+	}
+	defer rpcMutex.RUnlock()
+
+	messages := make([]*EMessage, 0, len(req.Messages))
+	for _, hm := range req.Messages {
+		msg := &proto.Message{Cmd: int(hm.Cmd), Version: int(hm.Version)}
+		if !msg.FromData(hm.Raw) {
+			return 0, fmt.Errorf("invalid message:%d", hm.MsgID)
+		}
+		msg.Version = STORAGE_VERSION
+		messages = append(messages, &EMessage{msgId: hm.MsgID, deviceId: hm.DeviceID, msg: msg})
+	}
+	lastMsgId := storage.ImportMessages(req.Id, req.Group, messages)
+	storage.Commit()
+	log.WithFields(log.Fields{"id": req.Id, "group": req.Group, "count": len(messages), "lastMsgId": lastMsgId}).Info("导入迁移的消息")
+	return lastMsgId, nil
+}
+
+func FreezeMessages(addr string, req *FreezeRequest) error {
+	fields := log.Fields{"id": req.Id, "group": req.Group, "buckets": req.Buckets, "bucket": req.Bucket, "frozen": req.Frozen}
+	if err := freezer.Set(req); err != nil {
+		fields["err"] = err
+		log.WithFields(fields).Error("保存冻结状态失败")
+		return err
+	}
+	log.WithFields(fields).Info("冻结消息写入")
+	return nil
+}
+
+func ListIds(addr string, req *ListIdsRequest) []int64 {
+	rpcMutex.RLock()
+	defer rpcMutex.RUnlock()
+
+	if req.Buckets <= 0 {
+		return nil
+	}
+	return storage.ListIds(req.Group, req.Buckets, req.Bucket)
+}
+
+func ExpireMessage(addr string, req *ExpireRequest) (int32, error) {
+	if err := beginWriteRPC(); err != nil {
+		return 0, err
+	}
+	defer rpcMutex.RUnlock()
+
+	expireAt := storage.ExpireMessage(req.UID, req.MsgId, req.ExpireAt)
+	if expireAt > 0 {
+		storage.Commit()
+	}
+	log.WithFields(log.Fields{"uid": req.UID, "msgId": req.MsgId, "expireAt": expireAt}).Info("设置消息过期时间")
+	return expireAt, nil
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sx-chat/proto"
+	"sync"
+	"time"
+	"unicode"
+)
+
+//单次搜索返回的最大数量
+const SEARCH_LIMIT = 50
+const SEARCH_DEFAULT_LIMIT = 20
+
+//单次搜索最多检查的候选消息数量, 超过之后返回HasMore由客户端继续翻页
+const SEARCH_SCAN_LIMIT = 1000
+
+//英文单词和数字的最大长度, 超过的部分不索引
+const SEARCH_MAX_WORD = 32
+
+// 倒排索引的key, 单聊和普通群的消息按照收件箱的uid索引, 超级群的消息按照群组id索引
+type searchKey struct {
+	owner int64
+	group bool
+	term  string
+}
+
+// 消息内容的倒排索引, 消息id按照从小到大排列
+// 还在写入的block的索引放在内存中, 和消息索引一样定时把新增的部分保存到增量文件
+// 写满的block的索引保存到消息文件旁边的search_block_N, 之后从内存中删除, 见SearchBlocks
+type SearchIndex struct {
+	mutex    sync.RWMutex
+	postings map[searchKey][]int64
+
+	//上次保存之后新增的索引
+	dirty map[searchKey][]int64
+
+	//小于sealed的block的索引在blocks中, 为nil时全部在内存中
+	blocks *SearchBlocks
+	sealed int
+}
+
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{
+		postings: make(map[searchKey][]int64),
+		dirty:    make(map[searchKey][]int64),
+	}
+}
+
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) ||
+		unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r)
+}
+
+// 把文本切分成连续的中日韩文字和连续的字母数字, 字母转成小写
+func splitText(text string, f func(segment []rune, cjk bool)) {
+	var segment []rune
+	cjk := false
+	flush := func() {
+		if len(segment) > 0 {
+			f(segment, cjk)
+			segment = segment[:0]
+		}
+	}
+	for _, r := range text {
+		switch {
+		case isCJK(r):
+			if !cjk {
+				flush()
+			}
+			cjk = true
+			segment = append(segment, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if cjk {
+				flush()
+			}
+			cjk = false
+			segment = append(segment, unicode.ToLower(r))
+		default:
+			flush()
+		}
+	}
+	flush()
+}
+
+// 索引使用的词: 中日韩文字的单字和相邻两个字, 英文单词和数字
+func tokenize(text string) []string {
+	seen := make(map[string]struct{})
+	terms := make([]string, 0, 16)
+	add := func(term string) {
+		if _, ok := seen[term]; !ok {
+			seen[term] = struct{}{}
+			terms = append(terms, term)
+		}
+	}
+	splitText(text, func(segment []rune, cjk bool) {
+		if !cjk {
+			if len(segment) > SEARCH_MAX_WORD {
+				segment = segment[:SEARCH_MAX_WORD]
+			}
+			add(string(segment))
+			return
+		}
+		for i := range segment {
+			add(string(segment[i : i+1]))
+			if i+1 < len(segment) {
+				add(string(segment[i : i+2]))
+			}
+		}
+	})
+	return terms
+}
+
+// 搜索使用的词, 两个字以上的中文只使用相邻两个字
+// 返回的segments用于检查消息内容是否包含完整的关键词
+func parseQuery(query string) ([]string, []string) {
+	seen := make(map[string]struct{})
+	var terms, segments []string
+	add := func(term string) {
+		if _, ok := seen[term]; !ok {
+			seen[term] = struct{}{}
+			terms = append(terms, term)
+		}
+	}
+	splitText(query, func(segment []rune, cjk bool) {
+		if !cjk && len(segment) > SEARCH_MAX_WORD {
+			segment = segment[:SEARCH_MAX_WORD]
+		}
+		segments = append(segments, string(segment))
+		if !cjk || len(segment) == 1 {
+			add(string(segment))
+			return
+		}
+		for i := 0; i+1 < len(segment); i++ {
+			add(string(segment[i : i+2]))
+		}
+	})
+	return terms, segments
+}
+
+// 只索引文本内容, 其它类型的消息使用注册的纯文本, 比如文件名
+func messageText(msg *proto.Message) string {
+	if msg.Cmd != proto.MSG_IM && msg.Cmd != proto.MSG_GROUP_IM {
+		return ""
+	}
+	im, ok := msg.Body.(*proto.IMMessage)
+	if !ok {
+		return ""
+	}
+	return proto.ContentPlainText(im.MessageType, im.Content)
+}
+
+// 添加一条消息的索引, 普通群的消息每个收件人都需要添加
+func (index *SearchIndex) Add(owners []int64, group bool, msgId int64, msg *proto.Message) {
+	if index == nil {
+		return
+	}
+	text := messageText(msg)
+	if text == "" {
+		return
+	}
+	terms := tokenize(text)
+
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	for _, owner := range owners {
+		for _, term := range terms {
+			index.add(searchKey{owner, group, term}, msgId)
+		}
+	}
+}
+
+// 消息id一般是递增的, 并发保存时可能乱序, 已经存在的id不重复添加
+// 乱序插入时复制一份新的slice, 搜索时持有的slice不会被修改
+func (index *SearchIndex) add(key searchKey, msgId int64) {
+	ids := index.postings[key]
+	n := len(ids)
+	if n == 0 || ids[n-1] < msgId {
+		index.postings[key] = append(ids, msgId)
+	} else {
+		i := sort.Search(n, func(i int) bool { return ids[i] >= msgId })
+		if ids[i] == msgId {
+			return
+		}
+		r := make([]int64, 0, n+1)
+		r = append(r, ids[:i]...)
+		r = append(r, msgId)
+		r = append(r, ids[i:]...)
+		index.postings[key] = r
+	}
+	index.dirty[key] = append(index.dirty[key], msgId)
+}
+
+// 取出上次保存之后新增的索引
+func (index *SearchIndex) takeDirty() map[searchKey][]int64 {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	dirty := index.dirty
+	index.dirty = make(map[searchKey][]int64)
+	return dirty
+}
+
+// 删除小于before的消息id, 这些id的索引已经在blocks中
+func (index *SearchIndex) removeBefore(before int64) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	for key, ids := range index.postings {
+		i := sort.Search(len(ids), func(i int) bool { return ids[i] >= before })
+		if i == len(ids) {
+			delete(index.postings, key)
+		} else if i > 0 {
+			index.postings[key] = append([]int64(nil), ids[i:]...)
+		}
+	}
+}
+
+// 把current之前的block的索引写入blocks, 写入之后从内存中删除
+// 已经写入的block之后又添加的索引(比如保存到一半的消息在切换block之后才添加)合并到原来的文件
+func (index *SearchIndex) seal(current int) {
+	if index.blocks == nil {
+		return
+	}
+	before := int64(current) * BLOCK_SIZE
+	blocks := make(map[int]map[searchKey][]int64)
+	index.mutex.RLock()
+	for key, ids := range index.postings {
+		for _, id := range ids {
+			if id >= before {
+				break
+			}
+			b := int(id / BLOCK_SIZE)
+			if blocks[b] == nil {
+				blocks[b] = make(map[searchKey][]int64)
+			}
+			blocks[b][key] = append(blocks[b][key], id)
+		}
+	}
+	index.mutex.RUnlock()
+	if len(blocks) == 0 && index.sealed >= current {
+		return
+	}
+
+	//从小到大写入, 中途崩溃时sealed之前的block都已经写入
+	nos := make([]int, 0, len(blocks))
+	for b := range blocks {
+		nos = append(nos, b)
+	}
+	sort.Ints(nos)
+	for _, b := range nos {
+		index.blocks.Write(b, blocks[b])
+	}
+
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	for _, postings := range blocks {
+		for key, written := range postings {
+			index.postings[key] = removeIds(index.postings[key], written)
+			if len(index.postings[key]) == 0 {
+				delete(index.postings, key)
+			}
+		}
+	}
+	if current > index.sealed {
+		index.sealed = current
+	}
+}
+
+// 返回删除了written(从小到大排列)之后的新的slice, 不修改ids
+func removeIds(ids, written []int64) []int64 {
+	r := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		i := sort.Search(len(written), func(i int) bool { return written[i] >= id })
+		if i == len(written) || written[i] != id {
+			r = append(r, id)
+		}
+	}
+	return r
+}
+
+// 从新到旧依次返回包含所有词并且小于beforeMsgId的消息id, f返回false时停止
+// 先返回内存中的索引, 再从新到旧读取每个block的索引文件
+func (index *SearchIndex) Search(owner int64, group bool, terms []string, beforeMsgId int64, f func(msgId int64) bool) {
+	if len(terms) == 0 {
+		return
+	}
+	index.mutex.RLock()
+	lists := make([][]int64, 0, len(terms))
+	for _, term := range terms {
+		lists = append(lists, index.postings[searchKey{owner, group, term}])
+	}
+	sealed := index.sealed
+	index.mutex.RUnlock()
+
+	emit := func(ids []int64) bool {
+		for i := len(ids) - 1; i >= 0; i-- {
+			if beforeMsgId > 0 && ids[i] >= beforeMsgId {
+				continue
+			}
+			if !f(ids[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	ids := intersectIds(lists)
+	n := sort.Search(len(ids), func(i int) bool { return ids[i] >= int64(sealed)*BLOCK_SIZE })
+	if !emit(ids[n:]) || index.blocks == nil {
+		return
+	}
+	ids = ids[:n]
+	for b := sealed - 1; b >= 0; b-- {
+		start := int64(b) * BLOCK_SIZE
+		if beforeMsgId > 0 && start >= beforeMsgId {
+			continue
+		}
+		blockIds := index.blocks.Search(b, owner, group, terms)
+		//内存中还没有合并到文件的索引
+		if i := sort.Search(len(ids), func(i int) bool { return ids[i] >= start }); i < len(ids) {
+			blockIds = unionIds(blockIds, ids[i:])
+			ids = ids[:i]
+		}
+		if !emit(blockIds) {
+			return
+		}
+	}
+}
+
+// 返回所有lists中都有的消息id, 从小到大排列
+func intersectIds(lists [][]int64) []int64 {
+	if len(lists) == 0 {
+		return nil
+	}
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+	ids := make([]int64, 0, len(lists[0]))
+	for _, msgId := range lists[0] {
+		if containsAll(lists[1:], msgId) {
+			ids = append(ids, msgId)
+		}
+	}
+	return ids
+}
+
+// 合并两个从小到大排列的slice, 去掉重复的id
+func unionIds(a, b []int64) []int64 {
+	r := make([]int64, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		var id int64
+		if j == len(b) || (i < len(a) && a[i] <= b[j]) {
+			id = a[i]
+			i++
+		} else {
+			id = b[j]
+			j++
+		}
+		if len(r) == 0 || r[len(r)-1] != id {
+			r = append(r, id)
+		}
+	}
+	return r
+}
+
+func containsAll(lists [][]int64, msgId int64) bool {
+	for _, ids := range lists {
+		i := sort.Search(len(ids), func(i int) bool { return ids[i] >= msgId })
+		if i == len(ids) || ids[i] != msgId {
+			return false
+		}
+	}
+	return true
+}
+
+// 相邻两个字的索引可能匹配到不连续的关键词, 再检查消息内容
+func matchSegments(text string, segments []string) bool {
+	text = strings.ToLower(text)
+	for _, s := range segments {
+		if !strings.Contains(text, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// 返回匹配的消息, 从新到旧排列, filter用来过滤会话和入群时间
+// hasMore为true时nextMsgId是下一次搜索的beforeMsgId
+func (storage *Storage) SearchMessages(owner int64, group bool, query string, beforeMsgId int64, limit int,
+	filter func(msg *proto.Message) bool) ([]*EMessage, bool, int64) {
+	terms, segments := parseQuery(query)
+	messages := make([]*EMessage, 0, limit)
+	scanned := 0
+	var lastId int64
+	hasMore := false
+	now := int32(time.Now().Unix())
+	storage.search.Search(owner, group, terms, beforeMsgId, func(msgId int64) bool {
+		if len(messages) >= limit || scanned >= SEARCH_SCAN_LIMIT {
+			hasMore = true
+			return false
+		}
+		scanned++
+		lastId = msgId
+
+		msg := storage.LoadMessage(msgId)
+		if msg == nil || storage.expiry.IsExpired(msgId, now) || !matchSegments(messageText(msg), segments) || !filter(msg) {
+			return true
+		}
+		messages = append(messages, &EMessage{msgId: msgId, msg: msg})
+		return true
+	})
+	return messages, hasMore, lastId
+}
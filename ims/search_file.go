@@ -0,0 +1,480 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sx-chat/lru"
+	"sync"
+	"time"
+)
+
+// 搜索索引的持久化, 和消息索引一样分为完整的索引文件和增量文件
+// 增量文件在消息索引的增量文件之前写入, 两者之间崩溃时修复消息索引会重复添加, 不会丢失
+// 加载时跳过已经写入search_block_N的block, 合并之后的完整索引文件只有还没有写满的block
+const SEARCH_INDEX_FILE_NAME = "search_index.v1"
+const SEARCH_DELTA_FILE_PREFIX = "search_delta."
+
+func (storage *Storage) searchDeltaPath(seq int) string {
+	return fmt.Sprintf("%s/%s%d", storage.root, SEARCH_DELTA_FILE_PREFIX, seq)
+}
+
+func (storage *Storage) listSearchDeltas() []int {
+	files, _ := filepath.Glob(fmt.Sprintf("%s/%s*", storage.root, SEARCH_DELTA_FILE_PREFIX))
+	seqs := make([]int, 0, len(files))
+	for _, f := range files {
+		seq, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(f), SEARCH_DELTA_FILE_PREFIX))
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	return seqs
+}
+
+// 读取完整的索引文件和序号不超过maxSeq的增量文件, 返回最后一个增量文件的序号
+func (storage *Storage) loadSearchIndex(index *SearchIndex, maxSeq int) int {
+	readIndexFile(storage.indexPath(SEARCH_INDEX_FILE_NAME), func(r io.Reader) error {
+		return readSearchIndex(r, index)
+	})
+	seq := 0
+	for _, s := range storage.listSearchDeltas() {
+		if maxSeq > 0 && s > maxSeq {
+			break
+		}
+		readIndexFile(storage.searchDeltaPath(s), func(r io.Reader) error {
+			return readSearchIndex(r, index)
+		})
+		seq = s
+	}
+	index.removeBefore(int64(storage.search.sealed) * BLOCK_SIZE)
+	//加载的索引已经保存过了
+	index.takeDirty()
+	return seq
+}
+
+// 在flushIndex中调用, 由flushMutex保护
+func (storage *Storage) flushSearchIndex(dirty map[searchKey][]int64) {
+	if len(dirty) == 0 {
+		return
+	}
+	begin := time.Now()
+	seq := storage.searchSeq + 1
+	writeIndexFile(storage.searchDeltaPath(seq), func(w io.Writer) {
+		writeSearchIndex(w, dirty)
+	})
+	storage.searchSeq = seq
+	log.WithFields(log.Fields{"seq": seq, "terms": len(dirty), "used": time.Since(begin)}).Info("保存搜索索引")
+
+	if len(storage.listSearchDeltas()) >= INDEX_MERGE_DELTAS {
+		storage.mergeSearchIndex(seq)
+	}
+}
+
+func (storage *Storage) mergeSearchIndex(seq int) {
+	begin := time.Now()
+	index := NewSearchIndex()
+	storage.loadSearchIndex(index, seq)
+
+	writeIndexFile(storage.indexPath(SEARCH_INDEX_FILE_NAME), func(w io.Writer) {
+		writeSearchIndex(w, index.postings)
+	})
+	for _, s := range storage.listSearchDeltas() {
+		if s > seq {
+			break
+		}
+		if err := os.Remove(storage.searchDeltaPath(s)); err != nil {
+			log.WithField("err", err).Warning("删除搜索索引增量文件失败")
+		}
+	}
+	log.WithFields(log.Fields{"seq": seq, "terms": len(index.postings), "used": time.Since(begin)}).Info("合并搜索索引文件")
+}
+
+// group(1) owner(8) 词的长度(1) 词 消息数量(4) 消息id(8*n)
+func writeSearchIndex(w io.Writer, postings map[searchKey][]int64) {
+	buf := make([]byte, 0, 1024)
+	for key, ids := range postings {
+		buf = buf[:0]
+		if key.group {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+		buf = appendUint64(buf, uint64(key.owner))
+		buf = append(buf, byte(len(key.term)))
+		buf = append(buf, key.term...)
+		buf = appendUint32(buf, uint32(len(ids)))
+		for _, id := range ids {
+			buf = appendUint64(buf, uint64(id))
+		}
+		w.Write(buf)
+	}
+}
+
+func readSearchIndex(r io.Reader, index *SearchIndex) error {
+	var header [10]byte
+	for {
+		_, err := io.ReadFull(r, header[:])
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		term := make([]byte, int(header[9])+4)
+		if _, err := io.ReadFull(r, term); err != nil {
+			return err
+		}
+		count := binary.BigEndian.Uint32(term[len(term)-4:])
+		ids := make([]byte, 8*int(count))
+		if _, err := io.ReadFull(r, ids); err != nil {
+			return err
+		}
+
+		key := searchKey{
+			owner: int64(binary.BigEndian.Uint64(header[1:])),
+			group: header[0] != 0,
+			term:  string(term[:len(term)-4]),
+		}
+		for i := 0; i < int(count); i++ {
+			index.add(key, int64(binary.BigEndian.Uint64(ids[i*8:])))
+		}
+	}
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return append(buf, b[:]...)
+}
+
+// 写满的block的倒排索引, 保存在消息文件旁边的search_block_N, 写入之后不再修改(合并时整个替换)
+// 内存中只缓存最近使用的文件的稀疏索引, 查找一个词时读取稀疏索引指向的一段词条和这个词的消息id
+//
+// search_block_N: 消息id(8*n) | 词条 | 稀疏索引 | 词条的位置(8) 稀疏索引的位置(8) MAGIC(4)
+// 词条: group(1) owner(8) 词的长度(1) 词 消息id的位置(8) 消息数量(4), 按照owner, group, term排列
+// 稀疏索引: 每SEARCH_SPARSE_INTERVAL个词条一项, group(1) owner(8) 词的长度(1) 词 词条的位置(8)
+const SEARCH_BLOCK_FILE_PREFIX = "search_block_"
+const SEARCH_SPARSE_INTERVAL = 64
+const SEARCH_CACHE_BLOCKS = 64
+const SEARCH_FOOTER_SIZE = 20
+
+type searchBlock struct {
+	keys    []searchKey
+	offsets []int64 //keys中每个词条在文件中的位置
+	end     int64   //词条结束的位置
+}
+
+type SearchBlocks struct {
+	root string
+
+	mutex sync.Mutex
+	cache *lru.Cache
+}
+
+func NewSearchBlocks(root string) *SearchBlocks {
+	return &SearchBlocks{root: root, cache: lru.New(SEARCH_CACHE_BLOCKS)}
+}
+
+func (blocks *SearchBlocks) path(blockNo int) string {
+	return fmt.Sprintf("%s/%s%d", blocks.root, SEARCH_BLOCK_FILE_PREFIX, blockNo)
+}
+
+// 已经写入的最大的block加1
+func (blocks *SearchBlocks) next() int {
+	files, _ := filepath.Glob(fmt.Sprintf("%s/%s*", blocks.root, SEARCH_BLOCK_FILE_PREFIX))
+	next := 0
+	for _, f := range files {
+		b, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(f), SEARCH_BLOCK_FILE_PREFIX))
+		if err == nil && b+1 > next {
+			next = b + 1
+		}
+	}
+	return next
+}
+
+func compareSearchKey(a, b searchKey) int {
+	if a.owner != b.owner {
+		if a.owner < b.owner {
+			return -1
+		}
+		return 1
+	}
+	if a.group != b.group {
+		if !a.group {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a.term, b.term)
+}
+
+// 返回block中包含所有词的消息id, 从小到大排列
+func (blocks *SearchBlocks) Search(blockNo int, owner int64, group bool, terms []string) []int64 {
+	lists := make([][]int64, 0, len(terms))
+	for _, term := range terms {
+		ids := blocks.Lookup(blockNo, searchKey{owner, group, term})
+		if len(ids) == 0 {
+			return nil
+		}
+		lists = append(lists, ids)
+	}
+	return intersectIds(lists)
+}
+
+func (blocks *SearchBlocks) Lookup(blockNo int, key searchKey) []int64 {
+	sb := blocks.load(blockNo)
+	if sb == nil {
+		return nil
+	}
+	i := sort.Search(len(sb.keys), func(i int) bool { return compareSearchKey(sb.keys[i], key) > 0 }) - 1
+	if i < 0 {
+		return nil
+	}
+	end := sb.end
+	if i+1 < len(sb.offsets) {
+		end = sb.offsets[i+1]
+	}
+
+	file, err := os.Open(blocks.path(blockNo))
+	if err != nil {
+		log.WithFields(log.Fields{"block": blockNo, "err": err}).Warning("打开搜索索引文件失败")
+		return nil
+	}
+	defer file.Close()
+	buf := make([]byte, end-sb.offsets[i])
+	if _, err := file.ReadAt(buf, sb.offsets[i]); err != nil {
+		log.WithFields(log.Fields{"block": blockNo, "err": err}).Warning("读取搜索索引文件失败")
+		return nil
+	}
+	for len(buf) > 0 {
+		k, offset, count, n := parseSearchEntry(buf)
+		if n == 0 {
+			log.WithField("block", blockNo).Warning("搜索索引文件的词条不完整")
+			return nil
+		}
+		buf = buf[n:]
+		if c := compareSearchKey(k, key); c > 0 {
+			return nil
+		} else if c < 0 {
+			continue
+		}
+		data := make([]byte, 8*int(count))
+		if _, err := file.ReadAt(data, offset); err != nil {
+			log.WithFields(log.Fields{"block": blockNo, "err": err}).Warning("读取搜索索引文件失败")
+			return nil
+		}
+		ids := make([]int64, count)
+		for j := range ids {
+			ids[j] = int64(binary.BigEndian.Uint64(data[j*8:]))
+		}
+		return ids
+	}
+	return nil
+}
+
+// 读取稀疏索引, 没有文件时也缓存, 写入时删除
+func (blocks *SearchBlocks) load(blockNo int) *searchBlock {
+	blocks.mutex.Lock()
+	if v, ok := blocks.cache.Get(blockNo); ok {
+		blocks.mutex.Unlock()
+		return v.(*searchBlock)
+	}
+	blocks.mutex.Unlock()
+
+	sb, err := readSearchBlock(blocks.path(blockNo))
+	if err != nil {
+		log.WithFields(log.Fields{"block": blockNo, "err": err}).Warning("读取搜索索引文件失败")
+		return nil
+	}
+	blocks.mutex.Lock()
+	blocks.cache.Add(blockNo, sb)
+	blocks.mutex.Unlock()
+	return sb
+}
+
+func readSearchBlock(path string) (*searchBlock, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return &searchBlock{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < SEARCH_FOOTER_SIZE {
+		return nil, fmt.Errorf("invalid search block size:%d", info.Size())
+	}
+	var footer [SEARCH_FOOTER_SIZE]byte
+	if _, err := file.ReadAt(footer[:], info.Size()-SEARCH_FOOTER_SIZE); err != nil {
+		return nil, err
+	}
+	entries := int64(binary.BigEndian.Uint64(footer[:]))
+	sparse := int64(binary.BigEndian.Uint64(footer[8:]))
+	if binary.BigEndian.Uint32(footer[16:]) != MAGIC || entries > sparse || sparse > info.Size()-SEARCH_FOOTER_SIZE {
+		return nil, errors.New("invalid search block footer")
+	}
+
+	buf := make([]byte, info.Size()-SEARCH_FOOTER_SIZE-sparse)
+	if _, err := file.ReadAt(buf, sparse); err != nil {
+		return nil, err
+	}
+	sb := &searchBlock{end: sparse}
+	for len(buf) > 0 {
+		k, offset, _, n := parseSearchKey(buf, 8)
+		if n == 0 || offset < entries || offset >= sparse {
+			return nil, errors.New("invalid search block sparse index")
+		}
+		sb.keys = append(sb.keys, k)
+		sb.offsets = append(sb.offsets, offset)
+		buf = buf[n:]
+	}
+	return sb, nil
+}
+
+// 解析group(1) owner(8) 词的长度(1) 词, 之后是extra个字节, 前8个字节是位置
+// 返回key, 位置, extra中位置之后的4个字节和占用的字节数, 不完整时返回0
+func parseSearchKey(buf []byte, extra int) (searchKey, int64, uint32, int) {
+	if len(buf) < 10 {
+		return searchKey{}, 0, 0, 0
+	}
+	size := 10 + int(buf[9]) + extra
+	if len(buf) < size {
+		return searchKey{}, 0, 0, 0
+	}
+	key := searchKey{owner: int64(binary.BigEndian.Uint64(buf[1:])), group: buf[0] != 0, term: string(buf[10 : 10+int(buf[9])])}
+	offset := int64(binary.BigEndian.Uint64(buf[size-extra:]))
+	var count uint32
+	if extra >= 12 {
+		count = binary.BigEndian.Uint32(buf[size-extra+8:])
+	}
+	return key, offset, count, size
+}
+
+func parseSearchEntry(buf []byte) (searchKey, int64, uint32, int) {
+	return parseSearchKey(buf, 12)
+}
+
+func appendSearchKey(buf []byte, key searchKey) []byte {
+	if key.group {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	buf = appendUint64(buf, uint64(key.owner))
+	buf = append(buf, byte(len(key.term)))
+	return append(buf, key.term...)
+}
+
+// 读取block中所有的索引, 没有文件时返回空的map
+func (blocks *SearchBlocks) readAll(blockNo int) (map[searchKey][]int64, error) {
+	postings := make(map[searchKey][]int64)
+	data, err := ioutil.ReadFile(blocks.path(blockNo))
+	if os.IsNotExist(err) {
+		return postings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < SEARCH_FOOTER_SIZE {
+		return nil, errors.New("invalid search block")
+	}
+	footer := data[len(data)-SEARCH_FOOTER_SIZE:]
+	entries := int64(binary.BigEndian.Uint64(footer))
+	sparse := int64(binary.BigEndian.Uint64(footer[8:]))
+	if binary.BigEndian.Uint32(footer[16:]) != MAGIC || entries > sparse || sparse > int64(len(data)-SEARCH_FOOTER_SIZE) {
+		return nil, errors.New("invalid search block footer")
+	}
+	buf := data[entries:sparse]
+	for len(buf) > 0 {
+		key, offset, count, n := parseSearchEntry(buf)
+		if n == 0 || offset+8*int64(count) > entries {
+			return nil, errors.New("invalid search block entry")
+		}
+		ids := make([]int64, count)
+		for i := range ids {
+			ids[i] = int64(binary.BigEndian.Uint64(data[offset+int64(i)*8:]))
+		}
+		postings[key] = ids
+		buf = buf[n:]
+	}
+	return postings, nil
+}
+
+// 和已经写入的索引合并之后替换整个文件, 只在保存索引时调用
+func (blocks *SearchBlocks) Write(blockNo int, postings map[searchKey][]int64) {
+	old, err := blocks.readAll(blockNo)
+	if err != nil {
+		log.WithFields(log.Fields{"block": blockNo, "err": err}).Fatal("读取搜索索引文件失败")
+	}
+	for key, ids := range postings {
+		old[key] = unionIds(old[key], ids)
+	}
+	keys := make([]searchKey, 0, len(old))
+	for key := range old {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return compareSearchKey(keys[i], keys[j]) < 0 })
+
+	begin := time.Now()
+	writeIndexFile(blocks.path(blockNo), func(w io.Writer) {
+		var pos int64
+		buf := make([]byte, 0, 1024)
+		for _, key := range keys {
+			buf = buf[:0]
+			for _, id := range old[key] {
+				buf = appendUint64(buf, uint64(id))
+			}
+			w.Write(buf)
+			pos += int64(len(buf))
+		}
+
+		entries := pos
+		var offset int64
+		sparse := make([]byte, 0, 1024)
+		for i, key := range keys {
+			if i%SEARCH_SPARSE_INTERVAL == 0 {
+				sparse = appendSearchKey(sparse, key)
+				sparse = appendUint64(sparse, uint64(pos))
+			}
+			buf = appendSearchKey(buf[:0], key)
+			buf = appendUint64(buf, uint64(offset))
+			buf = appendUint32(buf, uint32(len(old[key])))
+			w.Write(buf)
+			pos += int64(len(buf))
+			offset += 8 * int64(len(old[key]))
+		}
+
+		sparseOffset := pos
+		w.Write(sparse)
+		buf = appendUint64(buf[:0], uint64(entries))
+		buf = appendUint64(buf, uint64(sparseOffset))
+		buf = appendUint32(buf, MAGIC)
+		w.Write(buf)
+	})
+
+	blocks.mutex.Lock()
+	blocks.cache.Remove(blockNo)
+	blocks.mutex.Unlock()
+	log.WithFields(log.Fields{"block": blockNo, "terms": len(keys), "used": time.Since(begin)}).Info("保存block的搜索索引")
+}
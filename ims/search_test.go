@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sx-chat/proto"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	terms := tokenize("我爱北京, Hello World2")
+	expect := []string{"我", "我爱", "爱", "爱北", "北", "北京", "京", "hello", "world2"}
+	if !reflect.DeepEqual(terms, expect) {
+		t.Errorf("terms:%v expect:%v", terms, expect)
+	}
+
+	terms, segments := parseQuery("北京 hello")
+	if !reflect.DeepEqual(terms, []string{"北京", "hello"}) || !reflect.DeepEqual(segments, []string{"北京", "hello"}) {
+		t.Errorf("query terms:%v segments:%v", terms, segments)
+	}
+}
+
+// 搜索结果从新到旧排列, 重启之后从增量文件和消息文件恢复搜索索引
+func TestSearchMessages(t *testing.T) {
+	root, err := ioutil.TempDir("", "ims")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	s1 := NewStorage(root, SYNC_NONE)
+	save := func(receiver int64, content string) int64 {
+		im := &proto.IMMessage{Sender: 1, Receiver: receiver, Content: content}
+		msgId, _ := s1.SavePeerMessage(receiver, 1, &proto.Message{Cmd: proto.MSG_IM, Version: STORAGE_VERSION, Body: im})
+		return msgId
+	}
+	id1 := save(2, "我们是中国人")
+	save(2, "中国的国人")
+	save(3, "我们是中国人")
+	s1.FlushIndex()
+	id2 := save(2, "中国人 hello")
+	im := &proto.IMMessage{Sender: 1, Receiver: 10, Timestamp: 5, Content: "群里的中国人"}
+	s1.SaveGroupMessage(10, 1, &proto.Message{Cmd: proto.MSG_GROUP_IM, Version: STORAGE_VERSION, Body: im})
+	s1.file.Close()
+
+	s2 := NewStorage(root, SYNC_NONE)
+	all := func(msg *proto.Message) bool { return true }
+	for _, s := range []*Storage{s1, s2} {
+		messages, hasMore, _ := s.SearchMessages(2, false, "中国人", 0, 10, all)
+		if len(messages) != 2 || hasMore || messages[0].msgId != id2 || messages[1].msgId != id1 {
+			t.Errorf("search:%v %v", messages, hasMore)
+		}
+
+		messages, hasMore, next := s.SearchMessages(2, false, "中国人", 0, 1, all)
+		if len(messages) != 1 || !hasMore || next != id2 {
+			t.Errorf("search limit:%v %v %d", messages, hasMore, next)
+		}
+		messages, _, _ = s.SearchMessages(2, false, "中国人", next, 1, all)
+		if len(messages) != 1 || messages[0].msgId != id1 {
+			t.Errorf("search before:%v", messages)
+		}
+
+		if messages, _, _ := s.SearchMessages(2, false, "HELLO 中国", 0, 10, all); len(messages) != 1 {
+			t.Errorf("search words:%v", messages)
+		}
+		if messages, _, _ := s.SearchMessages(10, true, "中国人", 0, 10, all); len(messages) != 1 {
+			t.Errorf("search group:%v", messages)
+		}
+	}
+}
+
+// 写满的block的索引写入文件之后从内存中删除, 搜索时合并文件和内存中的索引
+func TestSearchBlocks(t *testing.T) {
+	root, err := ioutil.TempDir("", "ims")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	index := NewSearchIndex()
+	index.blocks = NewSearchBlocks(root)
+	key := func(term string) searchKey { return searchKey{2, false, term} }
+	ids := []int64{100, 200, BLOCK_SIZE + 100, 2*BLOCK_SIZE + 100}
+	for _, id := range ids {
+		index.add(key("中国"), id)
+		index.add(key("hello"), id)
+	}
+	index.add(key("中国"), 300)
+	index.add(searchKey{3, false, "中国"}, 400)
+	for owner := int64(100); owner < 300; owner++ {
+		index.add(searchKey{owner, true, "x"}, 500)
+	}
+	index.seal(2)
+
+	//切换block之后才添加的索引合并到已经写入的文件
+	index.add(key("中国"), BLOCK_SIZE+200)
+	index.add(key("hello"), BLOCK_SIZE+200)
+
+	search := func(index *SearchIndex, before int64) []int64 {
+		var r []int64
+		index.Search(2, false, []string{"中国", "hello"}, before, func(msgId int64) bool {
+			r = append(r, msgId)
+			return true
+		})
+		return r
+	}
+	expect := []int64{2*BLOCK_SIZE + 100, BLOCK_SIZE + 200, BLOCK_SIZE + 100, 200, 100}
+	if r := search(index, 0); !reflect.DeepEqual(r, expect) {
+		t.Errorf("search:%v expect:%v", r, expect)
+	}
+	if r := search(index, BLOCK_SIZE+150); !reflect.DeepEqual(r, expect[2:]) {
+		t.Errorf("search before:%v", r)
+	}
+	if len(index.postings) != 2 || len(index.postings[key("中国")]) != 2 {
+		t.Errorf("postings in memory:%v", index.postings)
+	}
+
+	index.seal(2)
+	index2 := NewSearchIndex()
+	index2.blocks = NewSearchBlocks(root)
+	index2.sealed = index2.blocks.next()
+	index2.add(key("中国"), 2*BLOCK_SIZE+100)
+	index2.add(key("hello"), 2*BLOCK_SIZE+100)
+	if r := search(index2, 0); index2.sealed != 2 || !reflect.DeepEqual(r, expect) {
+		t.Errorf("reopen sealed:%d search:%v", index2.sealed, r)
+	}
+	if r := index2.blocks.Lookup(0, searchKey{3, false, "中国"}); !reflect.DeepEqual(r, []int64{400}) {
+		t.Errorf("lookup:%v", r)
+	}
+	if r := index2.blocks.Lookup(0, searchKey{250, true, "x"}); !reflect.DeepEqual(r, []int64{500}) {
+		t.Errorf("lookup sparse:%v", r)
+	}
+	if r := index2.blocks.Lookup(0, searchKey{250, true, "y"}); r != nil {
+		t.Errorf("lookup missing:%v", r)
+	}
+}
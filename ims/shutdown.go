@@ -0,0 +1,33 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+//等待rpc的结果发送出去的时间, 大于gorpc.Server的FlushDelay
+const SHUTDOWN_FLUSH_DELAY = 100 * time.Millisecond
+
+// 阻塞直到收到SIGTERM或者SIGINT
+func WaitSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-c
+	log.WithField("signal", sig).Info("收到退出信号")
+}
+
+// 先拒绝新的写入, 等待处理中的rpc完成并且把结果发送给im之后再停止rpc服务
+// 直接停止rpc服务会断开连接, 已经保存的消息的结果丢失, im重试时保存重复的消息
+func Shutdown() {
+	atomic.StoreInt32(&rpcStopping, 1)
+	rpcMutex.Lock()
+	time.Sleep(SHUTDOWN_FLUSH_DELAY)
+	rpcServer.Stop()
+
+	storage.Close()
+	log.WithField("last id", storage.lastId).Info("storage已关闭")
+}
@@ -1,30 +1,52 @@
 package main
 
-import log "github.com/sirupsen/logrus"
+import (
+	log "github.com/sirupsen/logrus"
+	"sx-chat/proto"
+	"sync"
+	"time"
+)
 
 type Storage struct {
 	*StorageFile
 	*PeerStorage
 	*GroupStorage
+
+	flushMutex sync.Mutex //保存索引和合并索引文件不能同时进行
+	indexSeq   int        //最后一个增量索引文件的序号
+
+	search    *SearchIndex
+	searchSeq int //最后一个搜索索引增量文件的序号
 }
 
-func NewStorage(root string) *Storage {
-	file := NewStorageFile(root)
+func NewStorage(root string, syncMode int) *Storage {
+	file := NewStorageFile(root, syncMode)
 	ps := NewPeerStorage(file)
 	gs := NewGroupStorage(file)
 
+	search := NewSearchIndex()
+	search.blocks = NewSearchBlocks(root)
+	search.sealed = search.blocks.next()
+	ps.search = search
+	gs.search = search
+
 	storage := &Storage{
-		file,
-		ps,
-		gs,
+		StorageFile:  file,
+		PeerStorage:  ps,
+		GroupStorage: gs,
+		search:       search,
 	}
 
-	r1 := storage.readPeerIndex()
+	peerIndex := make(map[UserId]*UserIndex)
+	groupIndex := make(map[GroupId]*GroupIndex)
+	storage.indexSeq = storage.loadIndex(peerIndex, groupIndex, 0)
+	storage.searchSeq = storage.loadSearchIndex(search, 0)
+	storage.loadExpireIndex(file.expiry)
+	ps.initPeerIndex(peerIndex)
+	gs.initGroupIndex(groupIndex)
 	storage.lastSavedId = storage.lastId
 
-	if r1 {
-		storage.repairPeerIndex()
-	}
+	storage.repairIndex()
 
 	log.Infof("last id:%d last saved id:%d", storage.lastId, storage.lastSavedId)
 	storage.FlushIndex()
@@ -35,14 +57,50 @@ func (storage *Storage) FlushIndex() {
 	storage.flushIndex()
 }
 
-func (storage *Storage) flushIndex() {
+// 从消息文件中恢复最后一次保存索引之后的消息
+func (storage *Storage) repairIndex() {
+	log.Info("修复message index开始:", storage.lastId, time.Now().UnixNano())
+	first := storage.getBlockNo(storage.lastId)
+	off := storage.getBlockOffset(storage.lastId)
+
+	for i := first; i <= storage.blockNo; i++ {
+		file := storage.openReadFile(i)
+		if file == nil {
+			//历史消息被删除
+			continue
+		}
+
+		offset := HEADER_SIZE
+		if i == first && off > HEADER_SIZE {
+			offset = off
+		}
+		blockNo := i
+		scanBlock(file, int64(offset), func(msg *proto.Message, offset int64) {
+			msgId := int64(blockNo)*BLOCK_SIZE + offset
+			if msgId == storage.lastSavedId {
+				return
+			}
+			storage.PeerStorage.execMessage(msg, msgId)
+			storage.GroupStorage.execMessage(msg, msgId)
+			storage.expiry.execMessage(msg, msgId)
+		}, func(begin, end int64) {
+			log.WithFields(log.Fields{"block": blockNo, "begin": begin, "end": end}).Warning("消息文件损坏, 跳过")
+		})
+		file.Close()
+	}
+	log.Info("修复message index结束:", storage.lastId, time.Now().UnixNano())
+}
+
+// 退出之前把当前block同步到磁盘并且保存索引
+func (storage *Storage) Close() {
+	storage.closeAppend()
+
 	storage.mutex.Lock()
-	lastId := storage.lastId
-	peerIndex := storage.clonePeerIndex()
-	groupIndex := storage.cloneGroupIndex()
+	err := storage.file.Sync()
 	storage.mutex.Unlock()
+	if err != nil {
+		log.Error("同步storage文件失败 err:", err)
+	}
 
-	storage.savePeerIndex(peerIndex)
-	storage.saveGroupIndex(groupIndex)
-	storage.lastSavedId = lastId
+	storage.flushIndex()
 }
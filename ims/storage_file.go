@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
 	log "github.com/sirupsen/logrus"
@@ -11,31 +10,60 @@ import (
 	"strconv"
 	"strings"
 	"sx-chat/lru"
+	"sx-chat/proto"
 	"sync"
+	"sync/atomic"
 )
 
 const HEADER_SIZE = 32
 const MAGIC = 0x494d494d
-const F_VERSION = 1 << 16            //1.0
+const F_VERSION_1 = 1 << 16          //1.0, 记录没有crc
+const F_VERSION = 2 << 16            //2.0
 const BLOCK_SIZE = 128 * 1024 * 1024 // 1个文件的大小 128M
 const LRU_SIZE = 128
 
 type StorageFile struct {
-	root  string
+	root string
+
+	//保护当前写入的文件, 只有appendLoop写入, 同步和切换block时也需要持有
 	mutex sync.Mutex
+	StorageSyncer
+
+	dirty    bool     //是否有新的写入
+	blockNo  int      // 消息持久化文件的id
+	file     *os.File // 持久化文件，名称和blockNo有关
+	fileSize int64    //当前block的大小
+	writeId  int64    //最后一次写入之后在所有文件中的全局位置
+
+	appendCh chan *appendRequest
+	writeBuf []byte
+
+	//读取消息使用的文件, 使用ReadAt读取, 不需要持有mutex
+	filesMutex sync.Mutex
+	files      *lru.Cache
 
-	dirty   bool     //是否有新的写入
-	blockNo int      // 消息持久化文件的id
-	file    *os.File // 持久化文件，名称和blockNo有关
-	files   *lru.Cache
+	//保存消息的时候持有读锁, 保存索引时持有写锁取出修改过的索引
+	//这样写锁期间没有保存到一半的消息, 索引中的最大消息id之前的消息都已经在索引中
+	indexMutex sync.RWMutex
 
-	lastId      int64 //peer&group message_index记录的最大消息id
+	lastId      int64 //peer&group message_index记录的最大消息id, 使用atomic访问
 	lastSavedId int64 //索引文件中最大的消息id
+
+	//不为nil时本地不存在的block从归档下载
+	archive *BlockArchive
+
+	//消息的过期时间
+	expiry *ExpireIndex
+
+	//归档和清除过期消息不能同时进行
+	maintainMutex sync.Mutex
 }
 
-func NewStorageFile(root string) *StorageFile {
+func NewStorageFile(root string, syncMode int) *StorageFile {
 	storage := new(StorageFile)
 	storage.root = root
+	storage.expiry = NewExpireIndex()
+	storage.init(syncMode)
 	storage.files = lru.New(LRU_SIZE)
 	storage.files.OnEvicted = onFileEvicted
 
@@ -59,57 +87,28 @@ func NewStorageFile(root string) *StorageFile {
 	}
 
 	storage.openWriteFile(blockNo)
-	return storage
-}
 
-func onFileEvicted(key lru.Key, value interface{}) {
-	f := value.(*os.File)
-	f.Close()
+	storage.appendCh = make(chan *appendRequest, APPEND_QUEUE_SIZE)
+	go storage.appendLoop()
+	return storage
 }
 
-func (storage *StorageFile) saveMessage(msg *Message) int64 {
-	msgId, err := storage.file.Seek(0, io.SeekEnd)
-	if err != nil {
-		log.Fatalln(err)
-	}
-
-	buffer := new(bytes.Buffer)
-	binary.Write(buffer, binary.BigEndian, int32(MAGIC))
-	WriteMessage(buffer, msg)
-	binary.Write(buffer, binary.BigEndian, int32(MAGIC))
-
-	buf := buffer.Bytes()
-
-	if msgId+int64(len(buf)) > BLOCK_SIZE { // 当前这个文件满了，需要开启下一个文件
-		err := storage.file.Sync() // 同步到磁盘
-		if err != nil {
-			log.Fatalln("同步storage 文件失败 err: ", err)
-		}
-		storage.file.Close()
-		storage.openWriteFile(storage.blockNo + 1)
-		msgId, err = storage.file.Seek(0, io.SeekEnd)
-		if err != nil {
-			log.Fatalln(err)
+func (storage *StorageFile) updateLastId(lastId int64) {
+	for {
+		id := atomic.LoadInt64(&storage.lastId)
+		if lastId <= id || atomic.CompareAndSwapInt64(&storage.lastId, id, lastId) {
+			return
 		}
 	}
+}
 
-	if msgId+int64(len(buf)) > BLOCK_SIZE { // 如果这个时候还满足条件，那就是消息太大了
-		log.Fatalln("message size:", len(buf))
-	}
-
-	// 写入消息内容
-	n, err := storage.file.Write(buf)
-	if err != nil {
-		log.Fatal("文件写入失败 err:", err)
-	}
-	if n != len(buf) {
-		log.Fatal("文件写入大小不一致 write size:", len(buf), " nwrite:", n)
+// 在filesMutex内调用, 正在读取的文件等读取结束之后再关闭
+func onFileEvicted(key lru.Key, value interface{}) {
+	f := value.(*BlockFile)
+	f.evicted = true
+	if f.refs == 0 {
+		f.Close()
 	}
-	storage.dirty = true
-
-	msgId = int64(storage.blockNo)*BLOCK_SIZE + msgId // msgId是当前文件的偏移量，这里计算全局的偏移
-	log.Info("save message:", Command(msg.cmd), " ", msgId)
-	return msgId
 }
 
 func (storage *StorageFile) openWriteFile(blockNo int) {
@@ -133,8 +132,18 @@ func (storage *StorageFile) openWriteFile(blockNo int) {
 	}
 	if fileSize == 0 {
 		storage.WriteHeader(file)
+	} else if version := readFileVersion(file); version != F_VERSION {
+		// 旧版本的文件只读, 新的消息写入下一个block
+		log.Infof("message file version:%x, open next block", version)
+		file.Close()
+		storage.openWriteFile(blockNo + 1)
+		return
 	}
 	storage.file = file
+	storage.fileSize = fileSize
+	if fileSize == 0 {
+		storage.fileSize = HEADER_SIZE
+	}
 	storage.blockNo = blockNo
 	storage.dirty = false
 }
@@ -157,12 +166,10 @@ func (storage *StorageFile) WriteHeader(file *os.File) {
 	}
 }
 
-func (storage *StorageFile) LoadMessage(msgId int64) *Message {
+func (storage *StorageFile) LoadMessage(msgId int64) *proto.Message {
 	if msgId == 0 {
 		return nil
 	}
-	storage.mutex.Lock()
-	defer storage.mutex.Unlock()
 
 	blockNo := storage.getBlockNo(msgId)
 	offset := storage.getBlockOffset(msgId)
@@ -172,13 +179,17 @@ func (storage *StorageFile) LoadMessage(msgId int64) *Message {
 		log.Warning("can't get file object")
 		return nil
 	}
+	defer storage.releaseFile(file)
 
-	_, err := file.Seek(int64(offset), io.SeekStart)
+	msg, _, err := readRecord(file, int64(offset), file.version)
+	if err == errPurgedRecord {
+		return nil
+	}
 	if err != nil {
-		log.Warning("seek file err: ", err)
+		log.WithFields(log.Fields{"msgId": msgId, "err": err}).Warning("read message err")
 		return nil
 	}
-	return storage.ReadMessage(file)
+	return msg
 }
 
 func (storage *StorageFile) getBlockNo(msgId int64) int {
@@ -189,22 +200,67 @@ func (storage *StorageFile) getBlockOffset(msgId int64) int {
 	return int(msgId % BLOCK_SIZE)
 }
 
-func (storage *StorageFile) getFile(blockNo int) *os.File {
+// 使用完之后需要调用releaseFile
+func (storage *StorageFile) getFile(blockNo int) *BlockFile {
+	storage.filesMutex.Lock()
 	v, ok := storage.files.Get(blockNo)
 	if ok {
-		return v.(*os.File)
+		file := v.(*BlockFile)
+		file.refs++
+		storage.filesMutex.Unlock()
+		return file
 	}
+	storage.filesMutex.Unlock()
+
+	//从归档下载的时间可能比较长, 不持有filesMutex
 	file := storage.openReadFile(blockNo)
 	if file == nil {
 		return nil
 	}
+
+	storage.filesMutex.Lock()
+	defer storage.filesMutex.Unlock()
+	if v, ok := storage.files.Get(blockNo); ok {
+		file.Close()
+		f := v.(*BlockFile)
+		f.refs++
+		return f
+	}
+	file.refs++
 	storage.files.Add(blockNo, file)
 	return file
 }
 
-func (storage *StorageFile) openReadFile(blockNo int) *os.File {
+func (storage *StorageFile) releaseFile(file *BlockFile) {
+	storage.filesMutex.Lock()
+	defer storage.filesMutex.Unlock()
+
+	file.refs--
+	if file.refs == 0 && file.evicted {
+		file.Close()
+	}
+}
+
+func (storage *StorageFile) openReadFile(blockNo int) *BlockFile {
 	path := fmt.Sprintf("%s/message_%d", storage.root, blockNo)
 	log.Info("open message block file path:", path)
+	file := openBlockFile(path)
+	if file != nil || storage.archive == nil {
+		return file
+	}
+
+	path, err := storage.archive.fetch(blockNo)
+	if err != nil {
+		if err != errArchiveNotFound {
+			log.WithFields(log.Fields{"block": blockNo, "err": err}).Warning("下载归档的消息文件失败")
+		}
+		return nil
+	}
+	log.Info("open archived message block file path:", path)
+	return openBlockFile(path)
+}
+
+func openBlockFile(path string) *BlockFile {
 	file, err := os.Open(path)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -222,34 +278,18 @@ func (storage *StorageFile) openReadFile(blockNo int) *os.File {
 		log.Fatal("file header is't complete")
 	}
 
-	return file
+	return &BlockFile{File: file, version: readFileVersion(file), size: fileSize}
 }
 
-func (storage *StorageFile) ReadMessage(file *os.File) *Message {
-	var magic int32
-	err := binary.Read(file, binary.BigEndian, &magic)
-	if err != nil {
-		log.Info("read file err:", err)
-		return nil
+// 文件头中的版本号, 空文件按照当前版本处理
+func readFileVersion(file *os.File) int {
+	var header [8]byte
+	n, _ := file.ReadAt(header[:], 0)
+	if n < len(header) {
+		return F_VERSION
 	}
-	if magic != MAGIC {
-		log.Warning("magic err:", magic)
-		return nil
+	if binary.BigEndian.Uint32(header[:]) != MAGIC {
+		log.Fatal("file magic err:", file.Name())
 	}
-
-	msg := ReceiveMessage(file)
-
-	if msg == nil {
-		return msg
-	}
-	err = binary.Read(file, binary.BigEndian, &magic)
-	if err != nil {
-		log.Info("read file err:", err)
-		return nil
-	}
-	if magic != MAGIC {
-		log.Warning("magic err:", magic)
-		return nil
-	}
-	return msg
+	return int(binary.BigEndian.Uint32(header[4:]))
 }
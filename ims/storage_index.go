@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 索引的持久化
+// peer_index.v3和group_index.v3是完整的索引文件, index_delta.N是第N次保存时修改过的索引
+// 每次保存只写入一个新的增量文件, 增量文件超过INDEX_MERGE_DELTAS个之后合并到完整的索引文件
+// 加载时按顺序读取完整的索引文件和所有的增量文件, 后面的覆盖前面的
+const INDEX_DELTA_FILE_PREFIX = "index_delta."
+const INDEX_MERGE_DELTAS = 12
+
+const PEER_INDEX_SIZE = 48
+const GROUP_INDEX_SIZE = 40
+
+func (storage *Storage) indexPath(name string) string {
+	return fmt.Sprintf("%s/%s", storage.root, name)
+}
+
+func (storage *Storage) deltaPath(seq int) string {
+	return fmt.Sprintf("%s/%s%d", storage.root, INDEX_DELTA_FILE_PREFIX, seq)
+}
+
+// 所有增量文件的序号, 从小到大排列
+func (storage *Storage) listDeltas() []int {
+	files, _ := filepath.Glob(fmt.Sprintf("%s/%s*", storage.root, INDEX_DELTA_FILE_PREFIX))
+	seqs := make([]int, 0, len(files))
+	for _, f := range files {
+		seq, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(f), INDEX_DELTA_FILE_PREFIX))
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	return seqs
+}
+
+// 读取完整的索引文件和所有增量文件, 返回最后一个增量文件的序号
+func (storage *Storage) loadIndex(peerIndex map[UserId]*UserIndex, groupIndex map[GroupId]*GroupIndex, maxSeq int) int {
+	readIndexFile(storage.indexPath(PEER_INDEX_FILE_NAME), func(r io.Reader) error {
+		return readPeerIndex(r, -1, peerIndex)
+	})
+	readIndexFile(storage.indexPath(GROUP_INDEX_FILE_NAME), func(r io.Reader) error {
+		return readGroupIndex(r, -1, groupIndex)
+	})
+
+	seq := 0
+	for _, s := range storage.listDeltas() {
+		if maxSeq > 0 && s > maxSeq {
+			break
+		}
+		readIndexFile(storage.deltaPath(s), func(r io.Reader) error {
+			return readDelta(r, peerIndex, groupIndex)
+		})
+		seq = s
+	}
+	return seq
+}
+
+// 把上次保存之后修改过的索引写入一个新的增量文件
+// 只在交换每个分片修改过的索引时持有indexMutex, 耗时和分片的数量成正比
+func (storage *Storage) flushIndex() {
+	storage.flushMutex.Lock()
+	defer storage.flushMutex.Unlock()
+
+	storage.indexMutex.Lock()
+	lastId := atomic.LoadInt64(&storage.lastId)
+	peerShards := storage.takeDirtyPeerIndex()
+	groupShards := storage.takeDirtyGroupIndex()
+	searchDirty := storage.search.takeDirty()
+	expireEntries := storage.expiry.takeDirty()
+	storage.indexMutex.Unlock()
+
+	if len(peerShards) == 0 && len(groupShards) == 0 && len(searchDirty) == 0 && expireEntries == nil {
+		return
+	}
+
+	peerIndex := make(map[UserId]*UserIndex)
+	for _, shard := range peerShards {
+		for id, ui := range shard {
+			peerIndex[id] = ui
+		}
+	}
+	groupIndex := make(map[GroupId]*GroupIndex)
+	for _, shard := range groupShards {
+		for id, index := range shard {
+			groupIndex[id] = index
+		}
+	}
+
+	//索引指向的消息必须先落盘
+	storage.sync()
+
+	//搜索索引先保存, 消息索引保存之前崩溃时从消息文件中修复
+	//写满的block的搜索索引在增量文件之前写入, 加载时跳过的block一定已经在search_block_N中
+	storage.mutex.Lock()
+	current := storage.blockNo
+	storage.mutex.Unlock()
+	storage.search.seal(current)
+	storage.flushSearchIndex(searchDirty)
+	storage.flushExpireIndex(expireEntries)
+
+	begin := time.Now()
+	seq := storage.indexSeq + 1
+	writeIndexFile(storage.deltaPath(seq), func(w io.Writer) {
+		writeDelta(w, peerIndex, groupIndex)
+	})
+	storage.indexSeq = seq
+	storage.lastSavedId = lastId
+	log.WithFields(log.Fields{"seq": seq, "peers": len(peerIndex), "groups": len(groupIndex),
+		"used": time.Since(begin)}).Info("保存增量索引")
+
+	if len(storage.listDeltas()) >= INDEX_MERGE_DELTAS {
+		storage.mergeIndex(seq)
+	}
+}
+
+// 把序号不超过seq的增量文件合并到完整的索引文件中
+// 在单独的map中合并, 不影响消息的保存
+func (storage *Storage) mergeIndex(seq int) {
+	begin := time.Now()
+	peerIndex := make(map[UserId]*UserIndex)
+	groupIndex := make(map[GroupId]*GroupIndex)
+	storage.loadIndex(peerIndex, groupIndex, seq)
+
+	writeIndexFile(storage.indexPath(PEER_INDEX_FILE_NAME), func(w io.Writer) {
+		writePeerIndex(w, peerIndex)
+	})
+	writeIndexFile(storage.indexPath(GROUP_INDEX_FILE_NAME), func(w io.Writer) {
+		writeGroupIndex(w, groupIndex)
+	})
+
+	//两个索引文件都替换之后才能删除增量文件, 重复读取已经合并的增量文件不影响结果
+	for _, s := range storage.listDeltas() {
+		if s > seq {
+			break
+		}
+		if err := os.Remove(storage.deltaPath(s)); err != nil {
+			log.WithField("err", err).Warning("删除增量索引文件失败")
+		}
+	}
+	log.WithFields(log.Fields{"seq": seq, "peers": len(peerIndex), "groups": len(groupIndex),
+		"used": time.Since(begin)}).Info("合并索引文件")
+}
+
+// 先写入临时文件, 同步到磁盘之后再重命名, 不会留下不完整的索引文件
+func writeIndexFile(path string, f func(w io.Writer)) {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		log.Fatal("open file:", err)
+	}
+
+	w := bufio.NewWriterSize(file, 64*1024)
+	f(w)
+	if err := w.Flush(); err != nil {
+		log.Fatal("write file:", err)
+	}
+	if err := file.Sync(); err != nil {
+		log.Fatal("sync file:", err)
+	}
+	file.Close()
+
+	if err := os.Rename(tmp, path); err != nil {
+		log.Fatal("rename index file err:", err)
+	}
+}
+
+func readIndexFile(path string, f func(r io.Reader) error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Fatal("open file:", err)
+		}
+		return
+	}
+	defer file.Close()
+
+	log.Info("read message index path:", path)
+	if err := f(bufio.NewReaderSize(file, 64*1024)); err != nil {
+		log.Fatal("read index file:", path, " err:", err)
+	}
+}
+
+// 增量文件: 用户数量 | 用户索引 | 群组数量 | 群组索引
+func writeDelta(w io.Writer, peerIndex map[UserId]*UserIndex, groupIndex map[GroupId]*GroupIndex) {
+	binary.Write(w, binary.BigEndian, int32(len(peerIndex)))
+	writePeerIndex(w, peerIndex)
+	binary.Write(w, binary.BigEndian, int32(len(groupIndex)))
+	writeGroupIndex(w, groupIndex)
+}
+
+func readDelta(r io.Reader, peerIndex map[UserId]*UserIndex, groupIndex map[GroupId]*GroupIndex) error {
+	var count int32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return err
+	}
+	if err := readPeerIndex(r, int(count), peerIndex); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return err
+	}
+	return readGroupIndex(r, int(count), groupIndex)
+}
+
+func writePeerIndex(w io.Writer, messageIndex map[UserId]*UserIndex) {
+	var buf [PEER_INDEX_SIZE]byte
+	for id, value := range messageIndex {
+		binary.BigEndian.PutUint64(buf[0:], uint64(id.uid))
+		binary.BigEndian.PutUint64(buf[8:], uint64(value.lastMsgId))
+		binary.BigEndian.PutUint64(buf[16:], uint64(value.lastId))
+		binary.BigEndian.PutUint64(buf[24:], uint64(value.lastPeerId))
+		binary.BigEndian.PutUint64(buf[32:], uint64(value.lastBatchId))
+		binary.BigEndian.PutUint64(buf[40:], uint64(value.lastSeqId))
+		w.Write(buf[:])
+	}
+}
+
+// count小于0时读取到文件末尾
+func readPeerIndex(r io.Reader, count int, messageIndex map[UserId]*UserIndex) error {
+	var buf [PEER_INDEX_SIZE]byte
+	for i := 0; count < 0 || i < count; i++ {
+		_, err := io.ReadFull(r, buf[:])
+		if err == io.EOF && count < 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		id := UserId{int64(binary.BigEndian.Uint64(buf[0:]))}
+		messageIndex[id] = &UserIndex{
+			lastMsgId:   int64(binary.BigEndian.Uint64(buf[8:])),
+			lastId:      int64(binary.BigEndian.Uint64(buf[16:])),
+			lastPeerId:  int64(binary.BigEndian.Uint64(buf[24:])),
+			lastBatchId: int64(binary.BigEndian.Uint64(buf[32:])),
+			lastSeqId:   int64(binary.BigEndian.Uint64(buf[40:])),
+		}
+	}
+	return nil
+}
+
+func writeGroupIndex(w io.Writer, messageIndex map[GroupId]*GroupIndex) {
+	var buf [GROUP_INDEX_SIZE]byte
+	for id, value := range messageIndex {
+		binary.BigEndian.PutUint64(buf[0:], uint64(id.gid))
+		binary.BigEndian.PutUint64(buf[8:], uint64(value.lastMsgId))
+		binary.BigEndian.PutUint64(buf[16:], uint64(value.lastId))
+		binary.BigEndian.PutUint64(buf[24:], uint64(value.lastBatchId))
+		binary.BigEndian.PutUint64(buf[32:], uint64(value.lastSeqId))
+		w.Write(buf[:])
+	}
+}
+
+func readGroupIndex(r io.Reader, count int, messageIndex map[GroupId]*GroupIndex) error {
+	var buf [GROUP_INDEX_SIZE]byte
+	for i := 0; count < 0 || i < count; i++ {
+		_, err := io.ReadFull(r, buf[:])
+		if err == io.EOF && count < 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		id := GroupId{int64(binary.BigEndian.Uint64(buf[0:]))}
+		messageIndex[id] = &GroupIndex{
+			lastMsgId:   int64(binary.BigEndian.Uint64(buf[8:])),
+			lastId:      int64(binary.BigEndian.Uint64(buf[16:])),
+			lastBatchId: int64(binary.BigEndian.Uint64(buf[24:])),
+			lastSeqId:   int64(binary.BigEndian.Uint64(buf[32:])),
+		}
+	}
+	return nil
+}
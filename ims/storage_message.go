@@ -1,69 +1,61 @@
 package main
 
 import (
-	"bytes"
 	"encoding/binary"
+	"math"
+	"sx-chat/proto"
 )
 
-//内部文件存储使用
-//超级群消息队列
-const MSG_GROUP_OFFLINE = 247
-
-//个人消息队列
-const MSG_OFFLINE = 248
+//消息统一按照这个版本保存到文件, 之前版本保存的消息按照消息头中的版本解析
+const STORAGE_VERSION = proto.MAX_VERSION
 
 func init() {
-	messageCreators[MSG_GROUP_OFFLINE] = func() IMessage { return new(OfflineMessage) }
+	proto.RegisterMessage(proto.MSG_OFFLINE, func() proto.IMessage { return new(OfflineMessage) })
+	proto.RegisterMessage(proto.MSG_GROUP_OFFLINE, func() proto.IMessage { return new(OfflineMessage) })
 }
 
 type EMessage struct {
 	msgId    int64
 	deviceId int64
-	msg      *Message
+	msg      *proto.Message
 }
 
+// msgId(8) deviceId(8) 消息长度(2) 消息
 func (emsg *EMessage) ToData() []byte {
 	if emsg.msg == nil {
 		return nil
 	}
 
-	buffer := new(bytes.Buffer)
-	binary.Write(buffer, binary.BigEndian, emsg.msgId)
-	binary.Write(buffer, binary.BigEndian, emsg.deviceId)
-	mbuffer := new(bytes.Buffer)
-	WriteMessage(mbuffer, emsg.msg)
-	msgBuf := mbuffer.Bytes()
-	var l = int16(len(msgBuf))
-	binary.Write(buffer, binary.BigEndian, l)
-	buffer.Write(msgBuf)
-	buf := buffer.Bytes()
+	msgBuf := proto.EncodeMessage(emsg.msg)
+	if len(msgBuf) > math.MaxUint16 {
+		return nil
+	}
+	buf := make([]byte, 18+len(msgBuf))
+	binary.BigEndian.PutUint64(buf[0:], uint64(emsg.msgId))
+	binary.BigEndian.PutUint64(buf[8:], uint64(emsg.deviceId))
+	binary.BigEndian.PutUint16(buf[16:], uint16(len(msgBuf)))
+	copy(buf[18:], msgBuf)
 	return buf
 }
 
 func (emsg *EMessage) FromData(buff []byte) bool {
-	if len(buff) < 18 {
+	if len(buff) < 18+proto.MSG_HEADER_SIZE {
 		return false
 	}
 
-	buffer := bytes.NewBuffer(buff)
-	binary.Read(buffer, binary.BigEndian, &emsg.msgId)
-	binary.Read(buffer, binary.BigEndian, &emsg.deviceId)
-	var l int16
-	binary.Read(buffer, binary.BigEndian, &l)
-	if int(l) > buffer.Len() {
+	l := int(binary.BigEndian.Uint16(buff[16:]))
+	if 18+l > len(buff) {
 		return false
 	}
-
-	msgBuf := make([]byte, l)
-	buffer.Read(msgBuf)
-	mbuffer := bytes.NewBuffer(msgBuf)
 	//recusive
-	msg := ReceiveMessage(mbuffer)
-	if msg == nil {
+	msg, err := proto.DecodeMessage(buff[18:18+l], 64*1024)
+	if err != nil {
 		return false
 	}
-	emsg.msg = msg
 
+	emsg.msgId = int64(binary.BigEndian.Uint64(buff[0:]))
+	emsg.deviceId = int64(binary.BigEndian.Uint64(buff[8:]))
+	emsg.msg = msg
 	return true
 }
 
@@ -75,31 +67,52 @@ type OfflineMessage struct {
 	prevMsgId      int64 //个人消息队列(点对点消息，群组消息)
 	prevPeerMsgId  int64 //点对点消息队列
 	prevBatchMsgId int64 //0<-1000<-2000<-3000...构成一个消息队列
+
+	//从其它ims迁移过来的消息在原来的ims中同步使用的id, 客户端的syncKey不需要改变
+	originId int64
 }
 
+// 同步时客户端使用的消息id
+func (off *OfflineMessage) syncId() int64 {
+	if off.originId != 0 {
+		return off.originId
+	}
+	return off.msgId
+}
+
+// 迁移过来的消息在最后加上originId(8)
 func (off *OfflineMessage) ToData() []byte {
-	buffer := new(bytes.Buffer)
-	binary.Write(buffer, binary.BigEndian, off.receiver)
-	binary.Write(buffer, binary.BigEndian, off.msgId)
-	binary.Write(buffer, binary.BigEndian, off.deviceID)
-	binary.Write(buffer, binary.BigEndian, off.seqId)
-	binary.Write(buffer, binary.BigEndian, off.prevMsgId)
-	binary.Write(buffer, binary.BigEndian, off.prevPeerMsgId)
-	binary.Write(buffer, binary.BigEndian, off.prevBatchMsgId)
-	return buffer.Bytes()
+	size := 56
+	if off.originId != 0 {
+		size = 64
+	}
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint64(buf[0:], uint64(off.receiver))
+	binary.BigEndian.PutUint64(buf[8:], uint64(off.msgId))
+	binary.BigEndian.PutUint64(buf[16:], uint64(off.deviceID))
+	binary.BigEndian.PutUint64(buf[24:], uint64(off.seqId))
+	binary.BigEndian.PutUint64(buf[32:], uint64(off.prevMsgId))
+	binary.BigEndian.PutUint64(buf[40:], uint64(off.prevPeerMsgId))
+	binary.BigEndian.PutUint64(buf[48:], uint64(off.prevBatchMsgId))
+	if off.originId != 0 {
+		binary.BigEndian.PutUint64(buf[56:], uint64(off.originId))
+	}
+	return buf
 }
 
 func (off *OfflineMessage) FromData(buff []byte) bool {
 	if len(buff) < 56 {
 		return false
 	}
-	buffer := bytes.NewBuffer(buff)
-	binary.Read(buffer, binary.BigEndian, &off.receiver)
-	binary.Read(buffer, binary.BigEndian, &off.msgId)
-	binary.Read(buffer, binary.BigEndian, &off.deviceID)
-	binary.Read(buffer, binary.BigEndian, &off.seqId)
-	binary.Read(buffer, binary.BigEndian, &off.prevMsgId)
-	binary.Read(buffer, binary.BigEndian, &off.prevPeerMsgId)
-	binary.Read(buffer, binary.BigEndian, &off.prevBatchMsgId)
+	off.receiver = int64(binary.BigEndian.Uint64(buff[0:]))
+	off.msgId = int64(binary.BigEndian.Uint64(buff[8:]))
+	off.deviceID = int64(binary.BigEndian.Uint64(buff[16:]))
+	off.seqId = int64(binary.BigEndian.Uint64(buff[24:]))
+	off.prevMsgId = int64(binary.BigEndian.Uint64(buff[32:]))
+	off.prevPeerMsgId = int64(binary.BigEndian.Uint64(buff[40:]))
+	off.prevBatchMsgId = int64(binary.BigEndian.Uint64(buff[48:]))
+	if len(buff) >= 64 {
+		off.originId = int64(binary.BigEndian.Uint64(buff[56:]))
+	}
 	return true
 }
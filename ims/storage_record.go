@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sx-chat/proto"
+)
+
+// 消息文件中一条记录的格式
+// F_VERSION_1: MAGIC | 消息头 | 消息体 | MAGIC
+// F_VERSION:   MAGIC | CRC | 消息头 | 消息体 | MAGIC, CRC是消息头和消息体的crc32c
+const RECORD_HEADER_SIZE_1 = 4 + proto.MSG_HEADER_SIZE
+const RECORD_HEADER_SIZE = 4 + 4 + proto.MSG_HEADER_SIZE
+
+//单条消息的大小限制, 和ReceiveStorageMessage一致
+const STORAGE_MESSAGE_LIMIT = 1024 * 1024
+
+//向后查找下一条记录时每次读取的字节数
+const SCAN_CHUNK_SIZE = 64 * 1024
+
+var errCorruptRecord = errors.New("corrupt record")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type BlockFile struct {
+	*os.File
+	version int
+	size    int64
+
+	//正在读取的数量和是否已经从lru中移除, 由StorageFile.filesMutex保护
+	refs    int
+	evicted bool
+}
+
+func encodeRecord(msg *proto.Message) []byte {
+	frame := proto.EncodeMessage(msg)
+	buf := make([]byte, 8+len(frame)+4)
+	binary.BigEndian.PutUint32(buf[0:], MAGIC)
+	binary.BigEndian.PutUint32(buf[4:], crc32.Checksum(frame, crcTable))
+	copy(buf[8:], frame)
+	binary.BigEndian.PutUint32(buf[8+len(frame):], MAGIC)
+	return buf
+}
+
+// 读取offset处的一条记录, 返回消息和记录的长度
+// 正好在文件末尾时返回io.EOF, 记录不完整返回io.ErrUnexpectedEOF, 过期清零的记录返回errPurgedRecord
+// 其它错误返回errCorruptRecord
+func readRecord(r io.ReaderAt, offset int64, version int) (*proto.Message, int64, error) {
+	headerSize := RECORD_HEADER_SIZE
+	if version == F_VERSION_1 {
+		headerSize = RECORD_HEADER_SIZE_1
+	}
+
+	header := make([]byte, headerSize)
+	n, err := r.ReadAt(header, offset)
+	if n == 0 && err == io.EOF {
+		return nil, 0, io.EOF
+	}
+	if n < headerSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if binary.BigEndian.Uint32(header) == 0 {
+		return nil, 0, errPurgedRecord
+	}
+	if binary.BigEndian.Uint32(header) != MAGIC {
+		return nil, 0, errCorruptRecord
+	}
+
+	frameHeader := header[headerSize-proto.MSG_HEADER_SIZE:]
+	length, _, _, _, _ := proto.ReadHeader(frameHeader)
+	if length < 0 || length > STORAGE_MESSAGE_LIMIT {
+		return nil, 0, errCorruptRecord
+	}
+
+	frame := make([]byte, proto.MSG_HEADER_SIZE+length+4)
+	copy(frame, frameHeader)
+	n, err = r.ReadAt(frame[proto.MSG_HEADER_SIZE:], offset+int64(headerSize))
+	if n < length+4 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if binary.BigEndian.Uint32(frame[proto.MSG_HEADER_SIZE+length:]) != MAGIC {
+		return nil, 0, errCorruptRecord
+	}
+	frame = frame[:proto.MSG_HEADER_SIZE+length]
+
+	if version != F_VERSION_1 {
+		if binary.BigEndian.Uint32(header[4:]) != crc32.Checksum(frame, crcTable) {
+			return nil, 0, errCorruptRecord
+		}
+	}
+
+	msg, err := proto.DecodeMessage(frame, STORAGE_MESSAGE_LIMIT)
+	if err != nil {
+		return nil, 0, errCorruptRecord
+	}
+	return msg, int64(headerSize + length + 4), nil
+}
+
+// 从offset开始向后查找下一条完整的记录, 没有找到时返回end
+func nextRecord(r io.ReaderAt, offset, end int64, version int) int64 {
+	var magic [4]byte
+	binary.BigEndian.PutUint32(magic[:], MAGIC)
+
+	buf := make([]byte, SCAN_CHUNK_SIZE)
+	for offset < end {
+		n, _ := r.ReadAt(buf, offset)
+		if n < len(magic) {
+			return end
+		}
+		i := bytes.Index(buf[:n], magic[:])
+		if i == -1 {
+			//magic可能跨越两次读取
+			offset += int64(n - len(magic) + 1)
+			continue
+		}
+		if _, _, err := readRecord(r, offset+int64(i), version); err == nil {
+			return offset + int64(i)
+		}
+		offset += int64(i + 1)
+	}
+	return end
+}
+
+// 顺序读取block中offset之后的所有记录, 损坏的部分跳到下一条完整的记录继续读取
+// f的参数是消息和消息在block中的偏移, corrupt的参数是损坏部分的起止偏移
+// 已经被ims verify清零的部分直接跳过
+func scanBlock(file *BlockFile, offset int64, f func(*proto.Message, int64), corrupt func(int64, int64)) {
+	for offset < file.size {
+		msg, n, err := readRecord(file, offset, file.version)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			next := nextRecord(file, offset+1, file.size, file.version)
+			if corrupt != nil && !isZero(file, offset, next) {
+				corrupt(offset, next)
+			}
+			offset = next
+			continue
+		}
+		f(msg, offset)
+		offset += n
+	}
+}
+
+func isZero(r io.ReaderAt, begin, end int64) bool {
+	buf := make([]byte, SCAN_CHUNK_SIZE)
+	for begin < end {
+		if end-begin < int64(len(buf)) {
+			buf = buf[:end-begin]
+		}
+		n, _ := r.ReadAt(buf, begin)
+		if n == 0 {
+			return false
+		}
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false
+			}
+		}
+		begin += int64(n)
+	}
+	return true
+}
@@ -7,6 +7,7 @@ type PeerMessage struct {
 	UID      int64
 	DeviceID int64
 	Cmd      int32
+	Version  int32 //Raw的协议版本
 	Raw      []byte
 }
 
@@ -14,6 +15,7 @@ type SyncHistory struct {
 	UID       int64
 	DeviceID  int64
 	LastMsgID int64
+	Version   int32 //客户端的协议版本, 返回的消息按照这个版本编码
 }
 
 type PeerHistoryMessage struct {
@@ -26,6 +28,7 @@ type HistoryMessage struct {
 	MsgID    int64
 	DeviceID int64
 	Cmd      int32
+	Version  int32 //Raw的协议版本
 	Raw      []byte
 }
 
@@ -33,6 +36,7 @@ type PeerGroupMessage struct {
 	Members  []int64
 	DeviceID int64
 	Cmd      int32
+	Version  int32 //Raw的协议版本
 	Raw      []byte
 }
 
@@ -40,6 +44,7 @@ type GroupMessage struct {
 	GroupId  int64
 	DeviceID int64
 	Cmd      int32
+	Version  int32 //Raw的协议版本
 	Raw      []byte
 }
 
@@ -49,10 +54,75 @@ type SyncGroupHistory struct {
 	GroupId   int64
 	LastMsgId int64
 	Timestamp int32
+	Version   int32 //客户端的协议版本, 返回的消息按照这个版本编码
 }
 
 type GroupHistoryMessage PeerHistoryMessage
 
+// 搜索历史消息, Super为true时在群组的消息队列中搜索GroupId的消息
+// 否则在UID的收件箱中搜索, GroupId或者PeerUID不为0时只返回这个会话的消息
+// 群组消息只返回Timestamp(入群时间)之后的消息
+type SearchRequest struct {
+	UID         int64
+	PeerUID     int64
+	GroupId     int64
+	Super       bool
+	Timestamp   int32
+	BeforeMsgId int64
+	Limit       int32
+	Version     int32 //客户端的协议版本, 返回的消息按照这个版本编码
+	Query       string
+}
+
+type SearchResult struct {
+	Messages  []*HistoryMessage
+	HasMore   bool
+	NextMsgId int64
+}
+
+// 分片迁移时导出Id(用户或者超级群)在AfterMsgId之后的消息, 按照从旧到新排列
+// 导出的消息按照STORAGE_VERSION编码, MsgID是同步使用的id
+type ExportRequest struct {
+	Id         int64
+	Group      bool
+	AfterMsgId int64
+}
+
+type ExportResult struct {
+	Messages []*HistoryMessage
+	HasMore  bool
+}
+
+// 导入迁移的消息, 返回最后一条消息同步使用的id
+type ImportRequest struct {
+	Id       int64
+	Group    bool
+	Messages []*HistoryMessage
+}
+
+// 冻结或者解冻写入, Buckets大于0时冻结Id % Buckets == Bucket的所有用户或者群组
+type FreezeRequest struct {
+	Id      int64
+	Group   bool
+	Buckets int64
+	Bucket  int64
+	Frozen  bool
+}
+
+// 列出Id % Buckets == Bucket并且有消息的用户或者群组
+type ListIdsRequest struct {
+	Group   bool
+	Buckets int64
+	Bucket  int64
+}
+
+// 设置用户收件箱中一条阅后即焚的消息的过期时间, MsgId是同步使用的id
+type ExpireRequest struct {
+	UID      int64
+	MsgId    int64
+	ExpireAt int32
+}
+
 func SavePeerMessageInterface(addr string, m *PeerMessage) ([2]int64, error) {
 	return [2]int64{}, nil
 }
@@ -72,4 +142,12 @@ func SaveGroupMessageInterface(addr string, m *GroupMessage) ([2]int64, error) {
 
 func SyncGroupMessageInterface(addr string, syncKey *SyncGroupHistory) *GroupHistoryMessage {
 	return nil
-}
\ No newline at end of file
+}
+
+func SearchMessagesInterface(addr string, req *SearchRequest) *SearchResult {
+	return nil
+}
+
+func ExpireMessageInterface(addr string, req *ExpireRequest) (int32, error) {
+	return 0, nil
+}
@@ -3,22 +3,44 @@ package main
 import (
 	"github.com/valyala/gorpc"
 	"gopkg.in/natefinch/lumberjack.v2"
+	"os"
+	"path/filepath"
 	"time"
 )
 import log "github.com/sirupsen/logrus"
 
 var storage *Storage
 var config *StorageConfig
+var rpcServer *gorpc.Server
 
 func main() {
 	config = readStorageConf()
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(VerifyMain(os.Args[2:]))
+	}
 	initLog()
 
-	storage = NewStorage(config.storageRoot)
+	storage = NewStorage(config.storageRoot, config.syncMode)
+	if err := freezer.Load(filepath.Join(config.storageRoot, FREEZE_FILE)); err != nil {
+		log.Fatal("load freeze file:", err)
+	}
 
 	go FlushIndexLoop()
+	if config.archiveRoot != "" {
+		storage.archive = NewBlockArchive(NewLocalArchiveStore(config.archiveRoot),
+			filepath.Join(config.storageRoot, ARCHIVE_CACHE_DIR), config.archiveCacheBlocks)
+		go ArchiveLoop(time.Duration(config.archiveAfter) * 24 * time.Hour)
+	}
+	go PurgeLoop()
+	if config.syncMode == SYNC_INTERVAL {
+		go SyncLoop(time.Duration(config.syncInterval) * time.Millisecond)
+	}
 
 	ListenRPCClient()
+
+	WaitSignal()
+	Shutdown()
+	log.Info("exit")
 }
 
 // 将MessageIndex持久化到磁盘
@@ -29,6 +51,22 @@ func FlushIndexLoop()  {
 	}
 }
 
+// 定时归档不再写入的旧消息文件
+func ArchiveLoop(after time.Duration) {
+	ticker := time.NewTicker(ARCHIVE_CHECK_INTERVAL)
+	for range ticker.C {
+		storage.archiveBlocks(time.Now().Add(-after))
+	}
+}
+
+// 定时清除过期的消息
+func PurgeLoop() {
+	ticker := time.NewTicker(EXPIRE_PURGE_INTERVAL)
+	for range ticker.C {
+		storage.purgeExpired(int32(time.Now().Unix()))
+	}
+}
+
 func ListenRPCClient() {
 	dispatcher := gorpc.NewDispatcher()
 	dispatcher.AddFunc("SyncMessage", SyncMessage)
@@ -36,14 +74,19 @@ func ListenRPCClient() {
 	dispatcher.AddFunc("SavePeerGroupMessage", SavePeerGroupMessage)
 	dispatcher.AddFunc("SaveGroupMessage", SaveGroupMessage)
 	dispatcher.AddFunc("SyncGroupMessage", SyncGroupMessage)
+	dispatcher.AddFunc("SearchMessages", SearchMessages)
+	dispatcher.AddFunc("ExportMessages", ExportMessages)
+	dispatcher.AddFunc("ImportMessages", ImportMessages)
+	dispatcher.AddFunc("FreezeMessages", FreezeMessages)
+	dispatcher.AddFunc("ListIds", ListIds)
+	dispatcher.AddFunc("ExpireMessage", ExpireMessage)
 
-	s := gorpc.Server{
+	rpcServer = &gorpc.Server{
 		Addr:    config.rpcListen,
 		Handler: dispatcher.NewHandlerFunc(),
 	}
 
-	// 阻塞在Serve()
-	if err := s.Serve(); err != nil {
+	if err := rpcServer.Start(); err != nil {
 		log.Fatalf("Cannot start rpc server: %s", err)
 	}
 }
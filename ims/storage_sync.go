@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"sync"
+	"time"
+)
+
+//消息文件同步到磁盘的方式
+const SYNC_NONE = 0     //只在切换block时同步, 断电会丢失已经ack的消息
+const SYNC_INTERVAL = 1 //每隔syncInterval毫秒同步一次, 断电最多丢失这段时间内的消息
+const SYNC_WRITE = 2    //同步到磁盘之后rpc才返回, 并发的写入合并成一次fsync
+
+// 消息文件的group commit
+// 写入的消息在文件中的全局位置用writeId表示, syncedId之前的消息已经同步到磁盘
+// 同一时间只有一个rpc在执行fsync, 其它rpc等待这次fsync完成, 如果还没有覆盖到自己的写入再发起下一次
+type StorageSyncer struct {
+	syncMode int
+
+	syncMutex sync.Mutex
+	syncCond  *sync.Cond
+	syncing   bool
+	syncedId  int64
+}
+
+func (syncer *StorageSyncer) init(mode int) {
+	syncer.syncMode = mode
+	syncer.syncCond = sync.NewCond(&syncer.syncMutex)
+}
+
+// 在rpc返回之前调用, SYNC_WRITE模式下等待之前的写入同步到磁盘
+func (storage *StorageFile) Commit() {
+	if storage.syncMode != SYNC_WRITE {
+		return
+	}
+
+	storage.mutex.Lock()
+	writeId := storage.writeId
+	storage.mutex.Unlock()
+
+	storage.waitSync(writeId)
+}
+
+func (storage *StorageFile) waitSync(writeId int64) {
+	storage.syncMutex.Lock()
+	defer storage.syncMutex.Unlock()
+
+	for storage.syncedId < writeId {
+		if storage.syncing {
+			storage.syncCond.Wait()
+			continue
+		}
+
+		storage.syncing = true
+		storage.syncMutex.Unlock()
+		syncedId := storage.sync()
+		storage.syncMutex.Lock()
+		storage.syncing = false
+		if syncedId > storage.syncedId {
+			storage.syncedId = syncedId
+		}
+		storage.syncCond.Broadcast()
+	}
+}
+
+// 同步当前block, 返回已经同步到的位置
+// fsync的时候不持有storage.mutex, 不阻塞新的写入
+func (storage *StorageFile) sync() int64 {
+	storage.mutex.Lock()
+	file := storage.file
+	writeId := storage.writeId
+	storage.dirty = false
+	storage.mutex.Unlock()
+
+	err := file.Sync()
+	if errors.Is(err, os.ErrClosed) {
+		//切换block时已经同步过了
+		return writeId
+	}
+	if err != nil {
+		log.Fatalln("同步storage 文件失败 err: ", err)
+	}
+	return writeId
+}
+
+// block切换时旧文件已经同步, 之前的写入都不需要再同步
+func (storage *StorageFile) setSynced(writeId int64) {
+	storage.syncMutex.Lock()
+	defer storage.syncMutex.Unlock()
+	if writeId > storage.syncedId {
+		storage.syncedId = writeId
+	}
+	storage.syncCond.Broadcast()
+}
+
+// SYNC_INTERVAL模式下定时同步消息文件
+func SyncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		storage.mutex.Lock()
+		dirty := storage.dirty
+		storage.mutex.Unlock()
+		if dirty {
+			storage.sync()
+		}
+	}
+}
@@ -1,6 +1,278 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"encoding/binary"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sx-chat/proto"
+	"sync/atomic"
+	"testing"
+	"time"
+)
 
 func Test_LoadLatest(t *testing.T)  {
-}
\ No newline at end of file
+}
+
+// 损坏的记录之后的消息仍然可以读取, 隔离之后不再报告损坏
+func TestScanBlockResync(t *testing.T) {
+	root, err := ioutil.TempDir("", "ims")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	file := NewStorageFile(root, SYNC_NONE)
+	var ids []int64
+	for i := 0; i < 3; i++ {
+		im := &proto.IMMessage{Sender: 1, Receiver: 2, Timestamp: int32(i), Content: "hello"}
+		ids = append(ids, file.saveMessage(&proto.Message{Cmd: proto.MSG_IM, Version: STORAGE_VERSION, Body: im}))
+	}
+	file.file.Close()
+
+	//修改第二条消息的内容
+	f, err := os.OpenFile(blockPath(root, 0), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("x"), ids[2]-6)
+	f.Close()
+
+	scan := func() ([]int64, int) {
+		var offsets []int64
+		corrupts := 0
+		block := openBlockFile(blockPath(root, 0))
+		defer block.Close()
+		scanBlock(block, HEADER_SIZE, func(_ *proto.Message, offset int64) {
+			offsets = append(offsets, offset)
+		}, func(begin, end int64) {
+			if begin != ids[1] || end != ids[2] {
+				t.Errorf("corrupt range:[%d, %d) expect:[%d, %d)", begin, end, ids[1], ids[2])
+			}
+			corrupts++
+		})
+		return offsets, corrupts
+	}
+
+	offsets, corrupts := scan()
+	if corrupts != 1 || len(offsets) != 2 || offsets[0] != ids[0] || offsets[1] != ids[2] {
+		t.Fatalf("offsets:%v corrupts:%d", offsets, corrupts)
+	}
+
+	ranges, err := Verify(root)
+	if err != nil || len(ranges) != 1 {
+		t.Fatalf("verify ranges:%d err:%v", len(ranges), err)
+	}
+	if err := quarantineRange(root, ranges[0]); err != nil {
+		t.Fatal(err)
+	}
+	offsets, corrupts = scan()
+	if corrupts != 0 || len(offsets) != 2 {
+		t.Fatalf("after quarantine offsets:%v corrupts:%d", offsets, corrupts)
+	}
+}
+
+// F_VERSION_1的文件没有crc, 仍然可以读取
+func TestReadRecordVersion1(t *testing.T) {
+	msg := &proto.Message{Cmd: proto.MSG_IM, Version: STORAGE_VERSION, Body: &proto.IMMessage{Sender: 1, Receiver: 2, Content: "hi"}}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, int32(MAGIC))
+	proto.WriteMessage(buf, msg)
+	binary.Write(buf, binary.BigEndian, int32(MAGIC))
+
+	m, n, err := readRecord(bytes.NewReader(buf.Bytes()), 0, F_VERSION_1)
+	if err != nil || n != int64(buf.Len()) || m.Body.(*proto.IMMessage).Content != "hi" {
+		t.Fatalf("read version 1 record:%v %d %v", m, n, err)
+	}
+	if _, _, err := readRecord(bytes.NewReader(buf.Bytes()), 0, F_VERSION); err == nil {
+		t.Fatal("version 1 record read as version 2")
+	}
+}
+
+// 重启之后从索引文件, 增量文件和最后一次保存之后的消息恢复出同样的索引
+func TestIndexDeltaRestart(t *testing.T) {
+	root, err := ioutil.TempDir("", "ims")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	s1 := NewStorage(root, SYNC_NONE)
+	save := func(n int) {
+		for i := 0; i < n; i++ {
+			im := &proto.IMMessage{Sender: 1, Receiver: int64(i%3 + 1), Content: "hello"}
+			s1.SavePeerMessage(im.Receiver, 1, &proto.Message{Cmd: proto.MSG_IM, Version: STORAGE_VERSION, Body: im})
+			s1.SaveGroupMessage(10, 1, &proto.Message{Cmd: proto.MSG_GROUP_IM, Version: STORAGE_VERSION, Body: im})
+		}
+	}
+	for i := 0; i < INDEX_MERGE_DELTAS+2; i++ {
+		save(4)
+		s1.FlushIndex()
+	}
+	if n := len(s1.listDeltas()); n >= INDEX_MERGE_DELTAS {
+		t.Fatalf("deltas not merged:%d", n)
+	}
+	save(5)
+	s1.file.Close()
+
+	s2 := NewStorage(root, SYNC_NONE)
+	if !reflect.DeepEqual(allPeerIndex(s1), allPeerIndex(s2)) {
+		t.Errorf("peer index:%v expect:%v", allPeerIndex(s2), allPeerIndex(s1))
+	}
+	if !reflect.DeepEqual(allGroupIndex(s1), allGroupIndex(s2)) {
+		t.Errorf("group index:%v expect:%v", allGroupIndex(s2), allGroupIndex(s1))
+	}
+	if s1.lastId != s2.lastId {
+		t.Errorf("last id:%d expect:%d", s2.lastId, s1.lastId)
+	}
+}
+
+// 消息内容只保存一次, 返回值和逐个保存时的格式一致
+func TestSavePeerGroupMessage(t *testing.T) {
+	root, err := ioutil.TempDir("", "ims")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	s := NewStorage(root, SYNC_NONE)
+	im := &proto.IMMessage{Sender: 1, Receiver: 100, Content: "hello"}
+	prev, _ := s.SavePeerMessage(2, 1, &proto.Message{Cmd: proto.MSG_IM, Version: STORAGE_VERSION, Body: im})
+
+	members := []int64{1, 2, 3, 2}
+	r := s.SavePeerGroupMessage(members, 1, &proto.Message{Cmd: proto.MSG_GROUP_IM, Version: STORAGE_VERSION, Body: im})
+	if len(r) != len(members)*2 {
+		t.Fatalf("response:%v", r)
+	}
+	msgId := r[0]
+	expect := []int64{msgId, 0, msgId, prev, msgId, 0, msgId, prev}
+	if !reflect.DeepEqual(r, expect) {
+		t.Fatalf("response:%v expect:%v", r, expect)
+	}
+
+	for _, uid := range []int64{1, 2, 3} {
+		messages, lastMsgId, _ := s.LoadHistoryMessages(uid, 0, 10, 100)
+		if lastMsgId != msgId || messages[0].msgId != msgId || messages[0].msg.Cmd != proto.MSG_GROUP_IM {
+			t.Errorf("uid:%d history:%v last msgid:%d", uid, messages, lastMsgId)
+		}
+	}
+
+	// 2条消息内容和4条离线消息
+	count := 0
+	block := openBlockFile(blockPath(root, 0))
+	defer block.Close()
+	scanBlock(block, HEADER_SIZE, func(_ *proto.Message, _ int64) {
+		count++
+	}, nil)
+	if count != 6 {
+		t.Errorf("record count:%d", count)
+	}
+}
+
+func allPeerIndex(storage *Storage) map[UserId]*UserIndex {
+	messageIndex := make(map[UserId]*UserIndex)
+	for _, shard := range storage.PeerStorage.shards {
+		for id, ui := range shard.messageIndex {
+			messageIndex[id] = ui
+		}
+	}
+	return messageIndex
+}
+
+func allGroupIndex(storage *Storage) map[GroupId]*GroupIndex {
+	messageIndex := make(map[GroupId]*GroupIndex)
+	for _, shard := range storage.GroupStorage.shards {
+		for id, index := range shard.messageIndex {
+			messageIndex[id] = index
+		}
+	}
+	return messageIndex
+}
+
+func benchmarkSavePeerMessage(b *testing.B, syncMode int) {
+	level := log.GetLevel()
+	log.SetLevel(log.WarnLevel)
+	defer log.SetLevel(level)
+
+	root, err := ioutil.TempDir("", "ims")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	storage = NewStorage(root, syncMode)
+	if syncMode == SYNC_INTERVAL {
+		go SyncLoop(100 * time.Millisecond)
+	}
+
+	im := &proto.IMMessage{Sender: 1, Receiver: 2, Content: "hello world"}
+	var uid int64
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		receiver := atomic.AddInt64(&uid, 1)
+		for pb.Next() {
+			msg := &proto.Message{Cmd: proto.MSG_IM, Version: STORAGE_VERSION, Body: im}
+			storage.SavePeerMessage(receiver, 1, msg)
+			storage.Commit()
+		}
+	})
+}
+
+func BenchmarkSavePeerMessageSyncNone(b *testing.B) {
+	benchmarkSavePeerMessage(b, SYNC_NONE)
+}
+
+func BenchmarkSavePeerMessageSyncInterval(b *testing.B) {
+	benchmarkSavePeerMessage(b, SYNC_INTERVAL)
+}
+
+func BenchmarkSavePeerMessageSyncWrite(b *testing.B) {
+	benchmarkSavePeerMessage(b, SYNC_WRITE)
+}
+
+// 读取不持有写入的锁, 并发读取可以利用多个cpu
+func BenchmarkLoadMessage(b *testing.B) {
+	level := log.GetLevel()
+	log.SetLevel(log.WarnLevel)
+	defer log.SetLevel(level)
+
+	root, err := ioutil.TempDir("", "ims")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	storage := NewStorageFile(root, SYNC_NONE)
+	ids := make([]int64, 1000)
+	for i := range ids {
+		im := &proto.IMMessage{Sender: 1, Receiver: 2, Content: "hello world"}
+		ids[i] = storage.saveMessage(&proto.Message{Cmd: proto.MSG_IM, Version: STORAGE_VERSION, Body: im})
+	}
+
+	var n int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddInt64(&n, 1)
+			if storage.LoadMessage(ids[i%int64(len(ids))]) == nil {
+				b.Error("load message failed")
+			}
+		}
+	})
+}
+
+// 开始退出之后拒绝写入, 不会保存im收不到结果的消息
+func TestRejectWriteWhenStopping(t *testing.T) {
+	atomic.StoreInt32(&rpcStopping, 1)
+	defer atomic.StoreInt32(&rpcStopping, 0)
+
+	if _, err := SavePeerMessage("", &PeerMessage{UID: 1}); err != errStopping {
+		t.Errorf("save err:%v", err)
+	}
+	if _, err := ExpireMessage("", &ExpireRequest{UID: 1}); err != errStopping {
+		t.Errorf("expire err:%v", err)
+	}
+}
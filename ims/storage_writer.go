@@ -0,0 +1,152 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sx-chat/proto"
+)
+
+//等待写入的消息数量
+const APPEND_QUEUE_SIZE = 1024
+
+//一次write合并的最大字节数
+const APPEND_BATCH_SIZE = 1024 * 1024
+
+//一个请求中的消息连续写入
+type appendRequest struct {
+	bufs   [][]byte
+	size   int
+	msgIds []int64
+	done   chan struct{}
+}
+
+// 写入消息并返回消息id
+// 所有的写入都由appendLoop完成, 同时到达的消息合并成一次write
+func (storage *StorageFile) saveMessage(msg *proto.Message) int64 {
+	msgId := storage.saveMessages([]*proto.Message{msg})[0]
+	log.Info("save message:", proto.Command(msg.Cmd), " ", msgId)
+	return msgId
+}
+
+// 在一个请求中写入多条消息, 按顺序返回消息id
+func (storage *StorageFile) saveMessages(msgs []*proto.Message) []int64 {
+	req := &appendRequest{
+		bufs:   make([][]byte, len(msgs)),
+		msgIds: make([]int64, len(msgs)),
+		done:   make(chan struct{}),
+	}
+	for i, msg := range msgs {
+		req.bufs[i] = encodeRecord(msg)
+		req.size += len(req.bufs[i])
+	}
+	storage.appendCh <- req
+	<-req.done
+	return req.msgIds
+}
+
+func (storage *StorageFile) appendLoop() {
+	batch := make([]*appendRequest, 0, 64)
+	for req := range storage.appendCh {
+		batch = append(batch[:0], req)
+		size := req.size
+
+	drain:
+		for size < APPEND_BATCH_SIZE {
+			select {
+			case req, ok := <-storage.appendCh:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, req)
+				size += req.size
+			default:
+				break drain
+			}
+		}
+
+		storage.writeBatch(batch)
+		for i, req := range batch {
+			close(req.done)
+			batch[i] = nil
+		}
+	}
+}
+
+// 停止appendLoop, 之后不能再保存消息
+func (storage *StorageFile) closeAppend() {
+	close(storage.appendCh)
+}
+
+func (storage *StorageFile) writeBatch(batch []*appendRequest) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	buf := storage.writeBuf[:0]
+	for _, req := range batch {
+		for i, b := range req.bufs {
+			size := int64(len(b))
+			if storage.fileSize+int64(len(buf))+size > BLOCK_SIZE { // 当前这个文件满了，需要开启下一个文件
+				storage.write(buf)
+				buf = buf[:0]
+				storage.nextBlock()
+			}
+			if storage.fileSize+size > BLOCK_SIZE { // 如果这个时候还满足条件，那就是消息太大了
+				log.Fatalln("message size:", size)
+			}
+
+			// msgId是消息在所有文件中的全局偏移
+			req.msgIds[i] = int64(storage.blockNo)*BLOCK_SIZE + storage.fileSize + int64(len(buf))
+			buf = append(buf, b...)
+		}
+	}
+	storage.write(buf)
+
+	// 偶尔的大消息之后不长期占用内存
+	if cap(buf) > 4*APPEND_BATCH_SIZE {
+		buf = nil
+	}
+	storage.writeBuf = buf
+}
+
+func (storage *StorageFile) write(buf []byte) {
+	if len(buf) == 0 {
+		return
+	}
+	n, err := storage.file.Write(buf)
+	if err != nil {
+		log.Fatal("文件写入失败 err:", err)
+	}
+	if n != len(buf) {
+		log.Fatal("文件写入大小不一致 write size:", len(buf), " nwrite:", n)
+	}
+	storage.fileSize += int64(n)
+	storage.writeId = int64(storage.blockNo)*BLOCK_SIZE + storage.fileSize
+	storage.dirty = true
+}
+
+func (storage *StorageFile) nextBlock() {
+	storage.switchBlock(storage.blockNo + 1)
+}
+
+func (storage *StorageFile) switchBlock(blockNo int) {
+	err := storage.file.Sync() // 同步到磁盘
+	if err != nil {
+		log.Fatalln("同步storage 文件失败 err: ", err)
+	}
+	storage.file.Close()
+	storage.setSynced(storage.writeId)
+	storage.openWriteFile(blockNo)
+}
+
+// 保证之后写入的消息id都大于msgId, 跳过的block不创建文件
+// 迁移过来的消息使用原来的id同步, 之后的新消息需要使用更大的id
+func (storage *StorageFile) skipTo(msgId int64) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if int64(storage.blockNo)*BLOCK_SIZE+storage.fileSize > msgId {
+		return
+	}
+	blockNo := storage.getBlockNo(msgId) + 1
+	log.WithFields(log.Fields{"msgId": msgId, "block": blockNo}).Info("跳过消息id")
+	storage.switchBlock(blockNo)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sx-chat/proto"
+)
+
+//损坏的记录移动到这个目录
+const QUARANTINE_DIR = "quarantine"
+
+type corruptRange struct {
+	blockNo    int
+	begin, end int64
+}
+
+// ims verify [-root dir] [-quarantine]
+// 离线检查消息文件, 输出所有损坏的范围, 返回进程的退出码
+// -quarantine把损坏的内容复制到quarantine目录之后在原文件中清零, 不改变其它消息的msgid
+func VerifyMain(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	root := fs.String("root", config.storageRoot, "storage root")
+	quarantine := fs.Bool("quarantine", false, "quarantine corrupt ranges")
+	fs.Parse(args)
+
+	ranges, err := Verify(*root)
+	if err != nil {
+		fmt.Println("verify error:", err)
+		return 2
+	}
+	for _, r := range ranges {
+		fmt.Printf("message_%d corrupt range:[%d, %d) size:%d\n", r.blockNo, r.begin, r.end, r.end-r.begin)
+	}
+	if len(ranges) == 0 {
+		fmt.Println("ok")
+		return 0
+	}
+
+	if *quarantine {
+		for _, r := range ranges {
+			if err := quarantineRange(*root, r); err != nil {
+				fmt.Println("quarantine error:", err)
+				return 2
+			}
+		}
+		fmt.Printf("quarantined %d ranges\n", len(ranges))
+	}
+	return 1
+}
+
+func Verify(root string) ([]*corruptRange, error) {
+	blocks, err := listBlocks(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var ranges []*corruptRange
+	for _, blockNo := range blocks {
+		file := openBlockFile(blockPath(root, blockNo))
+		if file == nil {
+			continue
+		}
+		count := 0
+		scanBlock(file, HEADER_SIZE, func(_ *proto.Message, _ int64) {
+			count++
+		}, func(begin, end int64) {
+			ranges = append(ranges, &corruptRange{blockNo: blockNo, begin: begin, end: end})
+		})
+		file.Close()
+		fmt.Printf("message_%d version:%x size:%d messages:%d\n", blockNo, file.version, file.size, count)
+	}
+	return ranges, nil
+}
+
+func quarantineRange(root string, r *corruptRange) error {
+	dir := filepath.Join(root, QUARANTINE_DIR)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(blockPath(root, r.blockNo), os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buf := make([]byte, r.end-r.begin)
+	if _, err := file.ReadAt(buf, r.begin); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("message_%d.%d-%d", r.blockNo, r.begin, r.end)
+	if err := ioutil.WriteFile(filepath.Join(dir, name), buf, 0644); err != nil {
+		return err
+	}
+
+	//清零之后重新扫描时这段数据不会被当作记录
+	if _, err := file.WriteAt(make([]byte, len(buf)), r.begin); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func blockPath(root string, blockNo int) string {
+	return fmt.Sprintf("%s/message_%d", root, blockNo)
+}
+
+func listBlocks(root string) ([]int, error) {
+	files, err := filepath.Glob(fmt.Sprintf("%s/message_*", root))
+	if err != nil {
+		return nil, err
+	}
+	var blocks []int
+	for _, f := range files {
+		b, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(f), "message_"))
+		if err != nil {
+			continue
+		}
+		blocks = append(blocks, b)
+	}
+	sort.Ints(blocks)
+	return blocks, nil
+}
@@ -74,3 +74,12 @@ func (c *Cache) Get(key Key) (value interface{}, ok bool) {
 	}
 	return
 }
+
+func (c *Cache) Remove(key Key) {
+	if c.cache == nil {
+		return
+	}
+	if ele, hit := c.cache[key]; hit {
+		c.removeElement(ele)
+	}
+}
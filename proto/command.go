@@ -0,0 +1,161 @@
+package proto
+
+//所有的消息命令号都定义在这里, im, imr, ims和benchmark共用
+//新增命令号时不能和已有的冲突
+
+//群组消息 c -> s
+const MESSAGE_FLAG_GROUP = 0x04
+
+//离线消息由当前登录的用户在当前设备发出 c <- s
+const MESSAGE_FLAG_SELF = 0x08
+
+//消息由服务器主动推到客户端 c <- s
+const MESSAGE_FLAG_PUSH = 0x10
+
+//超级群消息 c <- s
+const MESSAGE_FLAG_SUPER_GROUP = 0x20
+
+const MSG_AUTH_STATUS = 3
+
+//服务端->客户端, 群组的系统通知, 比如成员加入, 作为群消息保存到消息队列
+const MSG_GROUP_NOTIFICATION = 7
+
+const MSG_IM = 4
+const MSG_ACK = 5
+
+const MSG_GROUP_IM = 8
+
+const MSG_PING = 13
+const MSG_PONG = 14
+
+const MSG_AUTH_TOKEN = 15
+
+//客户端->服务端
+const MSG_SYNC = 26 //同步消息
+//服务端->客服端
+const MSG_SYNC_BEGIN = 27
+const MSG_SYNC_END = 28
+
+//通知客户端有新消息
+const MSG_SYNC_NOTIFY = 29
+
+//客户端->服务端
+const MSG_SYNC_GROUP = 30 //同步超级群消息
+//服务端->客服端
+const MSG_SYNC_GROUP_BEGIN = 31
+const MSG_SYNC_GROUP_END = 32
+
+//通知客户端有新消息
+const MSG_SYNC_GROUP_NOTIFY = 33
+
+//客服端->服务端,更新服务器的synckey
+const MSG_SYNC_KEY = 34
+const MSG_GROUP_SYNC_KEY = 35
+
+//消息的meta信息
+const MSG_METADATA = 37
+
+//服务端->客户端, 当前连接被踢下线, 之后服务端会关闭连接
+const MSG_KICKED = 40
+
+//客户端->服务端, 查询当前用户所有的登录设备
+const MSG_LOAD_DEVICES = 41
+
+//服务端->客户端, 当前用户所有的登录设备
+const MSG_DEVICES = 42
+
+//客户端->服务端, 踢掉当前用户的某个登录设备
+const MSG_KICK_DEVICE = 43
+
+//服务端->客户端, 服务器即将关闭, 客户端等待一段时间之后重新连接, 之后服务端会关闭连接
+const MSG_SERVER_CLOSE = 44
+
+//客户端->服务端, 创建群组和修改群成员等群组管理命令
+const MSG_GROUP_COMMAND = 45
+
+//服务端->客户端, 群组管理命令的执行结果
+const MSG_GROUP_RESULT = 46
+
+//服务端->客户端, 用户在群组消息中被@, 保存到被@的成员的消息队列
+const MSG_GROUP_MENTION = 47
+
+//客户端->服务端, 搜索历史消息
+const MSG_SEARCH = 48
+
+//服务端->客户端, 搜索到的一条消息, 之后是MSG_SEARCH_END
+const MSG_SEARCH_HIT = 49
+const MSG_SEARCH_END = 50
+
+//客户端->服务端, 阅读了自己收件箱中的一条阅后即焚的消息, 第一次阅读之后开始计算过期时间
+const MSG_MESSAGE_READ = 51
+
+//服务端->客户端, 消息在ExpireAt之后过期, 已经收到这条消息的设备到时删除
+//保存到发送者和接收者的消息队列, 只用于阅后即焚的消息, 阅读时间只有服务端知道
+//按发送时间过期的消息没有这个事件, 客户端收到消息时已经可以算出过期时间, 需要自己根据Timestamp和Ttl删除
+const MSG_MESSAGE_EXPIRE = 52
+
+//im <-> imr
+const MSG_SUBSCRIBE = 130
+const MSG_UNSUBSCRIBE = 131
+const MSG_PUBLISH = 132
+
+const MSG_PUSH = 134
+const MSG_PUBLISH_GROUP = 135
+
+//踢掉用户在其它im实例上的登录会话, 作为MSG_PUBLISH的内容经过imr转发
+const MSG_KICK_SESSION = 136
+
+//内部文件存储使用, 消息结构在各自的服务中定义
+//消息的过期时间
+const MSG_EXPIRE_RECORD = 246
+
+//超级群消息队列
+const MSG_GROUP_OFFLINE = 247
+
+//个人消息队列
+const MSG_OFFLINE = 248
+
+//im实例使用, 待发送的群组消息
+const MSG_PENDING_GROUP_MESSAGE = 251
+
+//被踢下线的原因
+const KICK_REASON_LOGIN = 1 //同类型的设备在其它地方登录
+const KICK_REASON_USER = 2  //用户在其它设备上主动踢下线
+const KICK_REASON_ADMIN = 3 //管理后台踢下线
+
+//群组管理命令
+const GROUP_OP_CREATE = 1
+const GROUP_OP_ADD_MEMBER = 2
+const GROUP_OP_REMOVE_MEMBER = 3 //成员退出群组时移除的成员是自己
+const GROUP_OP_TRANSFER = 4      //转让群主
+const GROUP_OP_MUTE = 5
+const GROUP_OP_UNMUTE = 6
+const GROUP_OP_DISSOLVE = 7
+const GROUP_OP_SET_ADMIN = 8
+const GROUP_OP_UNSET_ADMIN = 9
+const GROUP_OP_SETTINGS = 10 //修改全员禁言, 邀请确认和成员数量上限
+
+//群组管理命令的执行结果
+const GROUP_STATUS_OK = 0
+const GROUP_STATUS_INVALID = 1    //参数错误
+const GROUP_STATUS_NOT_FOUND = 2  //群组不存在
+const GROUP_STATUS_PERMISSION = 3 //没有权限
+const GROUP_STATUS_ERROR = 4      //服务器内部错误
+const GROUP_STATUS_FULL = 5       //超过群成员数量上限
+
+//MSG_ACK的状态
+const ACK_SUCCESS = 0
+const ACK_NOT_GROUP_MEMBER = 64
+const ACK_GROUP_NONEXIST = 65
+const ACK_GROUP_MUTED = 66 //被禁言或者全员禁言
+const ACK_RATE_LIMITED = 67 //请求过于频繁, 客户端需要等待一段时间再重试
+const ACK_INVALID_CONTENT = 68 //消息类型未知或者content不符合类型的格式和大小限制
+const ACK_INVALID_QUERY = 69   //搜索的关键词为空
+const ACK_SERVER_ERROR = 70
+const ACK_STORAGE_UNAVAILABLE = 71 //ims不可用或者超时, 客户端可以稍后重试
+
+//平台号
+const PLATFORM_IOS = 1
+const PLATFORM_ANDROID = 2
+const PLATFORM_WEB = 3
+const PLATFORM_DESKTOP = 4
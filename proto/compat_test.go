@@ -0,0 +1,161 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// 线上协议的固定编码, 修改消息格式时这里的数据不能改变, 只能新增版本
+var compatVectors = []struct {
+	cmd     int
+	version int
+	body    interface{}
+	data    string
+}{
+	{MSG_AUTH_STATUS, 0, &AuthenticationStatus{Status: 1}, "00000001"},
+	{MSG_AUTH_STATUS, 2, &AuthenticationStatus{Status: 0, Capabilities: CAPABILITY_DEFLATE}, "00000000" + "01"},
+	{MSG_IM, 0, &IMMessage{Sender: 1, Receiver: 2, Timestamp: 3, MessageType: 4, Content: "hi"},
+		"0000000000000001" + "0000000000000002" + "00000003" + "00000004" + "6869"},
+	{MSG_IM, 2, &IMMessage{Sender: 1, Receiver: 2, Timestamp: 3, MessageType: 4, Content: "hi"},
+		"0000000000000001" + "0000000000000002" + "00000003" + "00000004" + "6869"},
+	{MSG_GROUP_IM, 3, &IMMessage{Sender: 1, Receiver: 2, Timestamp: 3, MessageType: 4, Mentions: []int64{5}, Content: "hi"},
+		"0000000000000001" + "0000000000000002" + "00000003" + "00000004" + "00" + "0001" + "0000000000000005" + "6869"},
+	{MSG_GROUP_IM, 3, &IMMessage{Sender: 1, Receiver: 2, Timestamp: 3, MessageType: 4, AtAll: true},
+		"0000000000000001" + "0000000000000002" + "00000003" + "00000004" + "01" + "0000"},
+	{MSG_IM, 4, &IMMessage{Sender: 1, Receiver: 2, Timestamp: 3, MessageType: 4, ClientMsgId: "id", Content: "hi"},
+		"0000000000000001" + "0000000000000002" + "00000003" + "00000004" + "00" + "0000" + "02" + "6964" + "6869"},
+	{MSG_GROUP_IM, 0, &IMMessage{Sender: 1, Receiver: 2, Timestamp: 3, MessageType: 4},
+		"0000000000000001" + "0000000000000002" + "00000003" + "00000004"},
+	{MSG_GROUP_IM, 2, &IMMessage{Sender: 1, Receiver: 2, Timestamp: 3, MessageType: 4},
+		"0000000000000001" + "0000000000000002" + "00000003" + "00000004"},
+	{MSG_ACK, 0, &MessageACK{Seq: 7, Status: 1}, "00000007" + "01"},
+	{MSG_ACK, 2, &MessageACK{Seq: 7, Status: 1}, "00000007" + "01"},
+	{MSG_AUTH_TOKEN, 0, &AuthenticationToken{Token: "tk", PlatformId: PLATFORM_ANDROID, DeviceId: "d1"},
+		"02" + "02" + "746b" + "02" + "6431"},
+	{MSG_AUTH_TOKEN, 2, &AuthenticationToken{Token: "tk", PlatformId: PLATFORM_ANDROID, DeviceId: "d1", Capabilities: CAPABILITY_DEFLATE},
+		"02" + "02" + "746b" + "02" + "6431" + "01"},
+	{MSG_SYNC, 0, &SyncKey{SyncKey: 9}, "0000000000000009"},
+	{MSG_SYNC_BEGIN, 0, &SyncKey{SyncKey: 9}, "0000000000000009"},
+	{MSG_SYNC_END, 0, &SyncKey{SyncKey: 9}, "0000000000000009"},
+	{MSG_SYNC_NOTIFY, 0, &SyncKey{SyncKey: 9}, "0000000000000009"},
+	{MSG_SYNC_GROUP, 0, &GroupSyncKey{GroupId: 1, SyncKey: 9}, "0000000000000001" + "0000000000000009"},
+	{MSG_SYNC_GROUP_BEGIN, 0, &GroupSyncKey{GroupId: 1, SyncKey: 9}, "0000000000000001" + "0000000000000009"},
+	{MSG_SYNC_GROUP_END, 0, &GroupSyncKey{GroupId: 1, SyncKey: 9}, "0000000000000001" + "0000000000000009"},
+	{MSG_SYNC_GROUP_NOTIFY, 0, &GroupSyncKey{GroupId: 1, SyncKey: 9}, "0000000000000001" + "0000000000000009"},
+	{MSG_GROUP_SYNC_KEY, 0, &GroupSyncKey{GroupId: 1, SyncKey: 9}, "0000000000000001" + "0000000000000009"},
+	{MSG_METADATA, 0, &Metadata{SyncKey: 2, PrevSyncKey: 1}, "0000000000000002" + "0000000000000001"},
+	{MSG_KICKED, 0, &KickedMessage{Reason: KICK_REASON_USER}, "00000002"},
+	{MSG_DEVICES, 0, &DeviceList{Devices: []*DeviceSession{{SessionId: 1, DeviceId: "d", PlatformId: PLATFORM_IOS, LoginTime: 2}}},
+		"0001" + "0000000000000001" + "01" + "0000000000000002" + "01" + "64"},
+	{MSG_KICK_DEVICE, 0, &SessionID{SessionId: 5}, "0000000000000005"},
+	{MSG_SERVER_CLOSE, 0, &ServerClose{Delay: 1000}, "000003e8"},
+	{MSG_SUBSCRIBE, 0, &SubscribeMessage{Uid: 1, Online: 1}, "0000000000000001" + "01"},
+	{MSG_UNSUBSCRIBE, 0, &UserID{Uid: 1}, "0000000000000001"},
+	{MSG_PUBLISH, 0, &AppMessage{Receiver: 1, MsgId: 2, DeviceID: 3, Timestamp: 4, Msg: &Message{Cmd: MSG_PING}},
+		"0000000000000001" + "0000000000000002" + "0000000000000003" + "0000000000000004" + "000c" +
+			"00000000" + "00000000" + "0d000000"},
+	{MSG_PUBLISH_GROUP, 0, &AppMessage{Receiver: 1, MsgId: 2, DeviceID: 3, Timestamp: 4, Msg: &Message{Cmd: MSG_PING}},
+		"0000000000000001" + "0000000000000002" + "0000000000000003" + "0000000000000004" + "000c" +
+			"00000000" + "00000000" + "0d000000"},
+	{MSG_GROUP_COMMAND, 0, &GroupCommand{Op: GROUP_OP_CREATE, Uid: 1, Super: true, Members: []int64{2}, Name: "g"},
+		"01" + "0000000000000000" + "0000000000000001" + "01" + "0001" + "0000000000000002" + "01" + "67"},
+	{MSG_GROUP_COMMAND, 0, &GroupCommand{Op: GROUP_OP_SETTINGS, GroupId: 1, GroupSettings: GroupSettings{MuteAll: true, MaxMembers: 500}},
+		"0a" + "0000000000000001" + "0000000000000000" + "00" + "0000" + "00" + "01" + "00" + "000001f4"},
+	{MSG_GROUP_RESULT, 0, &GroupResult{Seq: 3, Op: GROUP_OP_MUTE, Status: GROUP_STATUS_PERMISSION, GroupId: 1},
+		"00000003" + "05" + "00000003" + "0000000000000001"},
+	{MSG_GROUP_NOTIFICATION, 0, &GroupNotification{Op: GROUP_OP_ADD_MEMBER, GroupId: 1, Operator: 2, Timestamp: 3, Members: []int64{4}},
+		"02" + "0000000000000001" + "0000000000000002" + "00000003" + "0001" + "0000000000000004" + "00"},
+	{MSG_GROUP_MENTION, 0, &GroupMention{GroupId: 1, MsgId: 2, Sender: 3, Timestamp: 4},
+		"0000000000000001" + "0000000000000002" + "0000000000000003" + "00000004"},
+	{MSG_KICK_SESSION, 0, &KickSession{SessionId: 1, Reason: KICK_REASON_LOGIN}, "0000000000000001" + "00000001"},
+	{MSG_SEARCH, 0, &SearchQuery{PeerUid: 1, GroupId: 2, BeforeMsgId: 3, Limit: 4, Query: "hi"},
+		"0000000000000001" + "0000000000000002" + "0000000000000003" + "00000004" + "6869"},
+	{MSG_SEARCH_HIT, 0, &SearchHit{Seq: 1, MsgId: 2, Cmd: MSG_IM, Raw: []byte("hi")},
+		"00000001" + "0000000000000002" + "00000004" + "6869"},
+	{MSG_SEARCH_END, 0, &SearchEnd{Seq: 1, Status: ACK_SUCCESS, HasMore: true, NextMsgId: 2},
+		"00000001" + "00" + "01" + "0000000000000002"},
+	{MSG_IM, 5, &IMMessage{Sender: 1, Receiver: 2, Timestamp: 3, MessageType: 4, ClientMsgId: "id", Ttl: 10, BurnAfterRead: true, Content: "hi"},
+		"0000000000000001" + "0000000000000002" + "00000003" + "00000004" + "00" + "0000" + "02" + "6964" + "0000000a" + "01" + "6869"},
+	{MSG_MESSAGE_READ, 0, &SyncKey{SyncKey: 9}, "0000000000000009"},
+	{MSG_MESSAGE_EXPIRE, 0, &MessageExpire{MsgId: 9, ExpireAt: 10}, "0000000000000009" + "0000000a"},
+}
+
+func TestCompatEncode(t *testing.T) {
+	for _, v := range compatVectors {
+		msg := &Message{Cmd: v.cmd, Version: v.version, Body: v.body}
+		data := hex.EncodeToString(msg.ToData())
+		if data != v.data {
+			t.Errorf("cmd:%d version:%d encode:%s expect:%s", v.cmd, v.version, data, v.data)
+		}
+	}
+}
+
+func TestCompatDecode(t *testing.T) {
+	for _, v := range compatVectors {
+		data, _ := hex.DecodeString(v.data)
+		msg := &Message{Cmd: v.cmd, Version: v.version}
+		if !msg.FromData(data) {
+			t.Errorf("cmd:%d version:%d decode failed", v.cmd, v.version)
+			continue
+		}
+		if !reflect.DeepEqual(msg.Body, v.body) {
+			t.Errorf("cmd:%d version:%d decode:%+v expect:%+v", v.cmd, v.version, msg.Body, v.body)
+		}
+	}
+}
+
+// 每个注册的消息都必须有固定编码的测试数据
+func TestCompatCoverage(t *testing.T) {
+	covered := make(map[int]bool)
+	for _, v := range compatVectors {
+		covered[v.cmd] = true
+	}
+	for cmd := range messageCreators {
+		if !covered[cmd] {
+			t.Errorf("cmd:%d has no compat vector", cmd)
+		}
+	}
+	for cmd := range vmessageCreators {
+		if !covered[cmd] {
+			t.Errorf("cmd:%d has no compat vector", cmd)
+		}
+	}
+}
+
+// 旧版本服务编码的消息仍然可以解析
+func TestCompatLegacy(t *testing.T) {
+	// imr的v0 ack只有seq
+	ack := &Message{Cmd: MSG_ACK, Version: 0}
+	if !ack.FromData([]byte{0, 0, 0, 7}) || ack.Body.(*MessageACK).Seq != 7 {
+		t.Error("v0 ack without status")
+	}
+
+	// imr的metadata后面带有16个字节的padding
+	meta := &Metadata{}
+	buf := append((&Metadata{SyncKey: 2, PrevSyncKey: 1}).ToData(), make([]byte, 16)...)
+	if !meta.FromData(buf) || meta.SyncKey != 2 || meta.PrevSyncKey != 1 {
+		t.Error("padded metadata")
+	}
+}
+
+func TestCompatHeader(t *testing.T) {
+	msg := &Message{Cmd: MSG_SYNC, Seq: 3, Version: 2, Flag: MESSAGE_FLAG_PUSH, Body: &SyncKey{SyncKey: 9}}
+	expect := "00000008" + "00000003" + "1a021000" + "0000000000000009"
+	buf := EncodeMessage(msg)
+	if hex.EncodeToString(buf) != expect {
+		t.Fatalf("encode:%x expect:%s", buf, expect)
+	}
+
+	w := new(bytes.Buffer)
+	WriteMessage(w, msg)
+	if !bytes.Equal(w.Bytes(), buf) {
+		t.Fatalf("WriteMessage:%x EncodeMessage:%x", w.Bytes(), buf)
+	}
+
+	length, seq, cmd, version, flag := ReadHeader(buf)
+	if length != 8 || seq != 3 || cmd != MSG_SYNC || version != 2 || flag != MESSAGE_FLAG_PUSH {
+		t.Fatalf("header:%d %d %d %d %d", length, seq, cmd, version, flag)
+	}
+}
@@ -0,0 +1,73 @@
+package proto
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+//消息头中保留字节的取值, 表示消息体的压缩方式
+const COMPRESS_NONE = 0
+const COMPRESS_DEFLATE = 1
+
+//客户端在MSG_AUTH_TOKEN中声明支持的能力, 服务端在MSG_AUTH_STATUS中返回当前连接启用的能力
+const CAPABILITY_DEFLATE = 0x01
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// 消息体超过threshold字节时使用deflate压缩, 压缩后没有变小的消息按原样发送
+func EncodeCompressedMessage(msg *Message, threshold int) []byte {
+	body := msg.ToData()
+	compress := COMPRESS_NONE
+	if threshold > 0 && len(body) >= threshold {
+		if b := deflate(body); len(b) < len(body) {
+			body = b
+			compress = COMPRESS_DEFLATE
+		}
+	}
+
+	buf := make([]byte, MSG_HEADER_SIZE+len(body))
+	putHeader(buf, int32(len(body)), int32(msg.Seq), byte(msg.Cmd), byte(msg.Version), byte(msg.Flag))
+	buf[11] = byte(compress)
+	copy(buf[MSG_HEADER_SIZE:], body)
+	return buf
+}
+
+func deflate(body []byte) []byte {
+	var b bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	w.Reset(&b)
+	w.Write(body)
+	w.Close()
+	flateWriters.Put(w)
+	return b.Bytes()
+}
+
+// 解压之后的消息体同样受limitSize的限制
+func decompress(compress int, body []byte, limitSize int) ([]byte, error) {
+	switch compress {
+	case COMPRESS_NONE:
+		return body, nil
+	case COMPRESS_DEFLATE:
+		r := flate.NewReader(bytes.NewReader(body))
+		defer r.Close()
+		b, err := ioutil.ReadAll(io.LimitReader(r, int64(limitSize)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > limitSize {
+			return nil, errors.New("invalid length")
+		}
+		return b, nil
+	default:
+		return nil, errors.New("invalid compress")
+	}
+}
@@ -0,0 +1,60 @@
+package proto
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCompressedMessage(t *testing.T) {
+	content := strings.Repeat("hello world ", 100)
+	msg := &Message{Cmd: MSG_IM, Seq: 1, Version: 2, Body: &IMMessage{Sender: 1, Receiver: 2, Content: content}}
+
+	buf := EncodeCompressedMessage(msg, 512)
+	if buf[11] != COMPRESS_DEFLATE {
+		t.Fatal("message not compressed")
+	}
+	if len(buf) >= len(EncodeMessage(msg)) {
+		t.Fatalf("compressed size:%d", len(buf))
+	}
+
+	m, err := DecodeMessage(buf, 32*1024)
+	if err != nil || m.Body.(*IMMessage).Content != content {
+		t.Fatal("decode compressed message", err)
+	}
+	m, err = ReceiveLimitMessage(bytes.NewReader(buf), 32*1024, true)
+	if err != nil || m.Body.(*IMMessage).Content != content {
+		t.Fatal("receive compressed message", err)
+	}
+
+	// 小于阈值的消息不压缩
+	small := &Message{Cmd: MSG_SYNC, Body: &SyncKey{SyncKey: 1}}
+	if !bytes.Equal(EncodeCompressedMessage(small, 512), EncodeMessage(small)) {
+		t.Fatal("small message compressed")
+	}
+
+	// 解压之后超过限制的消息
+	if _, err := DecodeMessage(buf, len(buf)); err == nil {
+		t.Fatal("decompressed size not limited")
+	}
+}
+
+func BenchmarkEncodeMessage(b *testing.B) {
+	benchmarkEncode(b, 0)
+}
+
+func BenchmarkEncodeCompressedMessage(b *testing.B) {
+	benchmarkEncode(b, 512)
+}
+
+// 按照同步历史消息时常见的json内容比较流量
+func benchmarkEncode(b *testing.B, threshold int) {
+	content := `{"text":"` + strings.Repeat("今天晚上一起吃饭吗? ", 40) + `","uuid":"6a2f0c4e-3b8d-4d5a-9c1e-7f0b2a9d8e31"}`
+	msg := &Message{Cmd: MSG_IM, Version: 2, Body: &IMMessage{Sender: 1, Receiver: 2, Timestamp: 3, Content: content}}
+
+	size := 0
+	for i := 0; i < b.N; i++ {
+		size += len(EncodeCompressedMessage(msg, threshold))
+	}
+	b.ReportMetric(float64(size)/float64(b.N), "bytes/msg")
+}
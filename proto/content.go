@@ -0,0 +1,275 @@
+package proto
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//IMMessage.MessageType的取值, content是对应类型的json
+//0是旧版本客户端发送的没有类型的消息, 服务端不检查content
+const CONTENT_UNTYPED = 0
+const CONTENT_TEXT = 1     //{"text":""}
+const CONTENT_IMAGE = 2    //{"url":"", "attachment_id":"", "width":0, "height":0, "size":0, "thumbnail":""}
+const CONTENT_VOICE = 3    //{"url":"", "attachment_id":"", "duration":0, "size":0}
+const CONTENT_VIDEO = 4    //{"url":"", "attachment_id":"", "duration":0, "width":0, "height":0, "size":0, "thumbnail":""}
+const CONTENT_FILE = 5     //{"url":"", "attachment_id":"", "name":"", "size":0}
+const CONTENT_LOCATION = 6 //{"latitude":0, "longitude":0, "address":""}
+const CONTENT_CARD = 7     //{"uid":0, "name":"", "avatar":""}
+const CONTENT_CUSTOM = 8   //{"type":"", "data":{}, "summary":""}, 业务自定义的消息, summary用于推送和搜索
+
+//文本消息content的最大长度, 其它类型只保存文件的地址, 不需要太长
+const MAX_TEXT_CONTENT_SIZE = 16 * 1024
+const MAX_MEDIA_CONTENT_SIZE = 2 * 1024
+const MAX_CUSTOM_CONTENT_SIZE = 16 * 1024
+
+var ErrUnknownContentType = errors.New("unknown content type")
+
+type Content interface {
+	Validate() error
+	//用于关键词过滤, 推送的预览和搜索, 非文本消息返回一个简短的描述
+	PlainText() string
+}
+
+// 引用附件服务中的文件的消息, url和attachment_id至少有一个
+type AttachmentContent interface {
+	AttachmentId() string
+}
+
+type ContentType struct {
+	MaxSize int
+	Creator func() Content
+}
+
+var contentTypes = make(map[int32]*ContentType)
+
+func init() {
+	RegisterContentType(CONTENT_TEXT, MAX_TEXT_CONTENT_SIZE, func() Content { return new(TextContent) })
+	RegisterContentType(CONTENT_IMAGE, MAX_MEDIA_CONTENT_SIZE, func() Content { return new(ImageContent) })
+	RegisterContentType(CONTENT_VOICE, MAX_MEDIA_CONTENT_SIZE, func() Content { return new(VoiceContent) })
+	RegisterContentType(CONTENT_VIDEO, MAX_MEDIA_CONTENT_SIZE, func() Content { return new(VideoContent) })
+	RegisterContentType(CONTENT_FILE, MAX_MEDIA_CONTENT_SIZE, func() Content { return new(FileContent) })
+	RegisterContentType(CONTENT_LOCATION, MAX_MEDIA_CONTENT_SIZE, func() Content { return new(LocationContent) })
+	RegisterContentType(CONTENT_CARD, MAX_MEDIA_CONTENT_SIZE, func() Content { return new(CardContent) })
+	RegisterContentType(CONTENT_CUSTOM, MAX_CUSTOM_CONTENT_SIZE, func() Content { return new(CustomContent) })
+}
+
+// 新增的消息类型在init中注册, 不能和已有的冲突
+func RegisterContentType(messageType int32, maxSize int, creator func() Content) {
+	if _, ok := contentTypes[messageType]; ok {
+		panic(fmt.Sprintf("content type:%d already registered", messageType))
+	}
+	contentTypes[messageType] = &ContentType{MaxSize: maxSize, Creator: creator}
+}
+
+// 解析并检查消息的content, 没有类型的消息返回nil
+func ParseContent(messageType int32, content string) (Content, error) {
+	if messageType == CONTENT_UNTYPED {
+		return nil, nil
+	}
+	ct, ok := contentTypes[messageType]
+	if !ok {
+		return nil, ErrUnknownContentType
+	}
+	if len(content) > ct.MaxSize {
+		return nil, fmt.Errorf("content size:%d exceeds limit:%d", len(content), ct.MaxSize)
+	}
+	c := ct.Creator()
+	if err := json.Unmarshal([]byte(content), c); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// 没有类型的消息直接返回content, 解析失败时返回空字符串
+func ContentPlainText(messageType int32, content string) string {
+	if messageType == CONTENT_UNTYPED {
+		return content
+	}
+	c, err := ParseContent(messageType, content)
+	if err != nil {
+		return ""
+	}
+	return c.PlainText()
+}
+
+type TextContent struct {
+	Text string `json:"text"`
+}
+
+func (c *TextContent) Validate() error {
+	if strings.TrimSpace(c.Text) == "" {
+		return errors.New("empty text")
+	}
+	return nil
+}
+
+func (c *TextContent) PlainText() string {
+	return c.Text
+}
+
+type ImageContent struct {
+	URL        string `json:"url,omitempty"`
+	Attachment string `json:"attachment_id,omitempty"`
+	Width      int    `json:"width,omitempty"`
+	Height     int    `json:"height,omitempty"`
+	Size       int64  `json:"size,omitempty"`
+	Thumbnail  string `json:"thumbnail,omitempty"`
+}
+
+func (c *ImageContent) Validate() error {
+	if c.URL == "" && c.Attachment == "" {
+		return errors.New("empty url")
+	}
+	if c.Width < 0 || c.Height < 0 || c.Size < 0 {
+		return errors.New("invalid image size")
+	}
+	return nil
+}
+
+func (c *ImageContent) AttachmentId() string {
+	return c.Attachment
+}
+
+func (c *ImageContent) PlainText() string {
+	return "[图片]"
+}
+
+type VoiceContent struct {
+	URL        string `json:"url,omitempty"`
+	Attachment string `json:"attachment_id,omitempty"`
+	Duration   int    `json:"duration"` //秒
+	Size       int64  `json:"size,omitempty"`
+}
+
+func (c *VoiceContent) Validate() error {
+	if c.URL == "" && c.Attachment == "" {
+		return errors.New("empty url")
+	}
+	if c.Duration <= 0 || c.Size < 0 {
+		return errors.New("invalid voice duration")
+	}
+	return nil
+}
+
+func (c *VoiceContent) AttachmentId() string {
+	return c.Attachment
+}
+
+func (c *VoiceContent) PlainText() string {
+	return "[语音]"
+}
+
+type VideoContent struct {
+	URL        string `json:"url,omitempty"`
+	Attachment string `json:"attachment_id,omitempty"`
+	Duration   int    `json:"duration"` //秒
+	Width      int    `json:"width,omitempty"`
+	Height     int    `json:"height,omitempty"`
+	Size       int64  `json:"size,omitempty"`
+	Thumbnail  string `json:"thumbnail,omitempty"`
+}
+
+func (c *VideoContent) Validate() error {
+	if c.URL == "" && c.Attachment == "" {
+		return errors.New("empty url")
+	}
+	if c.Duration <= 0 || c.Width < 0 || c.Height < 0 || c.Size < 0 {
+		return errors.New("invalid video size")
+	}
+	return nil
+}
+
+func (c *VideoContent) AttachmentId() string {
+	return c.Attachment
+}
+
+func (c *VideoContent) PlainText() string {
+	return "[视频]"
+}
+
+type FileContent struct {
+	URL        string `json:"url,omitempty"`
+	Attachment string `json:"attachment_id,omitempty"`
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+}
+
+func (c *FileContent) Validate() error {
+	if (c.URL == "" && c.Attachment == "") || c.Name == "" {
+		return errors.New("empty url or name")
+	}
+	if c.Size < 0 {
+		return errors.New("invalid file size")
+	}
+	return nil
+}
+
+func (c *FileContent) AttachmentId() string {
+	return c.Attachment
+}
+
+func (c *FileContent) PlainText() string {
+	return "[文件] " + c.Name
+}
+
+type LocationContent struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Address   string  `json:"address,omitempty"`
+}
+
+func (c *LocationContent) Validate() error {
+	if c.Latitude < -90 || c.Latitude > 90 || c.Longitude < -180 || c.Longitude > 180 {
+		return errors.New("invalid coordinate")
+	}
+	return nil
+}
+
+func (c *LocationContent) PlainText() string {
+	if c.Address == "" {
+		return "[位置]"
+	}
+	return "[位置] " + c.Address
+}
+
+type CardContent struct {
+	Uid    int64  `json:"uid"`
+	Name   string `json:"name,omitempty"`
+	Avatar string `json:"avatar,omitempty"`
+}
+
+func (c *CardContent) Validate() error {
+	if c.Uid <= 0 {
+		return errors.New("invalid uid")
+	}
+	return nil
+}
+
+func (c *CardContent) PlainText() string {
+	if c.Name == "" {
+		return "[名片]"
+	}
+	return "[名片] " + c.Name
+}
+
+type CustomContent struct {
+	Type    string          `json:"type"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Summary string          `json:"summary,omitempty"`
+}
+
+func (c *CustomContent) Validate() error {
+	if c.Type == "" {
+		return errors.New("empty custom type")
+	}
+	return nil
+}
+
+func (c *CustomContent) PlainText() string {
+	return c.Summary
+}
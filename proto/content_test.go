@@ -0,0 +1,38 @@
+package proto
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseContent(t *testing.T) {
+	cases := []struct {
+		messageType int32
+		content     string
+		ok          bool
+		text        string
+	}{
+		{CONTENT_UNTYPED, "anything", true, "anything"},
+		{CONTENT_TEXT, `{"text":"hello"}`, true, "hello"},
+		{CONTENT_TEXT, `{"text":"  "}`, false, ""},
+		{CONTENT_TEXT, `hello`, false, ""},
+		{CONTENT_TEXT, `{"text":"` + strings.Repeat("a", MAX_TEXT_CONTENT_SIZE) + `"}`, false, ""},
+		{CONTENT_IMAGE, `{"url":"http://a/b.png","width":10,"height":10}`, true, "[图片]"},
+		{CONTENT_IMAGE, `{"width":10}`, false, ""},
+		{CONTENT_VOICE, `{"url":"http://a/b.amr","duration":0}`, false, ""},
+		{CONTENT_FILE, `{"url":"http://a/b","name":"b.pdf","size":1}`, true, "[文件] b.pdf"},
+		{CONTENT_LOCATION, `{"latitude":91,"longitude":0}`, false, ""},
+		{CONTENT_CARD, `{"uid":1}`, true, "[名片]"},
+		{CONTENT_CUSTOM, `{"type":"order","data":{"id":1},"summary":"订单"}`, true, "订单"},
+		{100, `{}`, false, ""},
+	}
+	for i, c := range cases {
+		_, err := ParseContent(c.messageType, c.content)
+		if (err == nil) != c.ok {
+			t.Errorf("case %d: err %v", i, err)
+		}
+		if text := ContentPlainText(c.messageType, c.content); text != c.text {
+			t.Errorf("case %d: text %q", i, text)
+		}
+	}
+}
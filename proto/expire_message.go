@@ -0,0 +1,31 @@
+package proto
+
+import "encoding/binary"
+
+func init() {
+	messageCreators[MSG_MESSAGE_READ] = func() IMessage { return new(SyncKey) }
+	messageCreators[MSG_MESSAGE_EXPIRE] = func() IMessage { return new(MessageExpire) }
+}
+
+// MsgId是收到这条事件的用户自己的消息队列中的id, ExpireAt是unix时间(秒)
+type MessageExpire struct {
+	MsgId    int64
+	ExpireAt int32
+}
+
+// msgId(8) expireAt(4)
+func (e *MessageExpire) ToData() []byte {
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint64(buf[0:], uint64(e.MsgId))
+	binary.BigEndian.PutUint32(buf[8:], uint32(e.ExpireAt))
+	return buf
+}
+
+func (e *MessageExpire) FromData(buff []byte) bool {
+	if len(buff) < 12 {
+		return false
+	}
+	e.MsgId = int64(binary.BigEndian.Uint64(buff[0:]))
+	e.ExpireAt = int32(binary.BigEndian.Uint32(buff[8:]))
+	return true
+}
@@ -0,0 +1,271 @@
+package proto
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+func init() {
+	messageCreators[MSG_GROUP_COMMAND] = func() IMessage { return new(GroupCommand) }
+	messageCreators[MSG_GROUP_RESULT] = func() IMessage { return new(GroupResult) }
+	messageCreators[MSG_GROUP_NOTIFICATION] = func() IMessage { return new(GroupNotification) }
+	messageCreators[MSG_GROUP_MENTION] = func() IMessage { return new(GroupMention) }
+}
+
+// 群组的设置, 只在GROUP_OP_SETTINGS中使用
+// muteAll(1) inviteOnly(1) maxMembers(4), 都是默认值时不编码, 兼容没有设置的旧格式
+type GroupSettings struct {
+	MuteAll    bool
+	InviteOnly bool
+	MaxMembers int32
+}
+
+const GROUP_SETTINGS_SIZE = 6
+
+func (s *GroupSettings) isZero() bool {
+	return !s.MuteAll && !s.InviteOnly && s.MaxMembers == 0
+}
+
+func (s *GroupSettings) size() int {
+	if s.isZero() {
+		return 0
+	}
+	return GROUP_SETTINGS_SIZE
+}
+
+func (s *GroupSettings) put(buf []byte) {
+	if s.isZero() {
+		return
+	}
+	if s.MuteAll {
+		buf[0] = 1
+	}
+	if s.InviteOnly {
+		buf[1] = 1
+	}
+	binary.BigEndian.PutUint32(buf[2:], uint32(s.MaxMembers))
+}
+
+func (s *GroupSettings) get(buff []byte) {
+	if len(buff) < GROUP_SETTINGS_SIZE {
+		return
+	}
+	s.MuteAll = buff[0] != 0
+	s.InviteOnly = buff[1] != 0
+	s.MaxMembers = int32(binary.BigEndian.Uint32(buff[2:]))
+}
+
+// 群组管理命令, 操作者是当前登录的用户
+// 创建群组时Members是初始的成员, 添加和移除成员时是被操作的成员
+// 转让群主, 禁言, 设置管理员和取消管理员时Uid是被操作的成员
+type GroupCommand struct {
+	Op      int8
+	GroupId int64
+	Uid     int64
+	Super   bool
+	Members []int64
+	Name    string
+	GroupSettings
+}
+
+// op(1) groupId(8) uid(8) super(1) 成员数量(2) 成员id(8*n) name长度(1) name [群组设置(6)]
+func (cmd *GroupCommand) ToData() []byte {
+	members := truncateMembers(cmd.Members)
+	name := truncateString(cmd.Name, 255)
+
+	buf := make([]byte, 18+2+8*len(members)+1+len(name)+cmd.GroupSettings.size())
+	buf[0] = byte(cmd.Op)
+	binary.BigEndian.PutUint64(buf[1:], uint64(cmd.GroupId))
+	binary.BigEndian.PutUint64(buf[9:], uint64(cmd.Uid))
+	if cmd.Super {
+		buf[17] = 1
+	}
+	off := 18 + putMembers(buf[18:], members)
+	buf[off] = byte(len(name))
+	off += 1 + copy(buf[off+1:], name)
+	cmd.GroupSettings.put(buf[off:])
+	return buf
+}
+
+func (cmd *GroupCommand) FromData(buff []byte) bool {
+	if len(buff) < 18 {
+		return false
+	}
+	cmd.Op = int8(buff[0])
+	cmd.GroupId = int64(binary.BigEndian.Uint64(buff[1:]))
+	cmd.Uid = int64(binary.BigEndian.Uint64(buff[9:]))
+	cmd.Super = buff[17] != 0
+
+	members, n, ok := getMembers(buff[18:])
+	if !ok {
+		return false
+	}
+	cmd.Members = members
+
+	name, ok := getString(buff[18+n:])
+	if !ok {
+		return false
+	}
+	cmd.Name = name
+	cmd.GroupSettings.get(buff[18+n+1+len(name):])
+	return true
+}
+
+type GroupResult struct {
+	Seq     int32
+	Op      int8
+	Status  int32
+	GroupId int64
+}
+
+// seq(4) op(1) status(4) groupId(8)
+func (r *GroupResult) ToData() []byte {
+	buf := make([]byte, 17)
+	binary.BigEndian.PutUint32(buf[0:], uint32(r.Seq))
+	buf[4] = byte(r.Op)
+	binary.BigEndian.PutUint32(buf[5:], uint32(r.Status))
+	binary.BigEndian.PutUint64(buf[9:], uint64(r.GroupId))
+	return buf
+}
+
+func (r *GroupResult) FromData(buff []byte) bool {
+	if len(buff) < 17 {
+		return false
+	}
+	r.Seq = int32(binary.BigEndian.Uint32(buff[0:]))
+	r.Op = int8(buff[4])
+	r.Status = int32(binary.BigEndian.Uint32(buff[5:]))
+	r.GroupId = int64(binary.BigEndian.Uint64(buff[9:]))
+	return true
+}
+
+// 群组的系统通知, Op和GroupCommand相同
+// Members是被操作的成员, 客户端根据Operator和Members显示"X加入了群组"
+type GroupNotification struct {
+	Op        int8
+	GroupId   int64
+	Operator  int64
+	Timestamp int32
+	Members   []int64
+	Name      string
+	GroupSettings
+}
+
+// op(1) groupId(8) operator(8) timestamp(4) 成员数量(2) 成员id(8*n) name长度(1) name [群组设置(6)]
+func (n *GroupNotification) ToData() []byte {
+	members := truncateMembers(n.Members)
+	name := truncateString(n.Name, 255)
+
+	buf := make([]byte, 21+2+8*len(members)+1+len(name)+n.GroupSettings.size())
+	buf[0] = byte(n.Op)
+	binary.BigEndian.PutUint64(buf[1:], uint64(n.GroupId))
+	binary.BigEndian.PutUint64(buf[9:], uint64(n.Operator))
+	binary.BigEndian.PutUint32(buf[17:], uint32(n.Timestamp))
+	off := 21 + putMembers(buf[21:], members)
+	buf[off] = byte(len(name))
+	off += 1 + copy(buf[off+1:], name)
+	n.GroupSettings.put(buf[off:])
+	return buf
+}
+
+func (n *GroupNotification) FromData(buff []byte) bool {
+	if len(buff) < 21 {
+		return false
+	}
+	n.Op = int8(buff[0])
+	n.GroupId = int64(binary.BigEndian.Uint64(buff[1:]))
+	n.Operator = int64(binary.BigEndian.Uint64(buff[9:]))
+	n.Timestamp = int32(binary.BigEndian.Uint32(buff[17:]))
+
+	members, l, ok := getMembers(buff[21:])
+	if !ok {
+		return false
+	}
+	n.Members = members
+
+	name, ok := getString(buff[21+l:])
+	if !ok {
+		return false
+	}
+	n.Name = name
+	n.GroupSettings.get(buff[21+l+1+len(name):])
+	return true
+}
+
+// 被@的群组消息, MsgId是超级群消息队列中的消息id, 客户端可以从这个位置开始同步群组消息
+type GroupMention struct {
+	GroupId   int64
+	MsgId     int64
+	Sender    int64
+	Timestamp int32
+}
+
+// groupId(8) msgId(8) sender(8) timestamp(4)
+func (m *GroupMention) ToData() []byte {
+	buf := make([]byte, 28)
+	binary.BigEndian.PutUint64(buf[0:], uint64(m.GroupId))
+	binary.BigEndian.PutUint64(buf[8:], uint64(m.MsgId))
+	binary.BigEndian.PutUint64(buf[16:], uint64(m.Sender))
+	binary.BigEndian.PutUint32(buf[24:], uint32(m.Timestamp))
+	return buf
+}
+
+func (m *GroupMention) FromData(buff []byte) bool {
+	if len(buff) < 28 {
+		return false
+	}
+	m.GroupId = int64(binary.BigEndian.Uint64(buff[0:]))
+	m.MsgId = int64(binary.BigEndian.Uint64(buff[8:]))
+	m.Sender = int64(binary.BigEndian.Uint64(buff[16:]))
+	m.Timestamp = int32(binary.BigEndian.Uint32(buff[24:]))
+	return true
+}
+
+func truncateMembers(members []int64) []int64 {
+	if len(members) > math.MaxInt16 {
+		return members[:math.MaxInt16]
+	}
+	return members
+}
+
+// 成员数量(2) 成员id(8*n), 返回写入的字节数
+func putMembers(buf []byte, members []int64) int {
+	binary.BigEndian.PutUint16(buf, uint16(len(members)))
+	off := 2
+	for _, member := range members {
+		binary.BigEndian.PutUint64(buf[off:], uint64(member))
+		off += 8
+	}
+	return off
+}
+
+// 返回成员id和读取的字节数
+func getMembers(buff []byte) ([]int64, int, bool) {
+	if len(buff) < 2 {
+		return nil, 0, false
+	}
+	count := int(int16(binary.BigEndian.Uint16(buff)))
+	if count < 0 || 2+count*8 > len(buff) {
+		return nil, 0, false
+	}
+	var members []int64
+	if count > 0 {
+		members = make([]int64, count)
+	}
+	for i := 0; i < count; i++ {
+		members[i] = int64(binary.BigEndian.Uint64(buff[2+i*8:]))
+	}
+	return members, 2 + count*8, true
+}
+
+// 长度(1) 字符串
+func getString(buff []byte) (string, bool) {
+	if len(buff) < 1 {
+		return "", false
+	}
+	l := int(buff[0])
+	if 1+l > len(buff) {
+		return "", false
+	}
+	return string(buff[1 : 1+l]), true
+}
@@ -0,0 +1,688 @@
+package proto
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+type MessageCreator func() IMessage
+
+var messageCreators map[int]MessageCreator = make(map[int]MessageCreator)
+
+type VersionMessageCreator func() IVersionMessage
+
+var vmessageCreators map[int]VersionMessageCreator = make(map[int]VersionMessageCreator)
+
+// 注册消息体的解析, 只能在init中调用
+// 服务内部使用的消息(比如文件存储的消息)由各自的服务注册
+func RegisterMessage(cmd int, creator MessageCreator) {
+	messageCreators[cmd] = creator
+}
+
+func RegisterVersionMessage(cmd int, creator VersionMessageCreator) {
+	vmessageCreators[cmd] = creator
+}
+
+func init() {
+	messageCreators[MSG_AUTH_TOKEN] = func() IMessage { return new(AuthenticationToken) }
+	messageCreators[MSG_AUTH_STATUS] = func() IMessage { return new(AuthenticationStatus) }
+
+	messageCreators[MSG_SYNC] = func() IMessage { return new(SyncKey) }
+	messageCreators[MSG_SYNC_BEGIN] = func() IMessage { return new(SyncKey) }
+	messageCreators[MSG_SYNC_END] = func() IMessage { return new(SyncKey) }
+	messageCreators[MSG_SYNC_NOTIFY] = func() IMessage { return new(SyncKey) }
+
+	messageCreators[MSG_SYNC_GROUP] = func() IMessage { return new(GroupSyncKey) }
+	messageCreators[MSG_SYNC_GROUP_BEGIN] = func() IMessage { return new(GroupSyncKey) }
+	messageCreators[MSG_SYNC_GROUP_END] = func() IMessage { return new(GroupSyncKey) }
+	messageCreators[MSG_GROUP_SYNC_KEY] = func() IMessage { return new(GroupSyncKey) }
+	messageCreators[MSG_SYNC_GROUP_NOTIFY] = func() IMessage { return new(GroupSyncKey) }
+
+	messageCreators[MSG_KICKED] = func() IMessage { return new(KickedMessage) }
+	messageCreators[MSG_DEVICES] = func() IMessage { return new(DeviceList) }
+	messageCreators[MSG_KICK_DEVICE] = func() IMessage { return new(SessionID) }
+	messageCreators[MSG_SERVER_CLOSE] = func() IMessage { return new(ServerClose) }
+
+	messageCreators[MSG_METADATA] = func() IMessage { return new(Metadata) }
+
+	vmessageCreators[MSG_IM] = func() IVersionMessage { return new(IMMessage) }
+	vmessageCreators[MSG_GROUP_IM] = func() IVersionMessage { return new(IMMessage) }
+	vmessageCreators[MSG_ACK] = func() IVersionMessage { return new(MessageACK) }
+}
+
+type Command int
+
+// Message是消息的统一格式
+// 根据cmd 可以将具体的消息，比如IMMessage,SystemMessage 存储在body字段
+type Message struct {
+	Cmd     int
+	Seq     int
+	Version int
+	Flag    int
+
+	Body     interface{}
+	BodyData []byte
+
+	Meta *Metadata
+}
+
+func (message *Message) ToData() []byte {
+	if message.BodyData != nil {
+		return message.BodyData
+	} else if message.Body != nil {
+		if m, ok := message.Body.(IMessage); ok {
+			return m.ToData()
+		}
+		if m, ok := message.Body.(IVersionMessage); ok {
+			return m.ToData(message.Version)
+		}
+		return nil
+	} else {
+		return nil
+	}
+}
+
+func (message *Message) FromData(buff []byte) bool {
+	cmd := message.Cmd
+	if creator, ok := messageCreators[cmd]; ok {
+		c := creator()
+		r := c.FromData(buff)
+		message.Body = c
+		return r
+	}
+	if creator, ok := vmessageCreators[cmd]; ok {
+		c := creator()
+		r := c.FromData(message.Version, buff)
+		message.Body = c
+		return r
+	}
+	return len(buff) == 0
+}
+
+type Metadata struct {
+	SyncKey     int64
+	PrevSyncKey int64
+}
+
+func (sync *Metadata) ToData() []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[0:], uint64(sync.SyncKey))
+	binary.BigEndian.PutUint64(buf[8:], uint64(sync.PrevSyncKey))
+	return buf
+}
+
+func (sync *Metadata) FromData(buff []byte) bool {
+	if len(buff) < 16 {
+		return false
+	}
+	sync.SyncKey = int64(binary.BigEndian.Uint64(buff[0:]))
+	sync.PrevSyncKey = int64(binary.BigEndian.Uint64(buff[8:]))
+	return true
+}
+
+// 消息转换的接口 相当于适配器
+type IMessage interface {
+	ToData() []byte
+	FromData([]byte) bool
+}
+
+// 带版本消息转换的接口 相当于适配器
+type IVersionMessage interface {
+	ToData(version int) []byte
+	FromData(version int, buff []byte) bool
+}
+
+type IMMessage struct {
+	Sender      int64
+	Receiver    int64
+	Timestamp   int32
+	MessageType int32
+	Content     string
+
+	//v3, 群组消息中@的成员和@所有人
+	AtAll    bool
+	Mentions []int64
+
+	//v4, 客户端生成的消息id, 重发时不变, 服务端用来去掉重复的消息
+	ClientMsgId string
+
+	//v5, 消息的有效时间(秒), 0表示不过期
+	//BurnAfterRead为false时从发送时间开始计算, 为true时从接收者第一次阅读开始计算(阅后即焚)
+	//按发送时间过期的消息服务端不发送MSG_MESSAGE_EXPIRE, 客户端必须自己在Timestamp+Ttl之后删除
+	//服务端只保证过期之后同步和搜索不再返回, 并且定时从磁盘上清除
+	Ttl           int32
+	BurnAfterRead bool
+}
+
+func (m *IMMessage) ToData(version int) []byte {
+	if version == 0 {
+		return m.ToDataV0()
+	} else if version < MENTION_VERSION {
+		return m.ToDataV2()
+	} else if version < CLIENT_MSG_ID_VERSION {
+		return m.ToDataV3()
+	} else if version < EXPIRE_VERSION {
+		return m.ToDataV4()
+	} else {
+		return m.ToDataV5()
+	}
+}
+
+func (m *IMMessage) FromData(version int, buff []byte) bool {
+	if version == 0 {
+		return m.FromDataV0(buff)
+	} else if version < MENTION_VERSION {
+		return m.FromDataV2(buff)
+	} else if version < CLIENT_MSG_ID_VERSION {
+		return m.FromDataV3(buff)
+	} else if version < EXPIRE_VERSION {
+		return m.FromDataV4(buff)
+	} else {
+		return m.FromDataV5(buff)
+	}
+}
+
+// 编码这个消息需要的最低版本, 没有新字段的消息仍然按照默认版本在服务之间传递
+func (m *IMMessage) MinVersion() int {
+	if m.Ttl > 0 {
+		return EXPIRE_VERSION
+	}
+	if m.ClientMsgId != "" {
+		return CLIENT_MSG_ID_VERSION
+	}
+	if m.AtAll || len(m.Mentions) > 0 {
+		return MENTION_VERSION
+	}
+	return DEFAULT_VERSION
+}
+
+// 按发送时间过期的消息的过期时间, 不过期或者阅后即焚的消息返回0
+func (m *IMMessage) ExpireAt() int32 {
+	if m.Ttl <= 0 || m.BurnAfterRead {
+		return 0
+	}
+	return m.Timestamp + m.Ttl
+}
+
+// uid是否被@
+func (m *IMMessage) IsMentioned(uid int64) bool {
+	if m.AtAll {
+		return true
+	}
+	for _, member := range m.Mentions {
+		if member == uid {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *IMMessage) ToDataV0() []byte {
+	buf := make([]byte, 24+len(m.Content))
+	binary.BigEndian.PutUint64(buf[0:], uint64(m.Sender))
+	binary.BigEndian.PutUint64(buf[8:], uint64(m.Receiver))
+	binary.BigEndian.PutUint32(buf[16:], uint32(m.Timestamp))
+	binary.BigEndian.PutUint32(buf[20:], uint32(m.MessageType))
+	copy(buf[24:], m.Content)
+	return buf
+}
+
+func (m *IMMessage) FromDataV0(buff []byte) bool {
+	if len(buff) < 24 {
+		return false
+	}
+	m.Sender = int64(binary.BigEndian.Uint64(buff[0:]))
+	m.Receiver = int64(binary.BigEndian.Uint64(buff[8:]))
+	m.Timestamp = int32(binary.BigEndian.Uint32(buff[16:]))
+	m.MessageType = int32(binary.BigEndian.Uint32(buff[20:]))
+	m.Content = string(buff[24:])
+	return true
+}
+
+// v2和v0的格式相同, 以后新增的字段只加在新的版本中
+func (m *IMMessage) ToDataV2() []byte {
+	buf := make([]byte, 24+len(m.Content))
+	binary.BigEndian.PutUint64(buf[0:], uint64(m.Sender))
+	binary.BigEndian.PutUint64(buf[8:], uint64(m.Receiver))
+	binary.BigEndian.PutUint32(buf[16:], uint32(m.Timestamp))
+	binary.BigEndian.PutUint32(buf[20:], uint32(m.MessageType))
+	copy(buf[24:], m.Content)
+	return buf
+}
+
+func (m *IMMessage) FromDataV2(buff []byte) bool {
+	if len(buff) < 24 {
+		return false
+	}
+	m.Sender = int64(binary.BigEndian.Uint64(buff[0:]))
+	m.Receiver = int64(binary.BigEndian.Uint64(buff[8:]))
+	m.Timestamp = int32(binary.BigEndian.Uint32(buff[16:]))
+	m.MessageType = int32(binary.BigEndian.Uint32(buff[20:]))
+	m.Content = string(buff[24:])
+	return true
+}
+
+// sender(8) receiver(8) timestamp(4) messageType(4) atAll(1) 成员数量(2) 成员id(8*n) content
+func (m *IMMessage) ToDataV3() []byte {
+	return m.toDataMention(MENTION_VERSION)
+}
+
+func (m *IMMessage) FromDataV3(buff []byte) bool {
+	return m.fromDataMention(buff, MENTION_VERSION)
+}
+
+// v3的格式在content之前增加clientMsgId长度(1) clientMsgId
+func (m *IMMessage) ToDataV4() []byte {
+	return m.toDataMention(CLIENT_MSG_ID_VERSION)
+}
+
+func (m *IMMessage) FromDataV4(buff []byte) bool {
+	return m.fromDataMention(buff, CLIENT_MSG_ID_VERSION)
+}
+
+// v4的格式在clientMsgId之后增加ttl(4) burnAfterRead(1)
+func (m *IMMessage) ToDataV5() []byte {
+	return m.toDataMention(EXPIRE_VERSION)
+}
+
+func (m *IMMessage) FromDataV5(buff []byte) bool {
+	return m.fromDataMention(buff, EXPIRE_VERSION)
+}
+
+func (m *IMMessage) toDataMention(version int) []byte {
+	withId := version >= CLIENT_MSG_ID_VERSION
+	withTtl := version >= EXPIRE_VERSION
+
+	mentions := truncateMembers(m.Mentions)
+	clientMsgId := ""
+	size := 25 + 2 + 8*len(mentions) + len(m.Content)
+	if withId {
+		clientMsgId = truncateString(m.ClientMsgId, 255)
+		size += 1 + len(clientMsgId)
+	}
+	if withTtl {
+		size += 5
+	}
+
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint64(buf[0:], uint64(m.Sender))
+	binary.BigEndian.PutUint64(buf[8:], uint64(m.Receiver))
+	binary.BigEndian.PutUint32(buf[16:], uint32(m.Timestamp))
+	binary.BigEndian.PutUint32(buf[20:], uint32(m.MessageType))
+	if m.AtAll {
+		buf[24] = 1
+	}
+	off := 25 + putMembers(buf[25:], mentions)
+	if withId {
+		buf[off] = byte(len(clientMsgId))
+		off += 1 + copy(buf[off+1:], clientMsgId)
+	}
+	if withTtl {
+		binary.BigEndian.PutUint32(buf[off:], uint32(m.Ttl))
+		if m.BurnAfterRead {
+			buf[off+4] = 1
+		}
+		off += 5
+	}
+	copy(buf[off:], m.Content)
+	return buf
+}
+
+func (m *IMMessage) fromDataMention(buff []byte, version int) bool {
+	withId := version >= CLIENT_MSG_ID_VERSION
+	withTtl := version >= EXPIRE_VERSION
+
+	if len(buff) < 25 {
+		return false
+	}
+	mentions, n, ok := getMembers(buff[25:])
+	if !ok {
+		return false
+	}
+	off := 25 + n
+
+	clientMsgId := ""
+	if withId {
+		clientMsgId, ok = getString(buff[off:])
+		if !ok {
+			return false
+		}
+		off += 1 + len(clientMsgId)
+	}
+
+	var ttl int32
+	var burnAfterRead bool
+	if withTtl {
+		if len(buff) < off+5 {
+			return false
+		}
+		ttl = int32(binary.BigEndian.Uint32(buff[off:]))
+		burnAfterRead = buff[off+4] != 0
+		off += 5
+	}
+
+	m.Sender = int64(binary.BigEndian.Uint64(buff[0:]))
+	m.Receiver = int64(binary.BigEndian.Uint64(buff[8:]))
+	m.Timestamp = int32(binary.BigEndian.Uint32(buff[16:]))
+	m.MessageType = int32(binary.BigEndian.Uint32(buff[20:]))
+	m.AtAll = buff[24] != 0
+	m.Mentions = mentions
+	m.ClientMsgId = clientMsgId
+	m.Ttl = ttl
+	m.BurnAfterRead = burnAfterRead
+	m.Content = string(buff[off:])
+	return true
+}
+
+// platformId(1) token长度(1) token deviceId长度(1) deviceId [capabilities(1)]
+// 长度都是无符号的单字节, token和deviceId最长255个字节
+// capabilities是可选的, 旧版本的客户端不会带上
+type AuthenticationToken struct {
+	Token        string
+	PlatformId   int8
+	DeviceId     string
+	Capabilities uint8
+}
+
+func (auth *AuthenticationToken) ToData() []byte {
+	token := truncateString(auth.Token, 255)
+	deviceId := truncateString(auth.DeviceId, 255)
+
+	size := 3 + len(token) + len(deviceId)
+	if auth.Capabilities != 0 {
+		size += 1
+	}
+	buf := make([]byte, size)
+	buf[0] = byte(auth.PlatformId)
+	buf[1] = byte(len(token))
+	off := 2 + copy(buf[2:], token)
+	buf[off] = byte(len(deviceId))
+	off += 1 + copy(buf[off+1:], deviceId)
+	if auth.Capabilities != 0 {
+		buf[off] = auth.Capabilities
+	}
+	return buf
+}
+
+func (auth *AuthenticationToken) FromData(buff []byte) bool {
+	if len(buff) < 3 {
+		return false
+	}
+
+	platformId := int8(buff[0])
+
+	l := int(buff[1])
+	off := 2
+	if off+l+1 > len(buff) {
+		return false
+	}
+	token := string(buff[off : off+l])
+	off += l
+
+	l = int(buff[off])
+	off += 1
+	if off+l > len(buff) {
+		return false
+	}
+	deviceId := string(buff[off : off+l])
+	off += l
+
+	var capabilities uint8
+	if off < len(buff) {
+		capabilities = buff[off]
+	}
+
+	auth.PlatformId = platformId
+	auth.Token = token
+	auth.DeviceId = deviceId
+	auth.Capabilities = capabilities
+	return true
+}
+
+// status(4) [capabilities(1)]
+// 鉴权成功时带上当前连接启用的能力, 旧版本的客户端会忽略
+type AuthenticationStatus struct {
+	Status       int32
+	Capabilities uint8
+}
+
+func (auth *AuthenticationStatus) ToData() []byte {
+	size := 4
+	if auth.Capabilities != 0 {
+		size += 1
+	}
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint32(buf, uint32(auth.Status))
+	if auth.Capabilities != 0 {
+		buf[4] = auth.Capabilities
+	}
+	return buf
+}
+
+func (auth *AuthenticationStatus) FromData(buff []byte) bool {
+	if len(buff) < 4 {
+		return false
+	}
+	auth.Status = int32(binary.BigEndian.Uint32(buff))
+	if len(buff) > 4 {
+		auth.Capabilities = buff[4]
+	}
+	return true
+}
+
+type MessageACK struct {
+	Seq    int32
+	Status int8
+}
+
+// 编码时总是带上status字段, v0兼容旧版本只有seq的ack
+func (ack *MessageACK) ToData(version int) []byte {
+	buf := make([]byte, 5)
+	binary.BigEndian.PutUint32(buf, uint32(ack.Seq))
+	buf[4] = byte(ack.Status)
+	return buf
+}
+
+func (ack *MessageACK) FromData(version int, buff []byte) bool {
+	if len(buff) < 4 {
+		return false
+	}
+	if version >= 2 && len(buff) < 5 {
+		return false
+	}
+	ack.Seq = int32(binary.BigEndian.Uint32(buff))
+	if len(buff) >= 5 {
+		ack.Status = int8(buff[4])
+	}
+	return true
+}
+
+type SyncKey struct {
+	SyncKey int64
+}
+
+func (id *SyncKey) ToData() []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(id.SyncKey))
+	return buf
+}
+
+func (id *SyncKey) FromData(buff []byte) bool {
+	if len(buff) < 8 {
+		return false
+	}
+	id.SyncKey = int64(binary.BigEndian.Uint64(buff))
+	return true
+}
+
+type UserID struct {
+	Uid int64
+}
+
+func (id *UserID) ToData() []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(id.Uid))
+	return buf
+}
+
+func (id *UserID) FromData(buff []byte) bool {
+	if len(buff) < 8 {
+		return false
+	}
+	id.Uid = int64(binary.BigEndian.Uint64(buff))
+	return true
+}
+
+type GroupSyncKey struct {
+	GroupId int64
+	SyncKey int64
+}
+
+func (id *GroupSyncKey) ToData() []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[0:], uint64(id.GroupId))
+	binary.BigEndian.PutUint64(buf[8:], uint64(id.SyncKey))
+	return buf
+}
+
+func (id *GroupSyncKey) FromData(buff []byte) bool {
+	if len(buff) < 16 {
+		return false
+	}
+	id.GroupId = int64(binary.BigEndian.Uint64(buff[0:]))
+	id.SyncKey = int64(binary.BigEndian.Uint64(buff[8:]))
+	return true
+}
+
+type KickedMessage struct {
+	Reason int32
+}
+
+func (kick *KickedMessage) ToData() []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, uint32(kick.Reason))
+	return buf
+}
+
+func (kick *KickedMessage) FromData(buff []byte) bool {
+	if len(buff) < 4 {
+		return false
+	}
+	kick.Reason = int32(binary.BigEndian.Uint32(buff))
+	return true
+}
+
+// 客户端等待delay毫秒之后重连, 避免所有客户端同时重连到其它服务器
+type ServerClose struct {
+	Delay int32
+}
+
+func (c *ServerClose) ToData() []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, uint32(c.Delay))
+	return buf
+}
+
+func (c *ServerClose) FromData(buff []byte) bool {
+	if len(buff) < 4 {
+		return false
+	}
+	c.Delay = int32(binary.BigEndian.Uint32(buff))
+	return true
+}
+
+type SessionID struct {
+	SessionId int64
+}
+
+func (id *SessionID) ToData() []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(id.SessionId))
+	return buf
+}
+
+func (id *SessionID) FromData(buff []byte) bool {
+	if len(buff) < 8 {
+		return false
+	}
+	id.SessionId = int64(binary.BigEndian.Uint64(buff))
+	return true
+}
+
+// 用户当前的一个登录会话
+type DeviceSession struct {
+	SessionId  int64
+	DeviceId   string
+	PlatformId int8
+	LoginTime  int64
+}
+
+// 设备数量(2) 每个设备: sessionId(8) platformId(1) loginTime(8) deviceId长度(1) deviceId
+type DeviceList struct {
+	Devices []*DeviceSession
+}
+
+func (list *DeviceList) ToData() []byte {
+	devices := list.Devices
+	if len(devices) > math.MaxInt16 {
+		devices = devices[:math.MaxInt16]
+	}
+
+	size := 2
+	for _, d := range devices {
+		size += 18 + len(truncateString(d.DeviceId, 255))
+	}
+
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint16(buf, uint16(len(devices)))
+	off := 2
+	for _, d := range devices {
+		deviceId := truncateString(d.DeviceId, 255)
+		binary.BigEndian.PutUint64(buf[off:], uint64(d.SessionId))
+		buf[off+8] = byte(d.PlatformId)
+		binary.BigEndian.PutUint64(buf[off+9:], uint64(d.LoginTime))
+		buf[off+17] = byte(len(deviceId))
+		off += 18 + copy(buf[off+18:], deviceId)
+	}
+	return buf
+}
+
+func (list *DeviceList) FromData(buff []byte) bool {
+	if len(buff) < 2 {
+		return false
+	}
+	count := int(int16(binary.BigEndian.Uint16(buff)))
+	if count < 0 || count*18 > len(buff)-2 {
+		return false
+	}
+
+	devices := make([]*DeviceSession, 0, count)
+	off := 2
+	for i := 0; i < count; i++ {
+		if off+18 > len(buff) {
+			return false
+		}
+		d := &DeviceSession{}
+		d.SessionId = int64(binary.BigEndian.Uint64(buff[off:]))
+		d.PlatformId = int8(buff[off+8])
+		d.LoginTime = int64(binary.BigEndian.Uint64(buff[off+9:]))
+		l := int(buff[off+17])
+		off += 18
+		if off+l > len(buff) {
+			return false
+		}
+		d.DeviceId = string(buff[off : off+l])
+		off += l
+		devices = append(devices, d)
+	}
+	list.Devices = devices
+	return true
+}
+
+// 按字节截断, 用于单字节长度前缀的字段
+func truncateString(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -0,0 +1,171 @@
+package proto
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+func roundTrip(t *testing.T, cmd int, version int, body interface{}) interface{} {
+	t.Helper()
+	msg := &Message{Cmd: cmd, Seq: 1, Version: version, Body: body}
+	buf := EncodeMessage(msg)
+	m, err := DecodeMessage(buf, len(buf))
+	if err != nil {
+		t.Fatalf("decode cmd:%d version:%d err:%s", cmd, version, err)
+	}
+	if m.Cmd != cmd || m.Seq != 1 || m.Version != version {
+		t.Fatalf("header mismatch: %d %d %d", m.Cmd, m.Seq, m.Version)
+	}
+	return m.Body
+}
+
+func TestIMMessageRoundTrip(t *testing.T) {
+	for _, version := range []int{0, 2} {
+		f := func(sender, receiver int64, timestamp, messageType int32, content string) bool {
+			im := &IMMessage{Sender: sender, Receiver: receiver, Timestamp: timestamp, MessageType: messageType, Content: content}
+			return reflect.DeepEqual(im, roundTrip(t, MSG_IM, version, im))
+		}
+		if err := quick.Check(f, nil); err != nil {
+			t.Error(version, err)
+		}
+	}
+}
+
+func TestIMMessageMentionRoundTrip(t *testing.T) {
+	f := func(sender, receiver int64, atAll bool, mentions []int64, content string) bool {
+		if len(mentions) == 0 {
+			mentions = nil
+		}
+		im := &IMMessage{Sender: sender, Receiver: receiver, AtAll: atAll, Mentions: mentions, Content: content}
+		return reflect.DeepEqual(im, roundTrip(t, MSG_GROUP_IM, MENTION_VERSION, im))
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+
+	g := func(mentions []int64, clientMsgId string, content string) bool {
+		if len(mentions) == 0 {
+			mentions = nil
+		}
+		im := &IMMessage{Sender: 1, Receiver: 2, Mentions: mentions, ClientMsgId: truncateString(clientMsgId, 255), Content: content}
+		return reflect.DeepEqual(im, roundTrip(t, MSG_IM, CLIENT_MSG_ID_VERSION, im))
+	}
+	if err := quick.Check(g, nil); err != nil {
+		t.Error(err)
+	}
+
+	h := func(ttl int32, burnAfterRead bool, content string) bool {
+		im := &IMMessage{Sender: 1, Receiver: 2, ClientMsgId: "id", Ttl: ttl, BurnAfterRead: burnAfterRead, Content: content}
+		return reflect.DeepEqual(im, roundTrip(t, MSG_IM, EXPIRE_VERSION, im))
+	}
+	if err := quick.Check(h, nil); err != nil {
+		t.Error(err)
+	}
+
+	//低版本的客户端收不到@的成员
+	im := &IMMessage{Sender: 1, Receiver: 2, Mentions: []int64{3}, Content: "hi"}
+	r := roundTrip(t, MSG_GROUP_IM, 2, im).(*IMMessage)
+	if r.Mentions != nil || r.Content != "hi" {
+		t.Errorf("v2 decode:%+v", r)
+	}
+}
+
+func TestAuthenticationTokenRoundTrip(t *testing.T) {
+	f := func(token string, platformId int8, deviceId string) bool {
+		auth := &AuthenticationToken{Token: token, PlatformId: platformId, DeviceId: deviceId}
+		r := roundTrip(t, MSG_AUTH_TOKEN, 0, auth).(*AuthenticationToken)
+		return r.PlatformId == platformId &&
+			r.Token == truncateString(token, 255) &&
+			r.DeviceId == truncateString(deviceId, 255)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+
+	long := &AuthenticationToken{Token: string(bytes.Repeat([]byte{'t'}, 200)), PlatformId: 1, DeviceId: "d"}
+	r := roundTrip(t, MSG_AUTH_TOKEN, 0, long).(*AuthenticationToken)
+	if r.Token != long.Token || r.DeviceId != "d" {
+		t.Error("token longer than 127 bytes")
+	}
+}
+
+func TestFixedMessageRoundTrip(t *testing.T) {
+	f := func(a, b int64, c int32, d int8) bool {
+		cases := []struct {
+			cmd     int
+			version int
+			body    interface{}
+		}{
+			{MSG_AUTH_STATUS, 0, &AuthenticationStatus{Status: c}},
+			{MSG_ACK, 0, &MessageACK{Seq: c, Status: d}},
+			{MSG_ACK, 2, &MessageACK{Seq: c, Status: d}},
+			{MSG_SYNC, 0, &SyncKey{a}},
+			{MSG_SYNC_GROUP, 0, &GroupSyncKey{GroupId: a, SyncKey: b}},
+			{MSG_GROUP_SYNC_KEY, 0, &GroupSyncKey{GroupId: a, SyncKey: b}},
+			{MSG_KICKED, 0, &KickedMessage{c}},
+			{MSG_KICK_DEVICE, 0, &SessionID{a}},
+			{MSG_UNSUBSCRIBE, 0, &UserID{a}},
+			{MSG_SUBSCRIBE, 0, &SubscribeMessage{Uid: a, Online: d}},
+			{MSG_KICK_SESSION, 0, &KickSession{SessionId: a, Reason: c}},
+		}
+		for _, c := range cases {
+			if !reflect.DeepEqual(c.body, roundTrip(t, c.cmd, c.version, c.body)) {
+				t.Logf("cmd:%d mismatch", c.cmd)
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeviceListRoundTrip(t *testing.T) {
+	f := func(ids []int64, deviceId string, platformId int8) bool {
+		list := &DeviceList{Devices: make([]*DeviceSession, 0, len(ids))}
+		for _, id := range ids {
+			d := &DeviceSession{SessionId: id, DeviceId: truncateString(deviceId, 255), PlatformId: platformId, LoginTime: id / 2}
+			list.Devices = append(list.Devices, d)
+		}
+		r := roundTrip(t, MSG_DEVICES, 0, list).(*DeviceList)
+		return reflect.DeepEqual(list, r)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNestedMessageRoundTrip(t *testing.T) {
+	f := func(receiver, msgId int64, content string) bool {
+		im := &IMMessage{Sender: 1, Receiver: receiver, Content: content}
+		amsg := &AppMessage{Receiver: receiver, MsgId: msgId, Msg: &Message{Cmd: MSG_IM, Version: 2, Body: im}}
+		r := roundTrip(t, MSG_PUBLISH, 0, amsg).(*AppMessage)
+		return r.Receiver == receiver && r.MsgId == msgId && reflect.DeepEqual(r.Msg.Body, im)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMalformedMessages(t *testing.T) {
+	cases := []struct {
+		cmd  int
+		body []byte
+	}{
+		{MSG_ACK, []byte{0, 0}},
+		{MSG_AUTH_TOKEN, []byte{1, 200, 'a'}},
+		{MSG_AUTH_TOKEN, []byte{1, 1, 'a', 5, 'b'}},
+		{MSG_SYNC_GROUP, make([]byte, 15)},
+		{MSG_DEVICES, []byte{0x7f, 0xff}},
+		{MSG_PUBLISH, append(make([]byte, 32), 0xff, 0xff)},
+	}
+	for _, c := range cases {
+		m := &Message{Cmd: c.cmd}
+		if m.FromData(c.body) {
+			t.Errorf("cmd:%d accepted malformed body %x", c.cmd, c.body)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+)
+
+const DEFAULT_VERSION = 0
+
+//IMMessage增加@的成员
+const MENTION_VERSION = 3
+
+//IMMessage增加客户端生成的消息id
+const CLIENT_MSG_ID_VERSION = 4
+
+//IMMessage增加过期时间和阅后即焚
+const EXPIRE_VERSION = 5
+
+//gateway支持的最高协议版本, 客户端在MSG_AUTH_TOKEN中带上自己的版本号
+const MAX_VERSION = 5
+
+// 协商客户端连接使用的协议版本, 客户端的版本高于服务端时使用服务端的最高版本
+func NegotiateVersion(version int) int {
+	if version > MAX_VERSION {
+		return MAX_VERSION
+	}
+	return version
+}
+
+const MSG_HEADER_SIZE = 12
+
+func ReceiveClientMessage(conn io.Reader) *Message {
+	m, _ := ReceiveLimitMessage(conn, 32*1024, true)
+	return m
+}
+
+func ReceiveMessage(conn io.Reader) *Message {
+	m, _ := ReceiveLimitMessage(conn, 32*1024, false)
+	return m
+}
+
+func ReceiveLimitMessage(conn io.Reader, limitSize int, external bool) (*Message, error) {
+	var header [MSG_HEADER_SIZE]byte
+	_, err := io.ReadFull(conn, header[:])
+	if err != nil {
+		log.Info("sock read error:", err)
+		return nil, err
+	}
+	length, seq, cmd, version, flag := ReadHeader(header[:])
+
+	// 没有消息体的消息长度为0, 比如MSG_PING
+	if length < 0 || length > limitSize {
+		log.Info("invalid len:", length)
+		return nil, errors.New("invalid length")
+	}
+
+	buff := make([]byte, length)
+	_, err = io.ReadFull(conn, buff)
+	if err != nil {
+		log.Info("sock read error:", err)
+		return nil, err
+	}
+
+	buff, err = decompress(int(header[11]), buff, limitSize)
+	if err != nil {
+		log.Info("decompress error:", err)
+		return nil, err
+	}
+
+	return parseMessage(cmd, seq, version, flag, buff)
+}
+
+// 从一段完整的消息帧(消息头+消息体)中解析消息, 没有压缩的消息体直接引用buff
+func DecodeMessage(buff []byte, limitSize int) (*Message, error) {
+	if len(buff) < MSG_HEADER_SIZE {
+		return nil, errors.New("invalid header")
+	}
+	length, seq, cmd, version, flag := ReadHeader(buff)
+	if length < 0 || length > limitSize || length > len(buff)-MSG_HEADER_SIZE {
+		log.Info("invalid len:", length)
+		return nil, errors.New("invalid length")
+	}
+	body, err := decompress(int(buff[11]), buff[MSG_HEADER_SIZE:MSG_HEADER_SIZE+length], limitSize)
+	if err != nil {
+		log.Info("decompress error:", err)
+		return nil, err
+	}
+	return parseMessage(cmd, seq, version, flag, body)
+}
+
+func parseMessage(cmd, seq, version, flag int, buff []byte) (*Message, error) {
+	message := new(Message)
+	message.Cmd = cmd
+	message.Seq = seq
+	message.Version = version
+	message.Flag = flag
+	if !message.FromData(buff) {
+		log.Warningf("parse error:%d, %d %d %d %s", cmd, seq, version,
+			flag, hex.EncodeToString(buff))
+		return nil, errors.New("parse error")
+	}
+	return message, nil
+}
+
+func ReadHeader(buff []byte) (int, int, int, int, int) {
+	length := int32(binary.BigEndian.Uint32(buff[0:]))
+	seq := int32(binary.BigEndian.Uint32(buff[4:]))
+	cmd := buff[8]
+	version := buff[9]
+	flag := buff[10]
+	return int(length), int(seq), int(cmd), int(version), int(flag)
+}
+
+func WriteMessage(w *bytes.Buffer, msg *Message) {
+	body := msg.ToData()
+	WriteHeader(int32(len(body)), int32(msg.Seq), byte(msg.Cmd), byte(msg.Version), byte(msg.Flag), w)
+	w.Write(body)
+}
+
+func WriteHeader(len int32, seq int32, cmd byte, version byte, flag byte, buffer io.Writer) {
+	var header [MSG_HEADER_SIZE]byte
+	putHeader(header[:], len, seq, cmd, version, flag)
+	buffer.Write(header[:])
+}
+
+func putHeader(buff []byte, len int32, seq int32, cmd byte, version byte, flag byte) {
+	binary.BigEndian.PutUint32(buff[0:], uint32(len))
+	binary.BigEndian.PutUint32(buff[4:], uint32(seq))
+	buff[8] = cmd
+	buff[9] = version
+	buff[10] = flag
+	buff[11] = 0
+}
+
+// 消息头和消息体编码到同一个buffer中, 只分配一次内存
+func EncodeMessage(msg *Message) []byte {
+	body := msg.ToData()
+	buf := make([]byte, MSG_HEADER_SIZE+len(body))
+	putHeader(buf, int32(len(body)), int32(msg.Seq), byte(msg.Cmd), byte(msg.Version), byte(msg.Flag))
+	copy(buf[MSG_HEADER_SIZE:], body)
+	return buf
+}
+
+func SendMessage(conn io.Writer, msg *Message) error {
+	buf := EncodeMessage(msg)
+	n, err := conn.Write(buf)
+	if err != nil {
+		log.Info("sock write error:", err)
+		return err
+	}
+	if n != len(buf) {
+		log.WithFields(log.Fields{"写入": n, "总数": len(buf)}).Info("write less")
+		return errors.New("write less")
+	}
+	return nil
+}
+
+//消息大小限制在1M
+func ReceiveStorageMessage(conn io.Reader) *Message {
+	m, _ := ReceiveLimitMessage(conn, 1024*1024, false)
+	return m
+}
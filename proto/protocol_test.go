@@ -0,0 +1,31 @@
+package proto
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+func FuzzReceiveLimitMessage(f *testing.F) {
+	for _, v := range compatVectors {
+		f.Add(EncodeMessage(&Message{Cmd: v.cmd, Seq: 1, Version: v.version, Body: v.body}))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := ReceiveLimitMessage(bytes.NewReader(data), 32*1024, true)
+		if err != nil {
+			return
+		}
+		// 解析成功的消息重新编码之后必须还能解析
+		buf := EncodeMessage(m)
+		if _, err := DecodeMessage(buf, len(buf)); err != nil {
+			t.Fatalf("re-decode cmd:%d err:%s", m.Cmd, err)
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package proto
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+func init() {
+	messageCreators[MSG_UNSUBSCRIBE] = func() IMessage { return new(UserID) }
+	messageCreators[MSG_SUBSCRIBE] = func() IMessage { return new(SubscribeMessage) }
+
+	messageCreators[MSG_PUBLISH] = func() IMessage { return new(AppMessage) }
+	messageCreators[MSG_PUBLISH_GROUP] = func() IMessage { return new(AppMessage) }
+
+	messageCreators[MSG_KICK_SESSION] = func() IMessage { return new(KickSession) }
+}
+
+type AppMessage struct {
+	Receiver  int64
+	MsgId     int64
+	PrevMsgId int64
+	DeviceID  int64
+	Timestamp int64
+	Msg       *Message
+}
+
+// receiver(8) msgId(8) deviceID(8) timestamp(8) 消息长度(2) 消息
+// 消息长度按无符号处理, 超过65535字节的消息无法转发
+func (amsg *AppMessage) ToData() []byte {
+	if amsg.Msg == nil {
+		return nil
+	}
+	msgBuf := EncodeMessage(amsg.Msg)
+	if len(msgBuf) > math.MaxUint16 {
+		return nil
+	}
+
+	buf := make([]byte, 34+len(msgBuf))
+	binary.BigEndian.PutUint64(buf[0:], uint64(amsg.Receiver))
+	binary.BigEndian.PutUint64(buf[8:], uint64(amsg.MsgId))
+	binary.BigEndian.PutUint64(buf[16:], uint64(amsg.DeviceID))
+	binary.BigEndian.PutUint64(buf[24:], uint64(amsg.Timestamp))
+	binary.BigEndian.PutUint16(buf[32:], uint16(len(msgBuf)))
+	copy(buf[34:], msgBuf)
+	return buf
+}
+
+func (amsg *AppMessage) FromData(buff []byte) bool {
+	if len(buff) < 34+MSG_HEADER_SIZE {
+		return false
+	}
+
+	l := int(binary.BigEndian.Uint16(buff[32:]))
+	if 34+l > len(buff) {
+		return false
+	}
+
+	//recusive
+	msg, err := DecodeMessage(buff[34:34+l], 64*1024)
+	if err != nil {
+		return false
+	}
+
+	amsg.Receiver = int64(binary.BigEndian.Uint64(buff[0:]))
+	amsg.MsgId = int64(binary.BigEndian.Uint64(buff[8:]))
+	amsg.DeviceID = int64(binary.BigEndian.Uint64(buff[16:]))
+	amsg.Timestamp = int64(binary.BigEndian.Uint64(buff[24:]))
+	amsg.Msg = msg
+	return true
+}
+
+type SubscribeMessage struct {
+	Uid    int64
+	Online int8
+}
+
+func (sub *SubscribeMessage) ToData() []byte {
+	buf := make([]byte, 9)
+	binary.BigEndian.PutUint64(buf, uint64(sub.Uid))
+	buf[8] = byte(sub.Online)
+	return buf
+}
+
+func (sub *SubscribeMessage) FromData(buff []byte) bool {
+	if len(buff) < 9 {
+		return false
+	}
+	sub.Uid = int64(binary.BigEndian.Uint64(buff))
+	sub.Online = int8(buff[8])
+	return true
+}
+
+type KickSession struct {
+	SessionId int64
+	Reason    int32
+}
+
+func (kick *KickSession) ToData() []byte {
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint64(buf[0:], uint64(kick.SessionId))
+	binary.BigEndian.PutUint32(buf[8:], uint32(kick.Reason))
+	return buf
+}
+
+func (kick *KickSession) FromData(buff []byte) bool {
+	if len(buff) < 12 {
+		return false
+	}
+	kick.SessionId = int64(binary.BigEndian.Uint64(buff[0:]))
+	kick.Reason = int32(binary.BigEndian.Uint32(buff[8:]))
+	return true
+}
@@ -0,0 +1,104 @@
+package proto
+
+import "encoding/binary"
+
+func init() {
+	messageCreators[MSG_SEARCH] = func() IMessage { return new(SearchQuery) }
+	messageCreators[MSG_SEARCH_HIT] = func() IMessage { return new(SearchHit) }
+	messageCreators[MSG_SEARCH_END] = func() IMessage { return new(SearchEnd) }
+}
+
+// 搜索当前用户的历史消息, 多个关键词之间是并且的关系
+// PeerUid和GroupId都为0时搜索所有单聊和普通群的消息, 超级群的消息需要指定GroupId
+// BeforeMsgId不为0时只返回比它更早的消息, 用于翻页
+type SearchQuery struct {
+	PeerUid     int64
+	GroupId     int64
+	BeforeMsgId int64
+	Limit       int32
+	Query       string
+}
+
+// peerUid(8) groupId(8) beforeMsgId(8) limit(4) query
+func (q *SearchQuery) ToData() []byte {
+	buf := make([]byte, 28+len(q.Query))
+	binary.BigEndian.PutUint64(buf[0:], uint64(q.PeerUid))
+	binary.BigEndian.PutUint64(buf[8:], uint64(q.GroupId))
+	binary.BigEndian.PutUint64(buf[16:], uint64(q.BeforeMsgId))
+	binary.BigEndian.PutUint32(buf[24:], uint32(q.Limit))
+	copy(buf[28:], q.Query)
+	return buf
+}
+
+func (q *SearchQuery) FromData(buff []byte) bool {
+	if len(buff) < 28 {
+		return false
+	}
+	q.PeerUid = int64(binary.BigEndian.Uint64(buff[0:]))
+	q.GroupId = int64(binary.BigEndian.Uint64(buff[8:]))
+	q.BeforeMsgId = int64(binary.BigEndian.Uint64(buff[16:]))
+	q.Limit = int32(binary.BigEndian.Uint32(buff[24:]))
+	q.Query = string(buff[28:])
+	return true
+}
+
+// 搜索到的消息, Raw是按照连接的协议版本编码的消息体, Seq是MSG_SEARCH的seq
+type SearchHit struct {
+	Seq   int32
+	MsgId int64
+	Cmd   int32
+	Raw   []byte
+}
+
+// seq(4) msgId(8) cmd(4) raw
+func (hit *SearchHit) ToData() []byte {
+	buf := make([]byte, 16+len(hit.Raw))
+	binary.BigEndian.PutUint32(buf[0:], uint32(hit.Seq))
+	binary.BigEndian.PutUint64(buf[4:], uint64(hit.MsgId))
+	binary.BigEndian.PutUint32(buf[12:], uint32(hit.Cmd))
+	copy(buf[16:], hit.Raw)
+	return buf
+}
+
+func (hit *SearchHit) FromData(buff []byte) bool {
+	if len(buff) < 16 {
+		return false
+	}
+	hit.Seq = int32(binary.BigEndian.Uint32(buff[0:]))
+	hit.MsgId = int64(binary.BigEndian.Uint64(buff[4:]))
+	hit.Cmd = int32(binary.BigEndian.Uint32(buff[12:]))
+	hit.Raw = append([]byte(nil), buff[16:]...)
+	return true
+}
+
+// 一次搜索结束, Status使用MSG_ACK的状态
+// HasMore为true时用NextMsgId作为BeforeMsgId继续搜索
+type SearchEnd struct {
+	Seq       int32
+	Status    int8
+	HasMore   bool
+	NextMsgId int64
+}
+
+// seq(4) status(1) hasMore(1) nextMsgId(8)
+func (end *SearchEnd) ToData() []byte {
+	buf := make([]byte, 14)
+	binary.BigEndian.PutUint32(buf[0:], uint32(end.Seq))
+	buf[4] = byte(end.Status)
+	if end.HasMore {
+		buf[5] = 1
+	}
+	binary.BigEndian.PutUint64(buf[6:], uint64(end.NextMsgId))
+	return buf
+}
+
+func (end *SearchEnd) FromData(buff []byte) bool {
+	if len(buff) < 14 {
+		return false
+	}
+	end.Seq = int32(binary.BigEndian.Uint32(buff[0:]))
+	end.Status = int8(buff[4])
+	end.HasMore = buff[5] != 0
+	end.NextMsgId = int64(binary.BigEndian.Uint64(buff[6:]))
+	return true
+}